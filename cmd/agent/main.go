@@ -23,7 +23,7 @@ var buildVersion, buildDate, buildCommit string = "N/A", "N/A", "N/A"
 func main() {
 	a, err := agent.NewAgent(config.SetAgentParams())
 	if err != nil {
-		loggers.ErrorLogger.Fatal("wrong protocol")
+		loggers.ErrorLogger.Fatal("error while creating agent: ", err)
 	}
 	cpuStat, err := cpu.Times(true)
 	if err != nil {
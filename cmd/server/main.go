@@ -4,33 +4,53 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
 	pb "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/proto"
 	serverHTTP "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/HTTP"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/database"
 	servergRPC "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/gRPC"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/graphite"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/statsd"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/tlsconfig"
 )
 
 // build info
 var buildVersion, buildDate, buildCommit string = "N/A", "N/A", "N/A"
 
-// StartServer starts server
-func StartServer() {
+// StartServer starts server and stops it on SIGTERM, SIGINT or SIGQUIT,
+// error is returned if server can't be started or stops by itself
+func StartServer() error {
 	cfg := config.SetServerParams()
 	var err error
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" || cfg.TLSClientCAFile != "" {
+		cfg.TLSConfig, err = tlsconfig.Server(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error while setting TLS: %w", err)
+		}
+	}
 	if cfg.DatabaseAddress != "" {
 		cfg.Database, err = sql.Open("pgx", cfg.DatabaseAddress)
 		if err != nil {
@@ -42,53 +62,285 @@ func StartServer() {
 				loggers.ErrorLogger.Println("error while setting database:", err)
 			}
 		}
-		defer cfg.Database.Close()
 	} else {
 		cfg.Database = nil
 	}
-	if cfg.Protocol == "HTTP" {
-		s := serverHTTP.NewMetricServer(cfg)
-		handler := serverHTTP.DecompressHandler(s.Router())
-		handler = serverHTTP.CompressHandler(handler)
-		srv := &http.Server{
-			Addr:    s.Addr,
-			Handler: handler,
+	if cfg.Authenticator, err = newAuthenticator(cfg); err != nil {
+		return fmt.Errorf("error while setting authentication: %w", err)
+	}
+	if cfg.ClientRateLimit > 0 {
+		cfg.Limiter = ratelimit.NewLimiter(cfg.ClientRateLimit, cfg.ClientRateBurst)
+	}
+	store, storageType, err := storage.NewStorage(cfg)
+	if err != nil {
+		return fmt.Errorf("error while setting storage: %w", err)
+	}
+	var listeners []listener
+	if cfg.Protocol == config.ProtocolHTTP || cfg.Protocol == config.ProtocolBoth {
+		l, err := newHTTPListener(cfg, store, storageType)
+		if err != nil {
+			store.Close()
+			return fmt.Errorf("error while starting HTTP server: %w", err)
 		}
-		loggers.InfoLogger.Printf("HTTP server started at %s", s.Addr)
-		idleConnsClosed := make(chan struct{})
-		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-		go func() {
-			<-sigs
-			if err := srv.Shutdown(context.Background()); err != nil {
-				loggers.InfoLogger.Printf("HTTP server Shutdown: %v", err)
-			}
-			close(idleConnsClosed)
-		}()
-		err = srv.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			loggers.ErrorLogger.Fatal(err)
+		listeners = append(listeners, l)
+	}
+	if cfg.Protocol == config.ProtocolGRPC || cfg.Protocol == config.ProtocolBoth {
+		addr := cfg.Address
+		if cfg.Protocol == config.ProtocolBoth {
+			addr = cfg.GRPCAddress
+		}
+		l, err := newGRPCListener(cfg, addr, store, storageType)
+		if err != nil {
+			shutdown(cfg.ShutdownTimeout, listeners, store)
+			return fmt.Errorf("error while starting gRPC server: %w", err)
 		}
-	} else if cfg.Protocol == "gRPC" {
-		s := servergRPC.NewMetricServer(cfg)
-		listen, err := net.Listen("tcp", s.Addr)
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		store.Close()
+		return fmt.Errorf("unknown protocol %q", cfg.Protocol)
+	}
+	if cfg.StatsDAddress != "" {
+		l, err := newStatsDListener(cfg, store)
 		if err != nil {
-			loggers.ErrorLogger.Fatal(err)
+			shutdown(cfg.ShutdownTimeout, listeners, store)
+			return fmt.Errorf("error while starting StatsD server: %w", err)
 		}
-		srv := grpc.NewServer(grpc.UnaryInterceptor(s.CheckRequestSubnetInterceptor))
-		pb.RegisterMetricsServer(srv, s)
-		loggers.InfoLogger.Println("gRPC server started at", s.Addr)
-		if err := srv.Serve(listen); err != nil {
-			loggers.ErrorLogger.Fatal(err)
+		listeners = append(listeners, l)
+	}
+	if cfg.GraphiteAddress != "" || cfg.GraphitePickleAddress != "" {
+		ls, err := newGraphiteListeners(cfg, store)
+		if err != nil {
+			shutdown(cfg.ShutdownTimeout, listeners, store)
+			return fmt.Errorf("error while starting Graphite server: %w", err)
 		}
+		listeners = append(listeners, ls...)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	serveErr := make(chan error, len(listeners))
+	for _, l := range listeners {
+		l := l
+		go func() {
+			serveErr <- l.serve()
+		}()
 	}
 	loggers.InfoLogger.Printf(`Build version: %s
 	Build date: %s
 	Build commit: %s`,
 		buildVersion, buildDate, buildCommit)
+	select {
+	case sig := <-sigs:
+		loggers.InfoLogger.Printf("got %v, shutting down", sig)
+		shutdown(cfg.ShutdownTimeout, listeners, store)
+		return nil
+	case err = <-serveErr:
+		shutdown(cfg.ShutdownTimeout, listeners, store)
+		return fmt.Errorf("server stopped: %w", err)
+	}
+}
+
+// newAuthenticator creates authenticator of tokens from file or database, it is nil if authentication is disabled
+func newAuthenticator(cfg config.Config) (auth.Authenticator, error) {
+	switch {
+	case cfg.AuthTokensFile != "" && cfg.AuthDatabase:
+		return nil, errors.New("tokens can't be read both from file and database")
+	case cfg.AuthTokensFile != "":
+		return auth.ReadTokensFile(cfg.AuthTokensFile)
+	case cfg.AuthDatabase:
+		if cfg.Database == nil {
+			return nil, errors.New("database is not set")
+		}
+		return auth.NewDBTokens(cfg.Database)
+	}
+	return nil, nil
+}
+
+// listener is a server of one protocol
+type listener struct {
+	// serve serves requests until server is stopped
+	serve func() error
+	// stop stops server waiting for in-flight requests until ctx is done
+	stop func(ctx context.Context) error
+}
+
+// newHTTPListener creates HTTP server working with store
+func newHTTPListener(cfg config.Config, store storage.Storage, storageType types.StorageType) (listener, error) {
+	s, err := serverHTTP.NewMetricServer(cfg, store, storageType)
+	if err != nil {
+		return listener{}, err
+	}
+	handler := serverHTTP.DecompressHandler(s.Router())
+	handler = serverHTTP.CompressHandler(handler)
+	srv := &http.Server{
+		Addr:      s.Addr,
+		Handler:   handler,
+		TLSConfig: cfg.TLSConfig,
+	}
+	srv.RegisterOnShutdown(s.CloseStreams)
+	return listener{
+		serve: func() error {
+			if srv.TLSConfig != nil {
+				loggers.InfoLogger.Printf("HTTPS server started at %s", s.Addr)
+				return srv.ListenAndServeTLS("", "")
+			}
+			loggers.InfoLogger.Printf("HTTP server started at %s", s.Addr)
+			return srv.ListenAndServe()
+		},
+		stop: func(ctx context.Context) error {
+			return stopHTTP(ctx, srv)
+		},
+	}, nil
+}
+
+// newGRPCListener creates gRPC server at addr working with store
+func newGRPCListener(cfg config.Config, addr string, store storage.Storage, storageType types.StorageType) (listener, error) {
+	s, err := servergRPC.NewMetricServer(cfg, store, storageType)
+	if err != nil {
+		return listener{}, err
+	}
+	s.Addr = addr
+	listen, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return listener{}, err
+	}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.SecurityInterceptors()...),
+		grpc.ChainStreamInterceptor(s.SecurityStreamInterceptors()...),
+	}
+	if cfg.MaxBodySize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(cfg.MaxBodySize)))
+	}
+	if cfg.TLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg.TLSConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	pb.RegisterMetricsServer(srv, s)
+	colmetricspb.RegisterMetricsServiceServer(srv, s.OTLPService())
+	return listener{
+		serve: func() error {
+			loggers.InfoLogger.Println("gRPC server started at", s.Addr)
+			return srv.Serve(listen)
+		},
+		stop: func(ctx context.Context) error {
+			s.CloseStreams()
+			return stopGRPC(ctx, srv)
+		},
+	}, nil
+}
+
+// newStatsDListener creates StatsD server receiving UDP packets and saving metrics to store
+func newStatsDListener(cfg config.Config, store storage.Storage) (listener, error) {
+	s, err := statsd.NewServer(cfg, store)
+	if err != nil {
+		return listener{}, err
+	}
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return listener{}, err
+	}
+	return listener{
+		serve: func() error {
+			loggers.InfoLogger.Println("StatsD server started at", s.Addr)
+			return s.Serve(conn)
+		},
+		stop: s.Shutdown,
+	}, nil
+}
+
+// newGraphiteListeners creates Graphite server receiving plaintext and pickle TCP connections and saving metrics to store.
+// Listeners share the server, it is stopped by the first of them
+func newGraphiteListeners(cfg config.Config, store storage.Storage) ([]listener, error) {
+	s, err := graphite.NewServer(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext, pickle net.Listener
+	if s.Addr != "" {
+		if plaintext, err = net.Listen("tcp", s.Addr); err != nil {
+			return nil, err
+		}
+	}
+	if s.PickleAddr != "" {
+		if pickle, err = net.Listen("tcp", s.PickleAddr); err != nil {
+			if plaintext != nil {
+				plaintext.Close()
+			}
+			return nil, err
+		}
+	}
+	var listeners []listener
+	if plaintext != nil {
+		listeners = append(listeners, listener{
+			serve: func() error {
+				loggers.InfoLogger.Println("Graphite plaintext server started at", s.Addr)
+				return s.Serve(plaintext)
+			},
+			stop: s.Shutdown,
+		})
+	}
+	if pickle != nil {
+		listeners = append(listeners, listener{
+			serve: func() error {
+				loggers.InfoLogger.Println("Graphite pickle server started at", s.PickleAddr)
+				return s.ServePickle(pickle)
+			},
+			stop: s.Shutdown,
+		})
+	}
+	return listeners, nil
+}
+
+// shutdown stops accepting requests by all listeners, waits for in-flight ones at most timeout,
+// then flushes and closes storage
+func shutdown(timeout time.Duration, listeners []listener, store storage.Storage) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l listener) {
+			defer wg.Done()
+			if err := l.stop(ctx); err != nil {
+				loggers.ErrorLogger.Println("error while stopping server:", err)
+			}
+		}(l)
+	}
+	wg.Wait()
+	if err := store.Close(); err != nil {
+		loggers.ErrorLogger.Println("error while closing storage:", err)
+	}
+	loggers.InfoLogger.Println("server stopped")
+}
+
+// stopHTTP gracefully shuts down HTTP server, connections left after ctx is done are closed
+func stopHTTP(ctx context.Context, srv *http.Server) error {
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
 
+// stopGRPC gracefully stops gRPC server, RPCs left after ctx is done are cancelled
+func stopGRPC(ctx context.Context, srv *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return ctx.Err()
+	}
 }
 
 func main() {
-	StartServer()
+	if err := StartServer(); err != nil {
+		loggers.ErrorLogger.Println(err)
+		os.Exit(1)
+	}
 }
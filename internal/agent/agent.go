@@ -11,6 +11,7 @@ import (
 	grpc "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metricsender/grpc"
 	http "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metricsender/http"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/tlsconfig"
 )
 
 // Agent makes all the work with metrics
@@ -21,31 +22,52 @@ type Agent struct {
 	ReportInterval time.Duration
 }
 
+// localIP returns IP of interface agent reaches server at address from.
+// Dialing UDP sends no packets, it only selects route to server
+func localIP(address string) string {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		loggers.ErrorLogger.Println("error while resolving route to server:", err)
+		return ""
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		loggers.ErrorLogger.Println("error while splitting host and port:", err)
+		return ""
+	}
+	return host
+}
+
 // NewAgent creates new Agent
 func NewAgent(cfg config.Config) (*Agent, error) {
-	var host string
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		loggers.ErrorLogger.Println("error while making connection:", err)
-	} else {
-		host, _, err = net.SplitHostPort(conn.LocalAddr().String())
+	cfg.HostAddress = localIP(cfg.Address)
+	var err error
+	if cfg.TLS || cfg.TLSCAFile != "" || cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cfg.TLSConfig, err = tlsconfig.Client(cfg.TLSCAFile, cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSServerName)
 		if err != nil {
-			loggers.ErrorLogger.Println("error while splitting host and port:", err)
+			return nil, fmt.Errorf("error while setting TLS: %w", err)
 		}
-		conn.Close()
 	}
-	cfg.HostAddress = host
 	var sender metricsender.MetricSender
 	if cfg.Protocol == "HTTP" {
-		sender = *http.NewSender(cfg)
+		s, err := http.NewSender(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sender = *s
 	} else if cfg.Protocol == "gRPC" {
-		sender = *grpc.NewSender(cfg)
+		s, err := grpc.NewSender(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sender = *s
 	} else {
 		return nil, fmt.Errorf("wrong protocol")
 	}
 	return &Agent{
 		Sender:         sender,
-		Collector:      metriccollector.NewMetricCollector(),
+		Collector:      metriccollector.NewMetricCollector(cfg.HistogramBuckets),
 		PollInterval:   cfg.PollInterval,
 		ReportInterval: cfg.ReportInterval,
 	}, nil
@@ -1,14 +1,17 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
 )
 
@@ -18,6 +21,8 @@ const (
 	defaultReportInterval = 10 * time.Second
 	defaultAddress        = "localhost:8080"
 	defaultRateLimit      = 100
+	// defaultHistogramBuckets are upper bounds of GC pause histogram buckets in seconds
+	defaultHistogramBuckets = "0.00001,0.0001,0.001,0.01,0.1"
 )
 
 type Config struct {
@@ -29,6 +34,35 @@ type Config struct {
 	CryptoKeyFile  string `json:"crypto_key"`
 	Protocol       string
 	HostAddress    string
+	// Labels are attached to every metric sent by agent
+	Labels map[string]string `json:"labels"`
+	// HistogramBuckets are upper bounds of histogram buckets
+	HistogramBuckets []float64 `json:"histogram_buckets"`
+	// TLS makes agent connect to server with TLS, it is enabled too if any TLS file is set
+	TLS bool `json:"tls"`
+	// TLSCAFile is a PEM bundle of CAs server certificate is verified with, system CAs are used if it is not set
+	TLSCAFile string `json:"tls_ca"`
+	// TLSCertFile and TLSKeyFile are PEM files of client certificate presented to server requiring mutual TLS
+	TLSCertFile string `json:"tls_cert"`
+	TLSKeyFile  string `json:"tls_key"`
+	// TLSServerName is a name server certificate is verified for, host of Address is used if it is not set
+	TLSServerName string `json:"tls_server_name"`
+	TLSConfig     *tls.Config
+	// Token is a bearer token agent authenticates with
+	Token string `json:"token"`
+}
+
+// parseBuckets parses comma separated histogram bucket bounds
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, str := range strings.Split(s, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
 }
 
 // setAgentParams set agent config
@@ -42,6 +76,14 @@ func SetAgentParams() (cfg Config) {
 		flagCryptoKeyFile  string
 		flagConfigFile     string
 		flagProtocol       string
+		flagLabels         string
+		flagBuckets        string
+		flagTLS            bool
+		flagTLSCA          string
+		flagTLSCert        string
+		flagTLSKey         string
+		flagTLSServerName  string
+		flagToken          string
 		cfgFile            string
 	)
 	flag.DurationVar(&flagPollInterval, "p", defaultPollInterval, "poll_metrics_interval")
@@ -52,6 +94,14 @@ func SetAgentParams() (cfg Config) {
 	flag.StringVar(&flagCryptoKeyFile, "crypto-key", "", "crypto_key_file")
 	flag.StringVar(&flagConfigFile, "c", "", "config_file_name")
 	flag.StringVar(&flagProtocol, "protocol", "HTTP", "protocol_HTTP_or_gRPC")
+	flag.StringVar(&flagLabels, "labels", "", "metric_labels_as_name=value_pairs")
+	flag.StringVar(&flagBuckets, "histogram-buckets", defaultHistogramBuckets, "comma_separated_histogram_bucket_bounds")
+	flag.BoolVar(&flagTLS, "tls", false, "connect_with_tls_true/false")
+	flag.StringVar(&flagTLSCA, "tls-ca", "", "tls_ca_file")
+	flag.StringVar(&flagTLSCert, "tls-cert", "", "tls_client_certificate_file")
+	flag.StringVar(&flagTLSKey, "tls-key", "", "tls_client_key_file")
+	flag.StringVar(&flagTLSServerName, "tls-server-name", "", "tls_server_name")
+	flag.StringVar(&flagToken, "token", "", "bearer_token")
 	flag.Parse()
 	var exists bool
 	if cfgFile, exists = os.LookupEnv("CONFIG"); !exists {
@@ -111,5 +161,51 @@ func SetAgentParams() (cfg Config) {
 		cfg.CryptoKeyFile = flagCryptoKeyFile
 	}
 	cfg.Protocol = flagProtocol
+	strLabels, exists := os.LookupEnv("LABELS")
+	if !exists {
+		strLabels = flagLabels
+	}
+	if strLabels != "" {
+		l, err := labels.ParsePairs(strLabels)
+		if err != nil {
+			loggers.ErrorLogger.Println("couldn't parse labels:", err)
+		} else {
+			cfg.Labels = l
+		}
+	}
+	strBuckets, exists := os.LookupEnv("HISTOGRAM_BUCKETS")
+	if !exists {
+		strBuckets = flagBuckets
+	}
+	if buckets, err := parseBuckets(strBuckets); err != nil {
+		loggers.ErrorLogger.Println("couldn't parse histogram buckets:", err)
+		cfg.HistogramBuckets, _ = parseBuckets(defaultHistogramBuckets)
+	} else {
+		cfg.HistogramBuckets = buckets
+	}
+	if strTLS, exists := os.LookupEnv("TLS"); !exists {
+		cfg.TLS = flagTLS
+	} else {
+		var err error
+		if cfg.TLS, err = strconv.ParseBool(strTLS); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse TLS bool")
+			cfg.TLS = true
+		}
+	}
+	if cfg.TLSCAFile, exists = os.LookupEnv("TLS_CA"); !exists {
+		cfg.TLSCAFile = flagTLSCA
+	}
+	if cfg.TLSCertFile, exists = os.LookupEnv("TLS_CERT"); !exists {
+		cfg.TLSCertFile = flagTLSCert
+	}
+	if cfg.TLSKeyFile, exists = os.LookupEnv("TLS_KEY"); !exists {
+		cfg.TLSKeyFile = flagTLSKey
+	}
+	if cfg.TLSServerName, exists = os.LookupEnv("TLS_SERVER_NAME"); !exists {
+		cfg.TLSServerName = flagTLSServerName
+	}
+	if cfg.Token, exists = os.LookupEnv("TOKEN"); !exists {
+		cfg.Token = flagToken
+	}
 	return cfg
 }
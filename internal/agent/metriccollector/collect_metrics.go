@@ -3,6 +3,7 @@ package metriccollector
 import (
 	"math/rand"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"time"
 
@@ -13,6 +14,9 @@ import (
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
 )
 
+// gcPauseQuantiles are quantiles of GC pauses reported by debug.ReadGCStats
+var gcPauseQuantiles = []float64{0, 0.25, 0.5, 0.75, 1}
+
 // CollectRuntimeMetrics collects runtime metrics
 func (c *MetricCollector) CollectRuntimeMetrics() {
 	var stats runtime.MemStats
@@ -76,9 +80,52 @@ func (c *MetricCollector) CollectRuntimeMetrics() {
 		{ID: "TotalAlloc", MType: "gauge", Value: &TotalAlloc},
 	}
 	*(c.PollCount.Delta)++
+	c.collectGCPauses(&stats)
 	loggers.InfoLogger.Println("Collected GaugeMetrics")
 }
 
+// collectGCPauses observes GC pauses made since the last collection and updates GC pause quantiles
+func (c *MetricCollector) collectGCPauses(stats *runtime.MemStats) {
+	gcStats := debug.GCStats{PauseQuantiles: make([]time.Duration, len(gcPauseQuantiles))}
+	debug.ReadGCStats(&gcStats)
+	c.GCPauseData.mu.Lock()
+	defer c.GCPauseData.mu.Unlock()
+	first := c.GCPauseData.lastNumGC
+	if stats.NumGC-first > uint32(len(stats.PauseNs)) {
+		first = stats.NumGC - uint32(len(stats.PauseNs))
+	}
+	for i := first; i < stats.NumGC; i++ {
+		c.GCPauseData.Pauses.Histogram.Observe(float64(stats.PauseNs[i%uint32(len(stats.PauseNs))]) / float64(time.Second))
+	}
+	c.GCPauseData.lastNumGC = stats.NumGC
+	summary := &types.Summary{
+		Count: uint64(gcStats.NumGC),
+		Sum:   gcStats.PauseTotal.Seconds(),
+	}
+	if gcStats.NumGC > 0 {
+		for i, q := range gcPauseQuantiles {
+			summary.Quantiles = append(summary.Quantiles, types.Quantile{Quantile: q, Value: gcStats.PauseQuantiles[i].Seconds()})
+		}
+	}
+	c.GCPauseData.PauseQuantiles.Summary = summary
+}
+
+// DistributionMetrics returns copies of histogram and summary metrics
+func (c *MetricCollector) DistributionMetrics() []types.Metrics {
+	c.GCPauseData.mu.Lock()
+	defer c.GCPauseData.mu.Unlock()
+	pauses := c.GCPauseData.Pauses
+	pauses.Histogram = pauses.Histogram.Copy()
+	return []types.Metrics{pauses, c.GCPauseData.PauseQuantiles}
+}
+
+// ResetHistograms drops observations which have been reported to the server
+func (c *MetricCollector) ResetHistograms() {
+	c.GCPauseData.mu.Lock()
+	defer c.GCPauseData.mu.Unlock()
+	c.GCPauseData.Pauses.Histogram.Reset()
+}
+
 // CollectRandomValueMetric collects metric with random value
 func (c *MetricCollector) CollectRandomValueMetric() types.Metrics {
 	rand.Seed(time.Now().Unix())
@@ -17,20 +17,45 @@ type UtilizationData struct {
 	CPUutilLastTime time.Time
 }
 
+// GCPauseData collects histogram and summary of GC pauses
+type GCPauseData struct {
+	mu sync.Mutex
+	// Pauses is a histogram of GC pauses in seconds made since the last report
+	Pauses types.Metrics
+	// PauseQuantiles is a summary of GC pauses in seconds
+	PauseQuantiles types.Metrics
+	// lastNumGC is a number of GC cycles already observed in Pauses
+	lastNumGC uint32
+}
+
 // metricCollector collects metrics
 type MetricCollector struct {
 	UtilData       UtilizationData
+	GCPauseData    GCPauseData
 	RuntimeMetrics []types.Metrics
 	PollCount      types.Metrics
 }
 
-// newCollector creates a new MetricCollector
-func NewMetricCollector() *MetricCollector {
+// newCollector creates a new MetricCollector, histogramBuckets are upper bounds of histogram buckets
+func NewMetricCollector(histogramBuckets []float64) *MetricCollector {
 	var delta int64 = 0
 	return &MetricCollector{
 		UtilData: UtilizationData{
 			mu: sync.Mutex{},
 		},
+		GCPauseData: GCPauseData{
+			mu: sync.Mutex{},
+			Pauses: types.Metrics{
+				ID:        "GCPauseSeconds",
+				MType:     "histogram",
+				Histogram: types.NewHistogram(histogramBuckets),
+			},
+			PauseQuantiles: types.Metrics{
+				ID:      "GCPauseQuantiles",
+				MType:   "summary",
+				Summary: &types.Summary{},
+			},
+		},
 		PollCount: types.Metrics{
 			ID:    "PollCount",
 			MType: "counter",
@@ -3,24 +3,30 @@ package grpc
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/rsa"
 	"fmt"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	pb "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/proto"
 
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/config"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metriccollector"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metricsender"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
 )
 
 type Sender struct {
@@ -28,21 +34,188 @@ type Sender struct {
 	HostAddress string
 	Key         string
 	RateLimit   int
+	Labels      map[string]string
+	CryptoKey   *rsa.PublicKey
+	Backoff     *metricsender.Backoff
 }
 
-func NewSender(cfg config.Config) *Sender {
-	conn, err := grpc.Dial(cfg.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+// tokenCredentials adds bearer token to metadata of every call
+type tokenCredentials string
+
+// GetRequestMetadata returns authorization metadata with token
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity allows sending token without TLS like HTTP sender does
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// NewSender creates Sender, crypto key file must be readable if it is set
+func NewSender(cfg config.Config) (*Sender, error) {
+	creds := insecure.NewCredentials()
+	if cfg.TLSConfig != nil {
+		creds = credentials.NewTLS(cfg.TLSConfig)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if cfg.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(cfg.Token)))
+	}
+	var cryptoKey *rsa.PublicKey
+	if cfg.CryptoKeyFile != "" {
+		var err error
+		if cryptoKey, err = encryption.ReadPublicKey(cfg.CryptoKeyFile); err != nil {
+			return nil, fmt.Errorf("error while loading crypto key: %w", err)
+		}
+	}
+	conn, err := grpc.Dial(cfg.Address, opts...)
 	if err != nil {
-		loggers.ErrorLogger.Println("error while making connection:", err)
+		return nil, fmt.Errorf("error while making connection: %w", err)
 	}
 	client := pb.NewMetricsClient(conn)
-	conn.Close()
 	return &Sender{
+		CryptoKey:   cryptoKey,
 		Client:      client,
 		HostAddress: cfg.HostAddress,
 		Key:         cfg.HashKey,
 		RateLimit:   cfg.RateLimit,
+		Labels:      cfg.Labels,
+		Backoff:     metricsender.NewBackoff(),
+	}, nil
+}
+
+// seal marshals request and encrypts it with crypto key
+func (s *Sender) seal(req proto.Message) ([]byte, error) {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error while marshalling request: %w", err)
+	}
+	envelope, err := encryption.Encrypt(s.CryptoKey, data)
+	if err != nil {
+		return nil, fmt.Errorf("error while encrypting request: %w", err)
+	}
+	return envelope, nil
+}
+
+// updateMetricRequest creates request updating metric, request is encrypted if crypto key is set
+func (s *Sender) updateMetricRequest(m *pb.Metric) (*pb.UpdateMetricRequest, error) {
+	req := &pb.UpdateMetricRequest{Metric: m}
+	if s.CryptoKey == nil {
+		return req, nil
+	}
+	envelope, err := s.seal(req)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricRequest{Encrypted: envelope}, nil
+}
+
+// updateManyMetricsRequest creates request updating metrics, request is encrypted if crypto key is set
+func (s *Sender) updateManyMetricsRequest(metrics []*pb.Metric) (*pb.UpdateManyMetricsRequest, error) {
+	req := &pb.UpdateManyMetricsRequest{Metrics: metrics}
+	if s.CryptoKey == nil {
+		return req, nil
+	}
+	envelope, err := s.seal(req)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UpdateManyMetricsRequest{Encrypted: envelope}, nil
+}
+
+// signedContext adds signature of req to outgoing metadata of ctx if hash key is set
+func (s *Sender) signedContext(ctx context.Context, method string, req proto.Message) (context.Context, signature.Signature, error) {
+	if s.Key == "" {
+		return ctx, signature.Signature{}, nil
+	}
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, signature.Signature{}, fmt.Errorf("error while marshalling request: %w", err)
+	}
+	sig, err := signature.New(s.Key, "POST", method, body)
+	if err != nil {
+		return nil, signature.Signature{}, err
+	}
+	for name, value := range sig.Fields() {
+		ctx = metadata.AppendToOutgoingContext(ctx, name, value)
 	}
+	return ctx, sig, nil
+}
+
+// verifyResponse checks that response is signed by server with nonce of request signature if hash key is set
+func (s *Sender) verifyResponse(method string, sig signature.Signature, header metadata.MD, resp proto.Message) error {
+	if s.Key == "" {
+		return nil
+	}
+	respSig, err := signature.Parse(func(key string) string {
+		if values := header.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	})
+	if err != nil {
+		return fmt.Errorf("response: %w", err)
+	}
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("error while marshalling response: %w", err)
+	}
+	if respSig.Nonce != sig.Nonce || !respSig.Valid(s.Key, codes.OK.String(), method, body) {
+		return fmt.Errorf("response: %w", signature.ErrInvalid)
+	}
+	return nil
+}
+
+// checkBackoff returns error if the server asked to retry later and the time has not come yet
+func (s *Sender) checkBackoff() error {
+	if left := s.Backoff.Left(); left > 0 {
+		return fmt.Errorf("%w in %s", metricsender.ErrBackoff, left.Round(time.Second))
+	}
+	return nil
+}
+
+// delay postpones sending for time from retry-after trailer of rejected call
+func (s *Sender) delay(err error, trailer metadata.MD) {
+	if status.Code(err) != codes.ResourceExhausted {
+		return
+	}
+	if values := trailer.Get("retry-after"); len(values) > 0 {
+		if wait, ok := metricsender.ParseRetryAfter(values[0], time.Now()); ok {
+			s.Backoff.Delay(wait)
+		}
+	}
+}
+
+// metricToProto converts metric to protobuf metric signed with key
+func metricToProto(metric types.Metrics, key string) *pb.Metric {
+	m := &pb.Metric{
+		Id:     metric.ID,
+		Mtype:  metric.MType,
+		Labels: metric.Labels,
+	}
+	if key != "" {
+		m.Hash = hash.Hash(hash.WithLabels(metric.HashSource(), metric.Labels), key)
+	}
+	if metric.Delta != nil {
+		m.Delta = *metric.Delta
+	}
+	if metric.Value != nil {
+		m.Value = *metric.Value
+	}
+	if metric.Histogram != nil {
+		m.Histogram = &pb.Histogram{Count: metric.Histogram.Count, Sum: metric.Histogram.Sum}
+		for _, b := range metric.Histogram.Buckets {
+			m.Histogram.Buckets = append(m.Histogram.Buckets, &pb.Bucket{UpperBound: b.UpperBound, Count: b.Count})
+		}
+	}
+	if metric.Summary != nil {
+		m.Summary = &pb.Summary{Count: metric.Summary.Count, Sum: metric.Summary.Sum}
+		for _, q := range metric.Summary.Quantiles {
+			m.Summary.Quantiles = append(m.Summary.Quantiles, &pb.Quantile{Quantile: q.Quantile, Value: q.Value})
+		}
+	}
+	return m
 }
 
 // metricWorker gets metrics from channel and sends them to the server
@@ -52,49 +225,45 @@ type metricWorker struct {
 	mu     sync.Mutex
 }
 
-func hash(src, key string) string {
-	h := hmac.New(sha256.New, []byte(key))
-	h.Write([]byte(src))
-	dst := h.Sum(nil)
-	return fmt.Sprintf("%x", dst)
-}
-
 // SendMetric sends one metric from
 func (w *metricWorker) SendMetric() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	for metric := range w.ch {
-		m := pb.Metric{
-			Id:    metric.ID,
-			Mtype: metric.MType,
-		}
-		if w.sender.Key != "" {
-			if metric.MType == "gauge" {
-				m.Hash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), w.sender.Key)
-			} else {
-				m.Hash = hash(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta), w.sender.Key)
-			}
+		m := metricToProto(metric.WithLabels(w.sender.Labels), w.sender.Key)
+		req, err := w.sender.updateMetricRequest(m)
+		if err != nil {
+			loggers.ErrorLogger.Println("Request Creation error:", err)
+			return err
 		}
-		switch metric.MType {
-		case "counter":
-			m.Delta = *metric.Delta
-		case "gauge":
-			m.Value = *metric.Value
+		ctx, sig, err := w.sender.signedContext(context.Background(), pb.Metrics_UpdateMetric_FullMethodName, req)
+		if err != nil {
+			loggers.ErrorLogger.Println("Request Creation error:", err)
+			return err
 		}
-		req := pb.UpdateMetricRequest{
-			Metric: &m,
+		if err = w.sender.checkBackoff(); err != nil {
+			loggers.ErrorLogger.Println("error while sending metric:", err)
+			return err
 		}
-		_, err := w.sender.Client.UpdateMetric(context.Background(), &req)
+		var header, trailer metadata.MD
+		resp, err := w.sender.Client.UpdateMetric(ctx, req, grpc.Header(&header), grpc.Trailer(&trailer))
 		if err != nil {
+			w.sender.delay(err, trailer)
 			if e, ok := status.FromError(err); ok {
 				if e.Code() == codes.PermissionDenied {
 					loggers.ErrorLogger.Println(`FORBIDDEN`, e.Message())
 				} else if e.Code() == codes.Unimplemented {
 					loggers.ErrorLogger.Println("UNIMPLEMENTED", e.Message())
+				} else if e.Code() == codes.ResourceExhausted {
+					loggers.ErrorLogger.Println("RESOURCE EXHAUSTED", e.Message())
 				}
 				return err
 			}
 		}
+		if err = w.sender.verifyResponse(pb.Metrics_UpdateMetric_FullMethodName, sig, header, resp); err != nil {
+			loggers.ErrorLogger.Println("error while verifying response:", err)
+			return err
+		}
 	}
 	return nil
 }
@@ -108,7 +277,8 @@ func (w *metricWorker) ReadMetrics(ctx context.Context, collector *metriccollect
 	metrics = append(metrics, collector.UtilData.CPUutilizations...)
 	metrics = append(metrics, collector.UtilData.TotalMemory, collector.UtilData.FreeMemory)
 	collector.RuntimeMetrics = append(metrics, newMetrics, collector.PollCount)
-	for _, metric := range collector.RuntimeMetrics {
+	metrics = append(collector.RuntimeMetrics, collector.DistributionMetrics()...)
+	for _, metric := range metrics {
 		select {
 		case <-ctx.Done():
 			return
@@ -135,6 +305,7 @@ func (s Sender) SendAllMetrics(collector *metriccollector.MetricCollector) {
 		loggers.ErrorLogger.Println("error sending metrics:", err)
 	}
 	*(collector.PollCount.Delta) = 0
+	collector.ResetHistograms()
 	loggers.InfoLogger.Println("Sent Gauge")
 }
 
@@ -144,75 +315,54 @@ func (s Sender) SendAllMetricsAsButch(collector *metriccollector.MetricCollector
 	collector.RuntimeMetrics = append(collector.RuntimeMetrics, newMetrics)
 	collector.RuntimeMetrics = append(collector.RuntimeMetrics, collector.PollCount)
 	var metrics []*pb.Metric
-	for _, metric := range collector.RuntimeMetrics {
-		m := pb.Metric{
-			Id:    metric.ID,
-			Mtype: metric.MType,
-		}
-		if s.Key != "" {
-			if metric.MType == "gauge" {
-				m.Hash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
-			} else {
-				m.Hash = hash(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta), s.Key)
-			}
-		}
-		switch metric.MType {
-		case "counter":
-			m.Delta = *metric.Delta
-		case "gauge":
-			m.Value = *metric.Value
-		}
-		metrics = append(metrics, &m)
+	for _, metric := range append(collector.RuntimeMetrics, collector.DistributionMetrics()...) {
+		metrics = append(metrics, metricToProto(metric.WithLabels(s.Labels), s.Key))
 	}
 	for _, metric := range collector.UtilData.CPUutilizations {
-		m := pb.Metric{
-			Id:    metric.ID,
-			Mtype: metric.MType,
-			Value: *metric.Value,
-		}
-		if s.Key != "" {
-			m.Hash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
-		}
-		metrics = append(metrics, &m)
-	}
-	metric := collector.UtilData.TotalMemory
-	m := pb.Metric{
-		Id:    metric.ID,
-		Mtype: metric.MType,
-		Value: *metric.Value,
-	}
-	if s.Key != "" {
-		m.Hash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
-	}
-	metrics = append(metrics, &m)
-	metric = collector.UtilData.FreeMemory
-	m = pb.Metric{
-		Id:    metric.ID,
-		Mtype: metric.MType,
-		Value: *metric.Value,
-	}
-	if s.Key != "" {
-		m.Hash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
+		metrics = append(metrics, metricToProto(metric.WithLabels(s.Labels), s.Key))
 	}
-	metrics = append(metrics, &m)
+	metrics = append(metrics,
+		metricToProto(collector.UtilData.TotalMemory.WithLabels(s.Labels), s.Key),
+		metricToProto(collector.UtilData.FreeMemory.WithLabels(s.Labels), s.Key),
+	)
 	loggers.InfoLogger.Println("Sent Metrics")
 	mdMap := make(map[string]string)
 	mdMap["X-Real-IP"] = s.HostAddress
 	md := metadata.New(mdMap)
 	ctx := metadata.NewOutgoingContext(context.Background(), md)
-	req := &pb.UpdateManyMetricsRequest{
-		Metrics: metrics,
+	req, err := s.updateManyMetricsRequest(metrics)
+	if err != nil {
+		loggers.ErrorLogger.Println("Request Creation error:", err)
+		return
 	}
-	_, err := s.Client.UpdateManyMetrics(ctx, req)
+	ctx, sig, err := s.signedContext(ctx, pb.Metrics_UpdateManyMetrics_FullMethodName, req)
 	if err != nil {
+		loggers.ErrorLogger.Println("Request Creation error:", err)
+		return
+	}
+	if err = s.checkBackoff(); err != nil {
+		loggers.ErrorLogger.Println("error while sending metrics:", err)
+		return
+	}
+	var header, trailer metadata.MD
+	resp, err := s.Client.UpdateManyMetrics(ctx, req, grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		s.delay(err, trailer)
 		if e, ok := status.FromError(err); ok {
 			if e.Code() == codes.PermissionDenied {
 				loggers.ErrorLogger.Println(`FORBIDDEN`, e.Message())
 			} else if e.Code() == codes.Unimplemented {
 				loggers.ErrorLogger.Println("UNIMPLEMENTED", e.Message())
+			} else if e.Code() == codes.ResourceExhausted {
+				loggers.ErrorLogger.Println("RESOURCE EXHAUSTED", e.Message())
 			}
 			return
 		}
 	}
+	if err = s.verifyResponse(pb.Metrics_UpdateManyMetrics_FullMethodName, sig, header, resp); err != nil {
+		loggers.ErrorLogger.Println("error while verifying response:", err)
+		return
+	}
 	*(collector.PollCount.Delta) = 0
+	collector.ResetHistograms()
 }
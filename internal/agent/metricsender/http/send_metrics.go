@@ -4,25 +4,25 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
-	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/config"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metriccollector"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metricsender"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
 )
 
 type Sender struct {
@@ -32,40 +32,40 @@ type Sender struct {
 	HostAddress      string
 	Key              string
 	CryptoKey        *rsa.PublicKey
+	Token            string
 	RateLimit        int
+	Labels           map[string]string
+	Backoff          *metricsender.Backoff
 }
 
-func NewSender(cfg config.Config) *Sender {
+// NewSender creates Sender, crypto key file must be readable if it is set
+func NewSender(cfg config.Config) (*Sender, error) {
 	var cryptoKey *rsa.PublicKey
 	if cfg.CryptoKeyFile != "" {
-		file, err := os.OpenFile(cfg.CryptoKeyFile, os.O_RDONLY, 0777)
-		if err != nil {
-			loggers.ErrorLogger.Println("error while opening crtypto key file:", err)
-			cryptoKey = nil
-		} else {
-			cryptoKeyByte, err := io.ReadAll(file)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while opening crtypto key file:", err)
-				cryptoKey = nil
-			}
-			var ok bool
-			key, err := x509.ParsePKIXPublicKey(cryptoKeyByte)
-			cryptoKey, ok = key.(*rsa.PublicKey)
-			if err != nil || !ok {
-				loggers.ErrorLogger.Println("error while opening crtypto key file:", err)
-				cryptoKey = nil
-			}
+		var err error
+		if cryptoKey, err = encryption.ReadPublicKey(cfg.CryptoKeyFile); err != nil {
+			return nil, fmt.Errorf("error while loading crypto key: %w", err)
 		}
 	}
+	client, scheme := &http.Client{}, "http"
+	if cfg.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg.TLSConfig
+		client.Transport = transport
+		scheme = "https"
+	}
 	return &Sender{
-		client:           &http.Client{},
-		UpdateAddress:    fmt.Sprintf("http://%s/update/", cfg.Address),
-		UpdateAllAddress: fmt.Sprintf("http://%s/updates/", cfg.Address),
+		client:           client,
+		UpdateAddress:    fmt.Sprintf("%s://%s/update/", scheme, cfg.Address),
+		UpdateAllAddress: fmt.Sprintf("%s://%s/updates/", scheme, cfg.Address),
 		HostAddress:      cfg.HostAddress,
 		Key:              cfg.HashKey,
 		CryptoKey:        cryptoKey,
+		Token:            cfg.Token,
 		RateLimit:        cfg.RateLimit,
-	}
+		Labels:           cfg.Labels,
+		Backoff:          metricsender.NewBackoff(),
+	}, nil
 }
 
 // metricWorker gets metrics from channel and sends them to the server
@@ -93,11 +93,83 @@ func Compress(data []byte) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func hash(src, key string) string {
-	h := hmac.New(sha256.New, []byte(key))
-	h.Write([]byte(src))
-	dst := h.Sum(nil)
-	return fmt.Sprintf("%x", dst)
+// newRequest creates compressed JSON request, body is encrypted if crypto key is set.
+// If hash key is set, body sent is signed and the signature is returned to verify response with
+func (s *Sender) newRequest(url string, data []byte) (*http.Request, signature.Signature, error) {
+	var sig signature.Signature
+	if s.CryptoKey != nil {
+		envelope, err := encryption.Encrypt(s.CryptoKey, data)
+		if err != nil {
+			return nil, sig, fmt.Errorf("error while encrypting request: %w", err)
+		}
+		data = envelope
+	}
+	compressed, err := Compress(data)
+	if err != nil {
+		return nil, sig, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(compressed))
+	if err != nil {
+		return nil, sig, err
+	}
+	req.Close = true
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Real-IP", s.HostAddress)
+	if s.CryptoKey != nil {
+		req.Header.Set(encryption.Header, encryption.Scheme)
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	if s.Key != "" {
+		if sig, err = signature.New(s.Key, req.Method, req.URL.RequestURI(), data); err != nil {
+			return nil, sig, err
+		}
+		for name, value := range sig.Fields() {
+			req.Header.Set(name, value)
+		}
+	}
+	return req, sig, nil
+}
+
+// send sends data to url and verifies signature of response if hash key is set.
+// Nothing is sent while the server asks to retry later with Retry-After
+func (s *Sender) send(url string, data []byte) error {
+	if left := s.Backoff.Left(); left > 0 {
+		return fmt.Errorf("%w in %s", metricsender.ErrBackoff, left.Round(time.Second))
+	}
+	req, sig, err := s.newRequest(url, data)
+	if err != nil {
+		return fmt.Errorf("error while creating request: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error while sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error while reading response: %w", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if wait, ok := metricsender.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			s.Backoff.Delay(wait)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	if s.Key != "" {
+		respSig, err := signature.Parse(resp.Header.Get)
+		if err != nil {
+			return fmt.Errorf("response: %w", err)
+		}
+		if respSig.Nonce != sig.Nonce || !respSig.Valid(s.Key, strconv.Itoa(resp.StatusCode), req.URL.RequestURI(), body) {
+			return fmt.Errorf("response: %w", signature.ErrInvalid)
+		}
+	}
+	return nil
 }
 
 // SendMetric sends one metric from
@@ -105,47 +177,18 @@ func (w *metricWorker) SendMetric() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	for metric := range w.ch {
+		metric = metric.WithLabels(w.sender.Labels)
 		url := w.sender.UpdateAddress
 		if w.sender.Key != "" {
-			if metric.MType == "gauge" {
-				metric.Hash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), w.sender.Key)
-			} else {
-				metric.Hash = hash(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta), w.sender.Key)
-			}
+			metric.Hash = hash.Hash(hash.WithLabels(metric.HashSource(), metric.Labels), w.sender.Key)
 		}
 		byteJSON, err := json.Marshal(metric)
 		if err != nil {
 			loggers.ErrorLogger.Println("json Marshal error:", err)
 			return err
 		}
-		if w.sender.CryptoKey != nil {
-			codedJSON, err := rsa.EncryptPKCS1v15(rand.Reader, w.sender.CryptoKey, byteJSON)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while coding json:", err)
-			} else {
-				byteJSON = codedJSON
-			}
-		}
-		compressedJSON, err := Compress(byteJSON)
-		if err != nil {
-			loggers.ErrorLogger.Printf("Compress error: %v", err)
-		}
-		body := strings.NewReader(string(compressedJSON))
-		req, err := http.NewRequest("POST", url, body)
-		if err != nil {
-			loggers.ErrorLogger.Println("Request Creation error:", err)
-			return err
-		}
-		req.Close = true
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Content-Encoding", "gzip")
-		req.Header.Set("X-Real-IP", w.sender.HostAddress)
-		resp, err := w.sender.client.Do(req)
-		if err != nil {
-			loggers.ErrorLogger.Println("Client.Do() error:", err)
-			return err
-		}
-		if err := resp.Body.Close(); err != nil {
+		if err = w.sender.send(url, byteJSON); err != nil {
+			loggers.ErrorLogger.Println("error while sending metric:", err)
 			return err
 		}
 	}
@@ -161,7 +204,8 @@ func (w *metricWorker) ReadMetrics(ctx context.Context, collector *metriccollect
 	metrics = append(metrics, collector.UtilData.CPUutilizations...)
 	metrics = append(metrics, collector.UtilData.TotalMemory, collector.UtilData.FreeMemory)
 	collector.RuntimeMetrics = append(metrics, newMetrics, collector.PollCount)
-	for _, metric := range collector.RuntimeMetrics {
+	metrics = append(collector.RuntimeMetrics, collector.DistributionMetrics()...)
+	for _, metric := range metrics {
 		select {
 		case <-ctx.Done():
 			return
@@ -173,21 +217,23 @@ func (w *metricWorker) ReadMetrics(ctx context.Context, collector *metriccollect
 
 // SendAllMetrics sends all metrics to the server one by one
 func (s Sender) SendAllMetrics(collector *metriccollector.MetricCollector) {
-	ctx := context.Background()
-	g, _ := errgroup.WithContext(ctx)
+	g, ctx := errgroup.WithContext(context.Background())
 	recordCh := make(chan types.Metrics)
 	for i := 0; i < s.RateLimit; i++ {
 		w := &metricWorker{ch: recordCh, mu: sync.Mutex{}, sender: &s}
 		g.Go(w.SendMetric)
 	}
 	readW := &metricWorker{ch: recordCh, mu: sync.Mutex{}, sender: &s}
+	// reading stops when any worker fails, so that it isn't blocked by stopped workers
 	readW.ReadMetrics(ctx, collector)
 	close(recordCh)
 	err := g.Wait()
 	if err != nil {
 		loggers.ErrorLogger.Println("error sending metrics:", err)
+		return
 	}
 	*(collector.PollCount.Delta) = 0
+	collector.ResetHistograms()
 	loggers.InfoLogger.Println("Sent Gauge")
 }
 
@@ -199,33 +245,31 @@ func (s Sender) SendAllMetricsAsButch(collector *metriccollector.MetricCollector
 	collector.RuntimeMetrics = append(collector.RuntimeMetrics, newMetrics)
 	collector.RuntimeMetrics = append(collector.RuntimeMetrics, collector.PollCount)
 	var metrics []types.Metrics
-	for _, metric := range collector.RuntimeMetrics {
+	for _, metric := range append(collector.RuntimeMetrics, collector.DistributionMetrics()...) {
+		metric = metric.WithLabels(s.Labels)
 		if s.Key != "" {
-			if metric.MType == "gauge" {
-				metricHash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
-			} else {
-				metricHash = hash(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta), s.Key)
-			}
+			metricHash = hash.Hash(hash.WithLabels(metric.HashSource(), metric.Labels), s.Key)
 			metric.Hash = metricHash
 		}
 		metrics = append(metrics, metric)
 	}
 	for _, metric := range collector.UtilData.CPUutilizations {
+		metric = metric.WithLabels(s.Labels)
 		if s.Key != "" {
-			metricHash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
+			metricHash = hash.Hash(hash.WithLabels(metric.HashSource(), metric.Labels), s.Key)
 			metric.Hash = metricHash
 		}
 		metrics = append(metrics, metric)
 	}
-	metric := collector.UtilData.TotalMemory
+	metric := collector.UtilData.TotalMemory.WithLabels(s.Labels)
 	if s.Key != "" {
-		metricHash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
+		metricHash = hash.Hash(hash.WithLabels(metric.HashSource(), metric.Labels), s.Key)
 		metric.Hash = metricHash
 	}
 	metrics = append(metrics, metric)
-	metric = collector.UtilData.FreeMemory
+	metric = collector.UtilData.FreeMemory.WithLabels(s.Labels)
 	if s.Key != "" {
-		metricHash = hash(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value), s.Key)
+		metricHash = hash.Hash(hash.WithLabels(metric.HashSource(), metric.Labels), s.Key)
 		metric.Hash = metricHash
 	}
 	metrics = append(metrics, metric)
@@ -236,28 +280,10 @@ func (s Sender) SendAllMetricsAsButch(collector *metriccollector.MetricCollector
 		loggers.ErrorLogger.Println("cannot marshal metrics: " + err.Error())
 		return
 	}
-	compressedJSON, err := Compress(jsonMetrics)
-	if err != nil {
-		loggers.ErrorLogger.Printf("Compress error: %v", err)
-	}
-	body := strings.NewReader(string(compressedJSON))
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		loggers.ErrorLogger.Println("Request Creation error")
+	if err = s.send(url, jsonMetrics); err != nil {
+		loggers.ErrorLogger.Println("error while sending metrics:", err)
 		return
 	}
-	req.Close = true
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("X-Real-IP", s.HostAddress)
-	resp, err := s.client.Do(req)
-	if err != nil {
-		loggers.ErrorLogger.Println("Client.Do() error:", err)
-		return
-	}
-	err = resp.Body.Close()
-	if err != nil {
-		loggers.ErrorLogger.Println("response body close error:", err)
-	}
 	*(collector.PollCount.Delta) = 0
+	collector.ResetHistograms()
 }
@@ -5,14 +5,19 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/config"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metriccollector"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metricsender"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/types"
 )
 
@@ -51,8 +56,9 @@ func TestSendCounter(t *testing.T) {
 		Address:        "localhost:8080",
 		RateLimit:      100,
 	}
-	c := metriccollector.NewMetricCollector()
-	s := NewSender(cfg)
+	c := metriccollector.NewMetricCollector(cfg.HistogramBuckets)
+	s, err := NewSender(cfg)
+	require.NoError(t, err)
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			metric := types.Metrics{
@@ -123,8 +129,9 @@ func TestSendGauge(t *testing.T) {
 		RateLimit:      100,
 		HostAddress:    "127.0.0.1",
 	}
-	c := metriccollector.NewMetricCollector()
-	s := NewSender(cfg)
+	c := metriccollector.NewMetricCollector(cfg.HistogramBuckets)
+	s, err := NewSender(cfg)
+	require.NoError(t, err)
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			metric := types.Metrics{
@@ -166,3 +173,43 @@ func TestSendGauge(t *testing.T) {
 	}
 
 }
+
+// TestSendRetryAfter tests that sender doesn't send anything while the server asks to retry later
+func TestSendRetryAfter(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	s, err := NewSender(config.Config{Address: strings.TrimPrefix(srv.URL, "http://"), RateLimit: 1})
+	require.NoError(t, err)
+	c := metriccollector.NewMetricCollector(nil)
+	delta := int64(5)
+	c.PollCount.Delta = &delta
+
+	assert.Error(t, s.send(s.UpdateAllAddress, []byte("[]")))
+	assert.InDelta(t, 30*time.Second, s.Backoff.Left(), float64(time.Second))
+	err = s.send(s.UpdateAllAddress, []byte("[]"))
+	assert.ErrorIs(t, err, metricsender.ErrBackoff)
+	s.SendAllMetricsAsButch(c)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, int64(5), *c.PollCount.Delta)
+}
+
+// TestSendAllMetricsFailure tests that poll count and histograms aren't reset when metrics weren't sent
+func TestSendAllMetricsFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "storage is unavailable", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	s, err := NewSender(config.Config{Address: strings.TrimPrefix(srv.URL, "http://"), RateLimit: 2})
+	require.NoError(t, err)
+	c := metriccollector.NewMetricCollector(nil)
+	delta := int64(5)
+	c.PollCount.Delta = &delta
+
+	s.SendAllMetrics(c)
+	assert.Equal(t, int64(5), *c.PollCount.Delta)
+}
@@ -1,7 +1,19 @@
 // // Package metricsender describes sending metrics' info to the server
 package metricsender
 
-import "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metriccollector"
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/agent/metriccollector"
+)
+
+// ErrBackoff is returned when the server asked to retry later and the time has not come yet
+var ErrBackoff = errors.New("server asked to retry later")
 
 // MetricSender sends metrics to the server
 type MetricSender interface {
@@ -12,3 +24,54 @@ type MetricSender interface {
 	//SendAllMetricsAsButch sends metrics to the server at once
 	SendAllMetricsAsButch(c *metriccollector.MetricCollector)
 }
+
+// Backoff holds time until which the server asked not to send metrics.
+// It is shared by copies of sender so it must be used by pointer
+type Backoff struct {
+	mu    sync.Mutex
+	until time.Time
+	now   func() time.Time
+}
+
+// NewBackoff creates Backoff allowing to send right away
+func NewBackoff() *Backoff {
+	return &Backoff{now: time.Now}
+}
+
+// Delay postpones sending for d, earlier deadline never shortens a later one
+func (b *Backoff) Delay(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := b.now().Add(d); until.After(b.until) {
+		b.until = until
+	}
+}
+
+// Left returns time left until metrics can be sent again
+func (b *Backoff) Left() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if left := b.until.Sub(b.now()); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// ParseRetryAfter parses value of Retry-After written in seconds or as HTTP date
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := date.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
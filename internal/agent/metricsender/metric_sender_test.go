@@ -0,0 +1,44 @@
+package metricsender
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseRetryAfter tests parsing of Retry-After in seconds and as HTTP date
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{value: "3", wait: 3 * time.Second, ok: true},
+		{value: " 0 ", wait: 0, ok: true},
+		{value: "Mon, 01 May 2023 12:00:10 GMT", wait: 10 * time.Second, ok: true},
+		{value: "Mon, 01 May 2023 11:00:00 GMT", wait: 0, ok: true},
+		{value: "-1"},
+		{value: "soon"},
+		{value: ""},
+	}
+	for _, tt := range tests {
+		wait, ok := ParseRetryAfter(tt.value, now)
+		assert.Equal(t, tt.ok, ok, tt.value)
+		assert.Equal(t, tt.wait, wait, tt.value)
+	}
+}
+
+// TestBackoff tests that later deadline is kept
+func TestBackoff(t *testing.T) {
+	now := time.Now()
+	b := NewBackoff()
+	b.now = func() time.Time { return now }
+	assert.Zero(t, b.Left())
+	b.Delay(5 * time.Second)
+	b.Delay(time.Second)
+	assert.Equal(t, 5*time.Second, b.Left())
+	now = now.Add(5 * time.Second)
+	assert.Zero(t, b.Left())
+}
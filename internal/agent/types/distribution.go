@@ -0,0 +1,98 @@
+package types
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bucket stores a number of histogram observations in (previous bucket's UpperBound, UpperBound]
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// Histogram stores observations counted in buckets.
+// Observations greater than the last bound are only counted in Count
+type Histogram struct {
+	Buckets []Bucket `json:"buckets"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+}
+
+// Quantile stores value of a quantile of observations
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Summary stores precomputed quantiles of observations
+type Summary struct {
+	Quantiles []Quantile `json:"quantiles"`
+	Count     uint64     `json:"count"`
+	Sum       float64    `json:"sum"`
+}
+
+// NewHistogram creates empty histogram with sorted bucket bounds
+func NewHistogram(bounds []float64) *Histogram {
+	sorted := make([]float64, len(bounds))
+	copy(sorted, bounds)
+	sort.Float64s(sorted)
+	h := &Histogram{Buckets: make([]Bucket, 0, len(sorted))}
+	for i, bound := range sorted {
+		if i > 0 && bound == sorted[i-1] {
+			continue
+		}
+		h.Buckets = append(h.Buckets, Bucket{UpperBound: bound})
+	}
+	return h
+}
+
+// Observe counts one observation in histogram
+func (h *Histogram) Observe(v float64) {
+	h.Count++
+	h.Sum += v
+	i := sort.Search(len(h.Buckets), func(i int) bool { return v <= h.Buckets[i].UpperBound })
+	if i < len(h.Buckets) {
+		h.Buckets[i].Count++
+	}
+}
+
+// Reset drops all observations keeping bucket bounds
+func (h *Histogram) Reset() {
+	for i := range h.Buckets {
+		h.Buckets[i].Count = 0
+	}
+	h.Count = 0
+	h.Sum = 0
+}
+
+// Copy makes a deep copy of histogram
+func (h Histogram) Copy() *Histogram {
+	buckets := make([]Bucket, len(h.Buckets))
+	copy(buckets, h.Buckets)
+	h.Buckets = buckets
+	return &h
+}
+
+// String makes a canonical string of histogram used in hashes
+func (h Histogram) String() string {
+	parts := make([]string, len(h.Buckets))
+	for i, b := range h.Buckets {
+		parts[i] = fmt.Sprintf("%s=%d", strconv.FormatFloat(b.UpperBound, 'g', -1, 64), b.Count)
+	}
+	return fmt.Sprintf("count=%d sum=%f buckets=%s", h.Count, h.Sum, strings.Join(parts, ","))
+}
+
+// String makes a canonical string of summary used in hashes
+func (s Summary) String() string {
+	quantiles := make([]Quantile, len(s.Quantiles))
+	copy(quantiles, s.Quantiles)
+	sort.Slice(quantiles, func(i, j int) bool { return quantiles[i].Quantile < quantiles[j].Quantile })
+	parts := make([]string, len(quantiles))
+	for i, q := range quantiles {
+		parts[i] = fmt.Sprintf("%s=%f", strconv.FormatFloat(q.Quantile, 'g', -1, 64), q.Value)
+	}
+	return fmt.Sprintf("count=%d sum=%f quantiles=%s", s.Count, s.Sum, strings.Join(parts, ","))
+}
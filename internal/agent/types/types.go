@@ -1,5 +1,7 @@
 package types
 
+import "fmt"
+
 // Metrics saves metric info
 type Metrics struct {
 	ID    string   `json:"id"`
@@ -7,4 +9,49 @@ type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
 	Hash  string   `json:"hash,omitempty"`
+	// Labels are optional key/value pairs attached to metric
+	Labels map[string]string `json:"labels,omitempty"`
+	// Histogram is set for histogram metrics and holds observations made since the last report
+	Histogram *Histogram `json:"histogram,omitempty"`
+	// Summary is set for summary metrics
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// HashSource makes a string of metric's value signed by hash without labels
+func (m Metrics) HashSource() string {
+	switch m.MType {
+	case "gauge":
+		if m.Value != nil {
+			return fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value)
+		}
+	case "counter":
+		if m.Delta != nil {
+			return fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta)
+		}
+	case "histogram":
+		if m.Histogram != nil {
+			return fmt.Sprintf("%s:histogram:%s", m.ID, m.Histogram.String())
+		}
+	case "summary":
+		if m.Summary != nil {
+			return fmt.Sprintf("%s:summary:%s", m.ID, m.Summary.String())
+		}
+	}
+	return m.ID + ":" + m.MType
+}
+
+// WithLabels returns metric with added labels, metric's own labels take precedence
+func (m Metrics) WithLabels(l map[string]string) Metrics {
+	if len(l) == 0 {
+		return m
+	}
+	merged := make(map[string]string, len(l)+len(m.Labels))
+	for name, value := range l {
+		merged[name] = value
+	}
+	for name, value := range m.Labels {
+		merged[name] = value
+	}
+	m.Labels = merged
+	return m
 }
@@ -0,0 +1,158 @@
+// Package encryption encrypts agent payloads with envelope encryption:
+// payload is sealed with a random AES-256-GCM key and the key is wrapped with RSA-OAEP
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header is an HTTP header set to Scheme if request body is an envelope
+const Header = "X-Encryption"
+
+// Scheme names envelope format
+const Scheme = "rsa-oaep-aes256gcm"
+
+// version is the first byte of envelope
+const version byte = 1
+
+// keySize is a size of AES-256 key
+const keySize = 32
+
+// ErrMalformed is returned when envelope can't be parsed
+var ErrMalformed = errors.New("malformed envelope")
+
+// Envelope layout:
+//
+//	version (1 byte) | wrapped key length (2 bytes, big endian) | wrapped key | nonce | ciphertext with tag
+//
+// Everything before nonce is authenticated as additional data of AES-GCM
+
+// Encrypt seals plaintext into envelope which only owner of private key can open
+func Encrypt(key *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	aesKey := make([]byte, keySize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, fmt.Errorf("error while generating key: %w", err)
+	}
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while wrapping key: %w", err)
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3, 3+len(wrappedKey)+gcm.NonceSize())
+	header[0] = version
+	binary.BigEndian.PutUint16(header[1:], uint16(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error while generating nonce: %w", err)
+	}
+	envelope := append(header, nonce...)
+	return gcm.Seal(envelope, nonce, plaintext, header), nil
+}
+
+// Decrypt opens envelope made by Encrypt
+func Decrypt(key *rsa.PrivateKey, envelope []byte) ([]byte, error) {
+	if len(envelope) < 3 || envelope[0] != version {
+		return nil, ErrMalformed
+	}
+	keyLen := int(binary.BigEndian.Uint16(envelope[1:]))
+	if len(envelope) < 3+keyLen {
+		return nil, ErrMalformed
+	}
+	header := envelope[:3+keyLen]
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, header[3:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while unwrapping key: %w", err)
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	rest := envelope[len(header):]
+	if len(rest) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrMalformed
+	}
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("error while decrypting payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// newGCM creates AES-GCM cipher with key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating cipher: %w", err)
+	}
+	return gcm, nil
+}
+
+// readKey reads DER key from file, PEM encoded keys are decoded
+func readKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading crypto key file: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	return data, nil
+}
+
+// ReadPrivateKey reads PKCS #1 or PKCS #8 RSA private key from file
+func ReadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	der, err := readKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing crypto key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("crypto key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// ReadPublicKey reads PKIX or PKCS #1 RSA public key from file
+func ReadPublicKey(path string) (*rsa.PublicKey, error) {
+	der, err := readKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing crypto key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("crypto key is not an RSA key")
+	}
+	return rsaKey, nil
+}
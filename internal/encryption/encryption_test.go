@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEncryptDecrypt tests that envelopes of payloads of any size are opened only with the right key
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	large := make([]byte, 1<<20)
+	_, err = rand.Read(large)
+	require.NoError(t, err)
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{name: "empty", plaintext: []byte{}},
+		{name: "metric", plaintext: []byte(`{"id":"PollCount","type":"counter","delta":5}`)},
+		{name: "larger than key", plaintext: large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := Encrypt(&key.PublicKey, tt.plaintext)
+			require.NoError(t, err)
+			plaintext, err := Decrypt(key, envelope)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(tt.plaintext, plaintext))
+			_, err = Decrypt(otherKey, envelope)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// TestDecryptRejectsTamperedEnvelope tests that any change of envelope is detected
+func TestDecryptRejectsTamperedEnvelope(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	envelope, err := Encrypt(&key.PublicKey, []byte(`{"id":"Alloc","type":"gauge","value":1.5}`))
+	require.NoError(t, err)
+	tests := []struct {
+		name   string
+		modify func(e []byte) []byte
+	}{
+		{name: "flipped ciphertext bit", modify: func(e []byte) []byte { e[len(e)-1] ^= 1; return e }},
+		{name: "flipped wrapped key bit", modify: func(e []byte) []byte { e[10] ^= 1; return e }},
+		{name: "truncated", modify: func(e []byte) []byte { return e[:len(e)-20] }},
+		{name: "wrong version", modify: func(e []byte) []byte { e[0] = 2; return e }},
+		{name: "too short", modify: func(e []byte) []byte { return e[:2] }},
+		{name: "plaintext", modify: func(e []byte) []byte { return []byte(`{"id":"Alloc"}`) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.modify(append([]byte(nil), envelope...))
+			_, err := Decrypt(key, tampered)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// TestReadKeys tests reading keys in DER and PEM encodings
+func TestReadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	files := map[string][]byte{
+		"private.der": x509.MarshalPKCS1PrivateKey(key),
+		"private.pem": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"public.der":  publicDER,
+		"public.pem":  pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}),
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0600))
+	}
+	for _, name := range []string{"private.der", "private.pem"} {
+		privateKey, err := ReadPrivateKey(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.True(t, key.Equal(privateKey), name)
+	}
+	for _, name := range []string{"public.der", "public.pem"} {
+		publicKey, err := ReadPublicKey(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.True(t, key.PublicKey.Equal(publicKey), name)
+	}
+	_, err = ReadPrivateKey(filepath.Join(dir, "public.der"))
+	assert.Error(t, err)
+}
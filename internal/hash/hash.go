@@ -5,6 +5,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"fmt"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
 )
 
 // Hash make a sha256 hash from data and key
@@ -14,3 +16,11 @@ func Hash(src, key string) string {
 	dst := h.Sum(nil)
 	return fmt.Sprintf("%x", dst)
 }
+
+// WithLabels appends canonical labels to hashed metric data if metric has any
+func WithLabels(src string, l map[string]string) string {
+	if len(l) == 0 {
+		return src
+	}
+	return src + ":" + labels.String(l)
+}
@@ -0,0 +1,121 @@
+// Package labels works with key/value labels of metrics
+package labels
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrWrongFormat is returned when labels can't be parsed
+var ErrWrongFormat = errors.New("wrong labels format")
+
+// String makes a canonical string of labels sorted by name: {a="1",b="2"}.
+// It returns an empty string for empty labels
+func String(l map[string]string) string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escape(l[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// escape escapes backslashes, quotes and line feeds in label value
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Parse parses labels from their canonical string
+func Parse(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("%w: %s", ErrWrongFormat, s)
+	}
+	l := make(map[string]string)
+	rest := s[1 : len(s)-1]
+	for rest != "" {
+		eq := strings.Index(rest, `="`)
+		if eq <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrWrongFormat, s)
+		}
+		name := rest[:eq]
+		rest = rest[eq+2:]
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(rest); i++ {
+			c := rest[i]
+			if c == '\\' && i+1 < len(rest) {
+				i++
+				if rest[i] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(rest[i])
+				}
+				continue
+			}
+			if c == '"' {
+				rest = rest[i+1:]
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, fmt.Errorf("%w: %s", ErrWrongFormat, s)
+		}
+		l[name] = value.String()
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("%w: %s", ErrWrongFormat, s)
+			}
+			rest = rest[1:]
+		}
+	}
+	return l, nil
+}
+
+// ParsePairs parses labels written as comma separated name=value pairs: a=1,b=2
+func ParsePairs(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	l := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w: %s", ErrWrongFormat, pair)
+		}
+		l[name] = strings.TrimSpace(value)
+	}
+	return l, nil
+}
+
+// Validate checks that label names are not empty and contain no special characters
+func Validate(l map[string]string) error {
+	for name := range l {
+		if name == "" || strings.ContainsAny(name, "{}=\",\n") {
+			return fmt.Errorf("%w: wrong label name %q", ErrWrongFormat, name)
+		}
+	}
+	return nil
+}
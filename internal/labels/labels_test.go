@@ -0,0 +1,43 @@
+package labels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStringParse tests that canonical string of labels is parsed back
+func TestStringParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "no labels", want: ""},
+		{name: "sorted by name", labels: map[string]string{"host": "a", "dc": "eu"}, want: `{dc="eu",host="a"}`},
+		{name: "escaped value", labels: map[string]string{"path": "C:\\tmp \"x\"\n,y"}, want: `{path="C:\\tmp \"x\"\n,y"}`},
+		{name: "empty value", labels: map[string]string{"host": ""}, want: `{host=""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := String(tt.labels)
+			assert.Equal(t, tt.want, s)
+			l, err := Parse(s)
+			require.NoError(t, err)
+			assert.Equal(t, len(tt.labels), len(l))
+			for name, value := range tt.labels {
+				assert.Equal(t, value, l[name])
+			}
+		})
+	}
+}
+
+// TestParsePairs tests parsing of name=value pairs
+func TestParsePairs(t *testing.T) {
+	l, err := ParsePairs("host=web-1, dc = eu")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"host": "web-1", "dc": "eu"}, l)
+	_, err = ParsePairs("host")
+	assert.Error(t, err)
+}
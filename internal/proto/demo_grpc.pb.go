@@ -25,6 +25,8 @@ const (
 	Metrics_GetMetric_FullMethodName         = "/grpc_server.Metrics/GetMetric"
 	Metrics_GetAllMetrics_FullMethodName     = "/grpc_server.Metrics/GetAllMetrics"
 	Metrics_PingDatabase_FullMethodName      = "/grpc_server.Metrics/PingDatabase"
+	Metrics_QueryMetric_FullMethodName       = "/grpc_server.Metrics/QueryMetric"
+	Metrics_WatchMetrics_FullMethodName      = "/grpc_server.Metrics/WatchMetrics"
 )
 
 // MetricsClient is the client API for Metrics service.
@@ -36,6 +38,8 @@ type MetricsClient interface {
 	GetMetric(ctx context.Context, in *GetMetricRequest, opts ...grpc.CallOption) (*GetMetricResponse, error)
 	GetAllMetrics(ctx context.Context, in *GetAllMetricsRequest, opts ...grpc.CallOption) (*GetAllMetricsResponse, error)
 	PingDatabase(ctx context.Context, in *PingDatabaseRequest, opts ...grpc.CallOption) (*PingDatabaseResponse, error)
+	QueryMetric(ctx context.Context, in *QueryMetricRequest, opts ...grpc.CallOption) (*QueryMetricResponse, error)
+	WatchMetrics(ctx context.Context, in *WatchMetricsRequest, opts ...grpc.CallOption) (Metrics_WatchMetricsClient, error)
 }
 
 type metricsClient struct {
@@ -91,6 +95,47 @@ func (c *metricsClient) PingDatabase(ctx context.Context, in *PingDatabaseReques
 	return out, nil
 }
 
+func (c *metricsClient) QueryMetric(ctx context.Context, in *QueryMetricRequest, opts ...grpc.CallOption) (*QueryMetricResponse, error) {
+	out := new(QueryMetricResponse)
+	err := c.cc.Invoke(ctx, Metrics_QueryMetric_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsClient) WatchMetrics(ctx context.Context, in *WatchMetricsRequest, opts ...grpc.CallOption) (Metrics_WatchMetricsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Metrics_ServiceDesc.Streams[0], Metrics_WatchMetrics_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsWatchMetricsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Metrics_WatchMetricsClient interface {
+	Recv() (*WatchMetricsResponse, error)
+	grpc.ClientStream
+}
+
+type metricsWatchMetricsClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsWatchMetricsClient) Recv() (*WatchMetricsResponse, error) {
+	m := new(WatchMetricsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // MetricsServer is the server API for Metrics service.
 // All implementations must embed UnimplementedMetricsServer
 // for forward compatibility
@@ -100,6 +145,8 @@ type MetricsServer interface {
 	GetMetric(context.Context, *GetMetricRequest) (*GetMetricResponse, error)
 	GetAllMetrics(context.Context, *GetAllMetricsRequest) (*GetAllMetricsResponse, error)
 	PingDatabase(context.Context, *PingDatabaseRequest) (*PingDatabaseResponse, error)
+	QueryMetric(context.Context, *QueryMetricRequest) (*QueryMetricResponse, error)
+	WatchMetrics(*WatchMetricsRequest, Metrics_WatchMetricsServer) error
 	mustEmbedUnimplementedMetricsServer()
 }
 
@@ -122,6 +169,12 @@ func (UnimplementedMetricsServer) GetAllMetrics(context.Context, *GetAllMetricsR
 func (UnimplementedMetricsServer) PingDatabase(context.Context, *PingDatabaseRequest) (*PingDatabaseResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PingDatabase not implemented")
 }
+func (UnimplementedMetricsServer) QueryMetric(context.Context, *QueryMetricRequest) (*QueryMetricResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryMetric not implemented")
+}
+func (UnimplementedMetricsServer) WatchMetrics(*WatchMetricsRequest, Metrics_WatchMetricsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchMetrics not implemented")
+}
 func (UnimplementedMetricsServer) mustEmbedUnimplementedMetricsServer() {}
 
 // UnsafeMetricsServer may be embedded to opt out of forward compatibility for this service.
@@ -225,6 +278,45 @@ func _Metrics_PingDatabase_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Metrics_QueryMetric_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryMetricRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsServer).QueryMetric(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Metrics_QueryMetric_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsServer).QueryMetric(ctx, req.(*QueryMetricRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Metrics_WatchMetrics_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchMetricsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetricsServer).WatchMetrics(m, &metricsWatchMetricsServer{stream})
+}
+
+type Metrics_WatchMetricsServer interface {
+	Send(*WatchMetricsResponse) error
+	grpc.ServerStream
+}
+
+type metricsWatchMetricsServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsWatchMetricsServer) Send(m *WatchMetricsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Metrics_ServiceDesc is the grpc.ServiceDesc for Metrics service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -252,7 +344,17 @@ var Metrics_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "PingDatabase",
 			Handler:    _Metrics_PingDatabase_Handler,
 		},
+		{
+			MethodName: "QueryMetric",
+			Handler:    _Metrics_QueryMetric_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchMetrics",
+			Handler:       _Metrics_WatchMetrics_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/demo.proto",
 }
@@ -0,0 +1,249 @@
+package httpserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// content types of metrics exposition formats
+const (
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// ExpositionFormat is a format in which metrics are exposed to scrapers
+type ExpositionFormat int
+
+// Exposition formats
+const (
+	FormatPrometheus ExpositionFormat = iota
+	FormatOpenMetrics
+)
+
+// NegotiateExpositionFormat chooses exposition format by Accept header
+func NegotiateExpositionFormat(accept string) ExpositionFormat {
+	if strings.Contains(accept, "application/openmetrics-text") {
+		return FormatOpenMetrics
+	}
+	return FormatPrometheus
+}
+
+// SanitizeMetricName turns metric ID into a valid Prometheus metric name
+func SanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// SanitizeLabelName turns label name into a valid Prometheus label name
+func SanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+// sanitizeName replaces characters not allowed in Prometheus names with underscores
+func sanitizeName(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColon:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// sanitizeLabels makes labels valid for Prometheus
+func sanitizeLabels(l map[string]string) map[string]string {
+	if len(l) == 0 {
+		return nil
+	}
+	sanitized := make(map[string]string, len(l))
+	for name, value := range l {
+		sanitized[SanitizeLabelName(name)] = value
+	}
+	return sanitized
+}
+
+// FormatFloat formats float value the way Prometheus does
+func FormatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// expositionSample is one sample of exposed metric family,
+// histograms and summaries are exposed as several lines
+type expositionSample struct {
+	id     string
+	family string
+	mtype  string
+	labels string
+	lines  []string
+}
+
+// withLabel returns labels of metric with one more label as a string
+func withLabel(l map[string]string, name, value string) string {
+	merged := make(map[string]string, len(l)+1)
+	for n, v := range l {
+		merged[n] = v
+	}
+	merged[name] = value
+	return labels.String(merged)
+}
+
+// expositionLines formats metric's value as exposition lines, false if metric has no value
+func expositionLines(m types.Metrics, family string, l map[string]string, format ExpositionFormat) ([]string, bool) {
+	lbls := labels.String(l)
+	switch m.MType {
+	case "counter":
+		if m.Delta == nil {
+			return nil, false
+		}
+		name := family
+		if format == FormatOpenMetrics {
+			name += "_total"
+		}
+		return []string{fmt.Sprintf("%s%s %d", name, lbls, *m.Delta)}, true
+	case "gauge":
+		if m.Value == nil {
+			return nil, false
+		}
+		return []string{fmt.Sprintf("%s%s %s", family, lbls, FormatFloat(*m.Value))}, true
+	case "histogram":
+		if m.Histogram == nil {
+			return nil, false
+		}
+		lines := make([]string, 0, len(m.Histogram.Buckets)+3)
+		for _, b := range m.Histogram.Cumulative() {
+			lines = append(lines, fmt.Sprintf("%s_bucket%s %d", family, withLabel(l, "le", FormatFloat(b.UpperBound)), b.Count))
+		}
+		return append(lines,
+			fmt.Sprintf("%s_bucket%s %d", family, withLabel(l, "le", "+Inf"), m.Histogram.Count),
+			fmt.Sprintf("%s_sum%s %s", family, lbls, FormatFloat(m.Histogram.Sum)),
+			fmt.Sprintf("%s_count%s %d", family, lbls, m.Histogram.Count),
+		), true
+	case "summary":
+		if m.Summary == nil {
+			return nil, false
+		}
+		lines := make([]string, 0, len(m.Summary.Quantiles)+2)
+		for _, q := range m.Summary.Quantiles {
+			lines = append(lines, fmt.Sprintf("%s%s %s", family, withLabel(l, "quantile", FormatFloat(q.Quantile)), FormatFloat(q.Value)))
+		}
+		return append(lines,
+			fmt.Sprintf("%s_sum%s %s", family, lbls, FormatFloat(m.Summary.Sum)),
+			fmt.Sprintf("%s_count%s %d", family, lbls, m.Summary.Count),
+		), true
+	}
+	return nil, false
+}
+
+// WriteExposition writes metrics in Prometheus text or OpenMetrics format
+func WriteExposition(w io.Writer, metrics []types.Metrics, format ExpositionFormat) error {
+	samples := make([]expositionSample, 0, len(metrics))
+	for _, m := range metrics {
+		family := SanitizeMetricName(m.ID)
+		if format == FormatOpenMetrics && m.MType == "counter" {
+			family = strings.TrimSuffix(family, "_total")
+		}
+		l := sanitizeLabels(m.Labels)
+		lines, ok := expositionLines(m, family, l, format)
+		if !ok {
+			continue
+		}
+		samples = append(samples, expositionSample{
+			id:     m.ID,
+			family: family,
+			mtype:  m.MType,
+			labels: labels.String(l),
+			lines:  lines,
+		})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].family != samples[j].family {
+			return samples[i].family < samples[j].family
+		}
+		if samples[i].mtype != samples[j].mtype {
+			return samples[i].mtype < samples[j].mtype
+		}
+		if samples[i].labels != samples[j].labels {
+			return samples[i].labels < samples[j].labels
+		}
+		return samples[i].id < samples[j].id
+	})
+	writer := bufio.NewWriter(w)
+	families := make(map[string]string)
+	// written are families with labels of written samples, IDs may be sanitized to the same family
+	written := make(map[string]bool)
+	for _, sample := range samples {
+		if mtype, ok := families[sample.family]; !ok {
+			families[sample.family] = sample.mtype
+			if _, err := fmt.Fprintf(writer, "# TYPE %s %s\n", sample.family, sample.mtype); err != nil {
+				return err
+			}
+		} else if mtype != sample.mtype {
+			loggers.ErrorLogger.Printf("exposition: %s metric %s collides with %s metric with the same name", sample.mtype, sample.family, mtype)
+			continue
+		}
+		if written[sample.family+sample.labels] {
+			loggers.ErrorLogger.Printf("exposition: %s metric %s collides with %s metric with the same name", sample.mtype, sample.family+sample.labels, sample.mtype)
+			continue
+		}
+		written[sample.family+sample.labels] = true
+		for _, line := range sample.lines {
+			if _, err := fmt.Fprintln(writer, line); err != nil {
+				return err
+			}
+		}
+	}
+	if format == FormatOpenMetrics {
+		if _, err := writer.WriteString("# EOF\n"); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// GetMetricsExpositionHandler exposes all metrics in Prometheus text or OpenMetrics format
+func (s *MetricServer) GetMetricsExpositionHandler(rw http.ResponseWriter, r *http.Request) {
+	metrics, err := s.Storage.GetAllMetrics()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		loggers.ErrorLogger.Println("error while getting all metrics:", err)
+		return
+	}
+	format := NegotiateExpositionFormat(r.Header.Get("Accept"))
+	if format == FormatOpenMetrics {
+		rw.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		rw.Header().Set("Content-Type", contentTypePrometheus)
+	}
+	rw.WriteHeader(http.StatusOK)
+	if err = WriteExposition(rw, metrics, format); err != nil {
+		loggers.ErrorLogger.Println("error while writing metrics exposition:", err)
+	}
+}
@@ -0,0 +1,137 @@
+package httpserver
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestWriteExposition tests rendering of metrics in exposition formats
+func TestWriteExposition(t *testing.T) {
+	var (
+		delta int64 = 5
+		alloc       = 200.1
+		nan         = math.NaN()
+		inf         = math.Inf(1)
+	)
+	metrics := []types.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: &alloc},
+		{ID: "1cpu.util-rate", MType: "gauge", Value: &nan},
+		{ID: "1cpu_util_rate", MType: "gauge", Value: &alloc},
+		{ID: "Huge", MType: "gauge", Value: &inf},
+		{ID: "Alloc", MType: "gauge", Value: &alloc, Labels: map[string]string{"host": "a\"b", "data-center": "eu"}},
+		{ID: "GCPauseSeconds", MType: "histogram", Labels: map[string]string{"host": "a"}, Histogram: &types.Histogram{
+			Buckets: []types.Bucket{{UpperBound: 0.001, Count: 2}, {UpperBound: 0.01, Count: 1}},
+			Count:   4,
+			Sum:     0.5,
+		}},
+		{ID: "GCPauseQuantiles", MType: "summary", Summary: &types.Summary{
+			Quantiles: []types.Quantile{{Quantile: 0.5, Value: 0.002}, {Quantile: 1, Value: 0.3}},
+			Count:     4,
+			Sum:       0.5,
+		}},
+	}
+	distributions := "# TYPE GCPauseQuantiles summary\n" +
+		"GCPauseQuantiles{quantile=\"0.5\"} 0.002\nGCPauseQuantiles{quantile=\"1\"} 0.3\n" +
+		"GCPauseQuantiles_sum 0.5\nGCPauseQuantiles_count 4\n" +
+		"# TYPE GCPauseSeconds histogram\n" +
+		"GCPauseSeconds_bucket{host=\"a\",le=\"0.001\"} 2\nGCPauseSeconds_bucket{host=\"a\",le=\"0.01\"} 3\n" +
+		"GCPauseSeconds_bucket{host=\"a\",le=\"+Inf\"} 4\n" +
+		"GCPauseSeconds_sum{host=\"a\"} 0.5\nGCPauseSeconds_count{host=\"a\"} 4\n"
+	tests := []struct {
+		name   string
+		format ExpositionFormat
+		want   string
+	}{
+		{
+			name:   "Prometheus text format",
+			format: FormatPrometheus,
+			want: "# TYPE Alloc gauge\nAlloc 200.1\nAlloc{data_center=\"eu\",host=\"a\\\"b\"} 200.1\n" +
+				distributions +
+				"# TYPE Huge gauge\nHuge +Inf\n" +
+				"# TYPE PollCount counter\nPollCount 5\n" +
+				"# TYPE _1cpu_util_rate gauge\n_1cpu_util_rate NaN\n",
+		},
+		{
+			name:   "OpenMetrics format",
+			format: FormatOpenMetrics,
+			want: "# TYPE Alloc gauge\nAlloc 200.1\nAlloc{data_center=\"eu\",host=\"a\\\"b\"} 200.1\n" +
+				distributions +
+				"# TYPE Huge gauge\nHuge +Inf\n" +
+				"# TYPE PollCount counter\nPollCount_total 5\n" +
+				"# TYPE _1cpu_util_rate gauge\n_1cpu_util_rate NaN\n" +
+				"# EOF\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			require.NoError(t, WriteExposition(&b, metrics, tt.format))
+			assert.Equal(t, tt.want, b.String())
+		})
+	}
+}
+
+// TestMetricsExpositionHandler tests content negotiation of /metrics endpoint
+func TestMetricsExpositionHandler(t *testing.T) {
+	cfg := config.Config{
+		StoreFile:     "/tmp/metrics-example.json",
+		StoreInterval: 5 * time.Second,
+		Restore:       false,
+		Address:       "locashost:8080",
+	}
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
+	server := httptest.NewServer(s.Router())
+	defer server.Close()
+	resp, _ := RunRequest(t, server, http.MethodPost, "/update/counter/PollCount/5", "", "text/plain")
+	resp.Body.Close()
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "Prometheus text format by default",
+			contentType: contentTypePrometheus,
+			body:        "# TYPE PollCount counter\nPollCount 5\n",
+		},
+		{
+			name:        "OpenMetrics format when accepted",
+			accept:      "application/openmetrics-text;version=1.0.0,text/plain;q=0.5",
+			contentType: contentTypeOpenMetrics,
+			body:        "# TYPE PollCount counter\nPollCount_total 5\n# EOF\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", tt.accept)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			var b strings.Builder
+			_, err = io.Copy(&b, resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, tt.body, b.String())
+		})
+	}
+}
@@ -1,82 +1,101 @@
 package httpserver
 
 import (
-	"bytes"
 	"compress/gzip"
-	"crypto/rand"
+	"context"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
 	"strconv"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
 	_ "github.com/jackc/pgx/v5/stdlib"
 
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/clientip"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
-	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/database"
-	filestorage "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/fileStorage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/influx"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/otlp"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
 )
 
 const contentTypeJSON = "application/json"
 
 // MetricServer has HTTP server info
 type MetricServer struct {
-	Addr          string
-	Debug         bool
-	Key           string
-	Storage       storage.Storage
-	StorageType   types.StorageType
-	CryptoKey     *rsa.PrivateKey
-	TrustedSubnet string
-}
+	Addr        string
+	Debug       bool
+	Key         string
+	Storage     storage.Storage
+	StorageType types.StorageType
+	CryptoKey   *rsa.PrivateKey
+	// TrustedSubnet is a list of networks clients are allowed to update metrics from, clients from anywhere are allowed if it is empty
+	TrustedSubnet clientip.Nets
+	// TrustedProxies are networks of proxies whose headers with client IP are honored
+	TrustedProxies clientip.Nets
+	// RequireEncryption makes server reject updates which are not encrypted
+	RequireEncryption bool
+	// RequireSignature makes server reject metrics without hash
+	RequireSignature bool
+	// RequireRequestSignature makes server reject updates without signature of whole request
+	RequireRequestSignature bool
+	// Verifier verifies request signatures, it is nil if hash key is not set
+	Verifier *signature.Verifier
+	// Authenticator authenticates tokens of agents, it is nil if authentication is disabled
+	Authenticator auth.Authenticator
+	// MaxBodySize is a maximum size of request body in bytes, 0 means no limit
+	MaxBodySize int64
+	// MaxBatchSize is a maximum number of metrics in one batch update, 0 means no limit
+	MaxBatchSize int
+	// Limiter limits rate of updates of every client, it is nil if rate limiting is disabled
+	Limiter *ratelimit.Limiter
+	// OTLP saves metrics exported with OpenTelemetry protocol
+	OTLP *otlp.Writer
+	// InfluxCounters are patterns of names of InfluxDB integer fields which are cumulative counters
+	InfluxCounters []string
 
-// NewServer creates new MetricServer
-func NewMetricServer(cfg config.Config) *MetricServer {
-	var (
-		storage     storage.Storage
-		storageType types.StorageType
-	)
+	// streams is done when streams of subscribers must end
+	streams      context.Context
+	closeStreams context.CancelFunc
+	// influxCounters turns cumulative InfluxDB fields into counter changes
+	influxCounters *influx.Cumulative
+}
 
+// NewServer creates new MetricServer working with storage
+func NewMetricServer(cfg config.Config, storage storage.Storage, storageType types.StorageType) (*MetricServer, error) {
 	var cryptoKey *rsa.PrivateKey
 	if cfg.CryptoKeyFile != "" {
-		file, err := os.OpenFile(cfg.CryptoKeyFile, os.O_RDONLY, 0777)
-		if err != nil {
-			loggers.ErrorLogger.Println("error while opening crypto key file:", err)
-			cryptoKey = nil
-		} else {
-			cryptoKeyByte, err := io.ReadAll(file)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while reading crypto key file:", err)
-				cryptoKey = nil
-			}
-			cryptoKey, err = x509.ParsePKCS1PrivateKey(cryptoKeyByte)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while parsing crypto key:", err)
-				cryptoKey = nil
-			}
+		var err error
+		if cryptoKey, err = encryption.ReadPrivateKey(cfg.CryptoKeyFile); err != nil {
+			return nil, fmt.Errorf("error while loading crypto key: %w", err)
 		}
 	}
-	if cfg.Database == nil {
-		fs := filestorage.NewFileStorage(cfg)
-		fs.SetFileStorage()
-		storage = fs
-		storageType = types.StorageTypeFile
-	} else {
-		storage = database.NewDatabase(cfg.Database)
-		storageType = types.StorageTypeDB
+	subnet, err := clientip.ParseNets(cfg.TrustedSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing trusted subnet: %w", err)
+	}
+	proxies, err := clientip.ParseNets(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing trusted proxies: %w", err)
 	}
+	var verifier *signature.Verifier
+	if cfg.HashKey != "" {
+		verifier = signature.NewVerifier(cfg.HashKey, cfg.SignatureSkew)
+	}
+	streams, closeStreams := context.WithCancel(context.Background())
 	return &MetricServer{
 		Addr:          cfg.Address,
 		Debug:         cfg.Debug,
@@ -84,40 +103,31 @@ func NewMetricServer(cfg config.Config) *MetricServer {
 		Storage:       storage,
 		StorageType:   storageType,
 		CryptoKey:     cryptoKey,
-		TrustedSubnet: cfg.TrustedSubnet,
-	}
-}
+		TrustedSubnet: subnet,
 
-func (s *MetricServer) CheckRequestSubnetMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		if s.TrustedSubnet == "" {
-			next.ServeHTTP(rw, r)
-			return
-		} else {
-			_, IPNet, err := net.ParseCIDR(s.TrustedSubnet)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while parsing trusted subnet CIDR:", err)
-				next.ServeHTTP(rw, r)
-				return
-			}
-			ClientIP, err := resolveIP(r)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while getting client's IP:", err)
-				next.ServeHTTP(rw, r)
-			}
-			if !IPNet.Contains(ClientIP) {
-				http.Error(rw, "client IP is not in trusted subnet", http.StatusForbidden)
-				return
-			}
-			next.ServeHTTP(rw, r)
-		}
-	})
+		TrustedProxies:    proxies,
+		RequireEncryption: cfg.RequireEncryption,
+		RequireSignature:  cfg.RequireSignature,
+
+		RequireRequestSignature: cfg.RequireRequestSignature,
+		Verifier:                verifier,
+		Authenticator:           cfg.Authenticator,
+		MaxBodySize:             cfg.MaxBodySize,
+		MaxBatchSize:            cfg.MaxBatchSize,
+		Limiter:                 cfg.Limiter,
+		OTLP:                    otlp.NewWriter(storage),
+		InfluxCounters:          cfg.InfluxCounters,
+		influxCounters:          influx.NewCumulative(influx.SeriesTTL),
+		streams:                 streams,
+		closeStreams:            closeStreams,
+	}, nil
 }
 
-// CompressHandler is a middleware that compresses data to gzip if gzip encoding is accepted
+// CompressHandler is a middleware that compresses data to gzip if gzip encoding is accepted,
+// WebSocket connections are not compressed since they are hijacked
 func CompressHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || websocket.IsWebSocketUpgrade(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -133,24 +143,6 @@ func CompressHandler(next http.Handler) http.Handler {
 	})
 }
 
-func (s *MetricServer) DecodeHandler(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			loggers.ErrorLogger.Println("DecodeHandler: error while reading request body:", err)
-		} else {
-			decodedBody, err := rsa.DecryptPKCS1v15(rand.Reader, s.CryptoKey, body)
-			if err != nil {
-				loggers.ErrorLogger.Println("DecodeHandler: error while reading request body:", err)
-			} else {
-				newReqBody := bytes.NewReader(decodedBody)
-				r.Body = io.NopCloser(newReqBody)
-			}
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
 // DecompressHandler is a middleware that decompresses data from gzip
 func DecompressHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
@@ -183,6 +175,17 @@ func GetGaugeStatusOK(rw http.ResponseWriter, metricVal float64) {
 	}
 }
 
+// GetDistributionStatusOK describes response in case of successful getting of histogram or summary metric from storage
+func GetDistributionStatusOK(rw http.ResponseWriter, metricVal fmt.Stringer) {
+	rw.Header().Add("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	_, err := rw.Write([]byte(metricVal.String()))
+	if err != nil {
+		loggers.ErrorLogger.Println("response writer error:", err)
+		return
+	}
+}
+
 // GetCounterStatusOK describes response in case of successful getting of counter metric value from storage
 func GetCounterStatusOK(rw http.ResponseWriter, metricVal int64) {
 	rw.WriteHeader(http.StatusOK)
@@ -198,24 +201,53 @@ func GetCounterStatusOK(rw http.ResponseWriter, metricVal int64) {
 // GetAllMetricsHandler prints info about all metrics in storage
 func (s *MetricServer) GetAllMetricsHandler(rw http.ResponseWriter, r *http.Request) {
 	loggers.InfoLogger.Println("Get all request")
-	rw.Header().Set("Content-Type", "text/html")
 	metrics, err := s.Storage.GetAllMetrics()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		loggers.ErrorLogger.Println("error while getting all metrics:", err)
 		return
 	}
+	// dashboard asks for metrics as JSON, others get lines of text
+	if strings.Contains(r.Header.Get("Accept"), contentTypeJSON) {
+		if metrics == nil {
+			metrics = []types.Metrics{}
+		}
+		byteResponse, err := json.Marshal(metrics)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("error while marshaling metrics: %v", err), http.StatusInternalServerError)
+			loggers.ErrorLogger.Println("error while marshaling all metrics:", err)
+			return
+		}
+		rw.Header().Set("Content-Type", contentTypeJSON)
+		rw.Write(byteResponse)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html")
 	for _, m := range metrics {
 		switch m.MType {
 		case "counter":
-			_, err := fmt.Fprintf(rw, "%s: %d", m.ID, *m.Delta)
+			_, err := fmt.Fprintf(rw, "%s%s: %d", m.ID, labels.String(m.Labels), *m.Delta)
 			if err != nil {
 				http.Error(rw, fmt.Sprintf("error while writing response body: %v", err), http.StatusInternalServerError)
 				loggers.ErrorLogger.Println("error while writing response body:", err)
 				return
 			}
 		case "gauge":
-			_, err := fmt.Fprintf(rw, "%s: %f", m.ID, *m.Value)
+			_, err := fmt.Fprintf(rw, "%s%s: %f", m.ID, labels.String(m.Labels), *m.Value)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("error while writing response body: %v", err), http.StatusInternalServerError)
+				loggers.ErrorLogger.Println("error while writing response body:", err)
+				return
+			}
+		case "histogram":
+			_, err := fmt.Fprintf(rw, "%s%s: histogram %s", m.ID, labels.String(m.Labels), m.Histogram)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("error while writing response body: %v", err), http.StatusInternalServerError)
+				loggers.ErrorLogger.Println("error while writing response body:", err)
+				return
+			}
+		case "summary":
+			_, err := fmt.Fprintf(rw, "%s%s: summary %s", m.ID, labels.String(m.Labels), m.Summary)
 			if err != nil {
 				http.Error(rw, fmt.Sprintf("error while writing response body: %v", err), http.StatusInternalServerError)
 				loggers.ErrorLogger.Println("error while writing response body:", err)
@@ -243,6 +275,10 @@ func (s *MetricServer) PostUpdateManyMetricsHandler(rw http.ResponseWriter, r *h
 	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
 		loggers.ErrorLogger.Println("update many decode error:", err)
 	}
+	if s.MaxBatchSize > 0 && len(metrics) > s.MaxBatchSize {
+		http.Error(rw, fmt.Sprintf("batch has %d metrics, at most %d are allowed", len(metrics), s.MaxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if s.Debug {
 		loggers.DebugLogger.Println("POST many metrics request")
 	}
@@ -257,6 +293,7 @@ func (s *MetricServer) PostUpdateManyMetricsHandler(rw http.ResponseWriter, r *h
 		loggers.ErrorLogger.Println("store many metrics error:", err)
 		return
 	}
+	auth.LogUpdate(r.Context(), s.Debug, "updated %d metrics", len(metrics))
 	byteResponse, err := json.Marshal(metrics)
 	if err != nil {
 		loggers.ErrorLogger.Println("error while marshaling many metrics update response:", err)
@@ -271,6 +308,7 @@ func (s *MetricServer) PostMetricHandler(rw http.ResponseWriter, r *http.Request
 	metricType, metricName, metricValue := chi.URLParam(r, "type"), chi.URLParam(r, "name"), chi.URLParam(r, "value")
 	m.ID = metricName
 	m.MType = metricType
+	m.Labels = labelsFromQuery(r)
 	if m.MType == "counter" {
 		delta, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
@@ -294,6 +332,8 @@ func (s *MetricServer) PostMetricHandler(rw http.ResponseWriter, r *http.Request
 	}
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	} else {
+		auth.LogUpdate(r.Context(), s.Debug, "updated metric %s", m.ID)
 	}
 	rw.Header().Add("Content-Type", "text/plain")
 	rw.WriteHeader(http.StatusOK)
@@ -302,17 +342,15 @@ func (s *MetricServer) PostMetricHandler(rw http.ResponseWriter, r *http.Request
 // GetMetricHandler prints value of requested metric
 func (s *MetricServer) GetMetricHandler(rw http.ResponseWriter, r *http.Request) {
 	var m = types.Metrics{
-		ID:    chi.URLParam(r, "name"),
-		MType: chi.URLParam(r, "type"),
+		ID:     chi.URLParam(r, "name"),
+		MType:  chi.URLParam(r, "type"),
+		Labels: labelsFromQuery(r),
 	}
 	var err error
 	if s.Debug {
 		loggers.DebugLogger.Printf("GET %s %s", m.MType, m.ID)
 	}
 	if m, err = s.Storage.GetMetric(m, s.Key); err == nil {
-		if s.Debug {
-			loggers.DebugLogger.Println(m.ID, *m.Delta)
-		}
 		switch m.MType {
 		case "counter":
 			if s.Debug {
@@ -321,6 +359,10 @@ func (s *MetricServer) GetMetricHandler(rw http.ResponseWriter, r *http.Request)
 			GetCounterStatusOK(rw, *m.Delta)
 		case "gauge":
 			GetGaugeStatusOK(rw, *m.Value)
+		case "histogram":
+			GetDistributionStatusOK(rw, m.Histogram)
+		case "summary":
+			GetDistributionStatusOK(rw, m.Summary)
 		}
 	} else {
 		if s.Debug {
@@ -376,6 +418,7 @@ func (s *MetricServer) PostMetricJSONHandler(rw http.ResponseWriter, r *http.Req
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auth.LogUpdate(r.Context(), s.Debug, "updated metric %s", m.ID)
 	jsonMetric, err := json.Marshal(m)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -463,11 +506,15 @@ func (s *MetricServer) GetPingDBHandler(rw http.ResponseWriter, r *http.Request)
 	rw.WriteHeader(http.StatusOK)
 }
 
-func resolveIP(r *http.Request) (net.IP, error) {
-	ipStr := r.Header.Get("X-Real-IP")
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return nil, fmt.Errorf("failed parse ip from http header")
+// labelsFromQuery gets metric labels from URL query parameters of plain text requests
+func labelsFromQuery(r *http.Request) map[string]string {
+	query := r.URL.Query()
+	if len(query) == 0 {
+		return nil
+	}
+	l := make(map[string]string, len(query))
+	for name := range query {
+		l[name] = query.Get(name)
 	}
-	return ip, nil
+	return l
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
 )
 
 func Example() {
@@ -23,7 +24,16 @@ func Example() {
 		Restore:       false,
 		Address:       "locashost:8080",
 	}
-	s := NewMetricServer(cfg)
+	st, storageType, err := storage.NewStorage(cfg)
+	if err != nil {
+		fmt.Println("error while setting storage:", err)
+		return
+	}
+	s, err := NewMetricServer(cfg, st, storageType)
+	if err != nil {
+		fmt.Println("error while creating server:", err)
+		return
+	}
 	handler := DecompressHandler(s.Router())
 	handler = CompressHandler(handler)
 	server := httptest.NewServer(handler)
@@ -149,7 +159,10 @@ func BenchmarkTextPlainMetricHandler(b *testing.B) {
 		Restore:       false,
 		Address:       "locashost:8080",
 	}
-	s := NewMetricServer(cfg)
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(b, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(b, err)
 	handler := DecompressHandler(s.Router())
 	handler = CompressHandler(handler)
 	server := httptest.NewServer(handler)
@@ -204,7 +217,10 @@ func BenchmarkJSONMetricHandler(b *testing.B) {
 		Restore:       false,
 		Address:       "locashost:8080",
 	}
-	s := NewMetricServer(cfg)
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(b, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(b, err)
 	handler := DecompressHandler(s.Router())
 	handler = CompressHandler(handler)
 	server := httptest.NewServer(handler)
@@ -344,7 +360,10 @@ func TestPlainTextHandler(t *testing.T) {
 		Restore:       false,
 		Address:       "locashost:8080",
 	}
-	s := NewMetricServer(cfg)
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
 	handler := DecompressHandler(s.Router())
 	handler = CompressHandler(handler)
 	server := httptest.NewServer(handler)
@@ -467,6 +486,95 @@ func TestJSONHandlers(t *testing.T) {
 			body:   `{"id":"asdasda","type":"counter"}`,
 			want:   want{code: 404},
 		},
+		{
+			name:   "200 Success JSON update gauge with labels",
+			URL:    "/update/",
+			method: http.MethodPost,
+			body:   `{"id":"Alloc","type":"gauge","value":300,"labels":{"host":"web-1"}}`,
+			want: want{code: 200,
+				body: []string{`{"id":"Alloc","type":"gauge","value":300,"labels":{"host":"web-1"}}`}},
+		},
+		{
+			name:   "200 Success JSON get gauge with labels",
+			URL:    "/value/",
+			method: http.MethodPost,
+			body:   `{"id":"Alloc","type":"gauge","labels":{"host":"web-1"}}`,
+			want: want{
+				code: 200,
+				body: []string{`{"id":"Alloc","type":"gauge","value":300,"labels":{"host":"web-1"}}`},
+			},
+		},
+		{
+			name:   "200 Success JSON get gauge without labels is another metric",
+			URL:    "/value/",
+			method: http.MethodPost,
+			body:   `{"id":"Alloc","type":"gauge"}`,
+			want: want{
+				code: 200,
+				body: []string{`{"id":"Alloc","type":"gauge","value":200}`},
+			},
+		},
+		{
+			name:   "404 JSON get gauge with other labels",
+			URL:    "/value/",
+			method: http.MethodPost,
+			body:   `{"id":"Alloc","type":"gauge","labels":{"host":"web-2"}}`,
+			want:   want{code: 404},
+		},
+		{
+			name:   "200 Success JSON update histogram",
+			URL:    "/update/",
+			method: http.MethodPost,
+			body:   `{"id":"Latency","type":"histogram","histogram":{"buckets":[{"le":0.1,"count":1},{"le":1,"count":2}],"count":4,"sum":5.5}}`,
+			want: want{code: 200,
+				body: []string{`{"id":"Latency","type":"histogram","histogram":{"buckets":[{"le":0.1,"count":1},{"le":1,"count":2}],"count":4,"sum":5.5}}`}},
+		},
+		{
+			name:   "400 JSON update histogram with other buckets",
+			URL:    "/update/",
+			method: http.MethodPost,
+			body:   `{"id":"Latency","type":"histogram","histogram":{"buckets":[{"le":0.5,"count":1},{"le":1,"count":1}],"count":2,"sum":1}}`,
+			want:   want{code: 400},
+		},
+		{
+			name:   "200 Success JSON get histogram not changed by other buckets",
+			URL:    "/value/",
+			method: http.MethodPost,
+			body:   `{"id":"Latency","type":"histogram"}`,
+			want: want{code: 200,
+				body: []string{`{"id":"Latency","type":"histogram","histogram":{"buckets":[{"le":0.1,"count":1},{"le":1,"count":2}],"count":4,"sum":5.5}}`}},
+		},
+		{
+			name:   "400 JSON update histogram with unsorted buckets",
+			URL:    "/update/",
+			method: http.MethodPost,
+			body:   `{"id":"Latency","type":"histogram","histogram":{"buckets":[{"le":1,"count":1},{"le":0.1,"count":1}],"count":2,"sum":1}}`,
+			want:   want{code: 400},
+		},
+		{
+			name:   "200 Success JSON update summary",
+			URL:    "/update/",
+			method: http.MethodPost,
+			body:   `{"id":"GCPause","type":"summary","summary":{"quantiles":[{"quantile":0.5,"value":0.1}],"count":3,"sum":0.4}}`,
+			want: want{code: 200,
+				body: []string{`{"id":"GCPause","type":"summary","summary":{"quantiles":[{"quantile":0.5,"value":0.1}],"count":3,"sum":0.4}}`}},
+		},
+		{
+			name:   "200 Success JSON summary is replaced",
+			URL:    "/update/",
+			method: http.MethodPost,
+			body:   `{"id":"GCPause","type":"summary","summary":{"quantiles":[{"quantile":0.5,"value":0.2}],"count":5,"sum":0.9}}`,
+			want: want{code: 200,
+				body: []string{`{"id":"GCPause","type":"summary","summary":{"quantiles":[{"quantile":0.5,"value":0.2}],"count":5,"sum":0.9}}`}},
+		},
+		{
+			name:   "200 Success JSON get summary",
+			URL:    "/value/",
+			method: http.MethodPost,
+			body:   `{"id":"GCPause","type":"summary"}`,
+			want: want{code: 200,
+				body: []string{`{"id":"GCPause","type":"summary","summary":{"quantiles":[{"quantile":0.5,"value":0.2}],"count":5,"sum":0.9}}`}},
+		},
 	}
 	cfg := config.Config{
 		StoreFile:     "/tmp/metrics-example.json",
@@ -474,7 +582,10 @@ func TestJSONHandlers(t *testing.T) {
 		Restore:       false,
 		Address:       "locashost:8080",
 	}
-	s := NewMetricServer(cfg)
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
 	handler := DecompressHandler(s.Router())
 	handler = CompressHandler(handler)
 	server := httptest.NewServer(handler)
@@ -507,3 +618,66 @@ func RunRequest(t *testing.T, ts *httptest.Server, method string, query string,
 	require.NoError(t, err)
 	return resp, string(RespBody)
 }
+
+// TestDashboard tests that dashboard is served at /ui and gets metrics as JSON
+func TestDashboard(t *testing.T) {
+	cfg := config.Config{}
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
+	server := httptest.NewServer(CompressHandler(DecompressHandler(s.Router())))
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.Get(server.URL + "/ui")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "/ui/", resp.Header.Get("Location"))
+
+	resp, err = client.Get(server.URL + "/ui/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	assert.Contains(t, string(body), `<script src="app.js">`)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, contentTypeJSON, resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `[]`, string(body))
+
+	resp, _ = RunRequest(t, server, http.MethodPost, "/update/", `{"id":"Alloc","type":"gauge","value":1.5,"labels":{"host":"a"}}`, "application/json")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"id":"Alloc","type":"gauge","value":1.5,"labels":{"host":"a"}}]`, string(body))
+}
+
+// TestGetDistributionContentType tests that plain text value of histogram is sent with its content type
+func TestGetDistributionContentType(t *testing.T) {
+	s := newSecurityServer(t, config.Config{})
+	server := httptest.NewServer(s.Router())
+	defer server.Close()
+	resp, _ := RunRequest(t, server, http.MethodPost, "/update/", `{"id":"Latency","type":"histogram","histogram":{"buckets":[{"le":1,"count":1}],"count":1,"sum":0.5}}`, "application/json")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body := RunRequest(t, server, http.MethodGet, "/value/histogram/Latency", "", "text/plain")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "count=1 sum=0.500000 buckets=1=1", body)
+}
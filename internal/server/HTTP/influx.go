@@ -0,0 +1,112 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/influx"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// lineError is an error of one line of line protocol body, lines are numbered from 1
+type lineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// influxError is a JSON body of failed write response like InfluxDB returns
+type influxError struct {
+	Error       string      `json:"error"`
+	FailedLines []lineError `json:"failed_lines,omitempty"`
+}
+
+// writeInfluxError writes JSON error with status code
+func writeInfluxError(rw http.ResponseWriter, code int, body influxError) {
+	rw.Header().Set("Content-Type", contentTypeJSON)
+	rw.Header().Set("X-Influxdb-Error", body.Error)
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		loggers.ErrorLogger.Println("response writer error:", err)
+	}
+}
+
+// PostInfluxWriteHandler saves points written in InfluxDB line protocol.
+// Lines which can't be parsed are reported with their numbers, other lines are saved anyway
+func (s *MetricServer) PostInfluxWriteHandler(rw http.ResponseWriter, r *http.Request) {
+	precision := r.URL.Query().Get("precision")
+	if !influx.ValidPrecision(precision) {
+		writeInfluxError(rw, http.StatusBadRequest, influxError{Error: fmt.Sprintf("unknown precision %q", precision)})
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeInfluxError(rw, http.StatusBadRequest, influxError{Error: "error while reading request body"})
+		return
+	}
+	var (
+		metrics []types.Metrics
+		failed  []lineError
+		total   int
+	)
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		total++
+		p, err := influx.ParseLine(line, precision)
+		if err != nil {
+			failed = append(failed, lineError{Line: i + 1, Error: err.Error()})
+			continue
+		}
+		if p.Time.After(time.Now().Add(types.MaxClockSkew)) {
+			failed = append(failed, lineError{Line: i + 1, Error: "timestamp is in the future"})
+			continue
+		}
+		metrics = append(metrics, p.Metrics(s.InfluxCounters)...)
+	}
+	if s.MaxBatchSize > 0 && len(metrics) > s.MaxBatchSize {
+		writeInfluxError(rw, http.StatusRequestEntityTooLarge, influxError{
+			Error: fmt.Sprintf("body has %d fields, at most %d are allowed", len(metrics), s.MaxBatchSize),
+		})
+		return
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("influx write of %d lines, %d failed", total, len(failed))
+	}
+	if len(metrics) > 0 {
+		if err = s.saveInfluxMetrics(metrics); err != nil {
+			loggers.ErrorLogger.Println("store influx metrics error:", err)
+			code := http.StatusInternalServerError
+			if errors.Is(err, myerrors.ErrTypeBadRequest) || errors.Is(err, myerrors.ErrTypeNotImplemented) {
+				code = http.StatusBadRequest
+			}
+			writeInfluxError(rw, code, influxError{Error: err.Error(), FailedLines: failed})
+			return
+		}
+		auth.LogUpdate(r.Context(), s.Debug, "updated %d metrics", len(metrics))
+	}
+	if len(failed) > 0 {
+		writeInfluxError(rw, http.StatusBadRequest, influxError{
+			Error:       fmt.Sprintf("partial write: %d of %d lines failed", len(failed), total),
+			FailedLines: failed,
+		})
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// saveInfluxMetrics saves metrics of points, cumulative values of counters are turned into changes
+func (s *MetricServer) saveInfluxMetrics(metrics []types.Metrics) error {
+	return s.influxCounters.Save(metrics, func(metrics []types.Metrics) error {
+		return s.Storage.SaveManyMetrics(metrics, s.Key)
+	})
+}
@@ -0,0 +1,105 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// postInflux posts line protocol body to /write with query and returns response
+func postInflux(s *MetricServer, query string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/write"+query, bytes.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	DecompressHandler(s.Router()).ServeHTTP(rec, r)
+	return rec
+}
+
+// TestPostInfluxWriteHandler tests saving of points and reporting of failed lines
+func TestPostInfluxWriteHandler(t *testing.T) {
+	s := newSecurityServer(t, config.Config{HistoryRetention: time.Hour, InfluxCounters: []string{"net_bytes_*"}})
+	ts := time.Now().Add(-time.Minute).Truncate(time.Second)
+	rec := postInflux(s, "?db=telegraf&precision=s", []byte(fmt.Sprintf("# comment\n"+
+		"net,iface=eth0 bytes_recv=100i,drop_rate=0.5 %d\r\n"+
+		"net,iface=eth0 bytes_recv=150i %d\n"+
+		"processes running=3i %d\n"+
+		"\n", ts.Unix()-10, ts.Unix(), ts.Unix())), nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	iface := map[string]string{"iface": "eth0"}
+	counter, err := s.Storage.GetMetric(types.Metrics{ID: "net_bytes_recv", MType: "counter", Labels: iface}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), *counter.Delta, "the first point is a baseline")
+	gauge, err := s.Storage.GetMetric(types.Metrics{ID: "net_drop_rate", MType: "gauge", Labels: iface}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, *gauge.Value)
+	gauge, err = s.Storage.GetMetric(types.Metrics{ID: "processes_running", MType: "gauge"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *gauge.Value, "integer fields are gauges by default")
+	samples, err := s.Storage.GetMetricHistory(types.Metrics{ID: "processes_running", MType: "gauge"}, ts.Add(-time.Hour), time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+	assert.True(t, ts.Equal(samples[0].Timestamp), "timestamp of line is stored")
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, err = gz.Write([]byte(fmt.Sprintf("net,iface=eth0 bytes_recv=120i\nnet,iface=eth0 bytes_recv=\nmem free=5\ncpu\nmem used=1 %d",
+		time.Now().Add(time.Hour).Unix())))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	rec = postInflux(s, "?precision=s", b.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp influxError
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "partial write: 3 of 5 lines failed", resp.Error)
+	require.Len(t, resp.FailedLines, 3)
+	assert.Equal(t, 2, resp.FailedLines[0].Line)
+	assert.Equal(t, 4, resp.FailedLines[1].Line)
+	assert.Equal(t, lineError{Line: 5, Error: "timestamp is in the future"}, resp.FailedLines[2])
+
+	counter, err = s.Storage.GetMetric(types.Metrics{ID: "net_bytes_recv", MType: "counter", Labels: iface}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(170), *counter.Delta, "decreased value is a reset of source")
+	_, err = s.Storage.GetMetric(types.Metrics{ID: "mem_free", MType: "gauge"}, "")
+	assert.NoError(t, err)
+	_, err = s.Storage.GetMetric(types.Metrics{ID: "mem_used", MType: "gauge"}, "")
+	assert.Error(t, err)
+}
+
+// TestPostInfluxWriteHandlerErrors tests rejection of whole writes
+func TestPostInfluxWriteHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   config.Config
+		query string
+		body  string
+		code  int
+	}{
+		{name: "unknown precision", query: "?precision=d", body: "cpu value=1", code: http.StatusBadRequest},
+		{name: "too many fields", cfg: config.Config{MaxBatchSize: 2}, body: "cpu a=1,b=2,c=3", code: http.StatusRequestEntityTooLarge},
+		{name: "signatures are required", cfg: config.Config{RequireSignature: true, HashKey: "secret"}, body: "cpu value=1", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, tt.cfg)
+			rec := postInflux(s, tt.query, []byte(tt.body), nil)
+			assert.Equal(t, tt.code, rec.Code)
+			metrics, err := s.Storage.GetAllMetrics()
+			require.NoError(t, err)
+			assert.Empty(t, metrics)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/otlp"
+)
+
+// content types of OTLP/HTTP
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// writeOTLP writes message encoded like request was with status code
+func writeOTLP(rw http.ResponseWriter, contentType string, code int, msg proto.Message) {
+	var (
+		body []byte
+		err  error
+	)
+	if contentType == contentTypeJSON {
+		body, err = protojson.Marshal(msg)
+	} else {
+		body, err = proto.Marshal(msg)
+	}
+	if err != nil {
+		loggers.ErrorLogger.Println("error while marshalling OTLP response:", err)
+		http.Error(rw, "error while marshalling response", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.WriteHeader(code)
+	if _, err = rw.Write(body); err != nil {
+		loggers.ErrorLogger.Println("response writer error:", err)
+	}
+}
+
+// writeOTLPError writes google.rpc.Status with message as OTLP/HTTP requires
+func writeOTLPError(rw http.ResponseWriter, contentType string, code int, msg string) {
+	grpcCode := codes.InvalidArgument
+	switch code {
+	case http.StatusRequestEntityTooLarge:
+		grpcCode = codes.ResourceExhausted
+	case http.StatusInternalServerError:
+		grpcCode = codes.Internal
+	}
+	writeOTLP(rw, contentType, code, status.New(grpcCode, msg).Proto())
+}
+
+// PostOTLPMetricsHandler saves metrics exported with OTLP/HTTP in protobuf or JSON encoding.
+// Data points which can't be saved are reported in partial success of response
+func (s *MetricServer) PostOTLPMetricsHandler(rw http.ResponseWriter, r *http.Request) {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || contentType != contentTypeProtobuf && contentType != contentTypeJSON {
+		http.Error(rw, "content type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeOTLPError(rw, contentType, http.StatusBadRequest, "error while reading request body")
+		return
+	}
+	var req colmetricspb.ExportMetricsServiceRequest
+	if contentType == contentTypeJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, &req)
+	} else {
+		err = proto.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeOTLPError(rw, contentType, http.StatusBadRequest, "cannot decode request: "+err.Error())
+		return
+	}
+	points, rejected, errs := otlp.Convert(&req)
+	if s.MaxBatchSize > 0 && len(points) > s.MaxBatchSize {
+		writeOTLPError(rw, contentType, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request has %d data points, at most %d are allowed", len(points), s.MaxBatchSize))
+		return
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("OTLP export of %d data points, %d rejected", len(points), rejected)
+	}
+	if len(points) > 0 {
+		if err = s.OTLP.Write(points, s.Key); err != nil {
+			loggers.ErrorLogger.Println("store OTLP metrics error:", err)
+			if errors.Is(err, myerrors.ErrTypeBadRequest) || errors.Is(err, myerrors.ErrTypeNotImplemented) {
+				writeOTLPError(rw, contentType, http.StatusBadRequest, err.Error())
+			} else {
+				writeOTLPError(rw, contentType, http.StatusInternalServerError, "error while saving metrics")
+			}
+			return
+		}
+		auth.LogUpdate(r.Context(), s.Debug, "updated %d metrics", len(points))
+	}
+	var resp colmetricspb.ExportMetricsServiceResponse
+	if rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       strings.Join(errs, "; "),
+		}
+	}
+	writeOTLP(rw, contentType, http.StatusOK, &resp)
+}
@@ -0,0 +1,103 @@
+package httpserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// postOTLP posts body to /v1/metrics with content type and returns response
+func postOTLP(s *MetricServer, contentType string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, r)
+	return rec
+}
+
+// otlpRequest makes export request with cumulative counter requests and gauge without name
+func otlpRequest(requests float64) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+			{Name: "requests", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				IsMonotonic:            true,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints:             []*metricspb.NumberDataPoint{{StartTimeUnixNano: 1, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: requests}}},
+			}}},
+			{Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsInt{AsInt: 1}}},
+			}}},
+		}}},
+	}}}
+}
+
+// TestPostOTLPMetricsHandler tests export in protobuf and JSON encodings
+func TestPostOTLPMetricsHandler(t *testing.T) {
+	s := newSecurityServer(t, config.Config{})
+	body, err := proto.Marshal(otlpRequest(10))
+	require.NoError(t, err)
+	rec := postOTLP(s, "application/x-protobuf", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-protobuf", rec.Header().Get("Content-Type"))
+	var resp colmetricspb.ExportMetricsServiceResponse
+	require.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, int64(1), resp.GetPartialSuccess().GetRejectedDataPoints())
+	assert.NotEmpty(t, resp.GetPartialSuccess().GetErrorMessage())
+
+	body, err = protojson.Marshal(otlpRequest(25))
+	require.NoError(t, err)
+	rec = postOTLP(s, "application/json; charset=utf-8", body)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.NoError(t, protojson.Unmarshal(rec.Body.Bytes(), &resp))
+
+	counter, err := s.Storage.GetMetric(types.Metrics{ID: "requests", MType: "counter"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), *counter.Delta, "cumulative sum is saved as changes since the first point")
+}
+
+// TestPostOTLPMetricsHandlerErrors tests rejection of whole exports
+func TestPostOTLPMetricsHandlerErrors(t *testing.T) {
+	valid, err := proto.Marshal(otlpRequest(1))
+	require.NoError(t, err)
+	tests := []struct {
+		name        string
+		cfg         config.Config
+		contentType string
+		body        []byte
+		code        int
+	}{
+		{name: "unknown content type", contentType: "text/plain", body: valid, code: http.StatusUnsupportedMediaType},
+		{name: "broken protobuf", contentType: "application/x-protobuf", body: []byte{0xff}, code: http.StatusBadRequest},
+		{name: "broken JSON", contentType: "application/json", body: []byte("{"), code: http.StatusBadRequest},
+		{name: "too many data points", cfg: config.Config{MaxBatchSize: 1}, contentType: "application/x-protobuf", body: append(append([]byte(nil), valid...), valid...), code: http.StatusRequestEntityTooLarge},
+		{name: "signatures are required", cfg: config.Config{RequireSignature: true, HashKey: "secret"}, contentType: "application/x-protobuf", body: valid, code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, tt.cfg)
+			rec := postOTLP(s, tt.contentType, tt.body)
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.contentType == "application/x-protobuf" && tt.code == http.StatusRequestEntityTooLarge {
+				var st spb.Status
+				require.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &st))
+				assert.NotEmpty(t, st.GetMessage())
+			}
+			metrics, err := s.Storage.GetAllMetrics()
+			require.NoError(t, err)
+			assert.Empty(t, metrics)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/query"
+)
+
+// queryRequest is a JSON body of range query request
+type queryRequest struct {
+	ID       string            `json:"id"`
+	MType    string            `json:"type"`
+	Labels   map[string]string `json:"labels"`
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	Range    string            `json:"range"`
+	Step     string            `json:"step"`
+	Func     string            `json:"func"`
+	Quantile *float64          `json:"quantile"`
+}
+
+// toQuery converts request to query.Query
+func (req queryRequest) toQuery() (query.Query, error) {
+	q := query.Query{
+		ID:       req.ID,
+		MType:    req.MType,
+		Labels:   req.Labels,
+		From:     req.From,
+		To:       req.To,
+		Func:     req.Func,
+		Quantile: req.Quantile,
+	}
+	var err error
+	if req.Range != "" {
+		if q.Range, err = time.ParseDuration(req.Range); err != nil {
+			return q, err
+		}
+	}
+	if req.Step != "" {
+		if q.Step, err = time.ParseDuration(req.Step); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// PostQueryHandler runs range query with aggregation over history of a metric
+func (s *MetricServer) PostQueryHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != contentTypeJSON {
+		http.Error(rw, "wrong content type", http.StatusBadRequest)
+		loggers.ErrorLogger.Println("Wrong content type:", r.Header.Get("Content-Type"))
+		return
+	}
+	var req queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "could not decode query: "+err.Error(), http.StatusBadRequest)
+		loggers.ErrorLogger.Println("query decode error:", err)
+		return
+	}
+	q, err := req.toQuery()
+	if err != nil {
+		http.Error(rw, "could not parse duration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("query %s(%s %s) step %s", q.Func, q.MType, q.ID, q.Step)
+	}
+	result, err := query.Execute(s.Storage, q)
+	if err != nil {
+		if errors.Is(err, myerrors.ErrTypeBadRequest) {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, myerrors.ErrTypeNotFound) {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+		} else if errors.Is(err, myerrors.ErrTypeNotImplemented) {
+			http.Error(rw, err.Error(), http.StatusNotImplemented)
+		} else {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			loggers.ErrorLogger.Println("query error:", err)
+		}
+		return
+	}
+	byteResponse, err := json.Marshal(result)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		loggers.ErrorLogger.Println("error while marshaling query response:", err)
+		return
+	}
+	rw.Header().Set("Content-Type", contentTypeJSON)
+	rw.Write(byteResponse)
+}
@@ -0,0 +1,108 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/golang/snappy"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/remotewrite"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// seriesError is an error of one series of remote_write request
+type seriesError struct {
+	Series string `json:"series"`
+	Error  string `json:"error"`
+}
+
+// remoteWriteError is a JSON body of failed remote_write response
+type remoteWriteError struct {
+	Error        string        `json:"error"`
+	FailedSeries []seriesError `json:"failed_series,omitempty"`
+}
+
+// writeRemoteWriteError writes JSON error with status code
+func writeRemoteWriteError(rw http.ResponseWriter, code int, body remoteWriteError) {
+	rw.Header().Set("Content-Type", contentTypeJSON)
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		loggers.ErrorLogger.Println("response writer error:", err)
+	}
+}
+
+// PostRemoteWriteHandler saves series of snappy compressed Prometheus remote_write request as gauges.
+// Series which can't be mapped are reported, other series are saved anyway
+func (s *MetricServer) PostRemoteWriteHandler(rw http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeRemoteWriteError(rw, http.StatusBadRequest, remoteWriteError{Error: "error while reading request body"})
+		return
+	}
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		writeRemoteWriteError(rw, http.StatusBadRequest, remoteWriteError{Error: fmt.Sprintf("wrong snappy body: %v", err)})
+		return
+	}
+	if s.MaxBodySize > 0 && int64(size) > s.MaxBodySize {
+		writeRemoteWriteError(rw, http.StatusRequestEntityTooLarge, remoteWriteError{
+			Error: fmt.Sprintf("decoded body has %d bytes, at most %d are allowed", size, s.MaxBodySize),
+		})
+		return
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		writeRemoteWriteError(rw, http.StatusBadRequest, remoteWriteError{Error: fmt.Sprintf("wrong snappy body: %v", err)})
+		return
+	}
+	req, err := remotewrite.Unmarshal(data)
+	if err != nil {
+		writeRemoteWriteError(rw, http.StatusBadRequest, remoteWriteError{Error: err.Error()})
+		return
+	}
+	var (
+		series [][]types.Metrics
+		failed []seriesError
+		total  int
+	)
+	for _, ts := range req.Timeseries {
+		metrics, err := ts.Metrics()
+		if err != nil {
+			failed = append(failed, seriesError{Series: ts.String(), Error: err.Error()})
+			continue
+		}
+		series = append(series, metrics)
+		total += len(metrics)
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("remote write of %d series, %d failed", len(req.Timeseries), len(failed))
+	}
+	for _, batch := range remotewrite.Batches(series, s.MaxBatchSize) {
+		if err = s.Storage.SaveManyMetrics(batch, s.Key); err != nil {
+			loggers.ErrorLogger.Println("store remote write metrics error:", err)
+			code := http.StatusInternalServerError
+			if errors.Is(err, myerrors.ErrTypeBadRequest) || errors.Is(err, myerrors.ErrTypeNotImplemented) {
+				code = http.StatusBadRequest
+			}
+			writeRemoteWriteError(rw, code, remoteWriteError{Error: err.Error(), FailedSeries: failed})
+			return
+		}
+	}
+	if total > 0 {
+		auth.LogUpdate(r.Context(), s.Debug, "updated %d metrics", total)
+	}
+	if len(failed) > 0 {
+		writeRemoteWriteError(rw, http.StatusBadRequest, remoteWriteError{
+			Error:        fmt.Sprintf("partial write: %d of %d series failed", len(failed), len(req.Timeseries)),
+			FailedSeries: failed,
+		})
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
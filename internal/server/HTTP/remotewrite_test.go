@@ -0,0 +1,99 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/remotewrite"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// postRemoteWrite posts snappy compressed body to /api/v1/write and returns response
+func postRemoteWrite(s *MetricServer, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, body)))
+	r.Header.Set("Content-Encoding", "snappy")
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	rec := httptest.NewRecorder()
+	DecompressHandler(s.Router()).ServeHTTP(rec, r)
+	return rec
+}
+
+// TestPostRemoteWriteHandler tests saving of series with timestamps and reporting of failed series
+func TestPostRemoteWriteHandler(t *testing.T) {
+	s := newSecurityServer(t, config.Config{HistoryRetention: time.Hour, MaxBatchSize: 2})
+	now := time.Now().Truncate(time.Millisecond)
+	rec := postRemoteWrite(s, remotewrite.WriteRequest{Timeseries: []remotewrite.TimeSeries{
+		{
+			Labels: []remotewrite.Label{{Name: "__name__", Value: "node_load1"}, {Name: "instance", Value: "a"}},
+			Samples: []remotewrite.Sample{
+				{Value: 2, Timestamp: now.Add(-time.Minute).UnixMilli()},
+				{Value: 1, Timestamp: now.Add(-2 * time.Minute).UnixMilli()},
+				{Value: 3, Timestamp: now.UnixMilli()},
+			},
+		},
+		{
+			Labels:  []remotewrite.Label{{Name: "__name__", Value: "up"}},
+			Samples: []remotewrite.Sample{{Value: 1, Timestamp: now.UnixMilli()}},
+		},
+	}}.Marshal())
+	assert.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+
+	load := types.Metrics{ID: "node_load1", MType: "gauge", Labels: map[string]string{"instance": "a"}}
+	gauge, err := s.Storage.GetMetric(load, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *gauge.Value, "the latest sample wins")
+	history, err := s.Storage.GetMetricHistory(load, now.Add(-time.Hour), now.Add(time.Hour))
+	require.NoError(t, err)
+	var values []float64
+	for _, sample := range history {
+		values = append(values, sample.Value)
+	}
+	assert.Equal(t, []float64{1, 2, 3}, values, "every sample is kept in history")
+	if assert.Len(t, history, 3) {
+		assert.True(t, history[0].Timestamp.Equal(now.Add(-2*time.Minute)), "sample has its timestamp")
+	}
+	_, err = s.Storage.GetMetric(types.Metrics{ID: "up", MType: "gauge"}, "")
+	assert.NoError(t, err)
+
+	rec = postRemoteWrite(s, remotewrite.WriteRequest{Timeseries: []remotewrite.TimeSeries{
+		{Labels: []remotewrite.Label{{Name: "job", Value: "node"}}, Samples: []remotewrite.Sample{{Value: 1}}},
+		{Labels: []remotewrite.Label{{Name: "__name__", Value: "ok"}}, Samples: []remotewrite.Sample{{Value: 5, Timestamp: now.UnixMilli()}}},
+		{Labels: []remotewrite.Label{{Name: "__name__", Value: "native"}}, Histograms: 1},
+	}}.Marshal())
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp remoteWriteError
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "partial write: 2 of 3 series failed", resp.Error)
+	require.Len(t, resp.FailedSeries, 2)
+	assert.Equal(t, `{job="node"}`, resp.FailedSeries[0].Series)
+	assert.Equal(t, "native", resp.FailedSeries[1].Series)
+	gauge, err = s.Storage.GetMetric(types.Metrics{ID: "ok", MType: "gauge"}, "")
+	require.NoError(t, err, "valid series are saved anyway")
+	assert.Equal(t, 5.0, *gauge.Value)
+}
+
+// TestPostRemoteWriteHandlerErrors tests rejection of bodies which can't be decoded
+func TestPostRemoteWriteHandlerErrors(t *testing.T) {
+	s := newSecurityServer(t, config.Config{MaxBodySize: 1 << 10})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader([]byte("not snappy")))
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postRemoteWrite(s, []byte{0x0a, 0x05, 0x0a})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postRemoteWrite(s, bytes.Repeat([]byte{0}, 2<<10))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "decoded body is limited")
+}
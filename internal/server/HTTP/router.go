@@ -1,28 +1,53 @@
 package httpserver
 
 import (
+	"net/http"
 	"net/http/pprof"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ui"
 )
 
 // Router routes handlers to urls
 func (s *MetricServer) Router() chi.Router {
 	router := chi.NewRouter()
-	router.Get("/", s.GetAllMetricsHandler)
-	router.Get("/value/{type}/{name}", s.GetMetricHandler)
-	router.Post("/update/{type}/{name}/{value}", s.PostMetricHandler)
-	router.Post("/update/", s.PostMetricJSONHandler)
-	router.Post("/value/", s.GetMetricPostJSONHandler)
 	router.Get("/ping", s.GetPingDBHandler)
-	router.Post("/updates/", s.PostUpdateManyMetricsHandler)
-	router.Get("/debug/pprof/", pprof.Index)
-	router.Get("/debug/pprof/cmdline", pprof.Cmdline)
-	router.Get("/debug/pprof/profile", pprof.Profile)
-	router.Get("/debug/pprof/symbol", pprof.Symbol)
-	router.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	router.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	router.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
-	router.Handle("/debug/pprof/block", pprof.Handler("block"))
+	// dashboard files are public, metrics it shows are read from endpoints with read scope
+	router.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	router.Handle("/ui/*", http.StripPrefix("/ui", ui.Handler()))
+	router.Group(func(r chi.Router) {
+		r.Use(s.RequireScope(auth.ScopeRead))
+		r.Get("/", s.GetAllMetricsHandler)
+		r.Get("/value/{type}/{name}", s.GetMetricHandler)
+		r.Post("/value/", s.GetMetricPostJSONHandler)
+		r.Get("/metrics", s.GetMetricsExpositionHandler)
+		r.Post("/query/", s.PostQueryHandler)
+		r.Get("/watch", s.GetWatchHandler)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(s.SecurityMiddlewares()...)
+		r.Post("/update/{type}/{name}/{value}", s.PostMetricHandler)
+		r.Post("/update/", s.PostMetricJSONHandler)
+		r.Post("/updates/", s.PostUpdateManyMetricsHandler)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(s.UnsignedSecurityMiddlewares()...)
+		r.Post("/write", s.PostInfluxWriteHandler)
+		r.Post("/v1/metrics", s.PostOTLPMetricsHandler)
+		r.Post("/api/v1/write", s.PostRemoteWriteHandler)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(s.RequireScope(auth.ScopeAdmin))
+		r.Get("/debug/pprof/", pprof.Index)
+		r.Get("/debug/pprof/cmdline", pprof.Cmdline)
+		r.Get("/debug/pprof/profile", pprof.Profile)
+		r.Get("/debug/pprof/symbol", pprof.Symbol)
+		r.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
+		r.Handle("/debug/pprof/heap", pprof.Handler("heap"))
+		r.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+		r.Handle("/debug/pprof/block", pprof.Handler("block"))
+	})
 	return router
 }
@@ -0,0 +1,341 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/clientip"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
+)
+
+// SecurityMiddlewares returns middlewares applied to write endpoints in order:
+// token of agent is authenticated first, then client IP is checked, then rate and size of request are limited,
+// then signature of whole request is verified,
+// then body is decrypted and signatures of decrypted metrics are verified.
+// Every middleware rejects request it can't check instead of passing it on
+func (s *MetricServer) SecurityMiddlewares() []func(http.Handler) http.Handler {
+	return []func(http.Handler) http.Handler{
+		s.RequireScope(auth.ScopeWrite),
+		s.CheckRequestSubnetMiddleware,
+		s.LimitRateMiddleware,
+		s.LimitBodySizeMiddleware,
+		s.RequestSignatureMiddleware,
+		s.DecodeHandler,
+		s.VerifySignatureMiddleware,
+	}
+}
+
+// UnsignedSecurityMiddlewares returns middlewares applied to write endpoints of formats without hashes of metrics,
+// such as InfluxDB line protocol, OTLP and Prometheus remote write.
+// They are the same as SecurityMiddlewares, but requests are rejected if signatures of metrics are required
+func (s *MetricServer) UnsignedSecurityMiddlewares() []func(http.Handler) http.Handler {
+	return []func(http.Handler) http.Handler{
+		s.RequireScope(auth.ScopeWrite),
+		s.CheckRequestSubnetMiddleware,
+		s.LimitRateMiddleware,
+		s.LimitBodySizeMiddleware,
+		s.RequestSignatureMiddleware,
+		s.DecodeHandler,
+		s.RejectUnsignedMiddleware,
+	}
+}
+
+// RequireScope returns middleware that rejects requests without bearer token having scope.
+// Identity of token is put into request context
+func (s *MetricServer) RequireScope(scope auth.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if s.Authenticator == nil {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			id, err := auth.Check(r.Context(), s.Authenticator, auth.TokenFromHeader(r.Header.Get("Authorization")), scope)
+			switch {
+			case errors.Is(err, auth.ErrUnauthenticated):
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(rw, "token is missing or unknown", http.StatusUnauthorized)
+				return
+			case errors.Is(err, auth.ErrForbidden):
+				http.Error(rw, fmt.Sprintf("token of %s has no %s scope", id.Name, scope), http.StatusForbidden)
+				return
+			case err != nil:
+				loggers.ErrorLogger.Println("error while authenticating token:", err)
+				http.Error(rw, "error while authenticating token", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(rw, r.WithContext(auth.NewContext(r.Context(), id)))
+		})
+	}
+}
+
+// CheckRequestSubnetMiddleware is a middleware that rejects requests from clients out of trusted subnet.
+// Client IP is the peer address, headers with client IP are honored only if the peer is a trusted proxy
+func (s *MetricServer) CheckRequestSubnetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if len(s.TrustedSubnet) == 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		ip, err := clientip.Resolve(r.RemoteAddr, r.Header.Get, s.TrustedProxies)
+		if err != nil {
+			http.Error(rw, "client IP is unknown", http.StatusForbidden)
+			return
+		}
+		if !s.TrustedSubnet.Contains(ip) {
+			http.Error(rw, "client IP is not in trusted subnet", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// clientKey identifies client for rate limiting by identity of token or by IP
+func (s *MetricServer) clientKey(r *http.Request) string {
+	if id, ok := auth.FromContext(r.Context()); ok {
+		return "token:" + id.Name
+	}
+	if ip, err := clientip.Resolve(r.RemoteAddr, r.Header.Get, s.TrustedProxies); err == nil {
+		return "ip:" + ip.String()
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// LimitRateMiddleware is a middleware that rejects requests of clients exceeding rate limit.
+// Response tells client in Retry-After header when it can retry
+func (s *MetricServer) LimitRateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s.Limiter == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if ok, wait := s.Limiter.Allow(s.clientKey(r)); !ok {
+			rw.Header().Set("Retry-After", strconv.Itoa(ratelimit.RetryAfter(wait)))
+			http.Error(rw, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// LimitBodySizeMiddleware is a middleware that rejects requests with decompressed body larger than limit
+func (s *MetricServer) LimitBodySizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s.MaxBodySize <= 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if r.ContentLength > s.MaxBodySize {
+			http.Error(rw, "request body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, s.MaxBodySize+1))
+		if err != nil {
+			http.Error(rw, "error while reading request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > s.MaxBodySize {
+			http.Error(rw, "request body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// signedResponseWriter buffers response to sign it before it is written
+type signedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+// WriteHeader remembers status code of response
+func (w *signedResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// Write buffers body of response
+func (w *signedResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// RequestSignatureMiddleware is a middleware that verifies signature of raw request body and rejects replayed requests.
+// Responses to signed requests are signed with nonce of request, so agent can verify the server too
+func (s *MetricServer) RequestSignatureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s.Verifier == nil {
+			if s.RequireRequestSignature {
+				loggers.ErrorLogger.Println("request signatures are required, but hash key is not set")
+				http.Error(rw, "server can't verify signatures", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(rw, r)
+			return
+		}
+		sig, err := signature.Parse(r.Header.Get)
+		if errors.Is(err, signature.ErrMissing) && !s.RequireRequestSignature {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(rw, "error while reading request body", http.StatusBadRequest)
+			return
+		}
+		if err = s.Verifier.Verify(sig, r.Method, r.URL.RequestURI(), body); err != nil {
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		w := &signedResponseWriter{ResponseWriter: rw}
+		next.ServeHTTP(w, r)
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		respSig := signature.Signature{Timestamp: time.Now().Unix(), Nonce: sig.Nonce}
+		respSig.Sign(s.Key, strconv.Itoa(w.code), r.URL.RequestURI(), w.body.Bytes())
+		for name, value := range respSig.Fields() {
+			rw.Header().Set(name, value)
+		}
+		rw.WriteHeader(w.code)
+		if _, err = rw.Write(w.body.Bytes()); err != nil {
+			loggers.ErrorLogger.Println("error while writing response:", err)
+		}
+	})
+}
+
+// DecodeHandler is a middleware that decrypts body of requests sent as encryption envelope.
+// If encryption is required plaintext requests are rejected
+func (s *MetricServer) DecodeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := r.Header.Get(encryption.Header)
+		if scheme == "" {
+			if s.RequireEncryption {
+				http.Error(w, "request body must be encrypted", http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if scheme != encryption.Scheme {
+			http.Error(w, fmt.Sprintf("unknown encryption scheme %q", scheme), http.StatusBadRequest)
+			return
+		}
+		if s.CryptoKey == nil {
+			http.Error(w, "encrypted requests are not accepted", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			loggers.ErrorLogger.Println("DecodeHandler: error while reading request body:", err)
+			http.Error(w, "error while reading request body", http.StatusBadRequest)
+			return
+		}
+		decodedBody, err := encryption.Decrypt(s.CryptoKey, body)
+		if err != nil {
+			loggers.ErrorLogger.Println("DecodeHandler: error while decrypting request body:", err)
+			http.Error(w, "cannot decrypt request body", http.StatusBadRequest)
+			return
+		}
+		r.Header.Del(encryption.Header)
+		r.Body = io.NopCloser(bytes.NewReader(decodedBody))
+		r.ContentLength = int64(len(decodedBody))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// VerifySignatureMiddleware is a middleware that rejects metrics without valid hash if signatures are required.
+// Updates passed in URL can't be signed, so they are rejected too
+func (s *MetricServer) VerifySignatureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !s.RequireSignature {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if s.Key == "" {
+			loggers.ErrorLogger.Println("signatures are required, but hash key is not set")
+			http.Error(rw, "server can't verify signatures", http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(rw, "error while reading request body", http.StatusBadRequest)
+			return
+		}
+		metrics, err := parseMetrics(body)
+		if err != nil {
+			http.Error(rw, "cannot parse request body", http.StatusBadRequest)
+			return
+		}
+		if len(metrics) == 0 {
+			http.Error(rw, "request must contain signed metrics", http.StatusBadRequest)
+			return
+		}
+		for _, m := range metrics {
+			if m.Hash == "" {
+				http.Error(rw, fmt.Sprintf("metric %s is not signed", m.ID), http.StatusBadRequest)
+				return
+			}
+			if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(hash.WithLabels(m.HashSource(), m.Labels), s.Key))) {
+				http.Error(rw, fmt.Sprintf("wrong hash of metric %s", m.ID), http.StatusBadRequest)
+				return
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// RejectUnsignedMiddleware is a middleware that rejects requests of formats without hashes of metrics
+// if signatures are required, since their metrics can't be verified
+func (s *MetricServer) RejectUnsignedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s.RequireSignature {
+			http.Error(rw, "request must contain signed metrics", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// parseMetrics parses one metric or array of metrics from JSON body
+func parseMetrics(body []byte) ([]types.Metrics, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, nil
+	}
+	if body[0] == '[' {
+		var metrics []types.Metrics
+		if err := json.Unmarshal(body, &metrics); err != nil {
+			return nil, err
+		}
+		return metrics, nil
+	}
+	var m types.Metrics
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return []types.Metrics{m}, nil
+}
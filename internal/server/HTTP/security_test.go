@@ -0,0 +1,453 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
+)
+
+// securityRequest is a request to write endpoint in security tests
+type securityRequest struct {
+	url        string
+	body       []byte
+	headers    map[string]string
+	remoteAddr string
+}
+
+// serveSecurityRequest serves request by router of s and returns status code and number of stored metrics
+func serveSecurityRequest(t *testing.T, s *MetricServer, req securityRequest) (int, int) {
+	r := httptest.NewRequest(http.MethodPost, req.url, bytes.NewReader(req.body))
+	r.Header.Set("Content-Type", contentTypeJSON)
+	for name, value := range req.headers {
+		r.Header.Set(name, value)
+	}
+	if req.remoteAddr != "" {
+		r.RemoteAddr = req.remoteAddr
+	}
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, r)
+	metrics, err := s.Storage.GetAllMetrics()
+	require.NoError(t, err)
+	return rec.Code, len(metrics)
+}
+
+// newSecurityServer creates MetricServer with memory storage
+func newSecurityServer(t *testing.T, cfg config.Config) *MetricServer {
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
+	return s
+}
+
+// TestDecodeHandler tests decryption of requests sent as encryption envelope
+func TestDecodeHandler(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	var batch []string
+	for i := 0; i < 200; i++ {
+		batch = append(batch, fmt.Sprintf(`{"id":"Gauge%d","type":"gauge","value":%d}`, i, i))
+	}
+	body := []byte("[" + strings.Join(batch, ",") + "]")
+	envelope, err := encryption.Encrypt(&key.PublicKey, body)
+	require.NoError(t, err)
+	tampered := append([]byte(nil), envelope...)
+	tampered[len(tampered)-1] ^= 1
+	encrypted := map[string]string{encryption.Header: encryption.Scheme}
+	tests := []struct {
+		name      string
+		serverKey *rsa.PrivateKey
+		require   bool
+		req       securityRequest
+		code      int
+	}{
+		{name: "plaintext", serverKey: key, req: securityRequest{url: "/updates/", body: body}, code: http.StatusOK},
+		{name: "encrypted batch larger than key", serverKey: key, req: securityRequest{url: "/updates/", body: envelope, headers: encrypted}, code: http.StatusOK},
+		{name: "required encryption", serverKey: key, require: true, req: securityRequest{url: "/updates/", body: envelope, headers: encrypted}, code: http.StatusOK},
+		{name: "tampered envelope", serverKey: key, req: securityRequest{url: "/updates/", body: tampered, headers: encrypted}, code: http.StatusBadRequest},
+		{name: "unknown scheme", serverKey: key, req: securityRequest{url: "/updates/", body: envelope, headers: map[string]string{encryption.Header: "rsa-pkcs1"}}, code: http.StatusBadRequest},
+		{name: "server without key", req: securityRequest{url: "/updates/", body: envelope, headers: encrypted}, code: http.StatusBadRequest},
+		{name: "plaintext when encryption is required", serverKey: key, require: true, req: securityRequest{url: "/updates/", body: body}, code: http.StatusBadRequest},
+		{name: "URL update when encryption is required", serverKey: key, require: true, req: securityRequest{url: "/update/gauge/Alloc/1"}, code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, config.Config{RequireEncryption: tt.require})
+			s.CryptoKey = tt.serverKey
+			code, stored := serveSecurityRequest(t, s, tt.req)
+			assert.Equal(t, tt.code, code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, len(batch), stored)
+			} else {
+				assert.Zero(t, stored)
+			}
+		})
+	}
+}
+
+// TestVerifySignatureMiddleware tests rejection of unsigned metrics when signatures are required
+func TestVerifySignatureMiddleware(t *testing.T) {
+	const key = "secret"
+	signed := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":5,"hash":"%s"}`, hash.Hash("PollCount:counter:5", key))
+	wrong := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":6,"hash":"%s"}`, hash.Hash("PollCount:counter:5", key))
+	unsigned := `{"id":"Alloc","type":"gauge","value":1.5}`
+	tests := []struct {
+		name    string
+		require bool
+		key     string
+		req     securityRequest
+		code    int
+	}{
+		{name: "unsigned when not required", req: securityRequest{url: "/update/", body: []byte(unsigned)}, code: http.StatusOK},
+		{name: "signed metric", require: true, key: key, req: securityRequest{url: "/update/", body: []byte(signed)}, code: http.StatusOK},
+		{name: "signed batch", require: true, key: key, req: securityRequest{url: "/updates/", body: []byte("[" + signed + "]")}, code: http.StatusOK},
+		{name: "unsigned metric", require: true, key: key, req: securityRequest{url: "/update/", body: []byte(unsigned)}, code: http.StatusBadRequest},
+		{name: "batch with unsigned metric", require: true, key: key, req: securityRequest{url: "/updates/", body: []byte("[" + signed + "," + unsigned + "]")}, code: http.StatusBadRequest},
+		{name: "wrong hash", require: true, key: key, req: securityRequest{url: "/update/", body: []byte(wrong)}, code: http.StatusBadRequest},
+		{name: "empty batch", require: true, key: key, req: securityRequest{url: "/updates/", body: []byte("[]")}, code: http.StatusBadRequest},
+		{name: "URL update", require: true, key: key, req: securityRequest{url: "/update/counter/PollCount/5"}, code: http.StatusBadRequest},
+		{name: "server without key", require: true, req: securityRequest{url: "/update/", body: []byte(signed)}, code: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, config.Config{RequireSignature: tt.require, HashKey: tt.key})
+			code, stored := serveSecurityRequest(t, s, tt.req)
+			assert.Equal(t, tt.code, code)
+			if tt.code != http.StatusOK {
+				assert.Zero(t, stored)
+			}
+		})
+	}
+}
+
+// TestRejectUnsignedMiddleware tests that formats without hashes of metrics are rejected when signatures are required
+func TestRejectUnsignedMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+	}{
+		{name: "InfluxDB line protocol", url: "/write", contentType: "text/plain", body: "cpu usage=1.5"},
+		{name: "OTLP", url: "/v1/metrics", contentType: "application/x-protobuf"},
+		{name: "remote write", url: "/api/v1/write", contentType: "application/x-protobuf"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, config.Config{RequireSignature: true, HashKey: "secret"})
+			r := httptest.NewRequest(http.MethodPost, tt.url, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, r)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Equal(t, "request must contain signed metrics\n", rec.Body.String())
+		})
+	}
+}
+
+// TestCheckRequestSubnetMiddleware tests rejection of clients out of trusted subnet
+func TestCheckRequestSubnetMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		subnet     string
+		proxies    string
+		remoteAddr string
+		headers    map[string]string
+		code       int
+	}{
+		{name: "no trusted subnet", remoteAddr: "10.0.0.1:5000", code: http.StatusOK},
+		{name: "client in subnet", subnet: "192.168.1.0/24", remoteAddr: "192.168.1.7:5000", code: http.StatusOK},
+		{name: "client in one of subnets", subnet: "192.168.1.0/24,2001:db8::/32", remoteAddr: "[2001:db8::7]:5000", code: http.StatusOK},
+		{name: "client out of subnet", subnet: "192.168.1.0/24", remoteAddr: "10.0.0.1:5000", code: http.StatusForbidden},
+		{name: "client forging X-Real-IP", subnet: "192.168.1.0/24", remoteAddr: "10.0.0.1:5000",
+			headers: map[string]string{"X-Real-IP": "192.168.1.7"}, code: http.StatusForbidden},
+		{name: "client forging X-Forwarded-For", subnet: "192.168.1.0/24", remoteAddr: "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "192.168.1.7"}, code: http.StatusForbidden},
+		{name: "client behind trusted proxy", subnet: "192.168.1.0/24", proxies: "172.16.0.0/12", remoteAddr: "172.16.0.2:443",
+			headers: map[string]string{"X-Forwarded-For": "192.168.1.7"}, code: http.StatusOK},
+		{name: "client out of subnet behind trusted proxy", subnet: "192.168.1.0/24", proxies: "172.16.0.0/12", remoteAddr: "172.16.0.2:443",
+			headers: map[string]string{"X-Real-IP": "10.0.0.1"}, code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, config.Config{TrustedSubnet: tt.subnet, TrustedProxies: tt.proxies})
+			code, stored := serveSecurityRequest(t, s, securityRequest{
+				url:        "/update/counter/PollCount/5",
+				headers:    tt.headers,
+				remoteAddr: tt.remoteAddr,
+			})
+			assert.Equal(t, tt.code, code)
+			if tt.code != http.StatusOK {
+				assert.Zero(t, stored)
+			}
+		})
+	}
+}
+
+// TestNewMetricServerTrustedNetworks tests that server isn't created with invalid trusted networks
+func TestNewMetricServerTrustedNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{name: "valid networks", cfg: config.Config{TrustedSubnet: "192.168.1.0/24", TrustedProxies: "172.16.0.0/12"}},
+		{name: "invalid subnet", cfg: config.Config{TrustedSubnet: "192.168.1.0/33"}, wantErr: true},
+		{name: "invalid proxies", cfg: config.Config{TrustedSubnet: "192.168.1.0/24", TrustedProxies: "proxy"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			st, storageType, err := storage.NewStorage(tt.cfg)
+			require.NoError(t, err)
+			_, err = NewMetricServer(tt.cfg, st, storageType)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestSecurityMiddlewaresOrder tests that signatures are verified after body is decrypted
+func TestSecurityMiddlewaresOrder(t *testing.T) {
+	const hashKey = "secret"
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	body := fmt.Sprintf(`[{"id":"PollCount","type":"counter","delta":5,"hash":"%s"}]`, hash.Hash("PollCount:counter:5", hashKey))
+	envelope, err := encryption.Encrypt(&key.PublicKey, []byte(body))
+	require.NoError(t, err)
+	s := newSecurityServer(t, config.Config{
+		HashKey:           hashKey,
+		TrustedSubnet:     "127.0.0.0/8",
+		TrustedProxies:    "192.0.2.1",
+		RequireEncryption: true,
+		RequireSignature:  true,
+	})
+	s.CryptoKey = key
+	code, stored := serveSecurityRequest(t, s, securityRequest{
+		url:  "/updates/",
+		body: envelope,
+		headers: map[string]string{
+			encryption.Header: encryption.Scheme,
+			"X-Real-IP":       "127.0.0.1",
+		},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, stored)
+}
+
+// TestRequestSignatureMiddleware tests verification of request signatures and signing of responses
+func TestRequestSignatureMiddleware(t *testing.T) {
+	const key = "secret"
+	body := []byte(`{"id":"PollCount","type":"counter","delta":5}`)
+	sign := func(key, path string, body []byte) map[string]string {
+		sig, err := signature.New(key, http.MethodPost, path, body)
+		require.NoError(t, err)
+		return sig.Fields()
+	}
+	expired := signature.Signature{Timestamp: time.Now().Add(-time.Hour).Unix(), Nonce: "00"}
+	expired.Sign(key, http.MethodPost, "/update/", body)
+	tests := []struct {
+		name    string
+		require bool
+		key     string
+		req     securityRequest
+		code    int
+	}{
+		{name: "unsigned when not required", key: key, req: securityRequest{url: "/update/", body: body}, code: http.StatusOK},
+		{name: "signed request", require: true, key: key, req: securityRequest{url: "/update/", body: body, headers: sign(key, "/update/", body)}, code: http.StatusOK},
+		{name: "signed URL update", require: true, key: key, req: securityRequest{url: "/update/counter/PollCount/5", headers: sign(key, "/update/counter/PollCount/5", nil)}, code: http.StatusOK},
+		{name: "unsigned when required", require: true, key: key, req: securityRequest{url: "/update/", body: body}, code: http.StatusUnauthorized},
+		{name: "signed with other key", key: key, req: securityRequest{url: "/update/", body: body, headers: sign("other", "/update/", body)}, code: http.StatusUnauthorized},
+		{name: "signature of other path", key: key, req: securityRequest{url: "/updates/", body: body, headers: sign(key, "/update/", body)}, code: http.StatusUnauthorized},
+		{name: "signed labels", require: true, key: key, req: securityRequest{url: "/update/?host=a", body: body, headers: sign(key, "/update/?host=a", body)}, code: http.StatusOK},
+		{name: "labels changed after signing", key: key, req: securityRequest{url: "/update/?host=b", body: body, headers: sign(key, "/update/?host=a", body)}, code: http.StatusUnauthorized},
+		{name: "labels added after signing", key: key, req: securityRequest{url: "/update/?host=b", body: body, headers: sign(key, "/update/", body)}, code: http.StatusUnauthorized},
+		{name: "expired signature", key: key, req: securityRequest{url: "/update/", body: body, headers: expired.Fields()}, code: http.StatusUnauthorized},
+		{name: "server without key", require: true, req: securityRequest{url: "/update/", body: body, headers: sign(key, "/update/", body)}, code: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, config.Config{RequireRequestSignature: tt.require, HashKey: tt.key})
+			code, stored := serveSecurityRequest(t, s, tt.req)
+			assert.Equal(t, tt.code, code)
+			if tt.code != http.StatusOK {
+				assert.Zero(t, stored)
+			}
+		})
+	}
+}
+
+// TestRequestSignatureReplay tests that signed request is accepted once and its response is signed
+func TestRequestSignatureReplay(t *testing.T) {
+	const key = "secret"
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":5}]`)
+	s := newSecurityServer(t, config.Config{HashKey: key})
+	sig, err := signature.New(key, http.MethodPost, "/updates/", body)
+	require.NoError(t, err)
+	router := s.Router()
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentTypeJSON)
+		for name, value := range sig.Fields() {
+			r.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		return rec
+	}
+	rec := send()
+	require.Equal(t, http.StatusOK, rec.Code)
+	respSig, err := signature.Parse(rec.Header().Get)
+	require.NoError(t, err)
+	assert.Equal(t, sig.Nonce, respSig.Nonce)
+	assert.True(t, respSig.Valid(key, strconv.Itoa(rec.Code), "/updates/", rec.Body.Bytes()))
+
+	assert.Equal(t, http.StatusUnauthorized, send().Code)
+	m, err := s.Storage.GetMetric(types.Metrics{ID: "PollCount", MType: "counter"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *m.Delta)
+}
+
+// staticTokens authenticates tokens from map
+type staticTokens map[string]auth.Identity
+
+// Authenticate returns identity of token from map
+func (t staticTokens) Authenticate(_ context.Context, token string) (auth.Identity, error) {
+	id, ok := t[token]
+	if !ok {
+		return auth.Identity{}, auth.ErrUnauthenticated
+	}
+	return id, nil
+}
+
+// TestRequireScope tests that endpoints are available only to tokens with required scope
+func TestRequireScope(t *testing.T) {
+	tokens := staticTokens{
+		"writer": {Name: "agent-1", Scopes: []auth.Scope{auth.ScopeWrite}},
+		"reader": {Name: "dashboard", Scopes: []auth.Scope{auth.ScopeRead}},
+		"admin":  {Name: "ops", Scopes: []auth.Scope{auth.ScopeAdmin}},
+	}
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		code   int
+	}{
+		{name: "write with write scope", method: http.MethodPost, url: "/update/counter/PollCount/5", token: "writer", code: http.StatusOK},
+		{name: "write with admin scope", method: http.MethodPost, url: "/update/counter/PollCount/5", token: "admin", code: http.StatusOK},
+		{name: "write with read scope", method: http.MethodPost, url: "/update/counter/PollCount/5", token: "reader", code: http.StatusForbidden},
+		{name: "write without token", method: http.MethodPost, url: "/update/counter/PollCount/5", code: http.StatusUnauthorized},
+		{name: "write with unknown token", method: http.MethodPost, url: "/update/counter/PollCount/5", token: "guess", code: http.StatusUnauthorized},
+		{name: "read with read scope", method: http.MethodGet, url: "/", token: "reader", code: http.StatusOK},
+		{name: "read with write scope", method: http.MethodGet, url: "/", token: "writer", code: http.StatusForbidden},
+		{name: "read without token", method: http.MethodGet, url: "/metrics", code: http.StatusUnauthorized},
+		{name: "debug with read scope", method: http.MethodGet, url: "/debug/pprof/", token: "reader", code: http.StatusForbidden},
+		{name: "debug with admin scope", method: http.MethodGet, url: "/debug/pprof/", token: "admin", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, config.Config{Authenticator: tokens})
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.Router().ServeHTTP(rec, r)
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusUnauthorized {
+				assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+// TestRequireScopeIdentity tests that identity of token is available to handlers
+func TestRequireScopeIdentity(t *testing.T) {
+	s := newSecurityServer(t, config.Config{Authenticator: staticTokens{
+		"writer": {Name: "agent-1", Scopes: []auth.Scope{auth.ScopeWrite}},
+	}})
+	var name string
+	handler := s.RequireScope(auth.ScopeWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name = auth.Name(r.Context())
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/update/", nil)
+	r.Header.Set("Authorization", "Bearer writer")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "agent-1", name)
+}
+
+// TestLimitRateMiddleware tests that every client is limited separately and told when to retry
+func TestLimitRateMiddleware(t *testing.T) {
+	cfg := config.Config{Limiter: ratelimit.NewLimiter(0.1, 2)}
+	s := newSecurityServer(t, cfg)
+	assert.Same(t, cfg.Limiter, s.Limiter, "limiter is shared with other servers")
+	update := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil)
+		r.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		s.Router().ServeHTTP(rec, r)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, update("192.168.0.5:5000").Code, i)
+	}
+	rec := update("192.168.0.5:5001")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 10, retryAfter, 1)
+	assert.Equal(t, http.StatusOK, update("192.168.0.6:5000").Code)
+}
+
+// TestRequestSizeLimits tests rejection of large bodies and batches
+func TestRequestSizeLimits(t *testing.T) {
+	metric := `{"id":"PollCount","type":"counter","delta":1}`
+	batch := func(n int) []byte {
+		return []byte("[" + strings.TrimSuffix(strings.Repeat(metric+",", n), ",") + "]")
+	}
+	tests := []struct {
+		name   string
+		cfg    config.Config
+		body   []byte
+		code   int
+		stored int
+	}{
+		{name: "no limits", body: batch(100), code: http.StatusOK, stored: 1},
+		{name: "body within limit", cfg: config.Config{MaxBodySize: int64(len(batch(3)))}, body: batch(3), code: http.StatusOK, stored: 1},
+		{name: "body too large", cfg: config.Config{MaxBodySize: int64(len(batch(3)))}, body: batch(4), code: http.StatusRequestEntityTooLarge},
+		{name: "batch within limit", cfg: config.Config{MaxBatchSize: 3}, body: batch(3), code: http.StatusOK, stored: 1},
+		{name: "batch too large", cfg: config.Config{MaxBatchSize: 3}, body: batch(4), code: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, stored := serveSecurityRequest(t, newSecurityServer(t, tt.cfg), securityRequest{url: "/updates/", body: tt.body})
+			assert.Equal(t, tt.code, code)
+			assert.Equal(t, tt.stored, stored)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/watch"
+)
+
+const (
+	// streamKeepAlive is a period of keep-alive messages, proxies close idle connections
+	streamKeepAlive = 15 * time.Second
+	// webSocketWriteWait is a time WebSocket message must be written in, slower clients are disconnected
+	webSocketWriteWait = 10 * time.Second
+	// webSocketReadLimit is a maximum size of message from client, clients are not expected to send anything but control frames
+	webSocketReadLimit = 512
+)
+
+// upgrader upgrades connections to WebSocket, only pages of the same origin can connect
+var upgrader = websocket.Upgrader{}
+
+// CloseStreams ends streams of subscribers, it is called on shutdown since connections of streams are never idle
+func (s *MetricServer) CloseStreams() {
+	if s.closeStreams != nil {
+		s.closeStreams()
+	}
+}
+
+// streamsDone returns channel which is closed when streams must end, it is nil if server can't close streams
+func (s *MetricServer) streamsDone() <-chan struct{} {
+	if s.streams == nil {
+		return nil
+	}
+	return s.streams.Done()
+}
+
+// filterFromQuery gets filter of updates from URL query parameters prefix, type and labels written as a=1,b=2
+func filterFromQuery(r *http.Request) (watch.Filter, error) {
+	query := r.URL.Query()
+	l, err := labels.ParsePairs(query.Get("labels"))
+	if err != nil {
+		return watch.Filter{}, err
+	}
+	return watch.Filter{Prefix: query.Get("prefix"), MType: query.Get("type"), Labels: l}, nil
+}
+
+// GetWatchHandler streams updates of metrics selected by query over WebSocket if connection is upgraded
+// and as Server-Sent Events otherwise. Clients which don't keep up with updates are disconnected
+func (s *MetricServer) GetWatchHandler(rw http.ResponseWriter, r *http.Request) {
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+	w, ok := s.Storage.(storage.Watcher)
+	if !ok {
+		http.Error(rw, "storage can't be watched", http.StatusNotImplemented)
+		return
+	}
+	sub, err := w.Watch(filter)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer sub.Close()
+	if s.Debug {
+		loggers.DebugLogger.Printf("watch of %q %q %v started", filter.Prefix, filter.MType, filter.Labels)
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		s.streamWebSocket(rw, r, sub)
+		return
+	}
+	s.streamEvents(rw, r, sub)
+}
+
+// streamEvents writes updates as events "metric" with JSON of metric,
+// event "error" tells why stream is ended by server
+func (s *MetricServer) streamEvents(rw http.ResponseWriter, r *http.Request, sub *watch.Subscription) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case m := <-sub.Updates():
+			var data []byte
+			if data, err = json.Marshal(m); err != nil {
+				loggers.ErrorLogger.Println("json Marshal error:", err)
+				continue
+			}
+			_, err = fmt.Fprintf(rw, "event: metric\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			_, err = io.WriteString(rw, ": keep-alive\n\n")
+		case <-sub.Done():
+			fmt.Fprintf(rw, "event: error\ndata: %v\n\n", sub.Err())
+			flusher.Flush()
+			return
+		case <-s.streamsDone():
+			io.WriteString(rw, "event: error\ndata: server is shutting down\n\n")
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// streamWebSocket upgrades connection to WebSocket and writes updates as text messages with JSON of metric.
+// Close message tells why stream is ended by server
+func (s *MetricServer) streamWebSocket(rw http.ResponseWriter, r *http.Request, sub *watch.Subscription) {
+	conn, err := upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		// upgrader has already replied with error
+		loggers.ErrorLogger.Println("error while upgrading to websocket:", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(webSocketReadLimit)
+	// control frames are handled while reading, connection is closed by client when reading fails
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case m := <-sub.Updates():
+			conn.SetWriteDeadline(time.Now().Add(webSocketWriteWait))
+			if err = conn.WriteJSON(m); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteWait)); err != nil {
+				return
+			}
+		case <-sub.Done():
+			code := websocket.CloseGoingAway
+			if errors.Is(sub.Err(), watch.ErrSlowSubscriber) {
+				code = websocket.CloseTryAgainLater
+			}
+			closeWebSocket(conn, code, sub.Err().Error())
+			return
+		case <-s.streamsDone():
+			closeWebSocket(conn, websocket.CloseGoingAway, "server is shutting down")
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// closeWebSocket sends close message with code and reason
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(webSocketWriteWait)); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		loggers.ErrorLogger.Println("error while closing websocket:", err)
+	}
+}
@@ -0,0 +1,143 @@
+package httpserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// readEvent reads lines of server-sent event up to empty line, comments are skipped
+func readEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// gauge makes gauge metric
+func gauge(id string, value float64, l map[string]string) types.Metrics {
+	return types.Metrics{ID: id, MType: "gauge", Value: &value, Labels: l}
+}
+
+// TestGetWatchHandlerEvents tests streaming of selected updates as server-sent events
+func TestGetWatchHandlerEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+	}{
+		{name: "plain"},
+		{name: "gzip", encoding: "gzip"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSecurityServer(t, config.Config{})
+			ts := httptest.NewServer(CompressHandler(s.Router()))
+			defer ts.Close()
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/watch?prefix=cpu&type=gauge&labels=host=a", nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", "text/event-stream")
+			if tt.encoding != "" {
+				req.Header.Set("Accept-Encoding", tt.encoding)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+			var body io.Reader = resp.Body
+			if tt.encoding == "gzip" {
+				require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+				body, err = gzip.NewReader(resp.Body)
+				require.NoError(t, err)
+			}
+			r := bufio.NewReader(body)
+
+			require.NoError(t, s.Storage.SaveManyMetrics([]types.Metrics{
+				gauge("mem", 1, map[string]string{"host": "a"}),
+				gauge("cpu", 2, map[string]string{"host": "b"}),
+				gauge("cpu", 3, map[string]string{"host": "a", "core": "0"}),
+			}, ""))
+			event, data := readEvent(t, r)
+			assert.Equal(t, "metric", event)
+			var m types.Metrics
+			require.NoError(t, json.Unmarshal([]byte(data), &m))
+			assert.Equal(t, "cpu", m.ID)
+			assert.Equal(t, 3.0, *m.Value)
+
+			s.CloseStreams()
+			event, data = readEvent(t, r)
+			assert.Equal(t, "error", event)
+			assert.Equal(t, "server is shutting down", data)
+		})
+	}
+}
+
+// TestGetWatchHandlerWebSocket tests streaming of selected updates over WebSocket
+func TestGetWatchHandlerWebSocket(t *testing.T) {
+	s := newSecurityServer(t, config.Config{})
+	ts := httptest.NewServer(CompressHandler(s.Router()))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/watch?type=counter"
+
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Accept-Encoding": {"gzip"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	delta := int64(5)
+	require.NoError(t, s.Storage.SaveMetric(gauge("cpu", 1, nil), ""))
+	require.NoError(t, s.Storage.SaveMetric(types.Metrics{ID: "requests", MType: "counter", Delta: &delta}, ""))
+	var m types.Metrics
+	require.NoError(t, conn.ReadJSON(&m))
+	assert.Equal(t, "requests", m.ID)
+	assert.Equal(t, int64(5), *m.Delta)
+
+	s.CloseStreams()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+
+	_, resp, err = websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://example.com"}})
+	assert.Error(t, err, "pages of other origins can't connect")
+	if resp != nil {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+// TestGetWatchHandlerErrors tests rejection of wrong filters and watches without scope
+func TestGetWatchHandlerErrors(t *testing.T) {
+	s := newSecurityServer(t, config.Config{})
+	rec := httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/watch?labels=host", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	s.Authenticator = staticTokens{"writer": {Name: "agent-1", Scopes: []auth.Scope{auth.ScopeWrite}}}
+	r := httptest.NewRequest(http.MethodGet, "/watch", nil)
+	r.Header.Set("Authorization", "Bearer writer")
+	rec = httptest.NewRecorder()
+	s.Router().ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,120 @@
+// Package auth authenticates agents by bearer tokens and authorizes them by scopes
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+)
+
+// Scope is a permission granted to token
+type Scope string
+
+// scopes of tokens
+const (
+	// ScopeWrite allows updating metrics
+	ScopeWrite Scope = "write"
+	// ScopeRead allows reading metrics
+	ScopeRead Scope = "read"
+	// ScopeAdmin allows everything including debug endpoints
+	ScopeAdmin Scope = "admin"
+)
+
+var (
+	// ErrUnauthenticated is returned when token is missing or unknown
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned when identity has no scope required
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Identity is an agent authenticated by token
+type Identity struct {
+	// Name identifies agent in logs
+	Name   string
+	Scopes []Scope
+}
+
+// Allows checks if identity has scope, admin has every scope
+func (id Identity) Allows(scope Scope) bool {
+	for _, s := range id.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator finds identity owning token
+type Authenticator interface {
+	// Authenticate returns identity of token or ErrUnauthenticated if token is unknown
+	Authenticate(ctx context.Context, token string) (Identity, error)
+}
+
+// HashToken returns hex encoded SHA-256 of token, only hashes of tokens are stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenFromHeader gets token from value of Authorization header with Bearer scheme
+func TokenFromHeader(header string) string {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// Check authenticates token and checks that its identity has scope
+func Check(ctx context.Context, a Authenticator, token string, scope Scope) (Identity, error) {
+	if token == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+	id, err := a.Authenticate(ctx, token)
+	if err != nil {
+		return Identity{}, err
+	}
+	if !id.Allows(scope) {
+		return id, ErrForbidden
+	}
+	return id, nil
+}
+
+// identityKey is a context key of identity
+type identityKey struct{}
+
+// NewContext returns ctx carrying identity
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns identity of request if it was authenticated
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// Name returns name of identity of request or "anonymous" if request wasn't authenticated
+func Name(ctx context.Context) string {
+	if id, ok := FromContext(ctx); ok {
+		return id.Name
+	}
+	return "anonymous"
+}
+
+// LogUpdate logs that identity of request updated metrics. Updates of authenticated requests are logged as info,
+// anonymous ones are too frequent and are logged only if debug is set
+func LogUpdate(ctx context.Context, debug bool, format string, v ...interface{}) {
+	id, ok := FromContext(ctx)
+	switch {
+	case ok:
+		loggers.InfoLogger.Println(id.Name, fmt.Sprintf(format, v...))
+	case debug:
+		loggers.DebugLogger.Println(Name(ctx), fmt.Sprintf(format, v...))
+	}
+}
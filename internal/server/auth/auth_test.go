@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+)
+
+// writeTokensFile writes tokens file with content to temporary directory
+func writeTokensFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// TestFileTokens tests authentication and authorization of tokens from file
+func TestFileTokens(t *testing.T) {
+	path := writeTokensFile(t, `{"agents": [
+		{"name": "agent-1", "token_sha256": "`+HashToken("writer-token")+`", "scopes": ["write"]},
+		{"name": "dashboard", "token_sha256": "`+HashToken("reader-token")+`", "scopes": ["read"]},
+		{"name": "ops", "token_sha256": "`+HashToken("admin-token")+`", "scopes": ["admin"]}
+	]}`)
+	tokens, err := ReadTokensFile(path)
+	require.NoError(t, err)
+	tests := []struct {
+		name  string
+		token string
+		scope Scope
+		id    string
+		err   error
+	}{
+		{name: "writer writes", token: "writer-token", scope: ScopeWrite, id: "agent-1"},
+		{name: "writer reads", token: "writer-token", scope: ScopeRead, id: "agent-1", err: ErrForbidden},
+		{name: "reader reads", token: "reader-token", scope: ScopeRead, id: "dashboard"},
+		{name: "reader writes", token: "reader-token", scope: ScopeWrite, id: "dashboard", err: ErrForbidden},
+		{name: "admin writes", token: "admin-token", scope: ScopeWrite, id: "ops"},
+		{name: "admin debugs", token: "admin-token", scope: ScopeAdmin, id: "ops"},
+		{name: "unknown token", token: "guess", scope: ScopeRead, err: ErrUnauthenticated},
+		{name: "hash as token", token: HashToken("admin-token"), scope: ScopeRead, err: ErrUnauthenticated},
+		{name: "no token", scope: ScopeRead, err: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := Check(context.Background(), tokens, tt.token, tt.scope)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.id, id.Name)
+		})
+	}
+}
+
+// TestReadTokensFileErrors tests rejection of invalid tokens files
+func TestReadTokensFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "not JSON", content: `agent-1:token`},
+		{name: "plaintext token", content: `{"agents": [{"name": "agent-1", "token_sha256": "token", "scopes": ["write"]}]}`},
+		{name: "no name", content: `{"agents": [{"token_sha256": "` + HashToken("token") + `", "scopes": ["write"]}]}`},
+		{name: "same token", content: `{"agents": [
+			{"name": "agent-1", "token_sha256": "` + HashToken("token") + `", "scopes": ["write"]},
+			{"name": "agent-2", "token_sha256": "` + HashToken("token") + `", "scopes": ["read"]}
+		]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadTokensFile(writeTokensFile(t, tt.content))
+			assert.Error(t, err)
+		})
+	}
+	_, err := ReadTokensFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+// TestTokenFromHeader tests parsing of Authorization header
+func TestTokenFromHeader(t *testing.T) {
+	assert.Equal(t, "abc", TokenFromHeader("Bearer abc"))
+	assert.Equal(t, "abc", TokenFromHeader("bearer  abc "))
+	assert.Empty(t, TokenFromHeader("Basic abc"))
+	assert.Empty(t, TokenFromHeader("abc"))
+	assert.Empty(t, TokenFromHeader(""))
+}
+
+// TestContext tests passing identity in context
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "anonymous", Name(ctx))
+	ctx = NewContext(ctx, Identity{Name: "agent-1"})
+	id, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "agent-1", id.Name)
+	assert.Equal(t, "agent-1", Name(ctx))
+}
+
+// TestLogUpdate tests that anonymous updates are logged only at debug level
+func TestLogUpdate(t *testing.T) {
+	var info, debug bytes.Buffer
+	loggers.InfoLogger.SetOutput(&info)
+	loggers.DebugLogger.SetOutput(&debug)
+	defer func() {
+		loggers.InfoLogger.SetOutput(os.Stdout)
+		loggers.DebugLogger.SetOutput(os.Stdout)
+	}()
+
+	ctx := context.Background()
+	LogUpdate(ctx, false, "updated %d metrics", 2)
+	assert.Empty(t, info.String())
+	assert.Empty(t, debug.String())
+
+	LogUpdate(ctx, true, "updated %d metrics", 2)
+	assert.Empty(t, info.String())
+	assert.Contains(t, debug.String(), "anonymous updated 2 metrics")
+
+	LogUpdate(NewContext(ctx, Identity{Name: "agent-1"}), false, "updated metric %s", "Alloc")
+	assert.Contains(t, info.String(), "agent-1 updated metric Alloc")
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tokensFile is a format of tokens file:
+//
+//	{"agents": [{"name": "agent-1", "token_sha256": "<hex SHA-256 of token>", "scopes": ["write"]}]}
+type tokensFile struct {
+	Agents []struct {
+		Name        string  `json:"name"`
+		TokenSHA256 string  `json:"token_sha256"`
+		Scopes      []Scope `json:"scopes"`
+	} `json:"agents"`
+}
+
+// FileTokens authenticates tokens listed in tokens file
+type FileTokens struct {
+	// identities maps hash of token to its identity
+	identities map[string]Identity
+}
+
+// ReadTokensFile reads identities of agents from JSON file
+func ReadTokensFile(path string) (*FileTokens, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading tokens file: %w", err)
+	}
+	var file tokensFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error while parsing tokens file: %w", err)
+	}
+	t := &FileTokens{identities: make(map[string]Identity)}
+	for _, agent := range file.Agents {
+		tokenHash := strings.ToLower(agent.TokenSHA256)
+		if agent.Name == "" || len(tokenHash) != 64 {
+			return nil, fmt.Errorf("agent %q must have name and SHA-256 of token", agent.Name)
+		}
+		if _, ok := t.identities[tokenHash]; ok {
+			return nil, fmt.Errorf("token of agent %q is not unique", agent.Name)
+		}
+		t.identities[tokenHash] = Identity{Name: agent.Name, Scopes: agent.Scopes}
+	}
+	return t, nil
+}
+
+// Authenticate returns identity of token from file
+func (t *FileTokens) Authenticate(_ context.Context, token string) (Identity, error) {
+	id, ok := t.identities[HashToken(token)]
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	return id, nil
+}
+
+// DBTokens authenticates tokens stored in agent_tokens table
+type DBTokens struct {
+	selectStmt *sql.Stmt
+}
+
+// NewDBTokens creates DBTokens reading tokens from db
+func NewDBTokens(db *sql.DB) (*DBTokens, error) {
+	stmt, err := db.Prepare(`SELECT name, scopes FROM agent_tokens WHERE token_hash = $1 AND NOT revoked`)
+	if err != nil {
+		return nil, fmt.Errorf("error while preparing tokens statement: %w", err)
+	}
+	return &DBTokens{selectStmt: stmt}, nil
+}
+
+// Authenticate returns identity of token from database, scopes are stored comma separated
+func (t *DBTokens) Authenticate(ctx context.Context, token string) (Identity, error) {
+	var name, scopes string
+	err := t.selectStmt.QueryRowContext(ctx, HashToken(token)).Scan(&name, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Identity{}, ErrUnauthenticated
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("error while selecting token: %w", err)
+	}
+	id := Identity{Name: name}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			id.Scopes = append(id.Scopes, Scope(scope))
+		}
+	}
+	return id, nil
+}
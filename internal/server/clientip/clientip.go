@@ -0,0 +1,101 @@
+// Package clientip resolves IP of client and matches it against trusted networks.
+// Headers with client IP are honored only if they are set by a trusted proxy
+package clientip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// headers set by proxies
+const (
+	HeaderForwardedFor = "X-Forwarded-For"
+	HeaderRealIP       = "X-Real-IP"
+)
+
+// ErrUnknown is returned when IP of client can't be resolved
+var ErrUnknown = errors.New("client IP is unknown")
+
+// Nets is a list of IPv4 and IPv6 networks
+type Nets []*net.IPNet
+
+// ParseNets parses comma separated CIDRs, single addresses are treated as /32 or /128 networks
+func ParseNets(s string) (Nets, error) {
+	var nets Nets
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		if !strings.Contains(str, "/") {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", str)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", str, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Contains checks if ip is in any of networks
+func (n Nets) Contains(ip net.IP) bool {
+	for _, ipNet := range n {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses IP which may be written with port or in brackets
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// Resolve returns IP of client connected from peer address.
+// If peer is a trusted proxy, client IP is taken from X-Forwarded-For skipping trusted proxies from the right,
+// or from X-Real-IP. Headers are got by get and ignored if peer is not trusted
+func Resolve(peer string, get func(string) string, proxies Nets) (net.IP, error) {
+	ip := parseIP(peer)
+	if ip == nil {
+		return nil, ErrUnknown
+	}
+	if !proxies.Contains(ip) {
+		return ip, nil
+	}
+	if forwarded := get(HeaderForwardedFor); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			if ip = parseIP(hops[i]); ip == nil {
+				return nil, ErrUnknown
+			}
+			if !proxies.Contains(ip) {
+				return ip, nil
+			}
+		}
+		return ip, nil
+	}
+	if realIP := get(HeaderRealIP); realIP != "" {
+		if ip = parseIP(realIP); ip == nil {
+			return nil, ErrUnknown
+		}
+	}
+	return ip, nil
+}
@@ -0,0 +1,78 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseNets tests parsing of IPv4 and IPv6 networks
+func TestParseNets(t *testing.T) {
+	nets, err := ParseNets("10.0.0.0/8, 2001:db8::/32,192.168.1.7,::1")
+	require.NoError(t, err)
+	require.Len(t, nets, 4)
+	for ip, contains := range map[string]bool{
+		"10.1.2.3":    true,
+		"2001:db8::5": true,
+		"192.168.1.7": true,
+		"::1":         true,
+		"192.168.1.8": false,
+		"2001:db9::5": false,
+		"127.0.0.1":   false,
+	} {
+		assert.Equal(t, contains, nets.Contains(net.ParseIP(ip)), ip)
+	}
+	nets, err = ParseNets("")
+	require.NoError(t, err)
+	assert.False(t, nets.Contains(net.ParseIP("10.0.0.1")))
+	for _, s := range []string{"10.0.0.0/33", "10.0.0", "10.0.0.0/8,example.com"} {
+		_, err = ParseNets(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// TestResolve tests that headers with client IP are honored only from trusted proxies
+func TestResolve(t *testing.T) {
+	proxies, err := ParseNets("10.0.0.0/24,fd00::/8")
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		ip      string
+		err     error
+	}{
+		{name: "direct client", peer: "192.168.1.7:51000", ip: "192.168.1.7"},
+		{name: "direct IPv6 client", peer: "[2001:db8::5]:51000", ip: "2001:db8::5"},
+		{name: "direct client forging headers", peer: "203.0.113.9:51000", headers: map[string]string{
+			HeaderRealIP:       "192.168.1.7",
+			HeaderForwardedFor: "192.168.1.7",
+		}, ip: "203.0.113.9"},
+		{name: "proxy with X-Real-IP", peer: "10.0.0.2:443", headers: map[string]string{HeaderRealIP: "192.168.1.7"}, ip: "192.168.1.7"},
+		{name: "proxy with X-Forwarded-For", peer: "10.0.0.2:443", headers: map[string]string{
+			HeaderForwardedFor: "198.51.100.1, 192.168.1.7, 10.0.0.3",
+			HeaderRealIP:       "10.0.0.3",
+		}, ip: "192.168.1.7"},
+		{name: "IPv6 proxy", peer: "[fd00::1]:443", headers: map[string]string{HeaderForwardedFor: "2001:db8::5"}, ip: "2001:db8::5"},
+		{name: "proxy without headers", peer: "10.0.0.2:443", ip: "10.0.0.2"},
+		{name: "only proxies forwarded", peer: "10.0.0.2:443", headers: map[string]string{HeaderForwardedFor: "10.0.0.4, 10.0.0.3"}, ip: "10.0.0.4"},
+		{name: "proxy with invalid header", peer: "10.0.0.2:443", headers: map[string]string{HeaderForwardedFor: "unknown"}, err: ErrUnknown},
+		{name: "no peer", err: ErrUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for name, value := range tt.headers {
+				h.Set(name, value)
+			}
+			ip, err := Resolve(tt.peer, h.Get, proxies)
+			assert.ErrorIs(t, err, tt.err)
+			if tt.err == nil {
+				assert.Equal(t, tt.ip, ip.String())
+			}
+		})
+	}
+}
@@ -1,25 +1,69 @@
 package config
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"flag"
 	"io"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
 )
 
 // defaultAddress is a default server address
 const defaultAddress = "localhost:8080"
 
+// defaultGRPCAddress is a default address of gRPC server when both protocols are served
+const defaultGRPCAddress = "localhost:3200"
+
+// protocols served by server
+const (
+	ProtocolHTTP = "HTTP"
+	ProtocolGRPC = "gRPC"
+	// ProtocolBoth serves HTTP at Address and gRPC at GRPCAddress
+	ProtocolBoth = "both"
+)
+
 // default file storage config
 const (
 	defaultStoreInterval = 300 * time.Second
 	defaultStoreFile     = "/tmp/devops-metrics-db.json"
 	defaultRestore       = true
+	defaultWALFsync      = "everysec"
+)
+
+// defaultShutdownTimeout is a default time given to in-flight requests and final flush of storage
+const defaultShutdownTimeout = 10 * time.Second
+
+// defaultSignatureSkew is a default maximum age of signed request
+const defaultSignatureSkew = 5 * time.Minute
+
+// default limits of requests
+const (
+	defaultMaxBodySize  = 8 << 20
+	defaultMaxBatchSize = 10000
+	// defaultWatchBufferSize is a default number of updates buffered for every subscriber
+	defaultWatchBufferSize = 256
+)
+
+// default StatsD config, timers are in milliseconds
+const (
+	defaultStatsDFlushInterval    = 10 * time.Second
+	defaultStatsDHistogramBuckets = "5,10,25,50,100,250,500,1000,2500,5000,10000"
+	defaultStatsDMaxMetrics       = 10000
+)
+
+// default metrics history config
+const (
+	defaultHistoryRetention  = 0
+	defaultHistoryResolution = 0
 )
 
 type Config struct {
@@ -30,27 +74,156 @@ type Config struct {
 	StoreFile       string        `json:"store_file"`
 	StoreInterval   time.Duration `json:"store_interval"`
 	Restore         bool          `json:"restore"`
-	HashKey         string
-	CryptoKeyFile   string `json:"crypto_key"`
-	TrustedSubnet   string `json:"trusted_subnet"`
-	Protocol        string
+	// WALFsync is a policy of syncing write-ahead log to disk: "always", "everysec" or "never"
+	WALFsync      string `json:"wal_fsync"`
+	HashKey       string
+	CryptoKeyFile string `json:"crypto_key"`
+	// RequireEncryption makes server reject updates which are not encrypted
+	RequireEncryption bool `json:"require_encryption"`
+	// RequireSignature makes server reject metrics without hash
+	RequireSignature bool `json:"require_signature"`
+	// RequireRequestSignature makes server reject updates without valid signature of whole request
+	RequireRequestSignature bool `json:"require_request_signature"`
+	// SignatureSkew is a maximum age of signed request, nonces are remembered for this time to reject replays
+	SignatureSkew time.Duration `json:"signature_skew"`
+	// TrustedSubnet is a comma separated list of IPv4 and IPv6 CIDRs clients are allowed to update metrics from
+	TrustedSubnet string `json:"trusted_subnet"`
+	// TrustedProxies are comma separated CIDRs of proxies whose X-Forwarded-For and X-Real-IP headers are honored
+	TrustedProxies string `json:"trusted_proxies"`
+	Protocol       string
+	// GRPCAddress is an address of gRPC server when both protocols are served
+	GRPCAddress string `json:"grpc_address"`
+	// HistoryRetention is a period samples of metrics are kept for, 0 disables history
+	HistoryRetention time.Duration `json:"history_retention"`
+	// HistoryResolution is a width of buckets old samples are downsampled to, 0 disables downsampling
+	HistoryResolution time.Duration `json:"history_resolution"`
+	// ShutdownTimeout is a time in-flight requests are waited for on shutdown
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+	// TLSCertFile and TLSKeyFile are PEM files of server certificate, TLS is enabled if they are set
+	TLSCertFile string `json:"tls_cert"`
+	TLSKeyFile  string `json:"tls_key"`
+	// TLSClientCAFile is a PEM bundle of CAs client certificates are verified with, if set clients must present certificate
+	TLSClientCAFile string `json:"tls_client_ca"`
+	TLSConfig       *tls.Config
+	// AuthTokensFile is a JSON file of agent identities, if it is set every request must carry token
+	AuthTokensFile string `json:"auth_tokens_file"`
+	// AuthDatabase makes server authenticate tokens from agent_tokens table of database
+	AuthDatabase  bool `json:"auth_database"`
+	Authenticator auth.Authenticator
+	// MaxBodySize is a maximum size of decompressed request body in bytes
+	MaxBodySize int64 `json:"max_body_size"`
+	// MaxBatchSize is a maximum number of metrics in one batch update
+	MaxBatchSize int `json:"max_batch_size"`
+	// ClientRateLimit is a number of updates per second allowed to every client, 0 disables rate limiting
+	ClientRateLimit float64 `json:"client_rate_limit"`
+	// ClientRateBurst is a number of updates client can make at once, ClientRateLimit rounded up if it is 0
+	ClientRateBurst int `json:"client_rate_burst"`
+	// Limiter limits rate of updates of every client, it is shared by HTTP and gRPC servers so limits apply to both
+	Limiter *ratelimit.Limiter
+	// StatsDAddress is a UDP address StatsD lines are received at, empty address disables StatsD
+	StatsDAddress string `json:"statsd_address"`
+	// StatsDFlushInterval is a period StatsD samples are aggregated for before they are saved
+	StatsDFlushInterval time.Duration `json:"statsd_flush_interval"`
+	// StatsDHistogramBuckets are upper bounds of buckets of histograms made of StatsD timers
+	StatsDHistogramBuckets []float64 `json:"statsd_histogram_buckets"`
+	// StatsDMaxMetrics is a maximum number of StatsD metrics aggregated between flushes, 0 means no limit
+	StatsDMaxMetrics int `json:"statsd_max_metrics"`
+	// GraphiteAddress is a TCP address Graphite plaintext lines are received at, empty address disables it
+	GraphiteAddress string `json:"graphite_address"`
+	// GraphitePickleAddress is a TCP address Graphite pickle frames are received at, empty address disables it
+	GraphitePickleAddress string `json:"graphite_pickle_address"`
+	// GraphiteTemplates map dotted Graphite paths to metric IDs and labels, the first matching template is used
+	GraphiteTemplates []string `json:"graphite_templates"`
+	// InfluxCounters are patterns of metric names measurement_field like net_bytes_* whose InfluxDB integer fields
+	// are cumulative counters, other integer fields are gauges
+	InfluxCounters []string `json:"influx_counters"`
+	// WatchBufferSize is a number of updates buffered for every subscriber, slower subscribers are disconnected
+	WatchBufferSize int `json:"watch_buffer_size"`
+}
+
+// parseBuckets parses comma separated histogram bucket bounds
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, str := range strings.Split(s, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// parseTemplates parses semicolon separated Graphite templates
+func parseTemplates(s string) []string {
+	var templates []string
+	for _, template := range strings.Split(s, ";") {
+		if template = strings.TrimSpace(template); template != "" {
+			templates = append(templates, template)
+		}
+	}
+	return templates
+}
+
+// parsePatterns parses comma separated name patterns, wrong patterns are skipped
+func parsePatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			loggers.ErrorLogger.Printf("wrong pattern %q: %v", pattern, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
 }
 
 // SetServerParams sets server config
 func SetServerParams() (cfg Config) {
 	var (
-		flagRestore       bool
-		flagStoreFile     string
-		flagAddress       string
-		flagStoreInterval time.Duration
-		flagDebug         bool
-		flagKey           string
-		flagDataBase      string
-		flagCryptoKeyFile string
-		flagConfigFile    string
-		flagTrustedSubnet string
-		flagProtocol      string
-		cfgFile           string
+		flagRestore        bool
+		flagStoreFile      string
+		flagAddress        string
+		flagStoreInterval  time.Duration
+		flagDebug          bool
+		flagKey            string
+		flagDataBase       string
+		flagCryptoKeyFile  string
+		flagConfigFile     string
+		flagTrustedSubnet  string
+		flagTrustedProxies string
+		flagProtocol       string
+		flagGRPCAddress    string
+		flagHistRetention  time.Duration
+		flagHistResolution time.Duration
+		flagWALFsync       string
+		flagShutdown       time.Duration
+		flagRequireEncrypt bool
+		flagRequireSign    bool
+		flagRequireReqSign bool
+		flagSignatureSkew  time.Duration
+		flagTLSCert        string
+		flagTLSKey         string
+		flagTLSClientCA    string
+		flagAuthTokensFile string
+		flagAuthDatabase   bool
+		flagMaxBodySize    int64
+		flagMaxBatchSize   int
+		flagClientRate     float64
+		flagClientBurst    int
+		flagStatsDAddress  string
+		flagStatsDFlush    time.Duration
+		flagStatsDBuckets  string
+		flagStatsDMax      int
+		flagGraphite       string
+		flagGraphitePickle string
+		flagGraphiteTmpl   string
+		flagWatchBuffer    int
+		flagInfluxCounters string
+		cfgFile            string
 	)
 	flag.BoolVar(&flagRestore, "r", defaultRestore, "restore_true/false")
 	flag.StringVar(&flagStoreFile, "f", defaultStoreFile, "store_file")
@@ -61,8 +234,36 @@ func SetServerParams() (cfg Config) {
 	flag.StringVar(&flagDataBase, "d", "", "db_address")
 	flag.StringVar(&flagCryptoKeyFile, "crypto-key", "", "crypto_key_file")
 	flag.StringVar(&flagConfigFile, "c", "", "config_as_json")
-	flag.StringVar(&flagTrustedSubnet, "t", "", "trusted_subnet_CIDR")
-	flag.StringVar(&flagProtocol, "protocol", "HTTP", "protocol_name_HTTP_or_gRPC")
+	flag.StringVar(&flagTrustedSubnet, "t", "", "comma_separated_trusted_subnet_CIDRs")
+	flag.StringVar(&flagTrustedProxies, "trusted-proxies", "", "comma_separated_trusted_proxy_CIDRs")
+	flag.StringVar(&flagProtocol, "protocol", ProtocolHTTP, "protocol_name_HTTP_or_gRPC_or_both")
+	flag.StringVar(&flagGRPCAddress, "grpc-address", defaultGRPCAddress, "grpc_server_address_if_protocol_is_both")
+	flag.DurationVar(&flagHistRetention, "history-retention", defaultHistoryRetention, "metrics_history_retention")
+	flag.StringVar(&flagWALFsync, "wal-fsync", defaultWALFsync, "wal_fsync_always/everysec/never")
+	flag.DurationVar(&flagHistResolution, "history-resolution", defaultHistoryResolution, "metrics_history_downsampling_resolution")
+	flag.DurationVar(&flagShutdown, "shutdown-timeout", defaultShutdownTimeout, "shutdown_timeout")
+	flag.BoolVar(&flagRequireEncrypt, "require-encryption", false, "reject_not_encrypted_updates_true/false")
+	flag.BoolVar(&flagRequireSign, "require-signature", false, "reject_not_signed_updates_true/false")
+	flag.BoolVar(&flagRequireReqSign, "require-request-signature", false, "reject_updates_without_request_signature_true/false")
+	flag.DurationVar(&flagSignatureSkew, "signature-skew", defaultSignatureSkew, "max_age_of_signed_request")
+	flag.StringVar(&flagTLSCert, "tls-cert", "", "tls_certificate_file")
+	flag.StringVar(&flagTLSKey, "tls-key", "", "tls_key_file")
+	flag.StringVar(&flagTLSClientCA, "tls-client-ca", "", "tls_client_ca_file_to_require_client_certificates")
+	flag.StringVar(&flagAuthTokensFile, "auth-tokens", "", "agent_tokens_json_file")
+	flag.BoolVar(&flagAuthDatabase, "auth-db", false, "authenticate_tokens_from_database_true/false")
+	flag.Int64Var(&flagMaxBodySize, "max-body-size", defaultMaxBodySize, "max_request_body_size_in_bytes")
+	flag.IntVar(&flagMaxBatchSize, "max-batch-size", defaultMaxBatchSize, "max_metrics_in_batch")
+	flag.Float64Var(&flagClientRate, "client-rate-limit", 0, "updates_per_second_per_client")
+	flag.IntVar(&flagClientBurst, "client-rate-burst", 0, "burst_of_updates_per_client")
+	flag.StringVar(&flagStatsDAddress, "statsd-address", "", "statsd_udp_address")
+	flag.DurationVar(&flagStatsDFlush, "statsd-flush-interval", defaultStatsDFlushInterval, "statsd_flush_interval")
+	flag.StringVar(&flagStatsDBuckets, "statsd-histogram-buckets", defaultStatsDHistogramBuckets, "comma_separated_statsd_timer_bucket_bounds_in_ms")
+	flag.IntVar(&flagStatsDMax, "statsd-max-metrics", defaultStatsDMaxMetrics, "max_statsd_metrics_between_flushes")
+	flag.StringVar(&flagGraphite, "graphite-address", "", "graphite_plaintext_tcp_address")
+	flag.StringVar(&flagGraphitePickle, "graphite-pickle-address", "", "graphite_pickle_tcp_address")
+	flag.StringVar(&flagGraphiteTmpl, "graphite-templates", "", "semicolon_separated_graphite_templates")
+	flag.IntVar(&flagWatchBuffer, "watch-buffer-size", defaultWatchBufferSize, "updates_buffered_per_subscriber")
+	flag.StringVar(&flagInfluxCounters, "influx-counters", "", "comma_separated_patterns_of_influx_integer_fields_which_are_counters")
 	flag.Parse()
 	var exists bool
 	if cfgFile, exists = os.LookupEnv("CONFIG"); !exists {
@@ -108,6 +309,9 @@ func SetServerParams() (cfg Config) {
 			cfg.Restore = flagRestore
 		}
 	}
+	if cfg.WALFsync, exists = os.LookupEnv("WAL_FSYNC"); !exists {
+		cfg.WALFsync = flagWALFsync
+	}
 	cfg.HashKey, exists = os.LookupEnv("KEY")
 	if !exists {
 		cfg.HashKey = flagKey
@@ -120,10 +324,203 @@ func SetServerParams() (cfg Config) {
 	if !exists {
 		cfg.CryptoKeyFile = flagCryptoKeyFile
 	}
+	var strRequireEncrypt, strRequireSign string
+	if strRequireEncrypt, exists = os.LookupEnv("REQUIRE_ENCRYPTION"); !exists {
+		cfg.RequireEncryption = flagRequireEncrypt
+	} else {
+		var err error
+		if cfg.RequireEncryption, err = strconv.ParseBool(strRequireEncrypt); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse require encryption bool")
+			cfg.RequireEncryption = true
+		}
+	}
+	if strRequireSign, exists = os.LookupEnv("REQUIRE_SIGNATURE"); !exists {
+		cfg.RequireSignature = flagRequireSign
+	} else {
+		var err error
+		if cfg.RequireSignature, err = strconv.ParseBool(strRequireSign); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse require signature bool")
+			cfg.RequireSignature = true
+		}
+	}
+	var strRequireReqSign, strSignatureSkew string
+	if strRequireReqSign, exists = os.LookupEnv("REQUIRE_REQUEST_SIGNATURE"); !exists {
+		cfg.RequireRequestSignature = flagRequireReqSign
+	} else {
+		var err error
+		if cfg.RequireRequestSignature, err = strconv.ParseBool(strRequireReqSign); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse require request signature bool")
+			cfg.RequireRequestSignature = true
+		}
+	}
+	if strSignatureSkew, exists = os.LookupEnv("SIGNATURE_SKEW"); !exists {
+		cfg.SignatureSkew = flagSignatureSkew
+	} else {
+		var err error
+		if cfg.SignatureSkew, err = time.ParseDuration(strSignatureSkew); err != nil || cfg.SignatureSkew <= 0 {
+			loggers.ErrorLogger.Println("couldn't parse signature skew")
+			cfg.SignatureSkew = flagSignatureSkew
+		}
+	}
 	cfg.TrustedSubnet, exists = os.LookupEnv("TRUSTED_SUBNET")
 	if !exists {
 		cfg.TrustedSubnet = flagTrustedSubnet
 	}
-	cfg.Protocol = flagProtocol
+	if cfg.TrustedProxies, exists = os.LookupEnv("TRUSTED_PROXIES"); !exists {
+		cfg.TrustedProxies = flagTrustedProxies
+	}
+	if cfg.Protocol, exists = os.LookupEnv("PROTOCOL"); !exists {
+		cfg.Protocol = flagProtocol
+	}
+	if cfg.GRPCAddress, exists = os.LookupEnv("GRPC_ADDRESS"); !exists {
+		cfg.GRPCAddress = flagGRPCAddress
+	}
+	var strHistRetention, strHistResolution string
+	if strHistRetention, exists = os.LookupEnv("HISTORY_RETENTION"); !exists {
+		cfg.HistoryRetention = flagHistRetention
+	} else {
+		var err error
+		if cfg.HistoryRetention, err = time.ParseDuration(strHistRetention); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse history retention")
+			cfg.HistoryRetention = flagHistRetention
+		}
+	}
+	if strHistResolution, exists = os.LookupEnv("HISTORY_RESOLUTION"); !exists {
+		cfg.HistoryResolution = flagHistResolution
+	} else {
+		var err error
+		if cfg.HistoryResolution, err = time.ParseDuration(strHistResolution); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse history resolution")
+			cfg.HistoryResolution = flagHistResolution
+		}
+	}
+	if cfg.TLSCertFile, exists = os.LookupEnv("TLS_CERT"); !exists {
+		cfg.TLSCertFile = flagTLSCert
+	}
+	if cfg.TLSKeyFile, exists = os.LookupEnv("TLS_KEY"); !exists {
+		cfg.TLSKeyFile = flagTLSKey
+	}
+	if cfg.TLSClientCAFile, exists = os.LookupEnv("TLS_CLIENT_CA"); !exists {
+		cfg.TLSClientCAFile = flagTLSClientCA
+	}
+	if cfg.AuthTokensFile, exists = os.LookupEnv("AUTH_TOKENS_FILE"); !exists {
+		cfg.AuthTokensFile = flagAuthTokensFile
+	}
+	var strAuthDatabase string
+	if strAuthDatabase, exists = os.LookupEnv("AUTH_DATABASE"); !exists {
+		cfg.AuthDatabase = flagAuthDatabase
+	} else {
+		var err error
+		if cfg.AuthDatabase, err = strconv.ParseBool(strAuthDatabase); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse auth database bool")
+			cfg.AuthDatabase = true
+		}
+	}
+	var strMaxBodySize, strMaxBatchSize, strClientRate, strClientBurst string
+	if strMaxBodySize, exists = os.LookupEnv("MAX_BODY_SIZE"); !exists {
+		cfg.MaxBodySize = flagMaxBodySize
+	} else {
+		var err error
+		if cfg.MaxBodySize, err = strconv.ParseInt(strMaxBodySize, 10, 64); err != nil || cfg.MaxBodySize <= 0 {
+			loggers.ErrorLogger.Println("couldn't parse max body size")
+			cfg.MaxBodySize = flagMaxBodySize
+		}
+	}
+	if strMaxBatchSize, exists = os.LookupEnv("MAX_BATCH_SIZE"); !exists {
+		cfg.MaxBatchSize = flagMaxBatchSize
+	} else {
+		var err error
+		if cfg.MaxBatchSize, err = strconv.Atoi(strMaxBatchSize); err != nil || cfg.MaxBatchSize <= 0 {
+			loggers.ErrorLogger.Println("couldn't parse max batch size")
+			cfg.MaxBatchSize = flagMaxBatchSize
+		}
+	}
+	if strClientRate, exists = os.LookupEnv("CLIENT_RATE_LIMIT"); !exists {
+		cfg.ClientRateLimit = flagClientRate
+	} else {
+		var err error
+		if cfg.ClientRateLimit, err = strconv.ParseFloat(strClientRate, 64); err != nil || cfg.ClientRateLimit < 0 {
+			loggers.ErrorLogger.Println("couldn't parse client rate limit")
+			cfg.ClientRateLimit = flagClientRate
+		}
+	}
+	if strClientBurst, exists = os.LookupEnv("CLIENT_RATE_BURST"); !exists {
+		cfg.ClientRateBurst = flagClientBurst
+	} else {
+		var err error
+		if cfg.ClientRateBurst, err = strconv.Atoi(strClientBurst); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse client rate burst")
+			cfg.ClientRateBurst = flagClientBurst
+		}
+	}
+	if cfg.StatsDAddress, exists = os.LookupEnv("STATSD_ADDRESS"); !exists {
+		cfg.StatsDAddress = flagStatsDAddress
+	}
+	var strStatsDFlush string
+	if strStatsDFlush, exists = os.LookupEnv("STATSD_FLUSH_INTERVAL"); !exists {
+		cfg.StatsDFlushInterval = flagStatsDFlush
+	} else {
+		var err error
+		if cfg.StatsDFlushInterval, err = time.ParseDuration(strStatsDFlush); err != nil || cfg.StatsDFlushInterval <= 0 {
+			loggers.ErrorLogger.Println("couldn't parse statsd flush interval")
+			cfg.StatsDFlushInterval = flagStatsDFlush
+		}
+	}
+	strStatsDBuckets, exists := os.LookupEnv("STATSD_HISTOGRAM_BUCKETS")
+	if !exists {
+		strStatsDBuckets = flagStatsDBuckets
+	}
+	if buckets, err := parseBuckets(strStatsDBuckets); err != nil {
+		loggers.ErrorLogger.Println("couldn't parse statsd histogram buckets:", err)
+		cfg.StatsDHistogramBuckets, _ = parseBuckets(defaultStatsDHistogramBuckets)
+	} else {
+		cfg.StatsDHistogramBuckets = buckets
+	}
+	var strStatsDMax string
+	if strStatsDMax, exists = os.LookupEnv("STATSD_MAX_METRICS"); !exists {
+		cfg.StatsDMaxMetrics = flagStatsDMax
+	} else {
+		var err error
+		if cfg.StatsDMaxMetrics, err = strconv.Atoi(strStatsDMax); err != nil || cfg.StatsDMaxMetrics < 0 {
+			loggers.ErrorLogger.Println("couldn't parse statsd max metrics")
+			cfg.StatsDMaxMetrics = flagStatsDMax
+		}
+	}
+	if cfg.GraphiteAddress, exists = os.LookupEnv("GRAPHITE_ADDRESS"); !exists {
+		cfg.GraphiteAddress = flagGraphite
+	}
+	if cfg.GraphitePickleAddress, exists = os.LookupEnv("GRAPHITE_PICKLE_ADDRESS"); !exists {
+		cfg.GraphitePickleAddress = flagGraphitePickle
+	}
+	strGraphiteTmpl, exists := os.LookupEnv("GRAPHITE_TEMPLATES")
+	if !exists {
+		strGraphiteTmpl = flagGraphiteTmpl
+	}
+	cfg.GraphiteTemplates = parseTemplates(strGraphiteTmpl)
+	strInfluxCounters, exists := os.LookupEnv("INFLUX_COUNTERS")
+	if !exists {
+		strInfluxCounters = flagInfluxCounters
+	}
+	cfg.InfluxCounters = parsePatterns(strInfluxCounters)
+	var strWatchBuffer string
+	if strWatchBuffer, exists = os.LookupEnv("WATCH_BUFFER_SIZE"); !exists {
+		cfg.WatchBufferSize = flagWatchBuffer
+	} else {
+		var err error
+		if cfg.WatchBufferSize, err = strconv.Atoi(strWatchBuffer); err != nil || cfg.WatchBufferSize <= 0 {
+			loggers.ErrorLogger.Println("couldn't parse watch buffer size")
+			cfg.WatchBufferSize = flagWatchBuffer
+		}
+	}
+	var strShutdown string
+	if strShutdown, exists = os.LookupEnv("SHUTDOWN_TIMEOUT"); !exists {
+		cfg.ShutdownTimeout = flagShutdown
+	} else {
+		var err error
+		if cfg.ShutdownTimeout, err = time.ParseDuration(strShutdown); err != nil {
+			loggers.ErrorLogger.Println("couldn't parse shutdown timeout")
+			cfg.ShutdownTimeout = flagShutdown
+		}
+	}
 	return cfg
 }
@@ -0,0 +1,277 @@
+package database
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// batchKey identifies metric row in a batch
+type batchKey struct {
+	id     string
+	labels string
+}
+
+// batch is a set of validated metrics prepared for bulk saving.
+// Counters with equal keys are summed up and the last gauge value wins,
+// rows are sorted by key so that concurrent batches lock rows in the same order, histograms and summaries
+// of the same key keep their order.
+// Times are timestamps of the last metric of key, keys without timestamps are sampled at time of saving
+type batch struct {
+	counterKeys   []batchKey
+	counterDeltas []int64
+	counterTimes  map[batchKey]time.Time
+	gaugeKeys     []batchKey
+	gaugeValues   []float64
+	gaugeTimes    map[batchKey]time.Time
+	histograms    []types.Metrics
+	summaries     []types.Metrics
+}
+
+// validateMetric checks metric's labels, value and hash
+func validateMetric(m types.Metrics, key string) error {
+	if err := labels.Validate(m.Labels); err != nil {
+		return fmt.Errorf("%w%v", myerrors.ErrTypeBadRequest, err)
+	}
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeBadRequest)
+		}
+	case "counter":
+		if m.Delta == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeBadRequest)
+		}
+	case "histogram":
+		if m.Histogram == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeBadRequest)
+		}
+		if err := m.Histogram.Validate(); err != nil {
+			return fmt.Errorf("%w%v", myerrors.ErrTypeBadRequest, err)
+		}
+	case "summary":
+		if m.Summary == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeBadRequest)
+		}
+		if err := m.Summary.Validate(); err != nil {
+			return fmt.Errorf("%w%v", myerrors.ErrTypeBadRequest, err)
+		}
+	default:
+		return fmt.Errorf("%wno such type of metric", myerrors.ErrTypeNotImplemented)
+	}
+	if key != "" && m.Hash != "" {
+		if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(hash.WithLabels(m.HashSource(), m.Labels), key))) {
+			return fmt.Errorf("%wwrong hash in request", myerrors.ErrTypeBadRequest)
+		}
+	}
+	return nil
+}
+
+// newBatch validates metrics and groups them by type, nothing is saved if any metric is invalid
+func newBatch(metrics []types.Metrics, key string) (batch, error) {
+	var b batch
+	counters := make(map[batchKey]int64)
+	gauges := make(map[batchKey]float64)
+	for _, m := range metrics {
+		if err := validateMetric(m, key); err != nil {
+			return batch{}, fmt.Errorf("metric %s: %w", m.ID, err)
+		}
+		k := batchKey{id: m.ID, labels: labels.String(m.Labels)}
+		switch m.MType {
+		case "counter":
+			counters[k] += *m.Delta
+			b.counterTimes = setTime(b.counterTimes, k, m.Timestamp)
+		case "gauge":
+			gauges[k] = *m.Value
+			b.gaugeTimes = setTime(b.gaugeTimes, k, m.Timestamp)
+		case "histogram":
+			b.histograms = append(b.histograms, m)
+		case "summary":
+			b.summaries = append(b.summaries, m)
+		}
+	}
+	for k := range counters {
+		b.counterKeys = append(b.counterKeys, k)
+	}
+	sortKeys(b.counterKeys)
+	for _, k := range b.counterKeys {
+		b.counterDeltas = append(b.counterDeltas, counters[k])
+	}
+	for k := range gauges {
+		b.gaugeKeys = append(b.gaugeKeys, k)
+	}
+	sortKeys(b.gaugeKeys)
+	for _, k := range b.gaugeKeys {
+		b.gaugeValues = append(b.gaugeValues, gauges[k])
+	}
+	sortMetrics(b.histograms)
+	sortMetrics(b.summaries)
+	return b, nil
+}
+
+// setTime sets time of key, times map is created for the first timestamp
+func setTime(times map[batchKey]time.Time, k batchKey, ts time.Time) map[batchKey]time.Time {
+	if ts.IsZero() {
+		if times != nil {
+			delete(times, k)
+		}
+		return times
+	}
+	if times == nil {
+		times = make(map[batchKey]time.Time)
+	}
+	times[k] = ts
+	return times
+}
+
+// sampleTime returns ts or now if ts is zero
+func sampleTime(ts, now time.Time) time.Time {
+	if ts.IsZero() {
+		return now
+	}
+	return ts
+}
+
+// sortKeys sorts keys by id and labels
+func sortKeys(keys []batchKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].labels < keys[j].labels
+	})
+}
+
+// sortMetrics sorts metrics by id and labels keeping order of metrics with the same key
+func sortMetrics(metrics []types.Metrics) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return labels.String(metrics[i].Labels) < labels.String(metrics[j].Labels)
+	})
+}
+
+// splitKeys splits keys into arrays of ids and labels passed to unnest
+func splitKeys(keys []batchKey) ([]string, []string) {
+	ids := make([]string, len(keys))
+	lbls := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i], lbls[i] = k.id, k.labels
+	}
+	return ids, lbls
+}
+
+// historyBatch collects samples saved to history table in one statement
+type historyBatch struct {
+	ids    []string
+	mtypes []string
+	labels []string
+	ts     []time.Time
+	values []float64
+}
+
+// add adds a sample to history batch
+func (h *historyBatch) add(id, mtype, labelsText string, ts time.Time, value float64) {
+	h.ids = append(h.ids, id)
+	h.mtypes = append(h.mtypes, mtype)
+	h.labels = append(h.labels, labelsText)
+	h.ts = append(h.ts, ts)
+	h.values = append(h.values, value)
+}
+
+// withTx runs fn in a transaction which is rolled back if fn fails
+func (db Database) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error while beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error while committing transaction: %w", err)
+	}
+	return nil
+}
+
+// upsertCounters adds deltas of batch counters to stored values and adds new values to history samples
+func (db Database) upsertCounters(tx *sql.Tx, b batch, now time.Time, samples *historyBatch) error {
+	ids, lbls := splitKeys(b.counterKeys)
+	rows, err := tx.Stmt(db.UpsertCountersToDatabaseStmt).Query(ids, b.counterDeltas, lbls)
+	if err != nil {
+		return fmt.Errorf("error while saving counters: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id, labelsText string
+			delta          int64
+		)
+		if err = rows.Scan(&id, &labelsText, &delta); err != nil {
+			return fmt.Errorf("error while scanning saved counters: %w", err)
+		}
+		samples.add(id, "counter", labelsText, sampleTime(b.counterTimes[batchKey{id: id, labels: labelsText}], now), float64(delta))
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error while saving counters: %w", err)
+	}
+	return nil
+}
+
+// saveBatch saves all metrics of batch in one transaction.
+// Counters and gauges are upserted by one multi-row statement each
+func (db Database) saveBatch(tx *sql.Tx, b batch) error {
+	now := time.Now()
+	var samples historyBatch
+	if len(b.counterKeys) > 0 {
+		if err := db.upsertCounters(tx, b, now, &samples); err != nil {
+			return err
+		}
+	}
+	if len(b.gaugeKeys) > 0 {
+		ids, lbls := splitKeys(b.gaugeKeys)
+		if _, err := tx.Stmt(db.UpsertGaugesToDatabaseStmt).Exec(ids, b.gaugeValues, lbls); err != nil {
+			return fmt.Errorf("error while saving gauges: %w", err)
+		}
+		for i, k := range b.gaugeKeys {
+			samples.add(k.id, "gauge", k.labels, sampleTime(b.gaugeTimes[k], now), b.gaugeValues[i])
+		}
+	}
+	for _, m := range b.histograms {
+		labelsText := labels.String(m.Labels)
+		histogram, err := db.mergeHistogram(tx, m.ID, labelsText, *m.Histogram)
+		if err != nil {
+			return err
+		}
+		samples.add(m.ID, m.MType, labelsText, sampleTime(m.Timestamp, now), float64(histogram.Count))
+	}
+	for _, m := range b.summaries {
+		labelsText := labels.String(m.Labels)
+		data, err := json.Marshal(m.Summary)
+		if err != nil {
+			return fmt.Errorf("error while marshalling summary: %w", err)
+		}
+		if _, err = tx.Stmt(db.InsertUpdateSummaryToDatabaseStmt).Exec(m.ID, labelsText, string(data)); err != nil {
+			return fmt.Errorf("error while saving summary: %w", err)
+		}
+		samples.add(m.ID, m.MType, labelsText, sampleTime(m.Timestamp, now), float64(m.Summary.Count))
+	}
+	if db.HistoryRetention <= 0 || len(samples.ids) == 0 {
+		return nil
+	}
+	_, err := tx.Stmt(db.InsertHistoryToDatabaseStmt).Exec(samples.ids, samples.mtypes, samples.labels, samples.ts, samples.values)
+	if err != nil {
+		return fmt.Errorf("error while saving metric samples: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestNewBatch tests validation and grouping of metrics saved in one batch
+func TestNewBatch(t *testing.T) {
+	var (
+		one       int64 = 1
+		two       int64 = 2
+		alloc           = 10.5
+		heap            = 20.5
+		histogram       = types.Histogram{Buckets: []types.Bucket{{UpperBound: 1, Count: 1}}, Count: 1, Sum: 0.5}
+	)
+	tests := []struct {
+		name    string
+		metrics []types.Metrics
+		key     string
+		want    batch
+		wantErr error
+	}{
+		{
+			name: "counters are summed up and gauges keep last value",
+			metrics: []types.Metrics{
+				{ID: "PollCount", MType: "counter", Delta: &two},
+				{ID: "Alloc", MType: "gauge", Value: &alloc},
+				{ID: "PollCount", MType: "counter", Delta: &one},
+				{ID: "PollCount", MType: "counter", Delta: &one, Labels: map[string]string{"host": "a"}},
+				{ID: "Alloc", MType: "gauge", Value: &heap},
+			},
+			want: batch{
+				counterKeys:   []batchKey{{id: "PollCount"}, {id: "PollCount", labels: `{host="a"}`}},
+				counterDeltas: []int64{3, 1},
+				gaugeKeys:     []batchKey{{id: "Alloc"}},
+				gaugeValues:   []float64{20.5},
+			},
+		},
+		{
+			name: "rows are sorted by key",
+			metrics: []types.Metrics{
+				{ID: "b", MType: "gauge", Value: &alloc},
+				{ID: "a", MType: "gauge", Value: &heap},
+			},
+			want: batch{
+				gaugeKeys:   []batchKey{{id: "a"}, {id: "b"}},
+				gaugeValues: []float64{20.5, 10.5},
+			},
+		},
+		{
+			name: "histograms are sorted by key",
+			metrics: []types.Metrics{
+				{ID: "b", MType: "histogram", Histogram: &histogram},
+				{ID: "a", MType: "histogram", Histogram: &histogram, Labels: map[string]string{"host": "b"}},
+				{ID: "a", MType: "histogram", Histogram: &histogram, Labels: map[string]string{"host": "a"}},
+			},
+			want: batch{
+				histograms: []types.Metrics{
+					{ID: "a", MType: "histogram", Histogram: &histogram, Labels: map[string]string{"host": "a"}},
+					{ID: "a", MType: "histogram", Histogram: &histogram, Labels: map[string]string{"host": "b"}},
+					{ID: "b", MType: "histogram", Histogram: &histogram},
+				},
+			},
+		},
+		{
+			name: "timestamp of the last metric of key is kept",
+			metrics: []types.Metrics{
+				{ID: "Alloc", MType: "gauge", Value: &alloc, Timestamp: time.Unix(100, 0)},
+				{ID: "Alloc", MType: "gauge", Value: &heap, Timestamp: time.Unix(200, 0)},
+				{ID: "PollCount", MType: "counter", Delta: &one, Timestamp: time.Unix(100, 0)},
+				{ID: "PollCount", MType: "counter", Delta: &one},
+			},
+			want: batch{
+				counterKeys:   []batchKey{{id: "PollCount"}},
+				counterDeltas: []int64{2},
+				counterTimes:  map[batchKey]time.Time{},
+				gaugeKeys:     []batchKey{{id: "Alloc"}},
+				gaugeValues:   []float64{20.5},
+				gaugeTimes:    map[batchKey]time.Time{{id: "Alloc"}: time.Unix(200, 0)},
+			},
+		},
+		{
+			name: "batch with invalid metric is rejected",
+			metrics: []types.Metrics{
+				{ID: "Alloc", MType: "gauge", Value: &alloc},
+				{ID: "PollCount", MType: "counter"},
+			},
+			wantErr: myerrors.ErrTypeBadRequest,
+		},
+		{
+			name: "batch with unknown type is rejected",
+			metrics: []types.Metrics{
+				{ID: "Alloc", MType: "unknown", Value: &alloc},
+			},
+			wantErr: myerrors.ErrTypeNotImplemented,
+		},
+		{
+			name: "batch with wrong hash is rejected",
+			metrics: []types.Metrics{
+				{ID: "Alloc", MType: "gauge", Value: &alloc, Hash: hash.Hash("Alloc:gauge:10.500000", "key")},
+				{ID: "PollCount", MType: "counter", Delta: &one, Hash: "wrong"},
+			},
+			key:     "key",
+			wantErr: myerrors.ErrTypeBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newBatch(tt.metrics, tt.key)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, b)
+		})
+	}
+}
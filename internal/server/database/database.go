@@ -2,10 +2,14 @@
 package database
 
 import (
-	"crypto/hmac"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
@@ -14,8 +18,11 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/repeating"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
 )
 
@@ -24,67 +31,124 @@ type Database struct {
 	// sql.DB pointer
 	DB *sql.DB
 	// database request statement
-	InsertCounterToDatabaseStmt      *sql.Stmt
-	UpdateCounterToDatabaseStmt      *sql.Stmt
-	InsertUpdateGaugeToDatabaseStmt  *sql.Stmt
+	UpsertCountersToDatabaseStmt     *sql.Stmt
+	UpsertGaugesToDatabaseStmt       *sql.Stmt
 	SelectAllFromDatabaseStmt        *sql.Stmt
 	SelectOneGaugeFromDatabaseStmt   *sql.Stmt
 	SelectOneCounterFromDatabaseStmt *sql.Stmt
-	CountIDsInDatabaseStmt           *sql.Stmt
+	InsertHistoryToDatabaseStmt      *sql.Stmt
+	SelectHistoryFromDatabaseStmt    *sql.Stmt
+	// statements for histograms and summaries stored as JSON in data column
+	InsertHistogramToDatabaseStmt         *sql.Stmt
+	SelectHistogramForUpdateStmt          *sql.Stmt
+	UpdateHistogramToDatabaseStmt         *sql.Stmt
+	InsertUpdateSummaryToDatabaseStmt     *sql.Stmt
+	SelectOneDistributionFromDatabaseStmt *sql.Stmt
+	// HistoryRetention is a period samples of metrics are kept for, 0 disables history
+	HistoryRetention time.Duration
+	// HistoryResolution is a width of buckets old samples are downsampled to, 0 disables downsampling
+	HistoryResolution time.Duration
 }
 
 // NewDatabase creates new Database
-func NewDatabase(db *sql.DB) Database {
-	var insertCounterStmt, updateCounterStmt, countIDsStmt, insertGaugeStmt, selectAllStmt, selectOneGaugeStmt, selectOneCounterStmt *sql.Stmt = nil, nil, nil, nil, nil, nil, nil
+func NewDatabase(cfg config.Config) Database {
+	db := cfg.Database
+	var upsertCountersStmt, upsertGaugesStmt, selectAllStmt, selectOneGaugeStmt, selectOneCounterStmt *sql.Stmt = nil, nil, nil, nil, nil
+	var insertHistoryStmt, selectHistoryStmt *sql.Stmt = nil, nil
+	var insertHistogramStmt, selectHistogramStmt, updateHistogramStmt, insertSummaryStmt, selectOneDistributionStmt *sql.Stmt = nil, nil, nil, nil, nil
 	if db != nil {
 		var err error
-		countIDsStmt, err = db.Prepare("SELECT COUNT(*) FROM metrics WHERE id=$1;")
+		upsertCountersStmt, err = db.Prepare(`
+			INSERT INTO metrics (id, type, value, delta, labels)
+			SELECT id, 'counter', NULL, delta, labels FROM unnest($1::text[], $2::bigint[], $3::text[]) AS batch (id, delta, labels)
+			ON CONFLICT (id, type, labels) DO UPDATE SET
+				delta = metrics.delta + EXCLUDED.delta
+			RETURNING id, labels, delta;
+		`)
 		if err != nil {
-			loggers.ErrorLogger.Println("count metrics with id statement prepare error:", err)
+			loggers.ErrorLogger.Println("upsert counters statement prepare error:", err)
 		}
-		insertCounterStmt, err = db.Prepare(`
-			INSERT INTO metrics (id, type, value, delta) VALUES ($1, 'counter', NULL, $2)
+		upsertGaugesStmt, err = db.Prepare(`
+			INSERT INTO metrics (id, type, value, delta, labels)
+			SELECT id, 'gauge', value, NULL, labels FROM unnest($1::text[], $2::float8[], $3::text[]) AS batch (id, value, labels)
+			ON CONFLICT (id, type, labels) DO UPDATE SET
+				value = EXCLUDED.value,
+				delta = NULL;
 		`)
 		if err != nil {
-			loggers.ErrorLogger.Println("insert counter statement prepare error:", err)
+			loggers.ErrorLogger.Println("upsert gauges statement prepare error:", err)
 		}
-		updateCounterStmt, err = db.Prepare(`
-			UPDATE metrics SET delta=$2 WHERE id=$1;
+		insertHistogramStmt, err = db.Prepare(`
+			INSERT INTO metrics (id, type, value, delta, labels, data) VALUES ($1, 'histogram', NULL, NULL, $2, $3::jsonb)
+			ON CONFLICT (id, type, labels) DO NOTHING;
 		`)
 		if err != nil {
-			loggers.ErrorLogger.Println("update counter statement prepare error:", err)
+			loggers.ErrorLogger.Println("insert histogram statement prepare error:", err)
+		}
+		selectHistogramStmt, err = db.Prepare(`SELECT data FROM metrics WHERE id=$1 AND type='histogram' AND labels=$2 FOR UPDATE;`)
+		if err != nil {
+			loggers.ErrorLogger.Println("select histogram statement prepare error:", err)
 		}
-		insertGaugeStmt, err = db.Prepare(`
-			INSERT INTO metrics (id, type, value, delta) VALUES ($1, 'gauge', $2, NULL)
-			ON CONFLICT (id, type) DO UPDATE SET
-				value=$2,
-				delta=NULL;
+		updateHistogramStmt, err = db.Prepare(`UPDATE metrics SET data=$3::jsonb WHERE id=$1 AND type='histogram' AND labels=$2;`)
+		if err != nil {
+			loggers.ErrorLogger.Println("update histogram statement prepare error:", err)
+		}
+		insertSummaryStmt, err = db.Prepare(`
+			INSERT INTO metrics (id, type, value, delta, labels, data) VALUES ($1, 'summary', NULL, NULL, $2, $3::jsonb)
+			ON CONFLICT (id, type, labels) DO UPDATE SET
+				data=$3::jsonb;
 		`)
 		if err != nil {
-			loggers.ErrorLogger.Println("insert statement prepare error:", err)
+			loggers.ErrorLogger.Println("insert summary statement prepare error:", err)
+		}
+		selectOneDistributionStmt, err = db.Prepare(`SELECT data FROM metrics WHERE id=$1 AND type=$2 AND labels=$3;`)
+		if err != nil {
+			loggers.ErrorLogger.Println("select one distribution statement prepare error:", err)
 		}
-		selectAllStmt, err = db.Prepare(`SELECT id, type, value, delta FROM metrics;`)
+		selectAllStmt, err = db.Prepare(`SELECT id, type, value, delta, labels, data FROM metrics;`)
 		if err != nil {
 			loggers.ErrorLogger.Println("select all statement prepare error:", err)
 		}
-		selectOneGaugeStmt, err = db.Prepare(`SELECT value FROM metrics WHERE id=$1;`)
+		selectOneGaugeStmt, err = db.Prepare(`SELECT value FROM metrics WHERE id=$1 AND type='gauge' AND labels=$2;`)
 		if err != nil {
 			loggers.ErrorLogger.Println("select one gauge statement prepare error:", err)
 		}
-		selectOneCounterStmt, err = db.Prepare(`SELECT delta FROM metrics WHERE id=$1;`)
+		selectOneCounterStmt, err = db.Prepare(`SELECT delta FROM metrics WHERE id=$1 AND type='counter' AND labels=$2;`)
 		if err != nil {
 			loggers.ErrorLogger.Println("select one counter statement prepare error:", err)
 		}
+		if cfg.HistoryRetention > 0 {
+			insertHistoryStmt, err = db.Prepare(`
+				INSERT INTO metrics_history (id, type, labels, ts, value)
+				SELECT * FROM unnest($1::text[], $2::text[], $3::text[], $4::timestamptz[], $5::float8[]);
+			`)
+			if err != nil {
+				loggers.ErrorLogger.Println("insert history statement prepare error:", err)
+			}
+			selectHistoryStmt, err = db.Prepare(`
+				SELECT ts, value FROM metrics_history WHERE id=$1 AND type=$2 AND labels=$3 AND ts>=$4 AND ts<=$5 ORDER BY ts;
+			`)
+			if err != nil {
+				loggers.ErrorLogger.Println("select history statement prepare error:", err)
+			}
+		}
 	}
 	return Database{
-		DB:                               db,
-		InsertCounterToDatabaseStmt:      insertCounterStmt,
-		UpdateCounterToDatabaseStmt:      updateCounterStmt,
-		InsertUpdateGaugeToDatabaseStmt:  insertGaugeStmt,
-		SelectAllFromDatabaseStmt:        selectAllStmt,
-		SelectOneGaugeFromDatabaseStmt:   selectOneGaugeStmt,
-		SelectOneCounterFromDatabaseStmt: selectOneCounterStmt,
-		CountIDsInDatabaseStmt:           countIDsStmt,
+		DB:                                    db,
+		UpsertCountersToDatabaseStmt:          upsertCountersStmt,
+		UpsertGaugesToDatabaseStmt:            upsertGaugesStmt,
+		SelectAllFromDatabaseStmt:             selectAllStmt,
+		SelectOneGaugeFromDatabaseStmt:        selectOneGaugeStmt,
+		SelectOneCounterFromDatabaseStmt:      selectOneCounterStmt,
+		InsertHistoryToDatabaseStmt:           insertHistoryStmt,
+		SelectHistoryFromDatabaseStmt:         selectHistoryStmt,
+		InsertHistogramToDatabaseStmt:         insertHistogramStmt,
+		SelectHistogramForUpdateStmt:          selectHistogramStmt,
+		UpdateHistogramToDatabaseStmt:         updateHistogramStmt,
+		InsertUpdateSummaryToDatabaseStmt:     insertSummaryStmt,
+		SelectOneDistributionFromDatabaseStmt: selectOneDistributionStmt,
+		HistoryRetention:                      cfg.HistoryRetention,
+		HistoryResolution:                     cfg.HistoryResolution,
 	}
 }
 
@@ -109,22 +173,41 @@ func SetDatabase(db *sql.DB, dbAddress string) error {
 // GetAllMetrics gets info about all metrics from database
 func (db Database) GetAllMetrics() ([]types.Metrics, error) {
 	var metrics []types.Metrics
-	rows, err := db.DB.Query("SELECT id, type, value, delta FROM metrics")
+	rows, err := db.SelectAllFromDatabaseStmt.Query()
 	if err != nil {
 		return nil, fmt.Errorf("error while getting metric from database: %w", err)
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var (
-			m     types.Metrics
-			value sql.NullFloat64
-			delta sql.NullInt64
+			m          types.Metrics
+			value      sql.NullFloat64
+			delta      sql.NullInt64
+			labelsText string
+			data       []byte
 		)
 
-		rows.Scan(&m.ID, &m.MType, &value, delta)
-		if value.Valid {
+		if err = rows.Scan(&m.ID, &m.MType, &value, &delta, &labelsText, &data); err != nil {
+			return nil, fmt.Errorf("error while scanning metrics from database: %w", err)
+		}
+		if m.Labels, err = labels.Parse(labelsText); err != nil {
+			return nil, fmt.Errorf("error while parsing labels of metric %s: %w", m.ID, err)
+		}
+		switch m.MType {
+		case "gauge":
 			m.Value = &value.Float64
-		} else {
+		case "counter":
 			m.Delta = &delta.Int64
+		case "histogram":
+			m.Histogram = &types.Histogram{}
+			if err = json.Unmarshal(data, m.Histogram); err != nil {
+				return nil, fmt.Errorf("error while unmarshalling histogram %s: %w", m.ID, err)
+			}
+		case "summary":
+			m.Summary = &types.Summary{}
+			if err = json.Unmarshal(data, m.Summary); err != nil {
+				return nil, fmt.Errorf("error while unmarshalling summary %s: %w", m.ID, err)
+			}
 		}
 		metrics = append(metrics, m)
 	}
@@ -139,27 +222,53 @@ func (db Database) GetMetric(m types.Metrics, key string) (types.Metrics, error)
 	switch m.MType {
 	case "gauge":
 		var value float64
-		err := db.SelectOneGaugeFromDatabaseStmt.QueryRow(m.ID).Scan(&value)
+		err := db.SelectOneGaugeFromDatabaseStmt.QueryRow(m.ID, labels.String(m.Labels)).Scan(&value)
+		if errors.Is(err, sql.ErrNoRows) {
+			return m, myerrors.ErrTypeNotFound
+		}
 		if err != nil {
 			loggers.ErrorLogger.Println("db query error:", err)
 			return m, err
 		}
 		m.Value = &value
 		if key != "" {
-			metricHash := hash.Hash(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value), key)
+			metricHash := hash.Hash(hash.WithLabels(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value), m.Labels), key)
 			m.Hash = string(metricHash)
 		}
 	case "counter":
 		var delta int64
-		err := db.SelectOneCounterFromDatabaseStmt.QueryRow(m.ID).Scan(&delta)
+		err := db.SelectOneCounterFromDatabaseStmt.QueryRow(m.ID, labels.String(m.Labels)).Scan(&delta)
 		if err != nil {
 			return m, myerrors.ErrTypeNotFound
 		}
 		m.Delta = &delta
 		if key != "" {
-			metricHash := hash.Hash(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), key)
+			metricHash := hash.Hash(hash.WithLabels(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), m.Labels), key)
 			m.Hash = string(metricHash)
 		}
+	case "histogram", "summary":
+		var data []byte
+		err := db.SelectOneDistributionFromDatabaseStmt.QueryRow(m.ID, m.MType, labels.String(m.Labels)).Scan(&data)
+		if errors.Is(err, sql.ErrNoRows) {
+			return m, myerrors.ErrTypeNotFound
+		}
+		if err != nil {
+			loggers.ErrorLogger.Println("db query error:", err)
+			return m, err
+		}
+		if m.MType == "histogram" {
+			m.Histogram = &types.Histogram{}
+			err = json.Unmarshal(data, m.Histogram)
+		} else {
+			m.Summary = &types.Summary{}
+			err = json.Unmarshal(data, m.Summary)
+		}
+		if err != nil {
+			return m, fmt.Errorf("error while unmarshalling %s %s: %w", m.MType, m.ID, err)
+		}
+		if key != "" {
+			m.Hash = hash.Hash(hash.WithLabels(m.HashSource(), m.Labels), key)
+		}
 	default:
 		return m, myerrors.ErrTypeNotFound
 	}
@@ -168,54 +277,121 @@ func (db Database) GetMetric(m types.Metrics, key string) (types.Metrics, error)
 
 // SaveMetric saves info about one metric into database
 func (db Database) SaveMetric(m types.Metrics, key string) error {
-	switch m.MType {
-	case "gauge":
-		if m.Value == nil {
-			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeBadRequest)
-		}
-		if key != "" && m.Hash != "" {
-			if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value), key))) {
-				return fmt.Errorf("%wwrong hash in request", myerrors.ErrTypeBadRequest)
-			}
-		}
-		_, err := db.InsertUpdateGaugeToDatabaseStmt.Exec(m.ID, *m.Value)
-		if err != nil {
-			return err
-		}
-	case "counter":
-		if m.Delta == nil {
-			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeBadRequest)
-		}
-		if key != "" && m.Hash != "" {
-			if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), key))) {
-				return fmt.Errorf("%wwrong hash in request", myerrors.ErrTypeBadRequest)
-			}
-		}
-		var numberOfMetrics int
-		err := db.CountIDsInDatabaseStmt.QueryRow(m.ID).Scan(&numberOfMetrics)
-		if err != nil {
-			return err
-		}
-		if numberOfMetrics != 0 {
-			var delta int64
-			err = db.SelectOneCounterFromDatabaseStmt.QueryRow(m.ID).Scan(&delta)
-			if err != nil {
-				return err
-			}
-			_, err = db.UpdateCounterToDatabaseStmt.Exec(m.ID, delta+*m.Delta)
-			if err != nil {
-				return err
-			}
-		} else {
-			_, err = db.InsertCounterToDatabaseStmt.Exec(m.ID, *m.Delta)
-			if err != nil {
-				return err
-			}
+	return db.SaveManyMetrics([]types.Metrics{m}, key)
+}
+
+// mergeHistogram adds observations to stored histogram and returns the merged histogram.
+// Row is created beforehand so that concurrent writers of a new histogram are serialized by the row lock
+func (db Database) mergeHistogram(tx *sql.Tx, id, labelsText string, h types.Histogram) (types.Histogram, error) {
+	var merged types.Histogram
+	empty, err := json.Marshal(merged)
+	if err != nil {
+		return merged, fmt.Errorf("error while marshalling histogram: %w", err)
+	}
+	if _, err = tx.Stmt(db.InsertHistogramToDatabaseStmt).Exec(id, labelsText, string(empty)); err != nil {
+		return merged, fmt.Errorf("error while saving histogram: %w", err)
+	}
+	var data []byte
+	if err = tx.Stmt(db.SelectHistogramForUpdateStmt).QueryRow(id, labelsText).Scan(&data); err != nil {
+		return merged, fmt.Errorf("error while getting histogram: %w", err)
+	}
+	if err = json.Unmarshal(data, &merged); err != nil {
+		return merged, fmt.Errorf("error while unmarshalling histogram %s: %w", id, err)
+	}
+	if err = merged.Merge(h); err != nil {
+		return merged, fmt.Errorf("error while merging histogram %s: %w", id, err)
+	}
+	if data, err = json.Marshal(merged); err != nil {
+		return merged, fmt.Errorf("error while marshalling histogram: %w", err)
+	}
+	if _, err = tx.Stmt(db.UpdateHistogramToDatabaseStmt).Exec(id, labelsText, string(data)); err != nil {
+		return merged, fmt.Errorf("error while saving histogram: %w", err)
+	}
+	return merged, nil
+}
+
+// GetMetricHistory gets samples of one metric in [from, to] from database
+func (db Database) GetMetricHistory(m types.Metrics, from, to time.Time) ([]types.Sample, error) {
+	if db.HistoryRetention <= 0 {
+		return nil, fmt.Errorf("%wmetrics history is disabled", myerrors.ErrTypeNotImplemented)
+	}
+	if m.MType != "gauge" && m.MType != "counter" && m.MType != "histogram" && m.MType != "summary" {
+		return nil, fmt.Errorf("%wno such type of metric", myerrors.ErrTypeNotImplemented)
+	}
+	if border := time.Now().Add(-db.HistoryRetention); from.Before(border) {
+		from = border
+	}
+	rows, err := db.SelectHistoryFromDatabaseStmt.Query(m.ID, m.MType, labels.String(m.Labels), from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error while getting metric history from database: %w", err)
+	}
+	defer rows.Close()
+	var samples []types.Sample
+	for rows.Next() {
+		var sample types.Sample
+		if err = rows.Scan(&sample.Timestamp, &sample.Value); err != nil {
+			return nil, fmt.Errorf("error while scanning metric history from database: %w", err)
 		}
-	default:
-		return fmt.Errorf("%wno such type of metric", myerrors.ErrTypeNotImplemented)
+		samples = append(samples, sample)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while scanning metric history from database: %w", err)
+	}
+	return samples, nil
+}
+
+// CompactHistory deletes expired samples and downsamples old ones in history table. Late samples are merged
+// into buckets downsampled before with numbers of their samples as weights
+func (db Database) CompactHistory() {
+	now := time.Now()
+	_, err := db.DB.Exec(`DELETE FROM metrics_history WHERE ts < $1;`, now.Add(-db.HistoryRetention))
+	if err != nil {
+		loggers.ErrorLogger.Println("error while deleting expired metric samples:", err)
+		return
+	}
+	if db.HistoryResolution <= 0 {
+		return
+	}
+	_, err = db.DB.Exec(`
+		WITH raw AS (
+			DELETE FROM metrics_history WHERE NOT downsampled AND ts < $1 RETURNING id, type, labels, ts, value
+		)
+		INSERT INTO metrics_history AS h (id, type, labels, ts, value, downsampled, samples, last_ts)
+		SELECT id, type, labels, to_timestamp(floor(extract(epoch FROM ts) / $2::float8) * $2::float8),
+			CASE WHEN type = 'gauge' THEN avg(value) ELSE (array_agg(value ORDER BY ts DESC))[1] END, TRUE, count(*), max(ts)
+		FROM raw
+		GROUP BY id, type, labels, floor(extract(epoch FROM ts) / $2::float8)
+		ON CONFLICT (id, type, labels, ts) WHERE downsampled DO UPDATE SET
+			value = CASE
+				WHEN h.type = 'gauge' THEN (h.value * h.samples + EXCLUDED.value * EXCLUDED.samples) / (h.samples + EXCLUDED.samples)
+				WHEN h.last_ts IS NULL OR EXCLUDED.last_ts >= h.last_ts THEN EXCLUDED.value
+				ELSE h.value
+			END,
+			samples = h.samples + EXCLUDED.samples,
+			last_ts = GREATEST(h.last_ts, EXCLUDED.last_ts);
+	`, now.Truncate(db.HistoryResolution), db.HistoryResolution.Seconds())
+	if err != nil {
+		loggers.ErrorLogger.Println("error while downsampling metric samples:", err)
 	}
-	return nil
+}
+
+// SetHistoryCompaction starts periodical compaction of history table if history is enabled
+func (db Database) SetHistoryCompaction() {
+	if db.HistoryRetention <= 0 {
+		return
+	}
+	compactInterval := db.HistoryResolution
+	if compactInterval <= 0 {
+		compactInterval = db.HistoryRetention
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	go repeating.Repeat(sigs, db.CompactHistory, compactInterval)
+}
+
+// Close closes database, every saved batch is already committed
+func (db Database) Close() error {
+	return db.DB.Close()
 }
 
 // Check checks if database works OK
@@ -223,13 +399,13 @@ func (db Database) Check() error {
 	return db.DB.Ping()
 }
 
-// SaveManyMetrics saves several metrics into database
+// SaveManyMetrics saves several metrics into database in one transaction, nothing is saved if any metric is invalid
 func (db Database) SaveManyMetrics(metrics []types.Metrics, key string) error {
-	for _, m := range metrics {
-		err := db.SaveMetric(m, key)
-		if err != nil {
-			return err
-		}
+	b, err := newBatch(metrics, key)
+	if err != nil {
+		return err
 	}
-	return nil
+	return db.withTx(func(tx *sql.Tx) error {
+		return db.saveBatch(tx, b)
+	})
 }
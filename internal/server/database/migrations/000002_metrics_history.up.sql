@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS metrics_history (
+    id VARCHAR(128) NOT NULL,
+	type VARCHAR(32) NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	value DOUBLE PRECISION NOT NULL,
+	downsampled BOOLEAN NOT NULL DEFAULT FALSE
+	);
+CREATE INDEX IF NOT EXISTS idx_metrics_history_id_type_ts ON metrics_history (id, type, ts);
\ No newline at end of file
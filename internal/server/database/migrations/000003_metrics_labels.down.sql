@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_metrics_history_id_type_labels_ts;
+CREATE INDEX IF NOT EXISTS idx_metrics_history_id_type_ts ON metrics_history (id, type, ts);
+ALTER TABLE metrics_history DROP COLUMN IF EXISTS labels;
+DROP INDEX IF EXISTS idx_metrics_id_type_labels;
+DELETE FROM metrics WHERE labels <> '';
+ALTER TABLE metrics DROP COLUMN IF EXISTS labels;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_id_type ON metrics (id, type);
\ No newline at end of file
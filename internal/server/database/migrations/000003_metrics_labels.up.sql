@@ -0,0 +1,7 @@
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+DROP INDEX IF EXISTS idx_metrics_id_type;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_id_type_labels ON metrics (id, type, labels);
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS idx_metrics_history_id_type_ts;
+CREATE INDEX IF NOT EXISTS idx_metrics_history_id_type_labels_ts ON metrics_history (id, type, labels, ts);
\ No newline at end of file
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS agent_tokens (
+    token_hash TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    revoked BOOLEAN NOT NULL DEFAULT false
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_metrics_history_downsampled;
+ALTER TABLE metrics_history DROP COLUMN IF EXISTS last_ts;
+ALTER TABLE metrics_history DROP COLUMN IF EXISTS samples;
@@ -0,0 +1,5 @@
+DELETE FROM metrics_history a USING metrics_history b
+    WHERE a.downsampled AND b.downsampled AND a.id = b.id AND a.type = b.type AND a.labels = b.labels AND a.ts = b.ts AND a.ctid < b.ctid;
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS samples INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS last_ts TIMESTAMPTZ;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_history_downsampled ON metrics_history (id, type, labels, ts) WHERE downsampled;
@@ -3,225 +3,313 @@ package filestorage
 
 import (
 	"bufio"
-	"crypto/hmac"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
-	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/repeating"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	memstorage "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/memStorage"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
 )
 
-// MemStorage stores metric info
-type MemStorage struct {
-	CounterMetrics map[string]int64
-	GaugeMetrics   map[string]float64
-}
-
-// NewMemStorage creates new MemStorage
-func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		CounterMetrics: make(map[string]int64),
-		GaugeMetrics:   make(map[string]float64),
-	}
-}
-
-// FileStorage gets metric info from file and save metric info into file
+// FileStorage gets metric info from file and save metric info into file.
+// Metrics are kept in embedded MemStorage, every accepted update is appended to write-ahead log
+// and all metrics are periodically stored to snapshot file
 type FileStorage struct {
-	// StoreInterval is an interval in witch data is stored to file
+	*memstorage.MemStorage
+	// StoreInterval is an interval in witch data is stored to file,
+	// 0 means every update is synced to disk before it is acknowledged
 	StoreInterval time.Duration
 	StoreFile     string
 	Restore       bool
-	storage       *MemStorage
+	// WALFsync is a policy of syncing write-ahead log to disk
+	WALFsync string
+	wal      *wal
+	// snapshotMu serializes snapshots, otherwise older snapshot may replace newer one
+	// after segments it depends on are removed
+	snapshotMu sync.Mutex
+}
+
+// snapshotHeader is the first line of snapshot file
+type snapshotHeader struct {
+	// WALSegment is the first WAL segment with updates not included into snapshot
+	WALSegment *int `json:"wal_segment"`
 }
 
 // NewFileStorage creates new FileStorage
-func NewFileStorage(cfg config.Config) FileStorage {
-	return FileStorage{
+func NewFileStorage(cfg config.Config) *FileStorage {
+	return &FileStorage{
+		MemStorage:    memstorage.NewMemStorage(cfg),
 		StoreInterval: cfg.StoreInterval,
 		StoreFile:     cfg.StoreFile,
 		Restore:       cfg.Restore,
-		storage:       NewMemStorage(),
+		WALFsync:      cfg.WALFsync,
 	}
 }
 
-// storeMetricsToFile stores data from MemStorage to file
-func (fs FileStorage) storeMetricsToFile() {
-	file, err := os.OpenFile(fs.StoreFile, os.O_WRONLY|os.O_CREATE, 0777)
-	writer := bufio.NewWriter(file)
-	if err != nil {
-		loggers.ErrorLogger.Printf("Failed to open file: %s", fs.StoreFile)
-	}
-	defer file.Close()
-	for name, value := range fs.storage.CounterMetrics {
-		gauge := types.Metrics{
-			ID:    name,
-			Delta: &value,
-			MType: "counter",
-		}
-		var jsonMetric []byte
-		jsonMetric, err = json.Marshal(gauge)
-		if err != nil {
-			loggers.ErrorLogger.Printf("error while marshalling json to file: %v", err)
-		}
-		_, err = writer.Write(jsonMetric)
-		if err != nil {
-			loggers.ErrorLogger.Printf("error while writing to file: %v", err)
-		}
-		_, err = writer.Write([]byte("\n"))
-		if err != nil {
-			loggers.ErrorLogger.Printf("error while writing counter to file: %v", err)
+// walBase returns path WAL segment numbers are appended to
+func (fs *FileStorage) walBase() string {
+	return fs.StoreFile + ".wal"
+}
+
+// SaveMetric saves info about one metric into FileStorage
+func (fs *FileStorage) SaveMetric(m types.Metrics, key string) error {
+	return fs.SaveManyMetrics([]types.Metrics{m}, key)
+}
+
+// SaveManyMetrics writes metrics to write-ahead log and saves them into FileStorage,
+// nothing is saved or logged if any metric is invalid
+func (fs *FileStorage) SaveManyMetrics(metrics []types.Metrics, key string) error {
+	for _, m := range metrics {
+		if err := memstorage.ValidateMetric(m, key); err != nil {
+			return err
 		}
 	}
-	for name, value := range fs.storage.GaugeMetrics {
-		gauge := types.Metrics{
-			ID:    name,
-			Value: &value,
-			MType: "gauge",
-		}
-		var jsonMetric []byte
-		jsonMetric, err = json.Marshal(gauge)
-		if err != nil {
-			loggers.ErrorLogger.Printf("error while marshalling json to file: %v", err)
-		}
-		_, err = writer.Write(jsonMetric)
-		if err != nil {
-			loggers.ErrorLogger.Printf("error while writing gauge to file: %v", err)
-		}
-		_, err = writer.Write([]byte("\n"))
-		if err != nil {
-			loggers.ErrorLogger.Printf("error while writing gauge to file: %v", err)
+	if fs.wal == nil {
+		return fs.MemStorage.SaveManyMetrics(metrics, "")
+	}
+	return fs.wal.append(metrics, func() error {
+		return fs.MemStorage.CheckMetrics(metrics, "")
+	}, func() error {
+		return fs.MemStorage.SaveManyMetrics(metrics, "")
+	})
+}
+
+// storeMetricsToFile stores data from MemStorage to file
+func (fs *FileStorage) storeMetricsToFile() {
+	if err := fs.snapshot(); err != nil {
+		loggers.ErrorLogger.Println("error while storing metrics to file:", err)
+		return
+	}
+	loggers.InfoLogger.Println("stored to file")
+}
+
+// snapshot atomically replaces store file with all metrics and removes WAL segments included into it.
+// WAL is rotated while updates are blocked, so every update is either in snapshot or in a newer segment
+func (fs *FileStorage) snapshot() error {
+	fs.snapshotMu.Lock()
+	defer fs.snapshotMu.Unlock()
+	var (
+		metrics []types.Metrics
+		segment int
+		err     error
+	)
+	if fs.wal != nil {
+		fs.wal.mu.Lock()
+		metrics, err = fs.GetAllMetrics()
+		if err == nil {
+			err = fs.wal.rotate()
+			segment = fs.wal.segment
 		}
+		fs.wal.mu.Unlock()
+	} else {
+		metrics, err = fs.GetAllMetrics()
 	}
-	err = writer.Flush()
 	if err != nil {
-		loggers.ErrorLogger.Printf("writer.Flush() error: %v", err)
+		return err
 	}
-	loggers.InfoLogger.Println("stored to file")
+	if err = writeSnapshot(fs.StoreFile, segment, metrics); err != nil {
+		return err
+	}
+	if fs.wal == nil {
+		return nil
+	}
+	return removeSegmentsBefore(fs.walBase(), segment)
 }
 
-// RestoreMetrics restores metric from file to MemStorage
-func (fs FileStorage) RestoreMetrics() error {
-	file, err := os.OpenFile(fs.StoreFile, os.O_RDONLY|os.O_CREATE, 0777)
-	scanner := bufio.NewScanner(file)
+// writeSnapshot writes metrics to temporary file and renames it to path
+func writeSnapshot(path string, segment int, metrics []types.Metrics) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
 	if err != nil {
-		loggers.ErrorLogger.Printf("Failed to open file: %s, %v", fs.StoreFile, err)
-		return fmt.Errorf("error while opening file: %w", err)
+		return fmt.Errorf("error while creating temporary file: %w", err)
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
-	for scanner.Scan() {
-		m := types.Metrics{}
-		err = json.Unmarshal(scanner.Bytes(), &m)
-		if err != nil {
-			loggers.ErrorLogger.Printf("json Unmarshal error: %v", err)
-			return fmt.Errorf("error while unmarshalling json: %w", err)
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	if err = encoder.Encode(snapshotHeader{WALSegment: &segment}); err != nil {
+		return fmt.Errorf("error while writing snapshot header: %w", err)
+	}
+	for _, m := range metrics {
+		if err = encoder.Encode(m); err != nil {
+			return fmt.Errorf("error while writing %s to file: %w", m.MType, err)
 		}
-		fs.SaveMetric(m, "")
 	}
-	loggers.InfoLogger.Printf("Restored Metrics from '%s'", fs.StoreFile)
-	return nil
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("writer.Flush() error: %w", err)
+	}
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("error while syncing file: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("error while closing file: %w", err)
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("error while renaming file: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
 }
 
-// SaveMetric saves info about one metric into MemStorage
-func (fs FileStorage) SaveMetric(m types.Metrics, key string) error {
-	switch m.MType {
-	case "gauge":
-		if m.Value == nil {
-			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeNotImplemented)
+// readSnapshot calls fn for every metric of snapshot file and returns the first WAL segment to replay.
+// If fn is nil only header is read. Missing file is an empty snapshot
+func readSnapshot(path string, fn func(m types.Metrics)) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error while opening file: %w", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	segment := 0
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return segment, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return segment, fmt.Errorf("error while reading file: %w", err)
 		}
-		if key != "" && m.Hash != "" {
-			if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value), key))) {
-				return fmt.Errorf("%wwrong hash in request", myerrors.ErrTypeBadRequest)
+		if n == 1 {
+			var header snapshotHeader
+			if json.Unmarshal(line, &header) == nil && header.WALSegment != nil {
+				segment = *header.WALSegment
+				if fn == nil {
+					return segment, nil
+				}
+				continue
 			}
 		}
-		fs.storage.GaugeMetrics[m.ID] = *m.Value
-	case "counter":
-		if m.Delta == nil {
-			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeNotImplemented)
+		if fn == nil {
+			return segment, nil
 		}
-		if key != "" && m.Hash != "" {
-			if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), key))) {
-				return fmt.Errorf("%wwrong hash in request", myerrors.ErrTypeBadRequest)
-			}
+		var m types.Metrics
+		if err = json.Unmarshal(line, &m); err != nil {
+			return segment, fmt.Errorf("error while unmarshalling json: %w", err)
 		}
-		fs.storage.CounterMetrics[m.ID] += *m.Delta
-	default:
-		return fmt.Errorf("%wno such type of metric", myerrors.ErrTypeNotImplemented)
+		fn(m)
 	}
-	return nil
 }
 
-// GetAllMetrics gets info about all metrics from MemStorage
-func (fs FileStorage) GetAllMetrics() ([]types.Metrics, error) {
-	var metrics []types.Metrics
-	for name, value := range fs.storage.CounterMetrics {
-		m := types.Metrics{ID: name, MType: "counter", Delta: &value}
-		metrics = append(metrics, m)
-	}
-	for name, value := range fs.storage.GaugeMetrics {
-		m := types.Metrics{ID: name, MType: "gauge", Value: &value}
-		metrics = append(metrics, m)
+// restore saves metric into MemStorage without writing it to write-ahead log
+func (fs *FileStorage) restore(m types.Metrics) {
+	if err := fs.MemStorage.SaveMetric(m, ""); err != nil {
+		loggers.ErrorLogger.Printf("error while restoring metric %s: %v", m.ID, err)
 	}
-	return metrics, nil
 }
 
-// SetFileStorage file storage preferences
-func (fs FileStorage) SetFileStorage() {
-	if strings.LastIndex(fs.StoreFile, "/") != -1 {
-		if err := os.MkdirAll(fs.StoreFile[:strings.LastIndex(fs.StoreFile, "/")], 0777); err != nil {
-			loggers.ErrorLogger.Println("failed to create directory:", err)
-		}
+// RestoreMetrics restores metrics from snapshot file and replays write-ahead log to MemStorage
+func (fs *FileStorage) RestoreMetrics() error {
+	segment, err := readSnapshot(fs.StoreFile, fs.restore)
+	if err != nil {
+		return fmt.Errorf("error while reading %s: %w", fs.StoreFile, err)
 	}
-	if fs.Restore {
-		err := fs.RestoreMetrics()
-		if err != nil {
-			loggers.ErrorLogger.Println("error while restoring from file:", err)
+	segments, err := listSegments(fs.walBase())
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s < segment {
+			continue
+		}
+		if err = replaySegment(segmentPath(fs.walBase(), s), fs.restore); err != nil {
+			return err
 		}
 	}
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	go repeating.Repeat(sigs, fs.storeMetricsToFile, fs.StoreInterval)
+	loggers.InfoLogger.Printf("Restored Metrics from '%s'", fs.StoreFile)
+	return nil
 }
 
-// GetMetric gets info about one metric from MemStorage
-func (fs FileStorage) GetMetric(m types.Metrics, key string) (types.Metrics, error) {
-	switch m.MType {
-	case "counter":
-		delta, ok := fs.storage.CounterMetrics[m.ID]
-		if !ok {
-			return m, myerrors.ErrTypeNotFound
-		}
-		m.Delta = &delta
-	case "gauge":
-		value, ok := fs.storage.GaugeMetrics[m.ID]
-		if !ok {
-			return m, myerrors.ErrTypeNotFound
-		}
-		m.Value = &value
+// nextSegment returns number of WAL segment new updates are appended to
+func (fs *FileStorage) nextSegment() (int, error) {
+	segment, err := readSnapshot(fs.StoreFile, nil)
+	if err != nil {
+		return 0, err
+	}
+	segments, err := listSegments(fs.walBase())
+	if err != nil {
+		return 0, err
 	}
-	return m, nil
+	if len(segments) > 0 && segments[len(segments)-1] >= segment {
+		segment = segments[len(segments)-1] + 1
+	}
+	return segment, nil
 }
 
-// Check checks if file storage works OK
-func (fs FileStorage) Check() error {
-	return nil
+// Close stores all metrics to file and closes write-ahead log, updates are refused after Close
+func (fs *FileStorage) Close() error {
+	if err := fs.snapshot(); err != nil {
+		return fmt.Errorf("error while storing metrics to file: %w", err)
+	}
+	if fs.wal == nil {
+		return nil
+	}
+	return fs.wal.Close()
 }
 
-// SaveManyMetrics saves several metrics into MemStorage
-func (fs FileStorage) SaveManyMetrics(metrics []types.Metrics, key string) error {
-	for _, m := range metrics {
-		err := fs.SaveMetric(m, key)
-		if err != nil {
-			return err
+// snapshotFullSegments takes a snapshot every time WAL segment gets too large
+func (fs *FileStorage) snapshotFullSegments() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	for {
+		select {
+		case <-sigs:
+			return
+		case <-fs.wal.full:
+			fs.storeMetricsToFile()
 		}
 	}
+}
+
+// SetFileStorage file storage preferences. Storage must not be used if metrics can't be restored:
+// startup snapshot would remove WAL segments which were not replayed
+func (fs *FileStorage) SetFileStorage() error {
+	if strings.LastIndex(fs.StoreFile, "/") != -1 {
+		if err := os.MkdirAll(fs.StoreFile[:strings.LastIndex(fs.StoreFile, "/")], 0777); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	if fs.Restore {
+		if err := fs.RestoreMetrics(); err != nil {
+			return fmt.Errorf("error while restoring from file: %w", err)
+		}
+	}
+	segment, err := fs.nextSegment()
+	if err != nil {
+		return fmt.Errorf("error while looking for wal segments: %w", err)
+	}
+	fsync := fs.WALFsync
+	if fs.StoreInterval <= 0 {
+		fsync = FsyncAlways
+	}
+	fs.wal = newWAL(fs.walBase(), segment, fsync)
+	// snapshot of restored metrics makes replayed segments unnecessary and opens the first segment,
+	// storage can't accept updates if it fails
+	if err = fs.snapshot(); err != nil {
+		return fmt.Errorf("error while storing metrics to file: %w", err)
+	}
+	if fs.StoreInterval > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+		go repeating.Repeat(sigs, fs.storeMetricsToFile, fs.StoreInterval)
+	}
+	go fs.snapshotFullSegments()
+	if fs.wal.fsync == FsyncEverySec {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+		go repeating.Repeat(sigs, fs.wal.Sync, time.Second)
+	}
+	fs.SetHistoryCompaction()
 	return nil
 }
@@ -0,0 +1,236 @@
+package filestorage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// newTestStorage creates FileStorage working in dir as if server was started
+func newTestStorage(t *testing.T, dir string) *FileStorage {
+	fs := NewFileStorage(config.Config{
+		StoreFile: filepath.Join(dir, "metrics.json"),
+		Restore:   true,
+		WALFsync:  FsyncNever,
+	})
+	require.NoError(t, fs.SetFileStorage())
+	t.Cleanup(func() { fs.wal.Close() })
+	return fs
+}
+
+// getCounter gets value of counter from storage
+func getCounter(t *testing.T, fs *FileStorage, id string) int64 {
+	m, err := fs.GetMetric(types.Metrics{ID: id, MType: "counter"}, "")
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+// TestReplayAfterCrash tests that updates accepted after the last snapshot survive a crash
+func TestReplayAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	var delta int64 = 2
+	value := 1.5
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	fs.storeMetricsToFile()
+	require.NoError(t, fs.SaveManyMetrics([]types.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+	}, ""))
+	// server crashes without storing metrics to file
+	require.NoError(t, fs.wal.Close())
+
+	restored := newTestStorage(t, dir)
+	assert.Equal(t, int64(4), getCounter(t, restored, "PollCount"))
+	m, err := restored.GetMetric(types.Metrics{ID: "Alloc", MType: "gauge"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+
+	// restore makes a snapshot so replayed updates are not applied twice
+	restored.wal.Close()
+	again := newTestStorage(t, dir)
+	assert.Equal(t, int64(4), getCounter(t, again, "PollCount"))
+	segments, err := listSegments(again.walBase())
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+// TestRejectedBatchIsNotReplayed tests that batch rejected by storage is not written to write-ahead log
+func TestRejectedBatchIsNotReplayed(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	var delta int64 = 2
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "latency", MType: "histogram", Histogram: &types.Histogram{
+		Buckets: []types.Bucket{{UpperBound: 10, Count: 1}},
+		Count:   1,
+	}}, ""))
+	err := fs.SaveManyMetrics([]types.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "latency", MType: "histogram", Histogram: &types.Histogram{
+			Buckets: []types.Bucket{{UpperBound: 100, Count: 1}},
+			Count:   1,
+		}},
+	}, "")
+	require.Error(t, err, "histogram bounds differ from stored ones")
+	// server crashes without storing metrics to file
+	require.NoError(t, fs.wal.Close())
+
+	restored := newTestStorage(t, dir)
+	_, err = restored.GetMetric(types.Metrics{ID: "PollCount", MType: "counter"}, "")
+	assert.Error(t, err, "counter of rejected batch is not restored")
+}
+
+// TestSyncModeConcurrentWriters tests that with zero store interval every acknowledged update is on disk
+func TestSyncModeConcurrentWriters(t *testing.T) {
+	const (
+		writers = 20
+		updates = 50
+	)
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	assert.Equal(t, FsyncAlways, fs.wal.fsync)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var delta int64 = 1
+			for j := 0; j < updates; j++ {
+				assert.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+			}
+		}()
+	}
+	wg.Wait()
+	fs.wal.mu.Lock()
+	assert.Equal(t, fs.wal.written, fs.wal.durable)
+	fs.wal.mu.Unlock()
+	require.NoError(t, fs.wal.Close())
+
+	restored := newTestStorage(t, dir)
+	assert.Equal(t, int64(writers*updates), getCounter(t, restored, "PollCount"))
+}
+
+// TestReplayStopsAtTornRecord tests that partially written record at the end of WAL is skipped
+func TestReplayStopsAtTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	var delta int64 = 1
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	require.NoError(t, fs.wal.Close())
+	file, err := os.OpenFile(segmentPath(fs.walBase(), fs.wal.segment), os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"id":"PollCount","type":"counter","del`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	restored := newTestStorage(t, dir)
+	assert.Equal(t, int64(1), getCounter(t, restored, "PollCount"))
+}
+
+// TestFailedWriteIsDiscarded tests that record torn by failed write is removed before the next record
+func TestFailedWriteIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	var delta int64 = 1
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	fs.wal.mu.Lock()
+	// write fails after part of record is written
+	_, err := fs.wal.file.WriteString(`{"id":"PollCount","type":"counter","del`)
+	require.NoError(t, err)
+	fs.wal.discardTorn()
+	fs.wal.mu.Unlock()
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	require.NoError(t, fs.wal.Close())
+
+	restored := newTestStorage(t, dir)
+	assert.Equal(t, int64(2), getCounter(t, restored, "PollCount"))
+}
+
+// TestCorruptedRecordFailsRestore tests that storage is not set up if WAL can't be replayed and WAL is kept
+func TestCorruptedRecordFailsRestore(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	var delta int64 = 1
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	require.NoError(t, fs.wal.Close())
+	path := segmentPath(fs.walBase(), fs.wal.segment)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString("{garbage}\n" + `{"id":"PollCount","type":"counter","delta":1}` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	restored := NewFileStorage(config.Config{StoreFile: fs.StoreFile, Restore: true, WALFsync: FsyncNever})
+	assert.Error(t, restored.SetFileStorage())
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+// TestSnapshotIsAtomic tests that snapshot replaces store file and leaves no temporary files
+func TestSnapshotIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	require.NoError(t, os.WriteFile(fs.StoreFile, []byte("garbage left by old version of server, much longer than snapshot\n"), 0666))
+	var delta int64 = 7
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	require.NoError(t, fs.snapshot())
+
+	var metrics []types.Metrics
+	segment, err := readSnapshot(fs.StoreFile, func(m types.Metrics) { metrics = append(metrics, m) })
+	require.NoError(t, err)
+	assert.Equal(t, fs.wal.segment, segment)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(7), *metrics[0].Delta)
+	tmp, err := filepath.Glob(filepath.Join(dir, "*.tmp*"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+}
+
+// TestRestoreFromSnapshotWithoutHeader tests that store file written by older server is restored
+func TestRestoreFromSnapshotWithoutHeader(t *testing.T) {
+	dir := t.TempDir()
+	storeFile := filepath.Join(dir, "metrics.json")
+	require.NoError(t, os.WriteFile(storeFile, []byte(`{"id":"PollCount","type":"counter","delta":3}`+"\n"), 0666))
+	fs := newTestStorage(t, dir)
+	assert.Equal(t, int64(3), getCounter(t, fs, "PollCount"))
+}
+
+// BenchmarkSyncSave measures throughput of concurrent writers when every update is synced to disk
+func BenchmarkSyncSave(b *testing.B) {
+	fs := NewFileStorage(config.Config{StoreFile: filepath.Join(b.TempDir(), "metrics.json")})
+	require.NoError(b, fs.SetFileStorage())
+	defer fs.wal.Close()
+	b.RunParallel(func(pb *testing.PB) {
+		var delta int64 = 1
+		m := types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}
+		for pb.Next() {
+			fs.SaveMetric(m, "")
+		}
+	})
+}
+
+// TestCloseStoresMetrics tests that Close stores all metrics to file and refuses later updates
+func TestCloseStoresMetrics(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestStorage(t, dir)
+	var delta int64 = 3
+	require.NoError(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	require.NoError(t, fs.Close())
+	assert.Error(t, fs.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+
+	var metrics []types.Metrics
+	_, err := readSnapshot(fs.StoreFile, func(m types.Metrics) { metrics = append(metrics, m) })
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(3), *metrics[0].Delta)
+}
@@ -0,0 +1,304 @@
+package filestorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// policies of syncing write-ahead log to disk
+const (
+	// FsyncAlways syncs log after every accepted update
+	FsyncAlways = "always"
+	// FsyncEverySec syncs log once a second, up to a second of updates may be lost on power failure
+	FsyncEverySec = "everysec"
+	// FsyncNever leaves syncing log to operating system
+	FsyncNever = "never"
+)
+
+// maxSegmentSize is a size of WAL segment after which a snapshot is taken
+const maxSegmentSize = 64 << 20
+
+// wal is an append-only log of accepted updates split into numbered segments.
+// Every snapshot of metrics starts a new segment, segments older than snapshot are removed
+type wal struct {
+	mu sync.Mutex
+	// synced is signalled when sync of segment finishes
+	synced *sync.Cond
+	// base is a path segment numbers are appended to
+	base    string
+	fsync   string
+	segment int
+	file    *os.File
+	// size is a number of bytes written to current segment
+	size int64
+	// full is notified when size of current segment exceeds maxSegmentSize
+	full chan struct{}
+	// written and durable are numbers of appended and synced writes,
+	// writes appended while segment is being synced are synced together by the next sync
+	written uint64
+	durable uint64
+	syncing bool
+	closed  bool
+}
+
+// segmentPath returns path of WAL segment with given number
+func segmentPath(base string, segment int) string {
+	return base + "." + strconv.Itoa(segment)
+}
+
+// listSegments returns numbers of existing WAL segments in ascending order
+func listSegments(base string) ([]int, error) {
+	paths, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("error while listing wal segments: %w", err)
+	}
+	var segments []int
+	for _, p := range paths {
+		segment, err := strconv.Atoi(strings.TrimPrefix(p, base+"."))
+		if err != nil || segment < 0 {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// removeSegmentsBefore removes WAL segments with numbers less than segment
+func removeSegmentsBefore(base string, segment int) error {
+	segments, err := listSegments(base)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= segment {
+			break
+		}
+		if err = os.Remove(segmentPath(base, s)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error while removing wal segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// newWAL creates WAL which appends to segment with given number.
+// Segment is opened by open, if it can't be opened updates are refused until the next rotation
+func newWAL(base string, segment int, fsync string) *wal {
+	switch fsync {
+	case FsyncAlways, FsyncEverySec, FsyncNever:
+	default:
+		loggers.ErrorLogger.Printf("unknown wal fsync policy %q, %q is used", fsync, FsyncEverySec)
+		fsync = FsyncEverySec
+	}
+	w := &wal{base: base, fsync: fsync, segment: segment, full: make(chan struct{}, 1)}
+	w.synced = sync.NewCond(&w.mu)
+	return w
+}
+
+// open opens current segment of WAL, w.mu must be held
+func (w *wal) open() error {
+	file, err := os.OpenFile(segmentPath(w.base, w.segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("error while opening wal segment: %w", err)
+	}
+	w.file = file
+	w.size = 0
+	return syncDir(filepath.Dir(w.base))
+}
+
+// append checks metrics, writes them to WAL with one write and applies them while holding the log lock,
+// so that updates are replayed in the same order they were applied and rejected ones are never logged.
+// With FsyncAlways policy append returns after write is synced to disk
+func (w *wal) append(metrics []types.Metrics, check, apply func() error) error {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.Hash = ""
+		line, err := json.Marshal(m)
+		if err != nil {
+			return fmt.Errorf("error while marshalling wal record: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return errors.New("wal segment is not opened")
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	n, err := w.file.Write(buf.Bytes())
+	if err != nil {
+		if n > 0 {
+			w.discardTorn()
+		}
+		return fmt.Errorf("error while writing wal record: %w", err)
+	}
+	w.size += int64(n)
+	w.written++
+	if w.size >= maxSegmentSize {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	if err = apply(); err != nil {
+		return err
+	}
+	if w.fsync == FsyncAlways {
+		return w.waitDurable(w.written)
+	}
+	return nil
+}
+
+// discardTorn removes part of record left by failed write, so that later records don't follow it.
+// If segment can't be truncated, updates go to the next segment, w.mu must be held
+func (w *wal) discardTorn() {
+	err := w.file.Truncate(w.size)
+	if err == nil {
+		return
+	}
+	loggers.ErrorLogger.Println("error while truncating torn wal record:", err)
+	if err = w.rotate(); err != nil {
+		loggers.ErrorLogger.Println("error while rotating wal:", err)
+	}
+}
+
+// waitDurable waits until write number seq is synced to disk, w.mu must be held.
+// The first waiting writer syncs segment without holding the lock,
+// writers appended meanwhile wait for it and are synced by the next one at once
+func (w *wal) waitDurable(seq uint64) error {
+	for w.durable < seq {
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+		w.syncing = true
+		file, target := w.file, w.written
+		w.mu.Unlock()
+		err := file.Sync()
+		w.mu.Lock()
+		w.syncing = false
+		if err == nil {
+			w.durable = target
+		}
+		w.synced.Broadcast()
+		if err != nil {
+			return fmt.Errorf("error while syncing wal: %w", err)
+		}
+	}
+	return nil
+}
+
+// sync syncs WAL segment to disk, w.mu must be held
+func (w *wal) sync() error {
+	for w.syncing {
+		w.synced.Wait()
+	}
+	if w.file == nil || w.durable == w.written {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("error while syncing wal: %w", err)
+	}
+	w.durable = w.written
+	return nil
+}
+
+// Sync syncs WAL segment to disk if there are unsynced writes
+func (w *wal) Sync() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.sync(); err != nil {
+		loggers.ErrorLogger.Println(err)
+	}
+}
+
+// rotate closes current segment and starts the next one, w.mu must be held
+func (w *wal) rotate() error {
+	if w.closed {
+		return errors.New("wal is closed")
+	}
+	if w.file != nil {
+		if err := w.sync(); err != nil {
+			return err
+		}
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("error while closing wal segment: %w", err)
+		}
+		w.file = nil
+	}
+	w.segment++
+	return w.open()
+}
+
+// Close syncs and closes WAL
+func (w *wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.file == nil {
+		return nil
+	}
+	if err := w.sync(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// replaySegment calls fn for every record of WAL segment.
+// Torn record at the end of segment is left by crash and skipped, corrupted complete record is an error
+func replaySegment(path string, fn func(m types.Metrics)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error while opening wal segment: %w", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				loggers.ErrorLogger.Printf("torn record %d in wal segment %s is skipped", n, path)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while reading wal segment: %w", err)
+		}
+		var m types.Metrics
+		if err = json.Unmarshal(line, &m); err != nil {
+			return fmt.Errorf("corrupted record %d in wal segment %s: %w", n, path, err)
+		}
+		fn(m)
+	}
+}
+
+// syncDir syncs directory so that created and renamed files survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error while opening directory: %w", err)
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("error while syncing directory: %w", err)
+	}
+	return nil
+}
@@ -4,75 +4,88 @@ package grpcserver
 import (
 	"context"
 	"crypto/rsa"
-	"crypto/x509"
 	"errors"
-	"io"
-	"net"
-	"os"
+	"fmt"
 
-	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
 	pb "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/proto"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/clientip"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
-	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/database"
-	filestorage "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/fileStorage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/otlp"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/query"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
 	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
 )
 
 // Server has gRPC server info
 type MetricServer struct {
 	pb.UnimplementedMetricsServer
 
-	Storage       storage.Storage
-	StorageType   types.StorageType
-	Key           string
-	Addr          string
-	Debug         bool
-	CryptoKey     *rsa.PrivateKey
-	TrustedSubnet string
-}
+	Storage     storage.Storage
+	StorageType types.StorageType
+	Key         string
+	Addr        string
+	Debug       bool
+	CryptoKey   *rsa.PrivateKey
+	// TrustedSubnet is a list of networks clients are allowed to update metrics from, clients from anywhere are allowed if it is empty
+	TrustedSubnet clientip.Nets
+	// TrustedProxies are networks of proxies whose headers with client IP are honored
+	TrustedProxies clientip.Nets
+	// RequireEncryption makes server reject updates which are not encrypted
+	RequireEncryption bool
+	// RequireSignature makes server reject metrics without hash
+	RequireSignature bool
+	// RequireRequestSignature makes server reject updates without signature of whole request
+	RequireRequestSignature bool
+	// Verifier verifies request signatures, it is nil if hash key is not set
+	Verifier *signature.Verifier
+	// Authenticator authenticates tokens of agents, it is nil if authentication is disabled
+	Authenticator auth.Authenticator
+	// MaxBodySize is a maximum size of request body in bytes, 0 means no limit
+	MaxBodySize int64
+	// MaxBatchSize is a maximum number of metrics in one batch update, 0 means no limit
+	MaxBatchSize int
+	// Limiter limits rate of updates of every client, it is nil if rate limiting is disabled
+	Limiter *ratelimit.Limiter
+	// OTLP saves metrics exported with OpenTelemetry protocol
+	OTLP *otlp.Writer
 
-// NewServer creates new Server
-func NewMetricServer(cfg config.Config) *MetricServer {
-	var (
-		storage     storage.Storage
-		storageType types.StorageType
-	)
+	// streams is done when streams of subscribers must end
+	streams      context.Context
+	closeStreams context.CancelFunc
+}
 
+// NewServer creates new Server working with storage
+func NewMetricServer(cfg config.Config, storage storage.Storage, storageType types.StorageType) (*MetricServer, error) {
 	var cryptoKey *rsa.PrivateKey
 	if cfg.CryptoKeyFile != "" {
-		file, err := os.OpenFile(cfg.CryptoKeyFile, os.O_RDONLY, 0777)
-		if err != nil {
-			loggers.ErrorLogger.Println("error while opening crypto key file:", err)
-			cryptoKey = nil
-		} else {
-			cryptoKeyByte, err := io.ReadAll(file)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while reading crypto key file:", err)
-				cryptoKey = nil
-			}
-			cryptoKey, err = x509.ParsePKCS1PrivateKey(cryptoKeyByte)
-			if err != nil {
-				loggers.ErrorLogger.Println("error while parsing crypto key:", err)
-				cryptoKey = nil
-			}
+		var err error
+		if cryptoKey, err = encryption.ReadPrivateKey(cfg.CryptoKeyFile); err != nil {
+			return nil, fmt.Errorf("error while loading crypto key: %w", err)
 		}
 	}
-	if cfg.Database == nil {
-		fs := filestorage.NewFileStorage(cfg)
-		fs.SetFileStorage()
-		storage = fs
-		storageType = types.StorageTypeFile
-	} else {
-		storage = database.NewDatabase(cfg.Database)
-		storageType = types.StorageTypeDB
+	subnet, err := clientip.ParseNets(cfg.TrustedSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing trusted subnet: %w", err)
+	}
+	proxies, err := clientip.ParseNets(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing trusted proxies: %w", err)
 	}
+	var verifier *signature.Verifier
+	if cfg.HashKey != "" {
+		verifier = signature.NewVerifier(cfg.HashKey, cfg.SignatureSkew)
+	}
+	streams, closeStreams := context.WithCancel(context.Background())
 	return &MetricServer{
 		Addr:          cfg.Address,
 		Debug:         cfg.Debug,
@@ -80,111 +93,150 @@ func NewMetricServer(cfg config.Config) *MetricServer {
 		Storage:       storage,
 		StorageType:   storageType,
 		CryptoKey:     cryptoKey,
-		TrustedSubnet: cfg.TrustedSubnet,
+		TrustedSubnet: subnet,
+
+		TrustedProxies:    proxies,
+		RequireEncryption: cfg.RequireEncryption,
+		RequireSignature:  cfg.RequireSignature,
+
+		RequireRequestSignature: cfg.RequireRequestSignature,
+		Verifier:                verifier,
+		Authenticator:           cfg.Authenticator,
+		MaxBodySize:             cfg.MaxBodySize,
+		MaxBatchSize:            cfg.MaxBatchSize,
+		Limiter:                 cfg.Limiter,
+		OTLP:                    otlp.NewWriter(storage),
+		streams:                 streams,
+		closeStreams:            closeStreams,
+	}, nil
+}
+
+// metricFromProto converts protobuf metric to types.Metrics
+func metricFromProto(in *pb.Metric) types.Metrics {
+	m := types.Metrics{
+		ID:     in.Id,
+		MType:  in.Mtype,
+		Hash:   in.Hash,
+		Labels: in.Labels,
 	}
+	switch in.Mtype {
+	case "counter":
+		var delta = in.Delta
+		m.Delta = &delta
+	case "gauge":
+		var value = in.Value
+		m.Value = &value
+	case "histogram":
+		if in.Histogram != nil {
+			h := &types.Histogram{Count: in.Histogram.Count, Sum: in.Histogram.Sum}
+			for _, b := range in.Histogram.Buckets {
+				h.Buckets = append(h.Buckets, types.Bucket{UpperBound: b.UpperBound, Count: b.Count})
+			}
+			m.Histogram = h
+		}
+	case "summary":
+		if in.Summary != nil {
+			s := &types.Summary{Count: in.Summary.Count, Sum: in.Summary.Sum}
+			for _, q := range in.Summary.Quantiles {
+				s.Quantiles = append(s.Quantiles, types.Quantile{Quantile: q.Quantile, Value: q.Value})
+			}
+			m.Summary = s
+		}
+	}
+	return m
 }
 
-// CheckRequestSubnetInterceptor checks if the client's IP is in the trusted subnet
-func (s *MetricServer) CheckRequestSubnetInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	var strIP string
-	if s.TrustedSubnet == "" {
-		return handler(ctx, req)
-	}
-	if md, ok := metadata.FromIncomingContext(ctx); ok {
-		values := md.Get("X-Real-IP")
-		if len(values) > 0 {
-			strIP = values[0]
+// metricToProto converts types.Metrics to protobuf metric
+func metricToProto(m types.Metrics) *pb.Metric {
+	out := &pb.Metric{
+		Id:     m.ID,
+		Mtype:  m.MType,
+		Hash:   m.Hash,
+		Labels: m.Labels,
+	}
+	if m.Delta != nil {
+		out.Delta = *m.Delta
+	}
+	if m.Value != nil {
+		out.Value = *m.Value
+	}
+	if m.Histogram != nil {
+		out.Histogram = &pb.Histogram{Count: m.Histogram.Count, Sum: m.Histogram.Sum}
+		for _, b := range m.Histogram.Buckets {
+			out.Histogram.Buckets = append(out.Histogram.Buckets, &pb.Bucket{UpperBound: b.UpperBound, Count: b.Count})
 		}
 	}
-	if len(strIP) == 0 {
-		return nil, status.Error(codes.PermissionDenied, "the client's IP is not in the trusted subnet")
+	if m.Summary != nil {
+		out.Summary = &pb.Summary{Count: m.Summary.Count, Sum: m.Summary.Sum}
+		for _, q := range m.Summary.Quantiles {
+			out.Summary.Quantiles = append(out.Summary.Quantiles, &pb.Quantile{Quantile: q.Quantile, Value: q.Value})
+		}
 	}
-	_, IPNet, err := net.ParseCIDR(s.TrustedSubnet)
-	if err != nil {
-		loggers.ErrorLogger.Println("error while parsing trusted subnet CIDR:", err)
-		return handler(ctx, req)
+	return out
+}
+
+// storageError converts storage error to gRPC status error
+func storageError(err error, msg string) error {
+	if errors.Is(err, myerrors.ErrTypeNotFound) {
+		return status.Error(codes.NotFound, err.Error())
 	}
-	clientIP := net.ParseIP(strIP)
-	if clientIP == nil {
-		loggers.ErrorLogger.Println("error while getting client's IP:", err)
-		return handler(ctx, req)
+	if errors.Is(err, myerrors.ErrTypeNotImplemented) {
+		return status.Error(codes.Unimplemented, err.Error())
 	}
-	if !IPNet.Contains(clientIP) {
-		return nil, status.Error(codes.PermissionDenied, "the client's IP is not in the trusted subnet")
+	if errors.Is(err, myerrors.ErrTypeBadRequest) {
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
-	return handler(ctx, req)
+	loggers.ErrorLogger.Println(msg+":", err)
+	return status.Error(codes.Internal, msg)
 }
 
 // UpdateMetric updates metric's value
 func (s *MetricServer) UpdateMetric(ctx context.Context, in *pb.UpdateMetricRequest) (*pb.UpdateMetricResponse, error) {
 	var response pb.UpdateMetricResponse
-	var m = types.Metrics{
-		ID:    in.Metric.Id,
-		MType: in.Metric.Mtype,
+	if in.Metric == nil {
+		return nil, status.Error(codes.InvalidArgument, "no metric in request")
 	}
-	switch in.Metric.Mtype {
-	case "counter":
-		var delta = in.Metric.Delta
-		m.Delta = &delta
-		curval, err := s.Storage.GetMetric(m, s.Key)
-		if err == nil {
-			in.Metric.Delta = *curval.Delta + in.Metric.Delta
-		}
-		response.Metric = &pb.Metric{
-			Id:    m.ID,
-			Mtype: m.MType,
-			Delta: *m.Delta + *curval.Delta,
-		}
-	case "gauge":
-		var value = in.Metric.Value
-		m.Value = &value
-		response.Metric = &pb.Metric{
-			Id:    m.ID,
-			Mtype: m.MType,
-			Value: *m.Value,
-		}
-	default:
+	m := metricFromProto(in.Metric)
+	if m.Delta == nil && m.Value == nil && m.Histogram == nil && m.Summary == nil {
 		return nil, status.Error(codes.Unimplemented, "wrong metric type")
 	}
 	err := s.Storage.SaveMetric(m, s.Key)
 	if err != nil {
-		loggers.ErrorLogger.Println("error while saving metric:", err)
-		return nil, status.Error(codes.Internal, "error while saving metric")
+		return nil, storageError(err, "error while saving metric")
 	}
+	auth.LogUpdate(ctx, s.Debug, "updated metric %s", m.ID)
+	curval, err := s.Storage.GetMetric(types.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}, s.Key)
+	if err != nil {
+		return nil, storageError(err, "error while getting saved metric")
+	}
+	response.Metric = metricToProto(curval)
 	return &response, nil
 }
 
 // UpdateManyMetrics updates many metrics' value
 func (s *MetricServer) UpdateManyMetrics(ctx context.Context, in *pb.UpdateManyMetricsRequest) (*pb.UpdateManyMetricsResponse, error) {
 	var response pb.UpdateManyMetricsResponse
+	if s.MaxBatchSize > 0 && len(in.Metrics) > s.MaxBatchSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "batch has %d metrics, at most %d are allowed", len(in.Metrics), s.MaxBatchSize)
+	}
 	var m = make([]types.Metrics, len(in.Metrics))
 	for i, metric := range in.Metrics {
-		switch metric.Mtype {
-		case "counter":
-			var delta = metric.Delta
-			m[i] = types.Metrics{
-				ID:    metric.Id,
-				MType: metric.Mtype,
-				Delta: &delta,
-			}
-			curval, err := s.Storage.GetMetric(m[i], s.Key)
-			if err == nil {
-				in.Metrics[i].Delta = *curval.Delta + metric.Delta
-			}
-		case "gauge":
-			var value = metric.Value
-			m[i] = types.Metrics{
-				ID:    metric.Id,
-				MType: metric.Mtype,
-				Value: &value,
-			}
-		default:
+		m[i] = metricFromProto(metric)
+		if m[i].Delta == nil && m[i].Value == nil && m[i].Histogram == nil && m[i].Summary == nil {
 			return nil, status.Error(codes.Unimplemented, "wrong metric type")
 		}
 	}
-	s.Storage.SaveManyMetrics(m, s.Key)
-	response = pb.UpdateManyMetricsResponse{
-		Metrics: in.Metrics,
+	if err := s.Storage.SaveManyMetrics(m, s.Key); err != nil {
+		return nil, storageError(err, "error while saving metrics")
+	}
+	auth.LogUpdate(ctx, s.Debug, "updated %d metrics", len(m))
+	response.Metrics = make([]*pb.Metric, len(m))
+	for i, metric := range m {
+		curval, err := s.Storage.GetMetric(types.Metrics{ID: metric.ID, MType: metric.MType, Labels: metric.Labels}, s.Key)
+		if err != nil {
+			return nil, storageError(err, "error while getting saved metric")
+		}
+		response.Metrics[i] = metricToProto(curval)
 	}
 	return &response, nil
 }
@@ -192,31 +244,19 @@ func (s *MetricServer) UpdateManyMetrics(ctx context.Context, in *pb.UpdateManyM
 // GetMetric returns info about one metric in the response
 func (s *MetricServer) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
 	var response pb.GetMetricResponse
+	if in.Metric == nil {
+		return nil, status.Error(codes.InvalidArgument, "no metric in request")
+	}
 	var m = types.Metrics{
-		ID:    in.Metric.Id,
-		MType: in.Metric.Mtype,
+		ID:     in.Metric.Id,
+		MType:  in.Metric.Mtype,
+		Labels: in.Metric.Labels,
 	}
 	curval, err := s.Storage.GetMetric(m, s.Key)
-	if errors.Is(err, myerrors.ErrTypeNotFound) {
-		return nil, status.Error(codes.NotFound, err.Error())
-	}
-	if errors.Is(err, myerrors.ErrTypeNotImplemented) {
-		return nil, status.Error(codes.Unimplemented, err.Error())
-	}
-	switch in.Metric.Mtype {
-	case "counter":
-		response.Metric = &pb.Metric{
-			Id:    m.ID,
-			Mtype: m.MType,
-			Delta: *m.Delta + *curval.Delta,
-		}
-	case "gauge":
-		response.Metric = &pb.Metric{
-			Id:    m.ID,
-			Mtype: m.MType,
-			Value: *m.Value,
-		}
+	if err != nil {
+		return nil, storageError(err, "error while getting metric")
 	}
+	response.Metric = metricToProto(curval)
 	return &response, nil
 }
 
@@ -229,20 +269,7 @@ func (s *MetricServer) GetAllMetrics(ctx context.Context, in *pb.GetAllMetricsRe
 	}
 	var responseMetrics = make([]*pb.Metric, len(metrics))
 	for i, m := range metrics {
-		switch m.MType {
-		case "counter":
-			responseMetrics[i] = &pb.Metric{
-				Id:    m.ID,
-				Mtype: m.MType,
-				Delta: *m.Delta,
-			}
-		case "gauge":
-			responseMetrics[i] = &pb.Metric{
-				Id:    m.ID,
-				Mtype: m.MType,
-				Value: *m.Value,
-			}
-		}
+		responseMetrics[i] = metricToProto(m)
 	}
 	response.Metrics = responseMetrics
 	return &response, nil
@@ -255,3 +282,40 @@ func (s *MetricServer) PingDatabase(ctx context.Context, _ *pb.PingDatabaseReque
 	}
 	return nil, nil
 }
+
+// QueryMetric runs range query with aggregation over history of a metric
+func (s *MetricServer) QueryMetric(ctx context.Context, in *pb.QueryMetricRequest) (*pb.QueryMetricResponse, error) {
+	// proto3 doesn't tell missing quantile from 0, so quantile is always set
+	q := query.Query{
+		ID:       in.Id,
+		MType:    in.Mtype,
+		Labels:   in.Labels,
+		Func:     in.Func,
+		Quantile: &in.Quantile,
+	}
+	if in.From != nil {
+		q.From = in.From.AsTime()
+	}
+	if in.To != nil {
+		q.To = in.To.AsTime()
+	}
+	if in.Range != nil {
+		q.Range = in.Range.AsDuration()
+	}
+	if in.Step != nil {
+		q.Step = in.Step.AsDuration()
+	}
+	result, err := query.Execute(s.Storage, q)
+	if err != nil {
+		return nil, storageError(err, "error while running query")
+	}
+	var response pb.QueryMetricResponse
+	response.Samples = make([]*pb.Sample, len(result.Points))
+	for i, p := range result.Points {
+		response.Samples[i] = &pb.Sample{
+			Timestamp: timestamppb.New(p.Timestamp),
+			Value:     p.Value,
+		}
+	}
+	return &response, nil
+}
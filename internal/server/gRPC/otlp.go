@@ -0,0 +1,52 @@
+package grpcserver
+
+import (
+	"context"
+	"strings"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/otlp"
+)
+
+// otlpService is OTLP metrics service saving exported metrics to storage of server
+type otlpService struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	s *MetricServer
+}
+
+// OTLPService returns OTLP metrics service of server, it uses interceptors of server
+func (s *MetricServer) OTLPService() colmetricspb.MetricsServiceServer {
+	return otlpService{s: s}
+}
+
+// Export saves exported metrics, data points which can't be saved are reported in partial success of response
+func (o otlpService) Export(ctx context.Context, in *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	s := o.s
+	points, rejected, errs := otlp.Convert(in)
+	if s.MaxBatchSize > 0 && len(points) > s.MaxBatchSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "request has %d data points, at most %d are allowed", len(points), s.MaxBatchSize)
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("OTLP export of %d data points, %d rejected", len(points), rejected)
+	}
+	if len(points) > 0 {
+		if err := s.OTLP.Write(points, s.Key); err != nil {
+			return nil, storageError(err, "error while saving metrics")
+		}
+		auth.LogUpdate(ctx, s.Debug, "updated %d metrics", len(points))
+	}
+	var response colmetricspb.ExportMetricsServiceResponse
+	if rejected > 0 {
+		response.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       strings.Join(errs, "; "),
+		}
+	}
+	return &response, nil
+}
@@ -0,0 +1,70 @@
+package grpcserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/otlp"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// gaugeExport makes export request with gauge temperature and gauge without name
+func gaugeExport() *colmetricspb.ExportMetricsServiceRequest {
+	point := []*metricspb.NumberDataPoint{{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 21.5}}}
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+			{Name: "temperature", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: point}}},
+			{Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: point}}},
+		}}},
+	}}}
+}
+
+// TestExport tests saving of OTLP exports and reporting of rejected data points
+func TestExport(t *testing.T) {
+	cfg := config.Config{}
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
+	resp, err := s.OTLPService().Export(context.Background(), gaugeExport())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resp.GetPartialSuccess().GetRejectedDataPoints())
+	m, err := st.GetMetric(types.Metrics{ID: "temperature", MType: "gauge"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 21.5, *m.Value)
+
+	s.MaxBatchSize = 1
+	req := gaugeExport()
+	req.ResourceMetrics = append(req.ResourceMetrics, req.ResourceMetrics...)
+	_, err = s.OTLPService().Export(context.Background(), req)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+// TestExportSecurity tests that OTLP exports are rejected when they can't meet requirements
+func TestExportSecurity(t *testing.T) {
+	tests := []struct {
+		name   string
+		server MetricServer
+		code   codes.Code
+	}{
+		{name: "no requirements", code: codes.OK},
+		{name: "encryption is required", server: MetricServer{RequireEncryption: true}, code: codes.InvalidArgument},
+		{name: "signatures are required", server: MetricServer{Key: "secret", RequireSignature: true}, code: codes.InvalidArgument},
+		{name: "request signatures are required", server: MetricServer{RequireRequestSignature: true}, code: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := chain(&tt.server, context.Background(), otlp.ExportMethod, gaugeExport())
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	pb "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/proto"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/clientip"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/otlp"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
+)
+
+// SecurityInterceptors returns interceptors applied to requests in order:
+// token of agent is authenticated first, then client IP is checked, then rate of updates is limited,
+// then signature of whole request is verified,
+// then request is decrypted and signatures of decrypted metrics are verified.
+// Every interceptor rejects request it can't check instead of passing it on
+func (s *MetricServer) SecurityInterceptors() []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{
+		s.AuthInterceptor,
+		s.CheckRequestSubnetInterceptor,
+		s.RateLimitInterceptor,
+		s.RequestSignatureInterceptor,
+		s.DecryptInterceptor,
+		s.VerifySignatureInterceptor,
+	}
+}
+
+// methodScopes are scopes required to call methods, methods not listed require admin scope
+var methodScopes = map[string]auth.Scope{
+	pb.Metrics_UpdateMetric_FullMethodName:      auth.ScopeWrite,
+	pb.Metrics_UpdateManyMetrics_FullMethodName: auth.ScopeWrite,
+	pb.Metrics_GetMetric_FullMethodName:         auth.ScopeRead,
+	pb.Metrics_GetAllMetrics_FullMethodName:     auth.ScopeRead,
+	pb.Metrics_QueryMetric_FullMethodName:       auth.ScopeRead,
+	pb.Metrics_WatchMetrics_FullMethodName:      auth.ScopeRead,
+	otlp.ExportMethod:                           auth.ScopeWrite,
+}
+
+// publicMethods can be called without token
+var publicMethods = map[string]bool{
+	pb.Metrics_PingDatabase_FullMethodName: true,
+}
+
+// SecurityStreamInterceptors returns interceptors applied to streams in order:
+// token is authenticated first, then client IP is checked.
+// Streams don't update metrics, so they are not rate limited, signed or encrypted
+func (s *MetricServer) SecurityStreamInterceptors() []grpc.StreamServerInterceptor {
+	return []grpc.StreamServerInterceptor{
+		s.AuthStreamInterceptor,
+		s.CheckRequestSubnetStreamInterceptor,
+	}
+}
+
+// contextStream is a server stream with context replaced
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns context of stream
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// AuthInterceptor rejects calls without bearer token having scope required by method.
+// Identity of token is put into context of call
+func (s *MetricServer) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// AuthStreamInterceptor rejects streams without bearer token having scope required by method.
+// Identity of token is put into context of stream
+func (s *MetricServer) AuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticate checks token of call of method and returns ctx with identity of token
+func (s *MetricServer) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if s.Authenticator == nil || publicMethods[method] {
+		return ctx, nil
+	}
+	scope, ok := methodScopes[method]
+	if !ok {
+		scope = auth.ScopeAdmin
+	}
+	id, err := auth.Check(ctx, s.Authenticator, auth.TokenFromHeader(metadataValue(ctx, "authorization")), scope)
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return nil, status.Error(codes.Unauthenticated, "token is missing or unknown")
+	case errors.Is(err, auth.ErrForbidden):
+		return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("token of %s has no %s scope", id.Name, scope))
+	case err != nil:
+		loggers.ErrorLogger.Println("error while authenticating token:", err)
+		return nil, status.Error(codes.Internal, "error while authenticating token")
+	}
+	return auth.NewContext(ctx, id), nil
+}
+
+// CheckRequestSubnetInterceptor checks if the client's IP is in the trusted subnet.
+// Client IP is the peer address, metadata with client IP is honored only if the peer is a trusted proxy
+func (s *MetricServer) CheckRequestSubnetInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.checkSubnet(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// CheckRequestSubnetStreamInterceptor checks if the client's IP of stream is in the trusted subnet
+func (s *MetricServer) CheckRequestSubnetStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.checkSubnet(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// checkSubnet rejects calls from clients out of trusted subnet
+func (s *MetricServer) checkSubnet(ctx context.Context) error {
+	if len(s.TrustedSubnet) == 0 {
+		return nil
+	}
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	ip, err := clientip.Resolve(addr, func(key string) string { return metadataValue(ctx, key) }, s.TrustedProxies)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "the client's IP is unknown")
+	}
+	if !s.TrustedSubnet.Contains(ip) {
+		return status.Error(codes.PermissionDenied, "the client's IP is not in the trusted subnet")
+	}
+	return nil
+}
+
+// clientKey identifies client for rate limiting by identity of token or by IP
+func (s *MetricServer) clientKey(ctx context.Context) string {
+	if id, ok := auth.FromContext(ctx); ok {
+		return "token:" + id.Name
+	}
+	var addr string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	if ip, err := clientip.Resolve(addr, func(key string) string { return metadataValue(ctx, key) }, s.TrustedProxies); err == nil {
+		return "ip:" + ip.String()
+	}
+	return "ip:" + addr
+}
+
+// RateLimitInterceptor rejects updates of clients exceeding rate limit with ResourceExhausted.
+// Trailer retry-after tells client in how many seconds it can retry
+func (s *MetricServer) RateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := updateRequest(req); !ok || s.Limiter == nil {
+		return handler(ctx, req)
+	}
+	if ok, wait := s.Limiter.Allow(s.clientKey(ctx)); !ok {
+		retryAfter := strconv.Itoa(ratelimit.RetryAfter(wait))
+		if err := grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter)); err != nil {
+			loggers.ErrorLogger.Println("error while setting retry-after:", err)
+		}
+		return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded, retry after "+retryAfter+"s")
+	}
+	return handler(ctx, req)
+}
+
+// metadataValue returns first value of key in incoming metadata of ctx
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// RequestSignatureInterceptor verifies signature of update requests marshalled deterministically and rejects replayed ones.
+// Responses to signed requests are signed with nonce of request, signature is sent in header metadata
+func (s *MetricServer) RequestSignatureInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	in, ok := updateRequest(req)
+	if !ok {
+		return handler(ctx, req)
+	}
+	if s.Verifier == nil {
+		if s.RequireRequestSignature {
+			loggers.ErrorLogger.Println("request signatures are required, but hash key is not set")
+			return nil, status.Error(codes.Internal, "server can't verify signatures")
+		}
+		return handler(ctx, req)
+	}
+	sig, err := signature.Parse(func(key string) string { return metadataValue(ctx, key) })
+	if errors.Is(err, signature.ErrMissing) && !s.RequireRequestSignature {
+		return handler(ctx, req)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	body, err := proto.MarshalOptions{Deterministic: true}.Marshal(in)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "cannot marshal request")
+	}
+	if err = s.Verifier.Verify(sig, "POST", info.FullMethod, body); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	out, ok := resp.(proto.Message)
+	if !ok {
+		return resp, nil
+	}
+	body, err = proto.MarshalOptions{Deterministic: true}.Marshal(out)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "cannot marshal response")
+	}
+	respSig := signature.Signature{Timestamp: time.Now().Unix(), Nonce: sig.Nonce}
+	respSig.Sign(s.Key, codes.OK.String(), info.FullMethod, body)
+	if err = grpc.SetHeader(ctx, metadata.New(respSig.Fields())); err != nil {
+		loggers.ErrorLogger.Println("error while setting response signature:", err)
+	}
+	return resp, nil
+}
+
+// encryptedRequest is a request which may be sent as encryption envelope
+type encryptedRequest interface {
+	proto.Message
+	GetEncrypted() []byte
+}
+
+// updateRequest returns request if it updates metrics
+func updateRequest(req interface{}) (proto.Message, bool) {
+	switch in := req.(type) {
+	case encryptedRequest:
+		return in, true
+	case *colmetricspb.ExportMetricsServiceRequest:
+		return in, true
+	}
+	return nil, false
+}
+
+// DecryptInterceptor replaces requests sent as encryption envelope with decrypted ones.
+// If encryption is required plaintext updates are rejected, OTLP exports can't be encrypted
+func (s *MetricServer) DecryptInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := req.(*colmetricspb.ExportMetricsServiceRequest); ok && s.RequireEncryption {
+		return nil, status.Error(codes.InvalidArgument, "request must be encrypted")
+	}
+	in, ok := req.(encryptedRequest)
+	if !ok {
+		return handler(ctx, req)
+	}
+	if len(in.GetEncrypted()) == 0 {
+		if s.RequireEncryption {
+			return nil, status.Error(codes.InvalidArgument, "request must be encrypted")
+		}
+		return handler(ctx, req)
+	}
+	if s.CryptoKey == nil {
+		return nil, status.Error(codes.InvalidArgument, "encrypted requests are not accepted")
+	}
+	plaintext, err := encryption.Decrypt(s.CryptoKey, in.GetEncrypted())
+	if err != nil {
+		loggers.ErrorLogger.Println("DecryptInterceptor: error while decrypting request:", err)
+		return nil, status.Error(codes.InvalidArgument, "cannot decrypt request")
+	}
+	decrypted := in.ProtoReflect().New().Interface()
+	if err = proto.Unmarshal(plaintext, decrypted); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "cannot unmarshal decrypted request")
+	}
+	return handler(ctx, decrypted)
+}
+
+// VerifySignatureInterceptor rejects updates with metrics without valid hash if signatures are required.
+// OTLP exports have no hashes of metrics, so they are rejected too
+func (s *MetricServer) VerifySignatureInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !s.RequireSignature {
+		return handler(ctx, req)
+	}
+	var metrics []*pb.Metric
+	switch in := req.(type) {
+	case *pb.UpdateMetricRequest:
+		metrics = []*pb.Metric{in.Metric}
+	case *pb.UpdateManyMetricsRequest:
+		metrics = in.Metrics
+	case *colmetricspb.ExportMetricsServiceRequest:
+		return nil, status.Error(codes.InvalidArgument, "request must contain signed metrics")
+	default:
+		return handler(ctx, req)
+	}
+	if s.Key == "" {
+		loggers.ErrorLogger.Println("signatures are required, but hash key is not set")
+		return nil, status.Error(codes.Internal, "server can't verify signatures")
+	}
+	if len(metrics) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "request must contain signed metrics")
+	}
+	for _, metric := range metrics {
+		if metric == nil {
+			return nil, status.Error(codes.InvalidArgument, "request must contain signed metrics")
+		}
+		if metric.Hash == "" {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("metric %s is not signed", metric.Id))
+		}
+		m := metricFromProto(metric)
+		if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(hash.WithLabels(m.HashSource(), m.Labels), s.Key))) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("wrong hash of metric %s", metric.Id))
+		}
+	}
+	return handler(ctx, req)
+}
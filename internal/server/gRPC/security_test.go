@@ -0,0 +1,266 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/encryption"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	pb "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/proto"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/clientip"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/ratelimit"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/signature"
+)
+
+// chain runs request to method through security interceptors of s and returns request passed to handler
+func chain(s *MetricServer, ctx context.Context, method string, req interface{}) (interface{}, error) {
+	var handler grpc.UnaryHandler = func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	}
+	interceptors := s.SecurityInterceptors()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, next)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// TestSecurityInterceptors tests that interceptors reject requests they can't check
+func TestSecurityInterceptors(t *testing.T) {
+	const hashKey = "secret"
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signed := &pb.UpdateManyMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "PollCount", Mtype: "counter", Delta: 5, Hash: hash.Hash("PollCount:counter:5", hashKey)},
+	}}
+	unsigned := &pb.UpdateMetricRequest{Metric: &pb.Metric{Id: "Alloc", Mtype: "gauge", Value: 1.5}}
+	data, err := proto.Marshal(signed)
+	require.NoError(t, err)
+	envelope, err := encryption.Encrypt(&key.PublicKey, data)
+	require.NoError(t, err)
+	encrypted := &pb.UpdateManyMetricsRequest{Encrypted: envelope}
+	tampered := &pb.UpdateManyMetricsRequest{Encrypted: append(append([]byte(nil), envelope[:len(envelope)-1]...), envelope[len(envelope)-1]^1)}
+	fromAddr := func(addr string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 5000}})
+	}
+	trusted, untrusted := fromAddr("10.0.0.5"), fromAddr("192.168.0.5")
+	forged := metadata.NewIncomingContext(untrusted, metadata.Pairs("X-Real-IP", "10.0.0.5"))
+	proxied := metadata.NewIncomingContext(fromAddr("172.16.0.2"), metadata.Pairs("X-Forwarded-For", "10.0.0.5"))
+	subnet, err := clientip.ParseNets("10.0.0.0/8")
+	require.NoError(t, err)
+	proxies, err := clientip.ParseNets("172.16.0.0/12")
+	require.NoError(t, err)
+	tests := []struct {
+		name   string
+		server MetricServer
+		ctx    context.Context
+		req    interface{}
+		code   codes.Code
+	}{
+		{name: "no requirements", ctx: context.Background(), req: unsigned, code: codes.OK},
+		{name: "reads are not checked", server: MetricServer{RequireEncryption: true, RequireSignature: true}, ctx: context.Background(), req: &pb.GetAllMetricsRequest{}, code: codes.OK},
+		{name: "client in subnet", server: MetricServer{TrustedSubnet: subnet}, ctx: trusted, req: unsigned, code: codes.OK},
+		{name: "client out of subnet", server: MetricServer{TrustedSubnet: subnet}, ctx: untrusted, req: unsigned, code: codes.PermissionDenied},
+		{name: "client forging X-Real-IP", server: MetricServer{TrustedSubnet: subnet}, ctx: forged, req: unsigned, code: codes.PermissionDenied},
+		{name: "client behind trusted proxy", server: MetricServer{TrustedSubnet: subnet, TrustedProxies: proxies}, ctx: proxied, req: unsigned, code: codes.OK},
+		{name: "client without peer", server: MetricServer{TrustedSubnet: subnet}, ctx: context.Background(), req: unsigned, code: codes.PermissionDenied},
+		{name: "encrypted and signed", server: MetricServer{CryptoKey: key, Key: hashKey, RequireEncryption: true, RequireSignature: true}, ctx: context.Background(), req: encrypted, code: codes.OK},
+		{name: "plaintext when encryption is required", server: MetricServer{CryptoKey: key, RequireEncryption: true}, ctx: context.Background(), req: signed, code: codes.InvalidArgument},
+		{name: "tampered envelope", server: MetricServer{CryptoKey: key}, ctx: context.Background(), req: tampered, code: codes.InvalidArgument},
+		{name: "server without crypto key", ctx: context.Background(), req: encrypted, code: codes.InvalidArgument},
+		{name: "unsigned when signature is required", server: MetricServer{Key: hashKey, RequireSignature: true}, ctx: context.Background(), req: unsigned, code: codes.InvalidArgument},
+		{name: "server without hash key", server: MetricServer{RequireSignature: true}, ctx: context.Background(), req: signed, code: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := chain(&tt.server, tt.ctx, pb.Metrics_UpdateManyMetrics_FullMethodName, tt.req)
+			assert.Equal(t, tt.code, status.Code(err))
+			if tt.code == codes.OK && tt.req == encrypted {
+				require.IsType(t, &pb.UpdateManyMetricsRequest{}, req)
+				assert.Len(t, req.(*pb.UpdateManyMetricsRequest).Metrics, 1)
+			}
+		})
+	}
+}
+
+// TestRequestSignatureInterceptor tests verification of request signatures and rejection of replays
+func TestRequestSignatureInterceptor(t *testing.T) {
+	const key = "secret"
+	method := pb.Metrics_UpdateManyMetrics_FullMethodName
+	req := &pb.UpdateManyMetricsRequest{Metrics: []*pb.Metric{{Id: "PollCount", Mtype: "counter", Delta: 5}}}
+	signed := func(key, method string, req proto.Message) context.Context {
+		body, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+		require.NoError(t, err)
+		sig, err := signature.New(key, "POST", method, body)
+		require.NoError(t, err)
+		return metadata.NewIncomingContext(context.Background(), metadata.New(sig.Fields()))
+	}
+	tests := []struct {
+		name    string
+		require bool
+		key     string
+		ctx     context.Context
+		req     interface{}
+		code    codes.Code
+	}{
+		{name: "unsigned when not required", key: key, ctx: context.Background(), req: req, code: codes.OK},
+		{name: "signed request", require: true, key: key, ctx: signed(key, method, req), req: req, code: codes.OK},
+		{name: "reads are not checked", require: true, key: key, ctx: context.Background(), req: &pb.GetAllMetricsRequest{}, code: codes.OK},
+		{name: "unsigned when required", require: true, key: key, ctx: context.Background(), req: req, code: codes.Unauthenticated},
+		{name: "signed with other key", key: key, ctx: signed("other", method, req), req: req, code: codes.Unauthenticated},
+		{name: "signature of other method", key: key, ctx: signed(key, pb.Metrics_UpdateMetric_FullMethodName, req), req: req, code: codes.Unauthenticated},
+		{name: "signature of other request", key: key, ctx: signed(key, method, &pb.UpdateManyMetricsRequest{}), req: req, code: codes.Unauthenticated},
+		{name: "server without key", require: true, ctx: signed(key, method, req), req: req, code: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &MetricServer{Key: tt.key, RequireRequestSignature: tt.require}
+			if tt.key != "" {
+				s.Verifier = signature.NewVerifier(tt.key, time.Minute)
+			}
+			_, err := chain(s, tt.ctx, method, tt.req)
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+	t.Run("replayed request", func(t *testing.T) {
+		s := &MetricServer{Key: key, Verifier: signature.NewVerifier(key, time.Minute)}
+		replayed := signed(key, method, req)
+		_, err := chain(s, replayed, method, req)
+		require.NoError(t, err)
+		_, err = chain(s, replayed, method, req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+}
+
+// staticTokens authenticates tokens from map
+type staticTokens map[string]auth.Identity
+
+// Authenticate returns identity of token from map
+func (t staticTokens) Authenticate(_ context.Context, token string) (auth.Identity, error) {
+	id, ok := t[token]
+	if !ok {
+		return auth.Identity{}, auth.ErrUnauthenticated
+	}
+	return id, nil
+}
+
+// TestAuthInterceptor tests that methods are available only to tokens with required scope
+func TestAuthInterceptor(t *testing.T) {
+	s := &MetricServer{Authenticator: staticTokens{
+		"writer": {Name: "agent-1", Scopes: []auth.Scope{auth.ScopeWrite}},
+		"reader": {Name: "dashboard", Scopes: []auth.Scope{auth.ScopeRead}},
+	}}
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	}
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		code   codes.Code
+		id     string
+	}{
+		{name: "write with write scope", ctx: withToken("writer"), method: pb.Metrics_UpdateManyMetrics_FullMethodName, code: codes.OK, id: "agent-1"},
+		{name: "write with read scope", ctx: withToken("reader"), method: pb.Metrics_UpdateMetric_FullMethodName, code: codes.PermissionDenied},
+		{name: "read with read scope", ctx: withToken("reader"), method: pb.Metrics_GetAllMetrics_FullMethodName, code: codes.OK, id: "dashboard"},
+		{name: "read with write scope", ctx: withToken("writer"), method: pb.Metrics_QueryMetric_FullMethodName, code: codes.PermissionDenied},
+		{name: "unknown token", ctx: withToken("guess"), method: pb.Metrics_GetMetric_FullMethodName, code: codes.Unauthenticated},
+		{name: "no token", ctx: context.Background(), method: pb.Metrics_UpdateMetric_FullMethodName, code: codes.Unauthenticated},
+		{name: "public method", ctx: context.Background(), method: pb.Metrics_PingDatabase_FullMethodName, code: codes.OK, id: "anonymous"},
+		{name: "unknown method requires admin", ctx: withToken("writer"), method: "/grpc_server.Metrics/DropMetrics", code: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var name string
+			_, err := s.AuthInterceptor(tt.ctx, nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				name = auth.Name(ctx)
+				return nil, nil
+			})
+			assert.Equal(t, tt.code, status.Code(err))
+			assert.Equal(t, tt.id, name)
+		})
+	}
+}
+
+// TestRateLimitInterceptor tests that every client is limited separately and only updates are limited
+func TestRateLimitInterceptor(t *testing.T) {
+	s := &MetricServer{Limiter: ratelimit.NewLimiter(0.1, 1)}
+	fromAddr := func(addr string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 5000}})
+	}
+	agent1 := auth.NewContext(fromAddr("192.168.0.5"), auth.Identity{Name: "agent-1"})
+	agent2 := auth.NewContext(fromAddr("192.168.0.5"), auth.Identity{Name: "agent-2"})
+	update := &pb.UpdateMetricRequest{Metric: &pb.Metric{Id: "Alloc", Mtype: "gauge", Value: 1.5}}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		req  interface{}
+		code codes.Code
+	}{
+		{name: "first update", ctx: agent1, req: update, code: codes.OK},
+		{name: "second update", ctx: agent1, req: update, code: codes.ResourceExhausted},
+		{name: "read", ctx: agent1, req: &pb.GetAllMetricsRequest{}, code: codes.OK},
+		{name: "other token from same IP", ctx: agent2, req: update, code: codes.OK},
+		{name: "anonymous client", ctx: fromAddr("192.168.0.5"), req: update, code: codes.OK},
+		{name: "anonymous client again", ctx: fromAddr("192.168.0.5"), req: update, code: codes.ResourceExhausted},
+		{name: "other anonymous client", ctx: fromAddr("192.168.0.6"), req: update, code: codes.OK},
+	}
+	for _, tt := range tests {
+		_, err := chain(s, tt.ctx, pb.Metrics_UpdateMetric_FullMethodName, tt.req)
+		assert.Equal(t, tt.code, status.Code(err), tt.name)
+	}
+}
+
+// TestUpdateManyMetricsBatchSize tests rejection of batches larger than limit
+func TestUpdateManyMetricsBatchSize(t *testing.T) {
+	s := &MetricServer{MaxBatchSize: 1}
+	_, err := s.UpdateManyMetrics(context.Background(), &pb.UpdateManyMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Mtype: "gauge", Value: 1},
+		{Id: "PollCount", Mtype: "counter", Delta: 1},
+	}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+// TestNewMetricServerTrustedNetworks tests that server isn't created with invalid trusted networks
+func TestNewMetricServerTrustedNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{name: "valid networks", cfg: config.Config{TrustedSubnet: "10.0.0.0/8", TrustedProxies: "172.16.0.2"}},
+		{name: "invalid subnet", cfg: config.Config{TrustedSubnet: "10.0.0.0/33"}, wantErr: true},
+		{name: "invalid proxies", cfg: config.Config{TrustedSubnet: "10.0.0.0/8", TrustedProxies: "proxy"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			st, storageType, err := storage.NewStorage(tt.cfg)
+			require.NoError(t, err)
+			_, err = NewMetricServer(tt.cfg, st, storageType)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
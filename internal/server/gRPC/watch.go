@@ -0,0 +1,67 @@
+package grpcserver
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	pb "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/proto"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/watch"
+)
+
+// CloseStreams ends streams of subscribers, it is called on shutdown since graceful stop waits for them
+func (s *MetricServer) CloseStreams() {
+	if s.closeStreams != nil {
+		s.closeStreams()
+	}
+}
+
+// streamsDone returns channel which is closed when streams must end, it is nil if server can't close streams
+func (s *MetricServer) streamsDone() <-chan struct{} {
+	if s.streams == nil {
+		return nil
+	}
+	return s.streams.Done()
+}
+
+// WatchMetrics streams updates of metrics selected by request until client cancels it, header is sent once stream is set up.
+// Clients which don't keep up with updates get ResourceExhausted
+func (s *MetricServer) WatchMetrics(in *pb.WatchMetricsRequest, stream pb.Metrics_WatchMetricsServer) error {
+	w, ok := s.Storage.(storage.Watcher)
+	if !ok {
+		return status.Error(codes.Unimplemented, "storage can't be watched")
+	}
+	sub, err := w.Watch(watch.Filter{Prefix: in.IdPrefix, MType: in.Mtype, Labels: in.Labels})
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer sub.Close()
+	// header tells client that updates saved from now on are streamed
+	if err = stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("watch of %q %q %v started", in.IdPrefix, in.Mtype, in.Labels)
+	}
+	for {
+		select {
+		case m := <-sub.Updates():
+			if err = stream.Send(&pb.WatchMetricsResponse{Metric: metricToProto(m)}); err != nil {
+				return err
+			}
+		case <-sub.Done():
+			if errors.Is(sub.Err(), watch.ErrSlowSubscriber) {
+				return status.Error(codes.ResourceExhausted, sub.Err().Error())
+			}
+			return status.Error(codes.Unavailable, sub.Err().Error())
+		case <-s.streamsDone():
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
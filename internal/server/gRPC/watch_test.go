@@ -0,0 +1,118 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/proto"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/auth"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// serveBuffered serves s with security interceptors over in-memory connection and returns client
+func serveBuffered(t *testing.T, s *MetricServer) pb.MetricsClient {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.SecurityInterceptors()...),
+		grpc.ChainStreamInterceptor(s.SecurityStreamInterceptors()...),
+	)
+	pb.RegisterMetricsServer(srv, s)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+// TestWatchMetrics tests streaming of selected updates and ending of streams on shutdown
+func TestWatchMetrics(t *testing.T) {
+	cfg := config.Config{}
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
+	client := serveBuffered(t, s)
+
+	stream, err := client.WatchMetrics(context.Background(), &pb.WatchMetricsRequest{
+		IdPrefix: "cpu",
+		Labels:   map[string]string{"host": "a"},
+	})
+	require.NoError(t, err)
+	// updates saved before stream is set up are not streamed
+	_, err = stream.Header()
+	require.NoError(t, err)
+	value := 3.0
+	require.NoError(t, st.SaveManyMetrics([]types.Metrics{
+		{ID: "mem", MType: "gauge", Value: &value, Labels: map[string]string{"host": "a"}},
+		{ID: "cpu", MType: "gauge", Value: &value, Labels: map[string]string{"host": "a"}},
+	}, ""))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "cpu", resp.Metric.Id)
+	assert.Equal(t, 3.0, resp.Metric.Value)
+	assert.Equal(t, map[string]string{"host": "a"}, resp.Metric.Labels)
+
+	s.CloseStreams()
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+// TestWatchMetricsSecurity tests that streams are available only to tokens with read scope
+func TestWatchMetricsSecurity(t *testing.T) {
+	cfg := config.Config{}
+	st, storageType, err := storage.NewStorage(cfg)
+	require.NoError(t, err)
+	s, err := NewMetricServer(cfg, st, storageType)
+	require.NoError(t, err)
+	s.Authenticator = staticTokens{
+		"writer": {Name: "agent-1", Scopes: []auth.Scope{auth.ScopeWrite}},
+		"reader": {Name: "dashboard", Scopes: []auth.Scope{auth.ScopeRead}},
+	}
+	client := serveBuffered(t, s)
+	tests := []struct {
+		name  string
+		token string
+		code  codes.Code
+	}{
+		{name: "no token", code: codes.Unauthenticated},
+		{name: "token without read scope", token: "writer", code: codes.PermissionDenied},
+		{name: "token with read scope", token: "reader", code: codes.OK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tt.token)
+			}
+			stream, err := client.WatchMetrics(ctx, &pb.WatchMetricsRequest{})
+			require.NoError(t, err)
+			if tt.code == codes.OK {
+				_, err = stream.Header()
+				assert.NoError(t, err)
+				return
+			}
+			_, err = stream.Recv()
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
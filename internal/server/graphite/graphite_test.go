@@ -0,0 +1,117 @@
+package graphite
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// pickleFrame is a frame of two metrics pickled with protocol 2
+const pickleFrame = "\x80\x02]q\x00(X\x16\x00\x00\x00servers.web01.cpu.loadq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x16\x00\x00\x00servers.web02.cpu.loadq\x04J\x00\xf1SeK\x02\x86q\x05\x86q\x06X\x03\x00\x00\x00badq\x07X\x01\x00\x00\x00xq\x08X\x01\x00\x00\x00yq\t\x86q\n\x86q\x0be."
+
+// startServer starts plaintext and pickle listeners of s at random ports
+func startServer(t *testing.T, s *Server) (plaintext, pickle string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	go s.ServePickle(lp)
+	return l.Addr().String(), lp.Addr().String()
+}
+
+// TestServer tests that plaintext lines and pickle frames received over TCP are saved to storage
+func TestServer(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	s, err := NewServer(config.Config{GraphiteTemplates: []string{"servers.* .host.measurement*"}}, store)
+	require.NoError(t, err)
+	plaintext, pickle := startServer(t, s)
+
+	conn, err := net.Dial("tcp", plaintext)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("servers.web03.cpu.load 3 1700000000\nbroken line\nmem.free;host=web03 100 -1\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	conn, err = net.Dial("tcp", pickle)
+	require.NoError(t, err)
+	frame := make([]byte, 4+len(pickleFrame))
+	binary.BigEndian.PutUint32(frame, uint32(len(pickleFrame)))
+	copy(frame[4:], pickleFrame)
+	_, err = conn.Write(frame)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	get := func(id, host string) (types.Metrics, error) {
+		return store.GetMetric(types.Metrics{ID: id, MType: "gauge", Labels: map[string]string{"host": host}}, "")
+	}
+	require.Eventually(t, func() bool {
+		metrics, err := store.GetAllMetrics()
+		return err == nil && len(metrics) == 4
+	}, time.Second, 10*time.Millisecond)
+	m, err := get("cpu.load", "web03")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *m.Value)
+	m, err = get("mem.free", "web03")
+	require.NoError(t, err)
+	assert.Equal(t, 100.0, *m.Value)
+	m, err = get("cpu.load", "web01")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	_, err = net.DialTimeout("tcp", plaintext, time.Second)
+	assert.Error(t, err, "listener is closed")
+}
+
+// TestServerLimits tests that connections from outside of trusted subnet and with too large frames are dropped
+func TestServerLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		size uint32
+	}{
+		{name: "untrusted client", cfg: config.Config{TrustedSubnet: "10.0.0.0/8"}},
+		{name: "too large frame", cfg: config.Config{MaxBodySize: 16}},
+		{name: "frame over default limit", size: maxFrameSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _, err := storage.NewStorage(config.Config{})
+			require.NoError(t, err)
+			s, err := NewServer(tt.cfg, store)
+			require.NoError(t, err)
+			_, pickle := startServer(t, s)
+			conn, err := net.Dial("tcp", pickle)
+			require.NoError(t, err)
+			defer conn.Close()
+			frame := make([]byte, 4+len(pickleFrame))
+			size := tt.size
+			if size == 0 {
+				size = uint32(len(pickleFrame))
+			}
+			binary.BigEndian.PutUint32(frame, size)
+			copy(frame[4:], pickleFrame)
+			conn.Write(frame)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			require.Error(t, err)
+			assert.False(t, os.IsTimeout(err), "server closes connection")
+			require.NoError(t, s.Shutdown(context.Background()))
+			metrics, err := store.GetAllMetrics()
+			require.NoError(t, err)
+			assert.Empty(t, metrics)
+		})
+	}
+}
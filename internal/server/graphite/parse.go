@@ -0,0 +1,228 @@
+// Package graphite receives Graphite plaintext and pickle metrics over TCP and saves them to storage as gauges.
+// Dotted paths are mapped to metric IDs and labels by templates
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// ErrWrongFormat is returned when Graphite line or template can't be parsed
+var ErrWrongFormat = errors.New("wrong graphite format")
+
+// Point is one value of Graphite metric
+type Point struct {
+	Path string
+	// Tags are tags of tagged path path;tag=value
+	Tags  map[string]string
+	Value float64
+	Time  time.Time
+}
+
+// ParseLine parses plaintext line "path value timestamp", timestamp -1 or missing timestamp means now
+func ParseLine(line string) (Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return Point{}, fmt.Errorf("%w: %q", ErrWrongFormat, line)
+	}
+	timestamp := "-1"
+	if len(fields) == 3 {
+		timestamp = fields[2]
+	}
+	return newPoint(fields[0], fields[1], timestamp)
+}
+
+// newPoint makes point of path, value and Unix timestamp in seconds, timestamps in the future are rejected
+func newPoint(path, value, timestamp string) (Point, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return Point{}, fmt.Errorf("%w: wrong value %q of %s", ErrWrongFormat, value, path)
+	}
+	ts, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) || math.Abs(ts) > math.MaxInt64/float64(time.Second) {
+		return Point{}, fmt.Errorf("%w: wrong timestamp %q of %s", ErrWrongFormat, timestamp, path)
+	}
+	p := Point{Value: v, Time: time.Now()}
+	if ts >= 0 {
+		p.Time = time.Unix(0, int64(ts*float64(time.Second)))
+		if p.Time.After(time.Now().Add(types.MaxClockSkew)) {
+			return Point{}, fmt.Errorf("%w: timestamp %q of %s is in the future", ErrWrongFormat, timestamp, path)
+		}
+	}
+	p.Path, p.Tags, err = parsePath(path)
+	return p, err
+}
+
+// parsePath splits tagged path path;tag=value;tag=value into path and tags
+func parsePath(path string) (string, map[string]string, error) {
+	parts := strings.Split(path, ";")
+	if parts[0] == "" || strings.HasPrefix(parts[0], ".") || strings.HasSuffix(parts[0], ".") || strings.Contains(parts[0], "..") {
+		return "", nil, fmt.Errorf("%w: wrong path %q", ErrWrongFormat, path)
+	}
+	if len(parts) == 1 {
+		return path, nil, nil
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		eq := strings.IndexByte(tag, '=')
+		if eq <= 0 || eq == len(tag)-1 {
+			return "", nil, fmt.Errorf("%w: wrong tag %q of %s", ErrWrongFormat, tag, parts[0])
+		}
+		tags[tag[:eq]] = tag[eq+1:]
+	}
+	return parts[0], tags, nil
+}
+
+// parts of template which are not tags
+const (
+	partMeasurement     = "measurement"
+	partMeasurementRest = "measurement*"
+)
+
+// Template maps nodes of matching paths to metric ID and labels
+type Template struct {
+	// filter is a pattern of path nodes, * matches any node, paths of any length match empty filter
+	filter []string
+	// parts name nodes of path: measurement, measurement* for the rest of nodes, empty to skip node, otherwise label
+	parts []string
+	tags  map[string]string
+}
+
+// ParseTemplate parses template "[filter] template [tag=value,...]" like host.measurement* or servers.* .host.measurement*
+func ParseTemplate(s string) (Template, error) {
+	fields := strings.Fields(s)
+	var t Template
+	if len(fields) > 1 && strings.Contains(fields[len(fields)-1], "=") {
+		t.tags = make(map[string]string)
+		for _, tag := range strings.Split(fields[len(fields)-1], ",") {
+			eq := strings.IndexByte(tag, '=')
+			if eq <= 0 {
+				return t, fmt.Errorf("%w: wrong tag %q of template %q", ErrWrongFormat, tag, s)
+			}
+			t.tags[tag[:eq]] = tag[eq+1:]
+		}
+		fields = fields[:len(fields)-1]
+	}
+	switch len(fields) {
+	case 1:
+		t.parts = strings.Split(fields[0], ".")
+	case 2:
+		t.filter = strings.Split(fields[0], ".")
+		t.parts = strings.Split(fields[1], ".")
+	default:
+		return t, fmt.Errorf("%w: template %q", ErrWrongFormat, s)
+	}
+	hasMeasurement := false
+	for i, part := range t.parts {
+		switch part {
+		case partMeasurement:
+			hasMeasurement = true
+		case partMeasurementRest:
+			hasMeasurement = true
+			if i != len(t.parts)-1 {
+				return t, fmt.Errorf("%w: %s must be the last node of template %q", ErrWrongFormat, partMeasurementRest, s)
+			}
+		}
+	}
+	if !hasMeasurement {
+		return t, fmt.Errorf("%w: template %q has no measurement", ErrWrongFormat, s)
+	}
+	return t, nil
+}
+
+// Match checks if nodes of path match filter of template
+func (t Template) Match(nodes []string) bool {
+	if len(t.filter) == 0 {
+		return true
+	}
+	if len(nodes) < len(t.filter) {
+		return false
+	}
+	for i, pattern := range t.filter {
+		if pattern != "*" && pattern != nodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply maps nodes of path to metric ID and labels, nodes named by the same label are joined with dots.
+// Nodes beyond template are ignored unless the last part is measurement*
+func (t Template) Apply(nodes []string) (string, map[string]string) {
+	var measurement []string
+	values := make(map[string][]string)
+	for i, part := range t.parts {
+		if i >= len(nodes) {
+			break
+		}
+		switch part {
+		case "":
+		case partMeasurement:
+			measurement = append(measurement, nodes[i])
+		case partMeasurementRest:
+			measurement = append(measurement, nodes[i:]...)
+		default:
+			values[part] = append(values[part], nodes[i])
+		}
+	}
+	if len(t.tags) == 0 && len(values) == 0 {
+		return strings.Join(measurement, "."), nil
+	}
+	l := make(map[string]string, len(t.tags)+len(values))
+	for name, value := range t.tags {
+		l[name] = value
+	}
+	for name, value := range values {
+		l[name] = strings.Join(value, ".")
+	}
+	return strings.Join(measurement, "."), l
+}
+
+// Templates maps paths by the first template matching them, paths matching no template become IDs as they are
+type Templates []Template
+
+// ParseTemplates parses templates in order they are tried
+func ParseTemplates(templates []string) (Templates, error) {
+	parsed := make(Templates, 0, len(templates))
+	for _, s := range templates {
+		t, err := ParseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, t)
+	}
+	return parsed, nil
+}
+
+// Metric maps point to gauge, tags of tagged path win over labels of template
+func (ts Templates) Metric(p Point) (types.Metrics, error) {
+	id, l := p.Path, map[string]string(nil)
+	nodes := strings.Split(p.Path, ".")
+	for _, t := range ts {
+		if t.Match(nodes) {
+			id, l = t.Apply(nodes)
+			break
+		}
+	}
+	if id == "" {
+		return types.Metrics{}, fmt.Errorf("%w: template maps %s to empty ID", ErrWrongFormat, p.Path)
+	}
+	for name, value := range p.Tags {
+		if l == nil {
+			l = make(map[string]string, len(p.Tags))
+		}
+		l[name] = value
+	}
+	if err := labels.Validate(l); err != nil {
+		return types.Metrics{}, fmt.Errorf("%w: %v", ErrWrongFormat, err)
+	}
+	value := p.Value
+	return types.Metrics{ID: id, MType: "gauge", Value: &value, Labels: l}, nil
+}
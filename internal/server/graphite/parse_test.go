@@ -0,0 +1,129 @@
+package graphite
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestParseLine tests parsing of plaintext lines with tagged paths and timestamps
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		point   Point
+		wantErr bool
+	}{
+		{name: "path value timestamp", line: "servers.web01.cpu.load 1.5 1700000000", point: Point{Path: "servers.web01.cpu.load", Value: 1.5, Time: time.Unix(1700000000, 0)}},
+		{name: "tagged path", line: "cpu.load;host=web01;dc=eu 2 1700000000.5", point: Point{Path: "cpu.load", Tags: map[string]string{"host": "web01", "dc": "eu"}, Value: 2, Time: time.Unix(1700000000, 5e8)}},
+		{name: "wrong value", line: "cpu.load abc 1700000000", wantErr: true},
+		{name: "infinite value", line: "cpu.load +Inf 1700000000", wantErr: true},
+		{name: "wrong timestamp", line: "cpu.load 1 yesterday", wantErr: true},
+		{name: "empty node", line: "cpu..load 1 1700000000", wantErr: true},
+		{name: "wrong tag", line: "cpu.load;host 1 1700000000", wantErr: true},
+		{name: "too many fields", line: "cpu.load 1 1700000000 extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrWrongFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.point.Path, p.Path)
+			assert.Equal(t, tt.point.Tags, p.Tags)
+			assert.Equal(t, tt.point.Value, p.Value)
+			assert.True(t, tt.point.Time.Equal(p.Time), p.Time)
+		})
+	}
+
+	p, err := ParseLine("cpu.load 1 -1")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), p.Time, time.Minute, "timestamp -1 means now")
+
+	_, err = ParseLine("cpu.load 1 " + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	assert.ErrorIs(t, err, ErrWrongFormat, "timestamp in the future")
+}
+
+// TestTemplates tests mapping of paths to IDs and labels by the first matching template
+func TestTemplates(t *testing.T) {
+	templates, err := ParseTemplates([]string{
+		"servers.* .host.measurement* env=prod",
+		"stats.*.* .dc.host.measurement.measurement",
+		"region.host.measurement*",
+	})
+	require.NoError(t, err)
+	tests := []struct {
+		name   string
+		point  Point
+		id     string
+		labels map[string]string
+	}{
+		{name: "filter with default tags", point: Point{Path: "servers.web01.cpu.load"}, id: "cpu.load", labels: map[string]string{"host": "web01", "env": "prod"}},
+		{name: "nodes beyond template are ignored", point: Point{Path: "stats.eu.web01.http.requests.total"}, id: "http.requests", labels: map[string]string{"dc": "eu", "host": "web01"}},
+		{name: "template without filter", point: Point{Path: "eu.web01.mem.free"}, id: "mem.free", labels: map[string]string{"region": "eu", "host": "web01"}},
+		{name: "tags of path win", point: Point{Path: "servers.web01.cpu", Tags: map[string]string{"host": "web02"}}, id: "cpu", labels: map[string]string{"host": "web02", "env": "prod"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.point.Value = 1
+			m, err := templates.Metric(tt.point)
+			require.NoError(t, err)
+			value := 1.0
+			assert.Equal(t, types.Metrics{ID: tt.id, MType: "gauge", Value: &value, Labels: tt.labels}, m)
+		})
+	}
+
+	m, err := Templates(nil).Metric(Point{Path: "servers.web01.cpu", Value: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "servers.web01.cpu", m.ID, "paths matching no template are IDs")
+	assert.Nil(t, m.Labels)
+
+	for _, wrong := range []string{"servers.* host.cpu", "measurement*.host", "a b c d", "measurement env"} {
+		_, err = ParseTemplate(wrong)
+		assert.ErrorIs(t, err, ErrWrongFormat, wrong)
+	}
+}
+
+// TestParsePickle tests decoding of pickles of protocols 0, 2 and 4 as carbon sends them
+func TestParsePickle(t *testing.T) {
+	pickles := map[string]string{
+		"protocol 0": "(lp0\n(Vservers.web01.cpu.load\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vservers.web02.cpu.load\np4\n(I1700000000\nI2\ntp5\ntp6\na(Vbad\np7\n(Vx\np8\nVy\np9\ntp10\ntp11\na.",
+		"protocol 2": "\x80\x02]q\x00(X\x16\x00\x00\x00servers.web01.cpu.loadq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x16\x00\x00\x00servers.web02.cpu.loadq\x04J\x00\xf1SeK\x02\x86q\x05\x86q\x06X\x03\x00\x00\x00badq\x07X\x01\x00\x00\x00xq\x08X\x01\x00\x00\x00yq\t\x86q\n\x86q\x0be.",
+		"protocol 4": "\x80\x04\x95f\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x16servers.web01.cpu.load\x94J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x16servers.web02.cpu.load\x94J\x00\xf1SeK\x02\x86\x94\x86\x94\x8c\x03bad\x94\x8c\x01x\x94\x8c\x01y\x94\x86\x94\x86\x94e.",
+	}
+	for name, data := range pickles {
+		t.Run(name, func(t *testing.T) {
+			points, errs, err := ParsePickle([]byte(data))
+			require.NoError(t, err)
+			assert.Len(t, errs, 1, "wrong point is skipped")
+			require.Len(t, points, 2)
+			assert.Equal(t, "servers.web01.cpu.load", points[0].Path)
+			assert.Equal(t, 1.5, points[0].Value)
+			assert.True(t, time.Unix(1700000000, 0).Equal(points[0].Time))
+			assert.Equal(t, "servers.web02.cpu.load", points[1].Path)
+			assert.Equal(t, 2.0, points[1].Value)
+		})
+	}
+
+	points, _, err := ParsePickle([]byte("\x80\x02]q\x00X\x01\x00\x00\x00aq\x01K\x01J\xd4\xfe\xff\xff\x86q\x02\x86q\x03a."))
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, -300.0, points[0].Value)
+
+	for name, data := range map[string]string{
+		"global":    "\x80\x02cposix\nsystem\nq\x00.",
+		"truncated": "\x80\x02]q\x00X\x16\x00\x00\x00servers",
+		"not list":  "\x80\x02K\x01.",
+		"no stop":   "\x80\x02]q\x00",
+	} {
+		_, _, err = ParsePickle([]byte(data))
+		assert.ErrorIs(t, err, ErrWrongFormat, name)
+	}
+}
@@ -0,0 +1,417 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// pickle opcodes of lists, tuples, strings and numbers, other opcodes like GLOBAL or REDUCE are rejected
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opPopMark        = '1'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opBinInt2        = 'M'
+	opLong           = 'L'
+	opNone           = 'N'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+	opAppend         = 'a'
+	opAppends        = 'e'
+	opFloat          = 'F'
+	opBinFloat       = 'G'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opList           = 'l'
+	opEmptyList      = ']'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opTuple          = 't'
+	opEmptyTuple     = ')'
+	opProto          = 0x80
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opLong1          = 0x8a
+	opShortBinUni    = 0x8c
+	opBinUnicode8    = 0x8d
+	opMemoize        = 0x94
+	opFrame          = 0x95
+)
+
+// mark is a pickle stack mark
+type mark struct{}
+
+// pickleList is a list, it is a pointer because lists in memo are appended to
+type pickleList struct {
+	items []interface{}
+}
+
+// unpickler decodes pickled lists and tuples of strings and numbers
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// read returns next n bytes of data
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, fmt.Errorf("%w: pickle is truncated", ErrWrongFormat)
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+// readLine returns data up to the next line feed
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return "", fmt.Errorf("%w: pickle is truncated", ErrWrongFormat)
+	}
+	line := string(u.data[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+// readUint reads little endian unsigned integer of n bytes
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// readString reads string with length of n bytes
+func (u *unpickler) readString(n int) (string, error) {
+	length, err := u.readUint(n)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(len(u.data)) {
+		return "", fmt.Errorf("%w: pickle is truncated", ErrWrongFormat)
+	}
+	b, err := u.read(int(length))
+	return string(b), err
+}
+
+// pop removes the top of stack
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("%w: pickle stack is empty", ErrWrongFormat)
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// popMark removes items up to the last mark from stack and returns them
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(mark); ok {
+			items := append([]interface{}(nil), u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: pickle has no mark", ErrWrongFormat)
+}
+
+// popTuple removes n items from stack and returns them as tuple
+func (u *unpickler) popTuple(n int) ([]interface{}, error) {
+	if len(u.stack) < n {
+		return nil, fmt.Errorf("%w: pickle stack is empty", ErrWrongFormat)
+	}
+	tuple := append([]interface{}(nil), u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	return tuple, nil
+}
+
+// appendTo appends items to list on the top of stack
+func (u *unpickler) appendTo(items ...interface{}) error {
+	if len(u.stack) == 0 {
+		return fmt.Errorf("%w: pickle stack is empty", ErrWrongFormat)
+	}
+	list, ok := u.stack[len(u.stack)-1].(*pickleList)
+	if !ok {
+		return fmt.Errorf("%w: pickle appends to not a list", ErrWrongFormat)
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+// put memoizes the top of stack at index
+func (u *unpickler) put(index int) error {
+	if len(u.stack) == 0 {
+		return fmt.Errorf("%w: pickle stack is empty", ErrWrongFormat)
+	}
+	u.memo[index] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+// get pushes memoized value at index
+func (u *unpickler) get(index int) error {
+	v, ok := u.memo[index]
+	if !ok {
+		return fmt.Errorf("%w: pickle memo has no %d", ErrWrongFormat, index)
+	}
+	u.stack = append(u.stack, v)
+	return nil
+}
+
+// unquote removes quotes of string written by protocol 0
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || s[0] != '\'' && s[0] != '"' || strings.ContainsRune(s, '\\') {
+		return "", fmt.Errorf("%w: pickle string %s", ErrWrongFormat, s)
+	}
+	return s[1 : len(s)-1], nil
+}
+
+// unpickle decodes pickled value, lists are *pickleList, tuples are []interface{}
+func unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{data: data, memo: make(map[int]interface{})}
+	for {
+		op, err := u.read(1)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			v    interface{}
+			push = true
+		)
+		switch op[0] {
+		case opStop:
+			if len(u.stack) != 1 {
+				return nil, fmt.Errorf("%w: pickle stack has %d values", ErrWrongFormat, len(u.stack))
+			}
+			return u.stack[0], nil
+		case opProto:
+			_, err = u.read(1)
+			push = false
+		case opFrame:
+			_, err = u.read(8)
+			push = false
+		case opMark:
+			v = mark{}
+		case opPop:
+			_, err = u.pop()
+			push = false
+		case opPopMark:
+			_, err = u.popMark()
+			push = false
+		case opNone:
+			v = nil
+		case opNewTrue:
+			v = true
+		case opNewFalse:
+			v = false
+		case opInt:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				switch line {
+				case "00":
+					v = false
+				case "01":
+					v = true
+				default:
+					v, err = strconv.ParseInt(line, 10, 64)
+				}
+			}
+		case opLong:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				v, err = strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+			}
+		case opBinInt:
+			var n uint64
+			n, err = u.readUint(4)
+			v = int64(int32(uint32(n)))
+		case opBinInt1:
+			var n uint64
+			n, err = u.readUint(1)
+			v = int64(n)
+		case opBinInt2:
+			var n uint64
+			n, err = u.readUint(2)
+			v = int64(n)
+		case opLong1:
+			var b []byte
+			if b, err = u.read(1); err == nil {
+				if b[0] > 8 {
+					return nil, fmt.Errorf("%w: pickle integer is too large", ErrWrongFormat)
+				}
+				n := int(b[0])
+				var x uint64
+				if x, err = u.readUint(n); err == nil && n > 0 && n < 8 && x&(1<<(8*n-1)) != 0 {
+					x -= 1 << (8 * n)
+				}
+				v = int64(x)
+			}
+		case opFloat:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				v, err = strconv.ParseFloat(line, 64)
+			}
+		case opBinFloat:
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				v = math.Float64frombits(binary.BigEndian.Uint64(b))
+			}
+		case opString:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				v, err = unquote(line)
+			}
+		case opUnicode:
+			v, err = u.readLine()
+		case opShortBinString, opShortBinBytes, opShortBinUni:
+			v, err = u.readString(1)
+		case opBinString, opBinBytes, opBinUnicode:
+			v, err = u.readString(4)
+		case opBinUnicode8:
+			v, err = u.readString(8)
+		case opEmptyList:
+			v = &pickleList{}
+		case opList:
+			var items []interface{}
+			items, err = u.popMark()
+			v = &pickleList{items: items}
+		case opAppend:
+			if v, err = u.pop(); err == nil {
+				err = u.appendTo(v)
+			}
+			push = false
+		case opAppends:
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTo(items...)
+			}
+			push = false
+		case opEmptyTuple:
+			v = []interface{}{}
+		case opTuple:
+			v, err = u.popMark()
+		case opTuple1, opTuple2, opTuple3:
+			v, err = u.popTuple(int(op[0]-opTuple1) + 1)
+		case opPut, opGet:
+			var (
+				line  string
+				index int
+			)
+			if line, err = u.readLine(); err == nil {
+				if index, err = strconv.Atoi(line); err == nil {
+					if op[0] == opPut {
+						err = u.put(index)
+					} else {
+						err = u.get(index)
+					}
+				}
+			}
+			push = false
+		case opBinPut, opBinGet, opLongBinPut, opLongBinGet:
+			size := 1
+			if op[0] == opLongBinPut || op[0] == opLongBinGet {
+				size = 4
+			}
+			var index uint64
+			if index, err = u.readUint(size); err == nil {
+				if op[0] == opBinPut || op[0] == opLongBinPut {
+					err = u.put(int(index))
+				} else {
+					err = u.get(int(index))
+				}
+			}
+			push = false
+		case opMemoize:
+			err = u.put(len(u.memo))
+			push = false
+		default:
+			return nil, fmt.Errorf("%w: unsupported pickle opcode 0x%02x", ErrWrongFormat, op[0])
+		}
+		if err != nil && !errors.Is(err, ErrWrongFormat) {
+			err = fmt.Errorf("%w: %v", ErrWrongFormat, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if push {
+			u.stack = append(u.stack, v)
+		}
+	}
+}
+
+// pickleNumber formats number or string of pickle
+func pickleNumber(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+// ParsePickle parses pickled list of (path, (timestamp, value)) tuples as carbon sends it.
+// Wrong points are skipped and returned as errs, err is returned if pickle can't be decoded
+func ParsePickle(data []byte) (points []Point, errs []error, err error) {
+	v, err := unpickle(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, ok := v.(*pickleList)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: pickle is not a list", ErrWrongFormat)
+	}
+	for _, item := range list.items {
+		metric, ok := item.([]interface{})
+		if !ok || len(metric) != 2 {
+			errs = append(errs, fmt.Errorf("%w: pickled metric is not a (path, (timestamp, value)) tuple", ErrWrongFormat))
+			continue
+		}
+		path, ok := metric[0].(string)
+		datapoint, isTuple := metric[1].([]interface{})
+		if !ok || !isTuple || len(datapoint) != 2 {
+			errs = append(errs, fmt.Errorf("%w: pickled metric is not a (path, (timestamp, value)) tuple", ErrWrongFormat))
+			continue
+		}
+		timestamp, okTimestamp := pickleNumber(datapoint[0])
+		value, okValue := pickleNumber(datapoint[1])
+		if !okTimestamp || !okValue {
+			errs = append(errs, fmt.Errorf("%w: wrong datapoint of %s", ErrWrongFormat, path))
+			continue
+		}
+		p, err := newPoint(path, value, timestamp)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		points = append(points, p)
+	}
+	return points, errs, nil
+}
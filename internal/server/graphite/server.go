@@ -0,0 +1,280 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/clientip"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// maxLineSize is a maximum size of plaintext line
+const maxLineSize = 64 << 10
+
+// maxFrameSize is a maximum size of pickle frame, it is used when MaxFrameSize is 0 or greater
+const maxFrameSize = 16 << 20
+
+// Server receives Graphite metrics over TCP and saves them to storage as gauges
+type Server struct {
+	Addr       string
+	PickleAddr string
+	Storage    storage.Storage
+	Templates  Templates
+	// TrustedSubnet is a list of networks connections are accepted from, connections from anywhere are accepted if it is empty
+	TrustedSubnet clientip.Nets
+	// MaxBatchSize is a maximum number of metrics saved at once, 0 means no limit
+	MaxBatchSize int
+	// MaxFrameSize is a maximum size of pickle frame in bytes, 0 or values over maxFrameSize mean maxFrameSize
+	MaxFrameSize int64
+	Debug        bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer creates Graphite server saving metrics to store, it fails if templates are wrong
+func NewServer(cfg config.Config, store storage.Storage) (*Server, error) {
+	templates, err := ParseTemplates(cfg.GraphiteTemplates)
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := clientip.ParseNets(cfg.TrustedSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing trusted subnet: %w", err)
+	}
+	return &Server{
+		Addr:          cfg.GraphiteAddress,
+		PickleAddr:    cfg.GraphitePickleAddress,
+		Storage:       store,
+		Templates:     templates,
+		TrustedSubnet: subnet,
+		MaxBatchSize:  cfg.MaxBatchSize,
+		MaxFrameSize:  cfg.MaxBodySize,
+		Debug:         cfg.Debug,
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve accepts plaintext connections from l until server is shut down
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, s.handlePlaintext)
+}
+
+// ServePickle accepts pickle connections from l until server is shut down
+func (s *Server) ServePickle(l net.Listener) error {
+	return s.serve(l, s.handlePickle)
+}
+
+// serve accepts connections from l and handles every one of them in its own goroutine
+func (s *Server) serve(l net.Listener, handle func(conn net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			loggers.ErrorLogger.Println("error while accepting graphite connection:", err)
+			continue
+		}
+		if len(s.TrustedSubnet) > 0 {
+			if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !s.TrustedSubnet.Contains(tcpAddr.IP) {
+				if s.Debug {
+					loggers.DebugLogger.Println("graphite connection from untrusted address", conn.RemoteAddr())
+				}
+				conn.Close()
+				continue
+			}
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// handlePlaintext reads lines of conn, wrong lines are skipped.
+// Metrics are saved when no more lines are buffered or batch is full
+func (s *Server) handlePlaintext(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, maxLineSize)
+	var batch []types.Metrics
+	for {
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			loggers.ErrorLogger.Println("graphite line is too long, closing connection from", conn.RemoteAddr())
+			break
+		}
+		if len(line) > 0 {
+			if m, ok := s.metric(string(line)); ok {
+				batch = append(batch, m)
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				loggers.ErrorLogger.Println("error while reading graphite connection:", err)
+			}
+			break
+		}
+		if r.Buffered() == 0 || s.MaxBatchSize > 0 && len(batch) >= s.MaxBatchSize {
+			s.save(batch)
+			batch = batch[:0]
+		}
+	}
+	s.save(batch)
+}
+
+// metric parses plaintext line and maps it to metric, it logs wrong lines
+func (s *Server) metric(line string) (types.Metrics, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return types.Metrics{}, false
+	}
+	p, err := ParseLine(line)
+	if err != nil {
+		loggers.ErrorLogger.Println("error while parsing graphite line:", err)
+		return types.Metrics{}, false
+	}
+	m, err := s.Templates.Metric(p)
+	if err != nil {
+		loggers.ErrorLogger.Println("error while mapping graphite metric:", err)
+		return types.Metrics{}, false
+	}
+	return m, true
+}
+
+// handlePickle reads frames of conn, every frame is a 4 byte big endian length and pickled list of metrics
+func (s *Server) handlePickle(conn net.Conn) {
+	var header [4]byte
+	limit := s.MaxFrameSize
+	if limit <= 0 || limit > maxFrameSize {
+		limit = maxFrameSize
+	}
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				loggers.ErrorLogger.Println("error while reading graphite pickle connection:", err)
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if int64(size) > limit {
+			loggers.ErrorLogger.Printf("graphite pickle frame of %d bytes is too large, closing connection from %s", size, conn.RemoteAddr())
+			return
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			loggers.ErrorLogger.Println("error while reading graphite pickle frame:", err)
+			return
+		}
+		points, errs, err := ParsePickle(frame)
+		if err != nil {
+			loggers.ErrorLogger.Println("error while parsing graphite pickle, closing connection:", err)
+			return
+		}
+		for _, err = range errs {
+			loggers.ErrorLogger.Println("error while parsing graphite pickle:", err)
+		}
+		batch := make([]types.Metrics, 0, len(points))
+		for _, p := range points {
+			m, err := s.Templates.Metric(p)
+			if err != nil {
+				loggers.ErrorLogger.Println("error while mapping graphite metric:", err)
+				continue
+			}
+			batch = append(batch, m)
+			if s.MaxBatchSize > 0 && len(batch) >= s.MaxBatchSize {
+				s.save(batch)
+				batch = batch[:0]
+			}
+		}
+		s.save(batch)
+	}
+}
+
+// save saves metrics to storage
+func (s *Server) save(metrics []types.Metrics) {
+	if len(metrics) == 0 {
+		return
+	}
+	if err := s.Storage.SaveManyMetrics(metrics, ""); err != nil {
+		loggers.ErrorLogger.Println("error while saving graphite metrics:", err)
+		return
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("saved %d graphite metrics", len(metrics))
+	}
+}
+
+// Shutdown stops accepting connections and closes open ones, metrics read so far are saved.
+// It waits for connections to be handled until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
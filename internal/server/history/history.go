@@ -0,0 +1,176 @@
+// Package history stores time series of metric values
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// series stores samples of one metric sorted by time
+type series struct {
+	mtype   string
+	samples []types.Sample
+	// compacted is a number of leading samples which are already downsampled
+	compacted int
+	// buckets describe samples merged into each of compacted samples
+	buckets []bucket
+}
+
+// bucket describes samples merged into one downsampled sample
+type bucket struct {
+	count int
+	// last is a timestamp of the latest merged sample
+	last time.Time
+}
+
+// add merges sample into downsampled sample p. Gauges are averaged with number of merged samples as a weight,
+// other types keep the value of the latest sample
+func (b *bucket) add(p *types.Sample, sample types.Sample, mtype string) {
+	if mtype == "gauge" {
+		p.Value = (p.Value*float64(b.count) + sample.Value) / float64(b.count+1)
+	} else if !sample.Timestamp.Before(b.last) {
+		p.Value = sample.Value
+		b.last = sample.Timestamp
+	}
+	b.count++
+}
+
+// History stores time series of all metrics
+type History struct {
+	mu sync.RWMutex
+	// Retention is a period of time samples are kept for, 0 means forever
+	Retention time.Duration
+	// Resolution is a width of buckets older samples are downsampled to, 0 disables downsampling
+	Resolution time.Duration
+	series     map[string]*series
+}
+
+// NewHistory creates new History
+func NewHistory(retention, resolution time.Duration) *History {
+	return &History{
+		Retention:  retention,
+		Resolution: resolution,
+		series:     make(map[string]*series),
+	}
+}
+
+// key makes a key of metric's series
+func key(m types.Metrics) string {
+	return m.ID + ":" + m.MType + labels.String(m.Labels)
+}
+
+// Append adds a sample to metric's series. Series is compacted at current time,
+// as timestamps of samples come from clients
+func (h *History) Append(m types.Metrics, ts time.Time, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key(m)]
+	if !ok {
+		s = &series{mtype: m.MType}
+		h.series[key(m)] = s
+	}
+	sample := types.Sample{Timestamp: ts, Value: value}
+	if n := len(s.samples); n == 0 || !ts.Before(s.samples[n-1].Timestamp) {
+		s.samples = append(s.samples, sample)
+	} else if s.compacted > 0 && h.Resolution > 0 && ts.Before(s.samples[s.compacted-1].Timestamp.Add(h.Resolution)) {
+		s.addLate(sample, h.Resolution)
+	} else {
+		i := s.compacted + sort.Search(n-s.compacted, func(i int) bool { return s.samples[s.compacted+i].Timestamp.After(ts) })
+		s.samples = append(s.samples, types.Sample{})
+		copy(s.samples[i+1:], s.samples[i:])
+		s.samples[i] = sample
+	}
+	s.compact(time.Now(), h.Retention, h.Resolution)
+}
+
+// Range returns samples of metric with timestamps in [from, to]
+func (h *History) Range(m types.Metrics, from, to time.Time) []types.Sample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	s, ok := h.series[key(m)]
+	if !ok {
+		return nil
+	}
+	if h.Retention > 0 {
+		if border := time.Now().Add(-h.Retention); from.Before(border) {
+			from = border
+		}
+	}
+	start := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].Timestamp.Before(from) })
+	end := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp.After(to) })
+	if start >= end {
+		return nil
+	}
+	samples := make([]types.Sample, end-start)
+	copy(samples, s.samples[start:end])
+	return samples
+}
+
+// Compact drops expired samples and downsamples old ones in all series
+func (h *History) Compact(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, s := range h.series {
+		s.compact(now, h.Retention, h.Resolution)
+		if len(s.samples) == 0 {
+			delete(h.series, k)
+		}
+	}
+}
+
+// compact drops samples older than retention and merges samples from complete buckets of resolution width.
+// Gauges are merged to their average, cumulative values of counters, histograms and summaries to their last value
+func (s *series) compact(now time.Time, retention, resolution time.Duration) {
+	if retention > 0 {
+		border := now.Add(-retention)
+		i := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].Timestamp.Before(border) })
+		s.samples = s.samples[i:]
+		if i > s.compacted {
+			i = s.compacted
+		}
+		s.buckets = s.buckets[i:]
+		s.compacted -= i
+	}
+	if resolution <= 0 {
+		return
+	}
+	cutoff := now.Truncate(resolution)
+	merged := s.samples[:s.compacted]
+	buckets := s.buckets[:s.compacted]
+	j := s.compacted
+	for ; j < len(s.samples) && s.samples[j].Timestamp.Before(cutoff); j++ {
+		sample := s.samples[j]
+		start := sample.Timestamp.Truncate(resolution)
+		if k := len(merged) - 1; k >= 0 && merged[k].Timestamp.Equal(start) {
+			buckets[k].add(&merged[k], sample, s.mtype)
+			continue
+		}
+		merged = append(merged, types.Sample{Timestamp: start, Value: sample.Value})
+		buckets = append(buckets, bucket{count: 1, last: sample.Timestamp})
+	}
+	s.compacted = len(merged)
+	s.buckets = buckets
+	s.samples = append(merged, s.samples[j:]...)
+}
+
+// addLate merges sample older than the end of the last downsampled bucket into its bucket,
+// so that downsampled samples are never split back to raw ones
+func (s *series) addLate(sample types.Sample, resolution time.Duration) {
+	start := sample.Timestamp.Truncate(resolution)
+	k := sort.Search(s.compacted, func(k int) bool { return !s.samples[k].Timestamp.Before(start) })
+	if k < s.compacted && s.samples[k].Timestamp.Equal(start) {
+		s.buckets[k].add(&s.samples[k], sample, s.mtype)
+		return
+	}
+	s.samples = append(s.samples, types.Sample{})
+	copy(s.samples[k+1:], s.samples[k:])
+	s.samples[k] = types.Sample{Timestamp: start, Value: sample.Value}
+	s.buckets = append(s.buckets, bucket{})
+	copy(s.buckets[k+1:], s.buckets[k:])
+	s.buckets[k] = bucket{count: 1, last: sample.Timestamp}
+	s.compacted++
+}
@@ -0,0 +1,148 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestHistory tests retention and downsampling of samples
+func TestHistory(t *testing.T) {
+	base := time.Now().Truncate(time.Minute).Add(-10 * time.Minute)
+	tests := []struct {
+		name       string
+		mtype      string
+		retention  time.Duration
+		resolution time.Duration
+		values     []float64
+		want       []types.Sample
+	}{
+		{
+			name:      "samples are kept raw without resolution",
+			mtype:     "gauge",
+			retention: time.Hour,
+			values:    []float64{1, 2, 3},
+			want: []types.Sample{
+				{Timestamp: base, Value: 1},
+				{Timestamp: base.Add(20 * time.Second), Value: 2},
+				{Timestamp: base.Add(40 * time.Second), Value: 3},
+			},
+		},
+		{
+			name:       "gauge samples are averaged in complete buckets",
+			mtype:      "gauge",
+			retention:  time.Hour,
+			resolution: time.Minute,
+			values:     []float64{1, 2, 3, 10},
+			want: []types.Sample{
+				{Timestamp: base, Value: 2},
+				{Timestamp: base.Add(time.Minute), Value: 10},
+			},
+		},
+		{
+			name:       "counter samples keep last value in complete buckets",
+			mtype:      "counter",
+			retention:  time.Hour,
+			resolution: time.Minute,
+			values:     []float64{1, 2, 3, 10},
+			want: []types.Sample{
+				{Timestamp: base, Value: 3},
+				{Timestamp: base.Add(time.Minute), Value: 10},
+			},
+		},
+		{
+			name:      "expired samples are dropped",
+			mtype:     "gauge",
+			retention: 5 * time.Minute,
+			values:    []float64{1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHistory(tt.retention, tt.resolution)
+			m := types.Metrics{ID: "Alloc", MType: tt.mtype, Labels: map[string]string{"host": "a"}}
+			for i, v := range tt.values {
+				h.Append(m, base.Add(time.Duration(i)*20*time.Second), v)
+			}
+			h.Compact(time.Now())
+			assert.Equal(t, tt.want, h.Range(m, base, time.Now()))
+			assert.Empty(t, h.Range(types.Metrics{ID: "Alloc", MType: tt.mtype}, base, time.Now()))
+		})
+	}
+}
+
+// TestAppendFutureSample tests that sample with timestamp in the future doesn't expire other samples
+func TestAppendFutureSample(t *testing.T) {
+	now := time.Now()
+	h := NewHistory(24*time.Hour, 0)
+	m := types.Metrics{ID: "up", MType: "gauge"}
+	h.Append(m, now.Add(-time.Minute), 1)
+	h.Append(m, now, 2)
+	h.Append(m, now.Add(48*time.Hour), 3)
+	assert.Equal(t, []types.Sample{
+		{Timestamp: now.Add(-time.Minute), Value: 1},
+		{Timestamp: now, Value: 2},
+	}, h.Range(m, now.Add(-24*time.Hour), now))
+}
+
+// TestAppendLateSample tests that late samples are merged into downsampled buckets with their weights
+func TestAppendLateSample(t *testing.T) {
+	base := time.Now().Truncate(time.Minute).Add(-10 * time.Minute)
+	tests := []struct {
+		name  string
+		mtype string
+		late  []types.Sample
+		want  []types.Sample
+	}{
+		{
+			name:  "gauge is averaged with all samples of bucket",
+			mtype: "gauge",
+			late: []types.Sample{
+				{Timestamp: base.Add(50 * time.Second), Value: 6},
+				{Timestamp: base.Add(110 * time.Second), Value: 40},
+			},
+			want: []types.Sample{
+				{Timestamp: base, Value: 3},
+				{Timestamp: base.Add(time.Minute), Value: 25},
+			},
+		},
+		{
+			name:  "counter keeps value of the latest sample",
+			mtype: "counter",
+			late:  []types.Sample{{Timestamp: base.Add(10 * time.Second), Value: 100}},
+			want: []types.Sample{
+				{Timestamp: base, Value: 3},
+				{Timestamp: base.Add(time.Minute), Value: 30},
+			},
+		},
+		{
+			name:  "sample of empty bucket makes new bucket",
+			mtype: "counter",
+			late:  []types.Sample{{Timestamp: base.Add(-30 * time.Second), Value: 100}},
+			want: []types.Sample{
+				{Timestamp: base.Add(-time.Minute), Value: 100},
+				{Timestamp: base, Value: 3},
+				{Timestamp: base.Add(time.Minute), Value: 30},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHistory(time.Hour, time.Minute)
+			m := types.Metrics{ID: "Alloc", MType: tt.mtype}
+			for i, v := range []float64{1, 2, 3, 10, 20, 30} {
+				h.Append(m, base.Add(time.Duration(i)*20*time.Second), v)
+			}
+			h.Compact(time.Now())
+			for _, sample := range tt.late {
+				h.Append(m, sample.Timestamp, sample.Value)
+				h.Compact(time.Now())
+			}
+			assert.Equal(t, tt.want, h.Range(m, base.Add(-time.Hour), time.Now()))
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package influx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// SeriesTTL is a period after which cumulative series which are not written are forgotten
+const SeriesTTL = time.Hour
+
+// point is the last cumulative value of series
+type point struct {
+	value int64
+	seen  time.Time
+}
+
+// Cumulative turns cumulative values of counters into changes since the previous point of series.
+// The first point of series is a baseline with no change: stored counter may be updated by other writers,
+// so it is not the previous value of series. Value less than the previous one means that source was reset,
+// then the whole value is a change. Series not written for TTL are forgotten and start with a baseline again
+type Cumulative struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	last    map[string]point
+	evicted time.Time
+}
+
+// NewCumulative creates Cumulative forgetting series after ttl
+func NewCumulative(ttl time.Duration) *Cumulative {
+	return &Cumulative{TTL: ttl, last: make(map[string]point), evicted: time.Now()}
+}
+
+// Save turns counters of metrics into changes and saves metrics with save.
+// Series are updated only if metrics are saved
+func (c *Cumulative) Save(metrics []types.Metrics, save func([]types.Metrics) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// values are remembered only if metrics are saved
+	last := make(map[string]int64)
+	for i, m := range metrics {
+		if m.MType != "counter" {
+			continue
+		}
+		k := m.ID + labels.String(m.Labels)
+		prev, ok := last[k]
+		if !ok {
+			var p point
+			p, ok = c.last[k]
+			ok = ok && now.Sub(p.seen) <= c.TTL
+			prev = p.value
+		}
+		var delta int64
+		switch {
+		case !ok:
+		case *m.Delta >= prev:
+			delta = *m.Delta - prev
+		default:
+			delta = *m.Delta
+		}
+		last[k] = *m.Delta
+		metrics[i].Delta = &delta
+	}
+	if err := save(metrics); err != nil {
+		return err
+	}
+	for k, value := range last {
+		c.last[k] = point{value: value, seen: now}
+	}
+	if now.Sub(c.evicted) >= c.TTL {
+		for k, p := range c.last {
+			if now.Sub(p.seen) > c.TTL {
+				delete(c.last, k)
+			}
+		}
+		c.evicted = now
+	}
+	return nil
+}
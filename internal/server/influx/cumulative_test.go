@@ -0,0 +1,57 @@
+package influx
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// counter makes counter metric holding cumulative value
+func counter(id string, value int64) types.Metrics {
+	return types.Metrics{ID: id, MType: "counter", Delta: &value}
+}
+
+// TestCumulative tests that cumulative values are turned into changes with baselines and resets
+func TestCumulative(t *testing.T) {
+	c := NewCumulative(time.Hour)
+	var saved []int64
+	save := func(metrics []types.Metrics) error {
+		for _, m := range metrics {
+			saved = append(saved, *m.Delta)
+		}
+		return nil
+	}
+	require.NoError(t, c.Save([]types.Metrics{counter("a", 100), counter("a", 150)}, save))
+	require.NoError(t, c.Save([]types.Metrics{counter("a", 170)}, save))
+	// source is reset
+	require.NoError(t, c.Save([]types.Metrics{counter("a", 30)}, save))
+	assert.Equal(t, []int64{0, 50, 20, 30}, saved)
+	// change is not remembered if metrics are not saved
+	assert.Error(t, c.Save([]types.Metrics{counter("a", 80)}, func([]types.Metrics) error { return errors.New("failed") }))
+	saved = nil
+	require.NoError(t, c.Save([]types.Metrics{counter("a", 40)}, save))
+	assert.Equal(t, []int64{10}, saved)
+}
+
+// TestCumulativeEviction tests that series not written for TTL are forgotten
+func TestCumulativeEviction(t *testing.T) {
+	c := NewCumulative(time.Hour)
+	save := func([]types.Metrics) error { return nil }
+	require.NoError(t, c.Save([]types.Metrics{counter("old", 1), counter("new", 1)}, save))
+	c.last["old"] = point{value: 1, seen: time.Now().Add(-2 * time.Hour)}
+	c.evicted = time.Now().Add(-2 * time.Hour)
+
+	metrics := []types.Metrics{counter("old", 5)}
+	require.NoError(t, c.Save(metrics, save))
+	assert.Equal(t, int64(0), *metrics[0].Delta, "expired series starts with a baseline")
+	c.last["old"] = point{value: 5, seen: time.Now().Add(-2 * time.Hour)}
+	c.evicted = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, c.Save([]types.Metrics{counter("new", 2)}, save))
+	assert.NotContains(t, c.last, "old")
+	assert.Contains(t, c.last, "new")
+}
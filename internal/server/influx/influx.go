@@ -0,0 +1,224 @@
+// Package influx parses InfluxDB line protocol and maps points to metrics.
+// Every numeric field of point becomes metric named measurement_field with tags as labels
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// ErrWrongFormat is returned when line can't be parsed
+var ErrWrongFormat = errors.New("wrong line protocol format")
+
+// Point is one line of line protocol
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	// Fields are values of types float64, int64, uint64, bool or string
+	Fields map[string]interface{}
+	// Time is zero if line has no timestamp
+	Time time.Time
+}
+
+// precisions are units of timestamps by precision parameter of write request
+var precisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// ValidPrecision checks if precision of timestamps is known
+func ValidPrecision(precision string) bool {
+	_, ok := precisions[precision]
+	return ok
+}
+
+// ParseLine parses line measurement[,tag=value...] field=value[,field=value...] [timestamp].
+// Timestamp is in units of precision
+func ParseLine(line, precision string) (Point, error) {
+	var p Point
+	unit, ok := precisions[precision]
+	if !ok {
+		return p, fmt.Errorf("%w: unknown precision %q", ErrWrongFormat, precision)
+	}
+	key, rest := splitUnescaped(line, ' ', false)
+	if rest == "" {
+		return p, fmt.Errorf("%w: no fields", ErrWrongFormat)
+	}
+	parts := splitAll(key, ',', false)
+	p.Measurement = unescape(parts[0])
+	if p.Measurement == "" {
+		return p, fmt.Errorf("%w: no measurement", ErrWrongFormat)
+	}
+	for _, tag := range parts[1:] {
+		name, value := splitUnescaped(tag, '=', false)
+		if name == "" || value == "" {
+			return p, fmt.Errorf("%w: wrong tag %q", ErrWrongFormat, tag)
+		}
+		if p.Tags == nil {
+			p.Tags = make(map[string]string)
+		}
+		p.Tags[unescape(name)] = unescape(value)
+	}
+	if err := labels.Validate(p.Tags); err != nil {
+		return p, fmt.Errorf("%w: %v", ErrWrongFormat, err)
+	}
+	fields, timestamp := splitUnescaped(rest, ' ', true)
+	p.Fields = make(map[string]interface{})
+	for _, field := range splitAll(fields, ',', true) {
+		name, value := splitUnescaped(field, '=', false)
+		if name == "" || value == "" {
+			return p, fmt.Errorf("%w: wrong field %q", ErrWrongFormat, field)
+		}
+		v, err := parseFieldValue(value)
+		if err != nil {
+			return p, fmt.Errorf("%w: field %q: %v", ErrWrongFormat, unescape(name), err)
+		}
+		p.Fields[unescape(name)] = v
+	}
+	if timestamp = strings.TrimSpace(timestamp); timestamp != "" {
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || ts > math.MaxInt64/int64(unit) || ts < math.MinInt64/int64(unit) {
+			return p, fmt.Errorf("%w: wrong timestamp %q", ErrWrongFormat, timestamp)
+		}
+		p.Time = time.Unix(0, 0).Add(time.Duration(ts) * unit)
+	}
+	return p, nil
+}
+
+// parseFieldValue parses float, integer (1i), unsigned (1u), boolean or quoted string
+func parseFieldValue(value string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+			return nil, errors.New("unterminated string")
+		}
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1]), nil
+	case strings.HasSuffix(value, "i"):
+		return strconv.ParseInt(value[:len(value)-1], 10, 64)
+	case strings.HasSuffix(value, "u"):
+		return strconv.ParseUint(value[:len(value)-1], 10, 64)
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, errors.New("value must be finite")
+	}
+	return v, nil
+}
+
+// IsCounter checks if metric named measurement_field matches one of patterns of cumulative counters
+func IsCounter(id string, counters []string) bool {
+	for _, pattern := range counters {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics maps numeric and boolean fields of point to metrics observed at time of point.
+// Fields are gauges, except integer fields matching patterns of counters: they become counters
+// whose Delta holds the cumulative value of field. String fields are skipped
+func (p Point) Metrics(counters []string) []types.Metrics {
+	var metrics []types.Metrics
+	for name, value := range p.Fields {
+		m := types.Metrics{ID: p.Measurement + "_" + name, MType: "gauge", Labels: p.Tags, Timestamp: p.Time}
+		switch v := value.(type) {
+		case float64:
+			m.Value = &v
+		case bool:
+			var f float64
+			if v {
+				f = 1
+			}
+			m.Value = &f
+		case int64:
+			if IsCounter(m.ID, counters) {
+				m.MType = "counter"
+				m.Delta = &v
+				break
+			}
+			f := float64(v)
+			m.Value = &f
+		case uint64:
+			if IsCounter(m.ID, counters) {
+				if v > math.MaxInt64 {
+					continue
+				}
+				delta := int64(v)
+				m.MType = "counter"
+				m.Delta = &delta
+				break
+			}
+			f := float64(v)
+			m.Value = &f
+		default:
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// splitUnescaped splits s at the first sep which is not escaped with backslash.
+// If quoted is set separators inside double quotes are skipped
+func splitUnescaped(s string, sep byte, quoted bool) (string, string) {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+// splitAll splits s at every sep which is not escaped with backslash.
+// If quoted is set separators inside double quotes are skipped
+func splitAll(s string, sep byte, quoted bool) []string {
+	var parts []string
+	for {
+		part, rest := splitUnescaped(s, sep, quoted)
+		parts = append(parts, part)
+		if len(part) == len(s) {
+			return parts
+		}
+		s = rest
+	}
+}
+
+// unescape removes backslashes escaping commas, spaces and equal signs
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`).Replace(s)
+}
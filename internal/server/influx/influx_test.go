@@ -0,0 +1,93 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestParseLine tests parsing of line protocol with escapes, field types and timestamps
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		precision string
+		point     Point
+		wantErr   bool
+	}{
+		{
+			name: "measurement with tags and timestamp",
+			line: "cpu,host=server01,region=us-west usage_idle=98.5,cores=8i 1465839830100400200",
+			point: Point{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "server01", "region": "us-west"},
+				Fields:      map[string]interface{}{"usage_idle": 98.5, "cores": int64(8)},
+				Time:        time.Unix(0, 1465839830100400200),
+			},
+		},
+		{
+			name:      "timestamp in seconds",
+			line:      "mem free=1u,ok=true 1465839830",
+			precision: "s",
+			point: Point{
+				Measurement: "mem",
+				Fields:      map[string]interface{}{"free": uint64(1), "ok": true},
+				Time:        time.Unix(1465839830, 0),
+			},
+		},
+		{
+			name: "escaped names and string with separators",
+			line: `disk\ io,path=/mnt\,data msg="a, b=\"c\" d",read\ bytes=1`,
+			point: Point{
+				Measurement: "disk io",
+				Tags:        map[string]string{"path": "/mnt,data"},
+				Fields:      map[string]interface{}{"msg": `a, b="c" d`, "read bytes": 1.0},
+			},
+		},
+		{name: "no fields", line: "cpu,host=a", wantErr: true},
+		{name: "empty field value", line: "cpu value=", wantErr: true},
+		{name: "wrong field value", line: "cpu value=abc", wantErr: true},
+		{name: "wrong integer", line: "cpu value=1.5i", wantErr: true},
+		{name: "unterminated string", line: `cpu msg="abc`, wantErr: true},
+		{name: "wrong tag", line: "cpu,host value=1", wantErr: true},
+		{name: "no measurement", line: ",host=a value=1", wantErr: true},
+		{name: "wrong timestamp", line: "cpu value=1 yesterday", wantErr: true},
+		{name: "timestamp overflow", line: "cpu value=1 9223372036854775807", precision: "h", wantErr: true},
+		{name: "unknown precision", line: "cpu value=1", precision: "d", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseLine(tt.line, tt.precision)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrWrongFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.point.Measurement, p.Measurement)
+			assert.Equal(t, tt.point.Tags, p.Tags)
+			assert.Equal(t, tt.point.Fields, p.Fields)
+			assert.True(t, tt.point.Time.Equal(p.Time), p.Time)
+		})
+	}
+}
+
+// TestPointMetrics tests mapping of fields to gauges and of integer fields matching patterns to counters
+func TestPointMetrics(t *testing.T) {
+	p, err := ParseLine(`net,iface=eth0 bytes_recv=100i,procs=3i,drop_rate=0.5,up=true,name="eth0" 1465839830`, "s")
+	require.NoError(t, err)
+	delta, procs, rate, up := int64(100), 3.0, 0.5, 1.0
+	tags := map[string]string{"iface": "eth0"}
+	ts := time.Unix(1465839830, 0)
+	assert.ElementsMatch(t, []types.Metrics{
+		{ID: "net_bytes_recv", MType: "counter", Delta: &delta, Labels: tags, Timestamp: ts},
+		{ID: "net_procs", MType: "gauge", Value: &procs, Labels: tags, Timestamp: ts},
+		{ID: "net_drop_rate", MType: "gauge", Value: &rate, Labels: tags, Timestamp: ts},
+		{ID: "net_up", MType: "gauge", Value: &up, Labels: tags, Timestamp: ts},
+	}, p.Metrics([]string{"*_bytes_*", "cpu_*"}))
+	recv := 100.0
+	assert.Contains(t, p.Metrics(nil), types.Metrics{ID: "net_bytes_recv", MType: "gauge", Value: &recv, Labels: tags, Timestamp: ts})
+}
@@ -0,0 +1,337 @@
+// Package memstorage stores metrics in memory
+package memstorage
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/hash"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/repeating"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/history"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// defaultShards is a number of shards metrics are spread over
+const defaultShards = 64
+
+// MetricKey identifies metric of some type in MemStorage
+type MetricKey struct {
+	ID string
+	// Labels are canonical string of metric's labels
+	Labels string
+}
+
+// NewMetricKey makes MetricKey of metric
+func NewMetricKey(m types.Metrics) MetricKey {
+	return MetricKey{ID: m.ID, Labels: labels.String(m.Labels)}
+}
+
+// shard stores part of metrics guarded by its own lock
+type shard struct {
+	mu         sync.RWMutex
+	counters   map[MetricKey]int64
+	gauges     map[MetricKey]float64
+	histograms map[MetricKey]types.Histogram
+	summaries  map[MetricKey]types.Summary
+}
+
+// MemStorage stores metrics in memory, metrics are spread over shards to reduce lock contention
+type MemStorage struct {
+	shards []*shard
+	// history stores samples of metrics, nil if history is disabled
+	history *history.History
+}
+
+// NewMemStorage creates new MemStorage
+func NewMemStorage(cfg config.Config) *MemStorage {
+	var hist *history.History
+	if cfg.HistoryRetention > 0 {
+		hist = history.NewHistory(cfg.HistoryRetention, cfg.HistoryResolution)
+	}
+	return newMemStorage(defaultShards, hist)
+}
+
+// newMemStorage creates MemStorage with given number of shards
+func newMemStorage(shards int, hist *history.History) *MemStorage {
+	ms := &MemStorage{
+		shards:  make([]*shard, shards),
+		history: hist,
+	}
+	for i := range ms.shards {
+		ms.shards[i] = &shard{
+			counters:   make(map[MetricKey]int64),
+			gauges:     make(map[MetricKey]float64),
+			histograms: make(map[MetricKey]types.Histogram),
+			summaries:  make(map[MetricKey]types.Summary),
+		}
+	}
+	return ms
+}
+
+// FNV-1a parameters used to pick a shard without allocations
+const (
+	fnvOffset uint32 = 2166136261
+	fnvPrime  uint32 = 16777619
+)
+
+// shard returns shard of metric key
+func (ms *MemStorage) shard(key MetricKey) *shard {
+	h := fnvOffset
+	for i := 0; i < len(key.ID); i++ {
+		h = (h ^ uint32(key.ID[i])) * fnvPrime
+	}
+	for i := 0; i < len(key.Labels); i++ {
+		h = (h ^ uint32(key.Labels[i])) * fnvPrime
+	}
+	return ms.shards[h%uint32(len(ms.shards))]
+}
+
+// SetHistoryCompaction starts periodical compaction of history if history is enabled
+func (ms *MemStorage) SetHistoryCompaction() {
+	if ms.history == nil {
+		return
+	}
+	compactInterval := ms.history.Resolution
+	if compactInterval <= 0 {
+		compactInterval = ms.history.Retention
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	go repeating.Repeat(sigs, func() { ms.history.Compact(time.Now()) }, compactInterval)
+}
+
+// ValidateMetric checks metric's labels, value and hash
+func ValidateMetric(m types.Metrics, key string) error {
+	if err := labels.Validate(m.Labels); err != nil {
+		return fmt.Errorf("%w%v", myerrors.ErrTypeBadRequest, err)
+	}
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeNotImplemented)
+		}
+	case "counter":
+		if m.Delta == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeNotImplemented)
+		}
+	case "histogram":
+		if m.Histogram == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeNotImplemented)
+		}
+		if err := m.Histogram.Validate(); err != nil {
+			return fmt.Errorf("%w%v", myerrors.ErrTypeBadRequest, err)
+		}
+	case "summary":
+		if m.Summary == nil {
+			return fmt.Errorf("%wno value in update request", myerrors.ErrTypeNotImplemented)
+		}
+		if err := m.Summary.Validate(); err != nil {
+			return fmt.Errorf("%w%v", myerrors.ErrTypeBadRequest, err)
+		}
+	default:
+		return fmt.Errorf("%wno such type of metric", myerrors.ErrTypeNotImplemented)
+	}
+	if key != "" && m.Hash != "" {
+		if !hmac.Equal([]byte(m.Hash), []byte(hash.Hash(hash.WithLabels(m.HashSource(), m.Labels), key))) {
+			return fmt.Errorf("%wwrong hash in request", myerrors.ErrTypeBadRequest)
+		}
+	}
+	return nil
+}
+
+// save saves validated metric into its shard
+func (ms *MemStorage) save(m types.Metrics) error {
+	key := NewMetricKey(m)
+	s := ms.shard(key)
+	var sample float64
+	s.mu.Lock()
+	ts := time.Now()
+	if !m.Timestamp.IsZero() {
+		ts = m.Timestamp
+	}
+	switch m.MType {
+	case "gauge":
+		s.gauges[key] = *m.Value
+		sample = *m.Value
+	case "counter":
+		s.counters[key] += *m.Delta
+		sample = float64(s.counters[key])
+	case "histogram":
+		histogram := s.histograms[key]
+		if err := histogram.Merge(*m.Histogram); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.histograms[key] = histogram
+		sample = float64(histogram.Count)
+	case "summary":
+		summary := *m.Summary
+		summary.Quantiles = append([]types.Quantile(nil), m.Summary.Quantiles...)
+		s.summaries[key] = summary
+		sample = float64(summary.Count)
+	}
+	s.mu.Unlock()
+	if ms.history != nil {
+		ms.history.Append(m, ts, sample)
+	}
+	return nil
+}
+
+// checkHistograms checks that histograms of metrics can be merged into stored ones and ones earlier in metrics
+func (ms *MemStorage) checkHistograms(metrics []types.Metrics) error {
+	merged := make(map[MetricKey]types.Histogram)
+	for _, m := range metrics {
+		if m.MType != "histogram" {
+			continue
+		}
+		key := NewMetricKey(m)
+		histogram, ok := merged[key]
+		if !ok {
+			s := ms.shard(key)
+			s.mu.RLock()
+			histogram = s.histograms[key]
+			s.mu.RUnlock()
+		}
+		if err := histogram.Merge(*m.Histogram); err != nil {
+			return fmt.Errorf("histogram %s: %w", m.ID, err)
+		}
+		merged[key] = histogram
+	}
+	return nil
+}
+
+// SaveMetric saves info about one metric into MemStorage
+func (ms *MemStorage) SaveMetric(m types.Metrics, key string) error {
+	if err := ValidateMetric(m, key); err != nil {
+		return err
+	}
+	return ms.save(m)
+}
+
+// CheckMetrics checks that metrics are valid and their histograms can be merged into stored ones
+func (ms *MemStorage) CheckMetrics(metrics []types.Metrics, key string) error {
+	for _, m := range metrics {
+		if err := ValidateMetric(m, key); err != nil {
+			return err
+		}
+	}
+	return ms.checkHistograms(metrics)
+}
+
+// SaveManyMetrics saves several metrics into MemStorage, nothing is saved if any metric is invalid
+func (ms *MemStorage) SaveManyMetrics(metrics []types.Metrics, key string) error {
+	if err := ms.CheckMetrics(metrics, key); err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		if err := ms.save(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMetric gets info about one metric from MemStorage
+func (ms *MemStorage) GetMetric(m types.Metrics, key string) (types.Metrics, error) {
+	k := NewMetricKey(m)
+	s := ms.shard(k)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch m.MType {
+	case "counter":
+		delta, ok := s.counters[k]
+		if !ok {
+			return m, myerrors.ErrTypeNotFound
+		}
+		m.Delta = &delta
+	case "gauge":
+		value, ok := s.gauges[k]
+		if !ok {
+			return m, myerrors.ErrTypeNotFound
+		}
+		m.Value = &value
+	case "histogram":
+		histogram, ok := s.histograms[k]
+		if !ok {
+			return m, myerrors.ErrTypeNotFound
+		}
+		m.Histogram = &histogram
+	case "summary":
+		summary, ok := s.summaries[k]
+		if !ok {
+			return m, myerrors.ErrTypeNotFound
+		}
+		m.Summary = &summary
+	}
+	return m, nil
+}
+
+// GetAllMetrics gets info about all metrics from MemStorage
+func (ms *MemStorage) GetAllMetrics() ([]types.Metrics, error) {
+	var metrics []types.Metrics
+	for _, s := range ms.shards {
+		s.mu.RLock()
+		for k, delta := range s.counters {
+			delta := delta
+			metrics = append(metrics, types.Metrics{ID: k.ID, MType: "counter", Delta: &delta, Labels: parseLabels(k)})
+		}
+		for k, value := range s.gauges {
+			value := value
+			metrics = append(metrics, types.Metrics{ID: k.ID, MType: "gauge", Value: &value, Labels: parseLabels(k)})
+		}
+		for k, histogram := range s.histograms {
+			histogram := histogram
+			metrics = append(metrics, types.Metrics{ID: k.ID, MType: "histogram", Histogram: &histogram, Labels: parseLabels(k)})
+		}
+		for k, summary := range s.summaries {
+			summary := summary
+			metrics = append(metrics, types.Metrics{ID: k.ID, MType: "summary", Summary: &summary, Labels: parseLabels(k)})
+		}
+		s.mu.RUnlock()
+	}
+	return metrics, nil
+}
+
+// GetMetricHistory gets samples of one metric in [from, to] from MemStorage history
+func (ms *MemStorage) GetMetricHistory(m types.Metrics, from, to time.Time) ([]types.Sample, error) {
+	if ms.history == nil {
+		return nil, fmt.Errorf("%wmetrics history is disabled", myerrors.ErrTypeNotImplemented)
+	}
+	switch m.MType {
+	case "counter", "gauge", "histogram", "summary":
+		if _, err := ms.GetMetric(types.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}, ""); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%wno such type of metric", myerrors.ErrTypeNotImplemented)
+	}
+	return ms.history.Range(m, from, to), nil
+}
+
+// Check checks if memory storage works OK
+func (ms *MemStorage) Check() error {
+	return nil
+}
+
+// Close does nothing as memory storage has nothing to flush
+func (ms *MemStorage) Close() error {
+	return nil
+}
+
+// parseLabels parses labels of metric key
+func parseLabels(key MetricKey) map[string]string {
+	l, err := labels.Parse(key.Labels)
+	if err != nil {
+		loggers.ErrorLogger.Printf("error while parsing labels of %s: %v", key.ID, err)
+	}
+	return l
+}
@@ -0,0 +1,169 @@
+package memstorage
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestMemStorage tests saving and getting metrics of all types
+func TestMemStorage(t *testing.T) {
+	ms := NewMemStorage(config.Config{})
+	var (
+		delta int64 = 5
+		value       = 1.5
+	)
+	host := map[string]string{"host": "a"}
+	require.NoError(t, ms.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	require.NoError(t, ms.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, ""))
+	require.NoError(t, ms.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta, Labels: host}, ""))
+	require.NoError(t, ms.SaveMetric(types.Metrics{ID: "Alloc", MType: "gauge", Value: &value}, ""))
+	require.NoError(t, ms.SaveMetric(types.Metrics{ID: "Latency", MType: "histogram", Histogram: &types.Histogram{
+		Buckets: []types.Bucket{{UpperBound: 1, Count: 1}},
+		Count:   2,
+		Sum:     3,
+	}}, ""))
+	require.NoError(t, ms.SaveMetric(types.Metrics{ID: "Latency", MType: "histogram", Histogram: &types.Histogram{
+		Buckets: []types.Bucket{{UpperBound: 1}},
+		Count:   1,
+		Sum:     2,
+	}}, ""))
+	err := ms.SaveMetric(types.Metrics{ID: "Latency", MType: "histogram", Histogram: &types.Histogram{Count: 1, Sum: 2}}, "")
+	assert.ErrorIs(t, err, myerrors.ErrTypeBadRequest)
+
+	m, err := ms.GetMetric(types.Metrics{ID: "PollCount", MType: "counter"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *m.Delta)
+	m, err = ms.GetMetric(types.Metrics{ID: "PollCount", MType: "counter", Labels: host}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *m.Delta)
+	m, err = ms.GetMetric(types.Metrics{ID: "Alloc", MType: "gauge"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+	m, err = ms.GetMetric(types.Metrics{ID: "Latency", MType: "histogram"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, types.Histogram{Buckets: []types.Bucket{{UpperBound: 1, Count: 1}}, Count: 3, Sum: 5}, *m.Histogram)
+	_, err = ms.GetMetric(types.Metrics{ID: "Alloc", MType: "counter"}, "")
+	assert.ErrorIs(t, err, myerrors.ErrTypeNotFound)
+
+	metrics, err := ms.GetAllMetrics()
+	require.NoError(t, err)
+	assert.Len(t, metrics, 4)
+}
+
+// TestSaveManyMetricsIsAllOrNothing tests that invalid batch leaves storage unchanged
+func TestSaveManyMetricsIsAllOrNothing(t *testing.T) {
+	ms := NewMemStorage(config.Config{})
+	var delta int64 = 1
+	err := ms.SaveManyMetrics([]types.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge"},
+	}, "")
+	assert.ErrorIs(t, err, myerrors.ErrTypeNotImplemented)
+	err = ms.SaveManyMetrics([]types.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Latency", MType: "histogram", Histogram: &types.Histogram{Buckets: []types.Bucket{{UpperBound: 1, Count: 1}}, Count: 1}},
+		{ID: "Latency", MType: "histogram", Histogram: &types.Histogram{Buckets: []types.Bucket{{UpperBound: 5, Count: 1}}, Count: 1}},
+	}, "")
+	assert.ErrorIs(t, err, myerrors.ErrTypeBadRequest)
+	metrics, err := ms.GetAllMetrics()
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+// TestConcurrentAccess tests that concurrent writers do not lose counter increments
+func TestConcurrentAccess(t *testing.T) {
+	const (
+		agents  = 50
+		updates = 200
+	)
+	ms := NewMemStorage(config.Config{})
+	var wg sync.WaitGroup
+	for i := 0; i < agents; i++ {
+		wg.Add(1)
+		go func(agent int) {
+			defer wg.Done()
+			var delta int64 = 1
+			value := float64(agent)
+			for j := 0; j < updates; j++ {
+				ms.SaveMetric(types.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, "")
+				ms.SaveMetric(types.Metrics{ID: "Alloc", MType: "gauge", Value: &value, Labels: map[string]string{"agent": strconv.Itoa(agent)}}, "")
+				ms.GetMetric(types.Metrics{ID: "PollCount", MType: "counter"}, "")
+				if j%50 == 0 {
+					ms.GetAllMetrics()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	m, err := ms.GetMetric(types.Metrics{ID: "PollCount", MType: "counter"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(agents*updates), *m.Delta)
+	metrics, err := ms.GetAllMetrics()
+	require.NoError(t, err)
+	assert.Len(t, metrics, agents+1)
+}
+
+// benchmarkSave measures throughput of concurrent agents updating their own metrics
+func benchmarkSave(b *testing.B, shards int) {
+	ms := newMemStorage(shards, nil)
+	var (
+		mu    sync.Mutex
+		agent int
+	)
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		agent++
+		id := fmt.Sprintf("agent%d", agent)
+		mu.Unlock()
+		var delta int64 = 1
+		value := 1.5
+		metrics := make([]types.Metrics, 30)
+		for i := range metrics {
+			metrics[i] = types.Metrics{ID: id + "Gauge" + strconv.Itoa(i), MType: "gauge", Value: &value}
+		}
+		counter := types.Metrics{ID: id + "PollCount", MType: "counter", Delta: &delta}
+		i := 0
+		for pb.Next() {
+			ms.SaveMetric(metrics[i%len(metrics)], "")
+			ms.SaveMetric(counter, "")
+			i++
+		}
+	})
+}
+
+// benchmarkMixed measures throughput of concurrent writers and readers of shared metrics
+func benchmarkMixed(b *testing.B, shards int) {
+	ms := newMemStorage(shards, nil)
+	value := 1.5
+	metrics := make([]types.Metrics, 1000)
+	for i := range metrics {
+		metrics[i] = types.Metrics{ID: "Gauge" + strconv.Itoa(i), MType: "gauge", Value: &value}
+		ms.SaveMetric(metrics[i], "")
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			m := metrics[i%len(metrics)]
+			if i%4 == 0 {
+				ms.SaveMetric(m, "")
+			} else {
+				ms.GetMetric(m, "")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkSaveSingleLock(b *testing.B)  { benchmarkSave(b, 1) }
+func BenchmarkSaveSharded(b *testing.B)     { benchmarkSave(b, defaultShards) }
+func BenchmarkMixedSingleLock(b *testing.B) { benchmarkMixed(b, 1) }
+func BenchmarkMixedSharded(b *testing.B)    { benchmarkMixed(b, defaultShards) }
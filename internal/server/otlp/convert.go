@@ -0,0 +1,271 @@
+// Package otlp maps OpenTelemetry metrics exported with OTLP to metrics of storage.
+// Attributes of resource and data point become labels, attributes of data point win on conflicts
+package otlp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// ExportMethod is a full name of gRPC method of OTLP metrics export
+const ExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// Point is a data point mapped to metric
+type Point struct {
+	Metric types.Metrics
+	// Cumulative is set for counters and histograms holding totals since StartTime instead of changes
+	Cumulative bool
+	// Relative is set for gauges of non-monotonic delta sums, they change gauge by Value
+	Relative bool
+	// StartTime is a start of cumulative series in Unix nanoseconds, it changes when series is reset
+	StartTime uint64
+}
+
+// Convert maps data points of request to points.
+// Data points which can't be mapped are counted as rejected, errors describe why
+func Convert(req *colmetricspb.ExportMetricsServiceRequest) (points []Point, rejected int64, errs []string) {
+	reject := func(name string, n int, reason string) {
+		rejected += int64(n)
+		errs = append(errs, fmt.Sprintf("%s: %s", name, reason))
+	}
+	for _, rm := range req.GetResourceMetrics() {
+		resource := rm.GetResource().GetAttributes()
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				name := m.GetName()
+				if name == "" {
+					reject("metric without name", countDataPoints(m), "name is required")
+					continue
+				}
+				switch data := m.GetData().(type) {
+				case *metricspb.Metric_Gauge:
+					for _, dp := range data.Gauge.GetDataPoints() {
+						p, err := numberPoint(name, resource, dp)
+						if err != nil {
+							reject(name, 1, err.Error())
+							continue
+						}
+						if p != nil {
+							points = append(points, *p)
+						}
+					}
+				case *metricspb.Metric_Sum:
+					temporality := data.Sum.GetAggregationTemporality()
+					if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED {
+						reject(name, len(data.Sum.GetDataPoints()), "aggregation temporality is unspecified")
+						continue
+					}
+					cumulative := temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+					for _, dp := range data.Sum.GetDataPoints() {
+						p, err := numberPoint(name, resource, dp)
+						if err != nil {
+							reject(name, 1, err.Error())
+							continue
+						}
+						if p == nil {
+							continue
+						}
+						switch {
+						case data.Sum.GetIsMonotonic():
+							delta := int64(math.Round(*p.Metric.Value))
+							p.Metric.MType, p.Metric.Value, p.Metric.Delta = "counter", nil, &delta
+							p.Cumulative = cumulative
+						case !cumulative:
+							p.Relative = true
+						}
+						points = append(points, *p)
+					}
+				case *metricspb.Metric_Histogram:
+					temporality := data.Histogram.GetAggregationTemporality()
+					if temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED {
+						reject(name, len(data.Histogram.GetDataPoints()), "aggregation temporality is unspecified")
+						continue
+					}
+					for _, dp := range data.Histogram.GetDataPoints() {
+						p, err := histogramPoint(name, resource, dp)
+						if err != nil {
+							reject(name, 1, err.Error())
+							continue
+						}
+						if p != nil {
+							p.Cumulative = temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+							points = append(points, *p)
+						}
+					}
+				case *metricspb.Metric_Summary:
+					for _, dp := range data.Summary.GetDataPoints() {
+						p, err := summaryPoint(name, resource, dp)
+						if err != nil {
+							reject(name, 1, err.Error())
+							continue
+						}
+						if p != nil {
+							points = append(points, *p)
+						}
+					}
+				default:
+					reject(name, countDataPoints(m), "only gauges, sums, histograms and summaries are supported")
+				}
+			}
+		}
+	}
+	return points, rejected, errs
+}
+
+// countDataPoints returns number of data points of metric
+func countDataPoints(m *metricspb.Metric) int {
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		return len(data.Gauge.GetDataPoints())
+	case *metricspb.Metric_Sum:
+		return len(data.Sum.GetDataPoints())
+	case *metricspb.Metric_Histogram:
+		return len(data.Histogram.GetDataPoints())
+	case *metricspb.Metric_ExponentialHistogram:
+		return len(data.ExponentialHistogram.GetDataPoints())
+	case *metricspb.Metric_Summary:
+		return len(data.Summary.GetDataPoints())
+	}
+	return 0
+}
+
+// noRecordedValue checks if data point only marks absence of value
+func noRecordedValue(flags uint32) bool {
+	return flags&uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE) != 0
+}
+
+// numberPoint maps number data point to gauge, it returns nil for data point without value
+func numberPoint(name string, resource []*commonpb.KeyValue, dp *metricspb.NumberDataPoint) (*Point, error) {
+	if noRecordedValue(dp.GetFlags()) {
+		return nil, nil
+	}
+	l, err := attributeLabels(resource, dp.GetAttributes())
+	if err != nil {
+		return nil, err
+	}
+	var value float64
+	switch v := dp.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsDouble:
+		value = v.AsDouble
+	case *metricspb.NumberDataPoint_AsInt:
+		value = float64(v.AsInt)
+	default:
+		return nil, fmt.Errorf("data point has no value")
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("value must be finite")
+	}
+	return &Point{
+		Metric:    types.Metrics{ID: name, MType: "gauge", Value: &value, Labels: l},
+		StartTime: dp.GetStartTimeUnixNano(),
+	}, nil
+}
+
+// histogramPoint maps histogram data point with explicit bounds to histogram.
+// Observations above the last bound are only counted in Count
+func histogramPoint(name string, resource []*commonpb.KeyValue, dp *metricspb.HistogramDataPoint) (*Point, error) {
+	if noRecordedValue(dp.GetFlags()) {
+		return nil, nil
+	}
+	l, err := attributeLabels(resource, dp.GetAttributes())
+	if err != nil {
+		return nil, err
+	}
+	bounds, counts := dp.GetExplicitBounds(), dp.GetBucketCounts()
+	if len(counts) != 0 && len(counts) != len(bounds)+1 {
+		return nil, fmt.Errorf("histogram has %d bounds and %d bucket counts", len(bounds), len(counts))
+	}
+	h := &types.Histogram{Count: dp.GetCount(), Sum: dp.GetSum()}
+	for i, bound := range bounds {
+		b := types.Bucket{UpperBound: bound}
+		if len(counts) != 0 {
+			b.Count = counts[i]
+		}
+		h.Buckets = append(h.Buckets, b)
+	}
+	if err = h.Validate(); err != nil {
+		return nil, err
+	}
+	return &Point{
+		Metric:    types.Metrics{ID: name, MType: "histogram", Histogram: h, Labels: l},
+		StartTime: dp.GetStartTimeUnixNano(),
+	}, nil
+}
+
+// summaryPoint maps summary data point to summary
+func summaryPoint(name string, resource []*commonpb.KeyValue, dp *metricspb.SummaryDataPoint) (*Point, error) {
+	if noRecordedValue(dp.GetFlags()) {
+		return nil, nil
+	}
+	l, err := attributeLabels(resource, dp.GetAttributes())
+	if err != nil {
+		return nil, err
+	}
+	s := &types.Summary{Count: dp.GetCount(), Sum: dp.GetSum()}
+	for _, q := range dp.GetQuantileValues() {
+		s.Quantiles = append(s.Quantiles, types.Quantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+	}
+	sort.Slice(s.Quantiles, func(i, j int) bool { return s.Quantiles[i].Quantile < s.Quantiles[j].Quantile })
+	if err = s.Validate(); err != nil {
+		return nil, err
+	}
+	return &Point{Metric: types.Metrics{ID: name, MType: "summary", Summary: s, Labels: l}}, nil
+}
+
+// attributeLabels makes labels of resource attributes and data point attributes
+func attributeLabels(resource, attributes []*commonpb.KeyValue) (map[string]string, error) {
+	if len(resource) == 0 && len(attributes) == 0 {
+		return nil, nil
+	}
+	l := make(map[string]string, len(resource)+len(attributes))
+	for _, kv := range resource {
+		l[kv.GetKey()] = anyValueString(kv.GetValue())
+	}
+	for _, kv := range attributes {
+		l[kv.GetKey()] = anyValueString(kv.GetValue())
+	}
+	if err := labels.Validate(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// anyValueString formats attribute value, arrays and maps are written like JSON
+func anyValueString(v *commonpb.AnyValue) string {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]string, len(v.ArrayValue.GetValues()))
+		for i, value := range v.ArrayValue.GetValues() {
+			values[i] = strconv.Quote(anyValueString(value))
+		}
+		return "[" + strings.Join(values, ",") + "]"
+	case *commonpb.AnyValue_KvlistValue:
+		values := make([]string, len(v.KvlistValue.GetValues()))
+		for i, kv := range v.KvlistValue.GetValues() {
+			values[i] = strconv.Quote(kv.GetKey()) + ":" + strconv.Quote(anyValueString(kv.GetValue()))
+		}
+		return "{" + strings.Join(values, ",") + "}"
+	}
+	return ""
+}
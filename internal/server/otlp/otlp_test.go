@@ -0,0 +1,180 @@
+package otlp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// attribute makes string attribute
+func attribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// exportRequest makes request with metrics of resource with service.name attribute
+func exportRequest(metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource:     &resourcepb.Resource{Attributes: []*commonpb.KeyValue{attribute("service.name", "api"), attribute("host", "a")}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+	}}}
+}
+
+// sum makes sum metric with one data point
+func sum(name string, value float64, monotonic bool, temporality metricspb.AggregationTemporality, start uint64) *metricspb.Metric {
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+		IsMonotonic:            monotonic,
+		AggregationTemporality: temporality,
+		DataPoints: []*metricspb.NumberDataPoint{{
+			StartTimeUnixNano: start,
+			Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+		}},
+	}}}
+}
+
+// histogram makes cumulative histogram metric with one data point
+func histogram(name string, counts []uint64, sum float64, start uint64) *metricspb.Metric {
+	var count uint64
+	for _, c := range counts {
+		count += c
+	}
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		DataPoints: []*metricspb.HistogramDataPoint{{
+			StartTimeUnixNano: start,
+			Count:             count,
+			Sum:               &sum,
+			BucketCounts:      counts,
+			ExplicitBounds:    []float64{10, 100},
+		}},
+	}}}
+}
+
+const (
+	delta      = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	cumulative = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+)
+
+// TestConvert tests mapping of metric kinds and attributes
+func TestConvert(t *testing.T) {
+	gauge := &metricspb.Metric{Name: "temperature", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+		{Attributes: []*commonpb.KeyValue{attribute("host", "b")}, Value: &metricspb.NumberDataPoint_AsInt{AsInt: 21}},
+		{Flags: uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE)},
+	}}}}
+	exponential := &metricspb.Metric{Name: "latency", Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+		DataPoints: []*metricspb.ExponentialHistogramDataPoint{{}, {}},
+	}}}
+	points, rejected, errs := Convert(exportRequest(
+		gauge,
+		sum("requests", 10.4, true, cumulative, 1),
+		sum("queue", -2, false, delta, 0),
+		sum("connections", 5, false, cumulative, 0),
+		histogram("duration", []uint64{1, 2, 3}, 700, 1),
+		sum("unspecified", 1, true, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED, 0),
+		exponential,
+	))
+	assert.Equal(t, int64(3), rejected)
+	assert.Len(t, errs, 2)
+	require.Len(t, points, 5)
+
+	resource := map[string]string{"service.name": "api", "host": "a"}
+	temperature, requests, queue, connections := 21.0, int64(10), -2.0, 5.0
+	assert.Equal(t, Point{Metric: types.Metrics{ID: "temperature", MType: "gauge", Value: &temperature,
+		Labels: map[string]string{"service.name": "api", "host": "b"}}}, points[0], "attributes of data point win")
+	assert.Equal(t, Point{Metric: types.Metrics{ID: "requests", MType: "counter", Delta: &requests, Labels: resource},
+		Cumulative: true, StartTime: 1}, points[1])
+	assert.Equal(t, Point{Metric: types.Metrics{ID: "queue", MType: "gauge", Value: &queue, Labels: resource}, Relative: true}, points[2])
+	assert.Equal(t, Point{Metric: types.Metrics{ID: "connections", MType: "gauge", Value: &connections, Labels: resource}}, points[3])
+	assert.Equal(t, Point{Metric: types.Metrics{ID: "duration", MType: "histogram", Labels: resource, Histogram: &types.Histogram{
+		Buckets: []types.Bucket{{UpperBound: 10, Count: 1}, {UpperBound: 100, Count: 2}},
+		Count:   6,
+		Sum:     700,
+	}}, Cumulative: true, StartTime: 1}, points[4])
+}
+
+// TestWriter tests that cumulative points are saved as changes and relative gauges are added up
+func TestWriter(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	w := NewWriter(store)
+	labels := map[string]string{"service.name": "api", "host": "a"}
+	write := func(metrics ...*metricspb.Metric) {
+		points, rejected, _ := Convert(exportRequest(metrics...))
+		require.Zero(t, rejected)
+		require.NoError(t, w.Write(points, ""))
+	}
+	get := func(id, mType string) types.Metrics {
+		m, err := store.GetMetric(types.Metrics{ID: id, MType: mType, Labels: labels}, "")
+		require.NoError(t, err)
+		return m
+	}
+
+	write(sum("requests", 10, true, cumulative, 1), sum("queue", 3, false, delta, 0), histogram("duration", []uint64{1, 1, 0}, 50, 1))
+	assert.Equal(t, int64(0), *get("requests", "counter").Delta, "the first point is a baseline")
+	assert.Equal(t, uint64(0), get("duration", "histogram").Histogram.Count, "the first point is a baseline")
+	write(sum("requests", 15, true, cumulative, 1), sum("queue", -1, false, delta, 0), histogram("duration", []uint64{1, 3, 1}, 400, 1))
+	assert.Equal(t, int64(5), *get("requests", "counter").Delta)
+	assert.Equal(t, 2.0, *get("queue", "gauge").Value)
+	h := get("duration", "histogram").Histogram
+	assert.Equal(t, uint64(3), h.Count)
+	assert.Equal(t, 350.0, h.Sum)
+	assert.Equal(t, []types.Bucket{{UpperBound: 10, Count: 0}, {UpperBound: 100, Count: 2}}, h.Buckets)
+
+	write(sum("requests", 4, true, cumulative, 2))
+	assert.Equal(t, int64(9), *get("requests", "counter").Delta, "total after reset is a change")
+
+	// other writers of the same counter don't change changes of series
+	other := int64(100)
+	require.NoError(t, store.SaveMetric(types.Metrics{ID: "requests", MType: "counter", Delta: &other, Labels: labels}, ""))
+	write(sum("requests", 6, true, cumulative, 2))
+	assert.Equal(t, int64(111), *get("requests", "counter").Delta)
+
+	w = NewWriter(store)
+	write(sum("requests", 25, true, cumulative, 2))
+	assert.Equal(t, int64(111), *get("requests", "counter").Delta, "the first point after restart is a baseline")
+	write(sum("requests", 30, true, cumulative, 2))
+	assert.Equal(t, int64(116), *get("requests", "counter").Delta)
+}
+
+// TestWriterEviction tests that series not written for TTL are forgotten
+func TestWriterEviction(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	w := NewWriter(store)
+	write := func(metrics ...*metricspb.Metric) {
+		points, _, _ := Convert(exportRequest(metrics...))
+		require.NoError(t, w.Write(points, ""))
+	}
+	write(sum("old", 1, true, cumulative, 1), sum("new", 1, true, cumulative, 1))
+	expire := func() {
+		for k, prev := range w.last {
+			if strings.HasPrefix(k, "counter:old") {
+				prev.seen = time.Now().Add(-2 * time.Hour)
+				w.last[k] = prev
+			}
+		}
+		w.evicted = time.Now().Add(-2 * time.Hour)
+	}
+
+	expire()
+	write(sum("old", 5, true, cumulative, 1))
+	m, err := store.GetMetric(types.Metrics{ID: "old", MType: "counter", Labels: map[string]string{"service.name": "api", "host": "a"}}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), *m.Delta, "expired series starts with a baseline")
+	expire()
+	write(sum("new", 2, true, cumulative, 1))
+	require.Len(t, w.last, 1)
+	for k := range w.last {
+		assert.True(t, strings.HasPrefix(k, "counter:new"))
+	}
+}
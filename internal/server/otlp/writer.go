@@ -0,0 +1,153 @@
+package otlp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// SeriesTTL is a period after which cumulative series which are not written are forgotten
+const SeriesTTL = time.Hour
+
+// series is the last point of cumulative series
+type series struct {
+	start     uint64
+	delta     int64
+	histogram *types.Histogram
+	seen      time.Time
+}
+
+// Writer saves points to storage. Storage adds up counters and histograms,
+// so cumulative points are turned into changes since the previous point of series.
+// The first point of series is a baseline with no change: stored metric may be updated by other writers,
+// so it is not the previous point of series. Series reset when start time changes or total decreases,
+// then the whole total is a change. Series not written for TTL are forgotten and start with a baseline again
+type Writer struct {
+	Storage storage.Storage
+	TTL     time.Duration
+
+	mu      sync.Mutex
+	last    map[string]series
+	evicted time.Time
+}
+
+// NewWriter creates Writer saving points to store
+func NewWriter(store storage.Storage) *Writer {
+	return &Writer{Storage: store, TTL: SeriesTTL, last: make(map[string]series), evicted: time.Now()}
+}
+
+// seriesKey identifies series of metric
+func seriesKey(m types.Metrics) string {
+	return m.MType + ":" + m.ID + labels.String(m.Labels)
+}
+
+// stored returns metric from storage, ok is false if it is not stored yet
+func (w *Writer) stored(m types.Metrics) (types.Metrics, bool, error) {
+	stored, err := w.Storage.GetMetric(types.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}, "")
+	if errors.Is(err, myerrors.ErrTypeNotFound) {
+		return stored, false, nil
+	}
+	if err != nil {
+		return stored, false, err
+	}
+	return stored, true, nil
+}
+
+// Write saves points to storage, key is a hash key of server
+func (w *Writer) Write(points []Point, key string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	metrics := make([]types.Metrics, 0, len(points))
+	gauges := make(map[string]float64)
+	// last points are remembered only if metrics are saved
+	last := make(map[string]series)
+	previous := func(k string) (series, bool) {
+		if prev, ok := last[k]; ok {
+			return prev, true
+		}
+		prev, ok := w.last[k]
+		return prev, ok && now.Sub(prev.seen) <= w.TTL
+	}
+	for _, p := range points {
+		m := p.Metric
+		k := seriesKey(m)
+		switch {
+		case p.Cumulative && m.MType == "counter":
+			prev, ok := previous(k)
+			delta := *m.Delta
+			switch {
+			case !ok:
+				delta = 0
+			case prev.start == p.StartTime && delta >= prev.delta:
+				delta -= prev.delta
+			}
+			last[k] = series{start: p.StartTime, delta: *m.Delta, seen: now}
+			m.Delta = &delta
+		case p.Cumulative && m.MType == "histogram":
+			prev, ok := previous(k)
+			total := m.Histogram
+			if !ok {
+				// baseline has bounds of series and no observations
+				prev = series{start: p.StartTime, histogram: total}
+			}
+			if prev.start == p.StartTime && prev.histogram != nil {
+				if change, ok := subtract(*total, *prev.histogram); ok {
+					m.Histogram = change
+				}
+			}
+			last[k] = series{start: p.StartTime, histogram: total, seen: now}
+		case p.Relative:
+			value, ok := gauges[k]
+			if !ok {
+				stored, found, err := w.stored(m)
+				if err != nil {
+					return err
+				}
+				if found {
+					value = *stored.Value
+				}
+			}
+			value += *m.Value
+			gauges[k] = value
+			m.Value = &value
+		}
+		metrics = append(metrics, m)
+	}
+	if err := w.Storage.SaveManyMetrics(metrics, key); err != nil {
+		return err
+	}
+	for k, prev := range last {
+		w.last[k] = prev
+	}
+	if now.Sub(w.evicted) >= w.TTL {
+		for k, prev := range w.last {
+			if now.Sub(prev.seen) > w.TTL {
+				delete(w.last, k)
+			}
+		}
+		w.evicted = now
+	}
+	return nil
+}
+
+// subtract returns observations of h made after prev.
+// It returns false if h can't continue prev because bounds differ or counts decreased
+func subtract(h, prev types.Histogram) (*types.Histogram, bool) {
+	if len(h.Buckets) != len(prev.Buckets) || h.Count < prev.Count {
+		return nil, false
+	}
+	change := &types.Histogram{Buckets: make([]types.Bucket, len(h.Buckets)), Count: h.Count - prev.Count, Sum: h.Sum - prev.Sum}
+	for i, b := range h.Buckets {
+		if b.UpperBound != prev.Buckets[i].UpperBound || b.Count < prev.Buckets[i].Count {
+			return nil, false
+		}
+		change.Buckets[i] = types.Bucket{UpperBound: b.UpperBound, Count: b.Count - prev.Buckets[i].Count}
+	}
+	return change, true
+}
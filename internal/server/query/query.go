@@ -0,0 +1,206 @@
+// Package query runs range queries with aggregation over metrics history
+package query
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// maxPoints is a maximum number of points in one query result
+const maxPoints = 11000
+
+// Aggregation functions
+const (
+	FuncAvg        = "avg"
+	FuncMin        = "min"
+	FuncMax        = "max"
+	FuncSum        = "sum"
+	FuncRate       = "rate"
+	FuncLast       = "last"
+	FuncPercentile = "percentile"
+)
+
+// Query describes range query over history of one metric
+type Query struct {
+	ID     string
+	MType  string
+	Labels map[string]string
+	// From and To limit queried time range, To defaults to now
+	From time.Time
+	To   time.Time
+	// Range sets From to To minus Range if From is not set
+	Range time.Duration
+	// Step is a width of aggregation buckets, 0 aggregates the whole range into one point
+	Step time.Duration
+	Func string
+	// Quantile is required by percentile function and must be in [0, 1]
+	Quantile *float64
+}
+
+// Result is a series of aggregated points
+type Result struct {
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Func   string            `json:"func"`
+	From   time.Time         `json:"from"`
+	To     time.Time         `json:"to"`
+	Step   string            `json:"step"`
+	Points []types.Sample    `json:"points"`
+}
+
+// Validate checks query and fills default values
+func (q *Query) Validate(now time.Time) error {
+	if q.ID == "" {
+		return fmt.Errorf("%wno metric id in query", myerrors.ErrTypeBadRequest)
+	}
+	switch q.MType {
+	case "counter", "gauge", "histogram", "summary":
+	case "":
+		return fmt.Errorf("%wno metric type in query", myerrors.ErrTypeBadRequest)
+	default:
+		return fmt.Errorf("%wunknown metric type %s", myerrors.ErrTypeBadRequest, q.MType)
+	}
+	if q.To.IsZero() {
+		q.To = now
+	}
+	if q.From.IsZero() {
+		if q.Range <= 0 {
+			return fmt.Errorf("%wneither from nor range is set in query", myerrors.ErrTypeBadRequest)
+		}
+		q.From = q.To.Add(-q.Range)
+	}
+	if !q.From.Before(q.To) {
+		return fmt.Errorf("%wfrom must be before to", myerrors.ErrTypeBadRequest)
+	}
+	if q.Step < 0 {
+		return fmt.Errorf("%wnegative step", myerrors.ErrTypeBadRequest)
+	}
+	if q.Step > 0 && q.To.Sub(q.From)/q.Step > maxPoints {
+		return fmt.Errorf("%wtoo many points in query result, increase step", myerrors.ErrTypeBadRequest)
+	}
+	switch q.Func {
+	case FuncAvg, FuncMin, FuncMax, FuncSum, FuncRate, FuncLast:
+	case FuncPercentile:
+		if q.Quantile == nil {
+			return fmt.Errorf("%wno quantile for percentile function", myerrors.ErrTypeBadRequest)
+		}
+		if *q.Quantile < 0 || *q.Quantile > 1 || math.IsNaN(*q.Quantile) {
+			return fmt.Errorf("%wquantile must be in [0, 1]", myerrors.ErrTypeBadRequest)
+		}
+	case "":
+		q.Func = FuncLast
+	default:
+		return fmt.Errorf("%wunknown aggregation function %s", myerrors.ErrTypeBadRequest, q.Func)
+	}
+	return nil
+}
+
+// Execute runs query over metric history in storage
+func Execute(st storage.Storage, q Query) (Result, error) {
+	if err := q.Validate(time.Now()); err != nil {
+		return Result{}, err
+	}
+	samples, err := st.GetMetricHistory(types.Metrics{ID: q.ID, MType: q.MType, Labels: q.Labels}, q.From, q.To)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		ID:     q.ID,
+		MType:  q.MType,
+		Labels: q.Labels,
+		Func:   q.Func,
+		From:   q.From,
+		To:     q.To,
+		Step:   q.Step.String(),
+		Points: Aggregate(samples, q),
+	}, nil
+}
+
+// Aggregate splits sorted samples into buckets of query step and aggregates each of them.
+// Points are stamped with the end of their bucket, empty buckets are skipped
+func Aggregate(samples []types.Sample, q Query) []types.Sample {
+	points := make([]types.Sample, 0)
+	var prev *types.Sample
+	i := 0
+	for start := q.From; start.Before(q.To); {
+		end := q.To
+		if q.Step > 0 && start.Add(q.Step).Before(q.To) {
+			end = start.Add(q.Step)
+		}
+		j := i
+		for j < len(samples) && !samples[j].Timestamp.After(end) {
+			j++
+		}
+		if bucket := samples[i:j]; len(bucket) > 0 {
+			if value, ok := aggregateBucket(bucket, prev, q); ok {
+				points = append(points, types.Sample{Timestamp: end, Value: value})
+			}
+			prev = &samples[j-1]
+		}
+		i = j
+		start = end
+	}
+	return points
+}
+
+// aggregateBucket applies aggregation function to samples of one bucket.
+// prev is the last sample of previous buckets used as a baseline for rate
+func aggregateBucket(bucket []types.Sample, prev *types.Sample, q Query) (float64, bool) {
+	switch q.Func {
+	case FuncAvg, FuncSum:
+		var sum float64
+		for _, s := range bucket {
+			sum += s.Value
+		}
+		if q.Func == FuncAvg {
+			return sum / float64(len(bucket)), true
+		}
+		return sum, true
+	case FuncMin:
+		min := bucket[0].Value
+		for _, s := range bucket[1:] {
+			min = math.Min(min, s.Value)
+		}
+		return min, true
+	case FuncMax:
+		max := bucket[0].Value
+		for _, s := range bucket[1:] {
+			max = math.Max(max, s.Value)
+		}
+		return max, true
+	case FuncRate:
+		first, last := bucket[0], bucket[len(bucket)-1]
+		if prev != nil {
+			first = *prev
+		}
+		seconds := last.Timestamp.Sub(first.Timestamp).Seconds()
+		if seconds <= 0 {
+			return 0, false
+		}
+		return (last.Value - first.Value) / seconds, true
+	case FuncPercentile:
+		return percentile(bucket, *q.Quantile), true
+	default:
+		return bucket[len(bucket)-1].Value, true
+	}
+}
+
+// percentile counts quantile of sample values with linear interpolation
+func percentile(bucket []types.Sample, quantile float64) float64 {
+	values := make([]float64, len(bucket))
+	for i, s := range bucket {
+		values[i] = s.Value
+	}
+	sort.Float64s(values)
+	rank := quantile * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return values[lower] + (values[upper]-values[lower])*(rank-float64(lower))
+}
@@ -0,0 +1,86 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestAggregate tests aggregation functions over buckets
+func TestAggregate(t *testing.T) {
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := []types.Sample{
+		{Timestamp: from.Add(10 * time.Second), Value: 10},
+		{Timestamp: from.Add(20 * time.Second), Value: 30},
+		{Timestamp: from.Add(40 * time.Second), Value: 20},
+		{Timestamp: from.Add(70 * time.Second), Value: 50},
+		{Timestamp: from.Add(80 * time.Second), Value: 90},
+	}
+	tests := []struct {
+		name     string
+		fn       string
+		step     time.Duration
+		quantile float64
+		want     []float64
+	}{
+		{name: "avg over whole range", fn: FuncAvg, want: []float64{40}},
+		{name: "avg by minute", fn: FuncAvg, step: time.Minute, want: []float64{20, 70}},
+		{name: "min by minute", fn: FuncMin, step: time.Minute, want: []float64{10, 50}},
+		{name: "max by minute", fn: FuncMax, step: time.Minute, want: []float64{30, 90}},
+		{name: "sum by minute", fn: FuncSum, step: time.Minute, want: []float64{60, 140}},
+		{name: "last by minute", fn: FuncLast, step: time.Minute, want: []float64{20, 90}},
+		{name: "rate over whole range", fn: FuncRate, want: []float64{80.0 / 70}},
+		{name: "rate by minute uses previous bucket", fn: FuncRate, step: time.Minute, want: []float64{10.0 / 30, 70.0 / 40}},
+		{name: "median over whole range", fn: FuncPercentile, quantile: 0.5, want: []float64{30}},
+		{name: "percentile with interpolation", fn: FuncPercentile, quantile: 0.75, want: []float64{50}},
+		{name: "90th percentile", fn: FuncPercentile, quantile: 0.9, want: []float64{74}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := Query{
+				From:     from,
+				To:       from.Add(2 * time.Minute),
+				Step:     tt.step,
+				Func:     tt.fn,
+				Quantile: &tt.quantile,
+			}
+			points := Aggregate(samples, q)
+			values := make([]float64, len(points))
+			for i, p := range points {
+				values[i] = p.Value
+			}
+			assert.InDeltaSlice(t, tt.want, values, 1e-9)
+		})
+	}
+}
+
+// TestValidate tests query validation
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	median, wrong := 0.5, 2.0
+	tests := []struct {
+		name    string
+		query   Query
+		wantErr bool
+	}{
+		{name: "range from now", query: Query{ID: "Alloc", MType: "gauge", Range: 15 * time.Minute, Func: FuncAvg}},
+		{name: "no id", query: Query{MType: "gauge", Range: time.Minute}, wantErr: true},
+		{name: "no type", query: Query{ID: "Alloc", Range: time.Minute}, wantErr: true},
+		{name: "unknown type", query: Query{ID: "Alloc", MType: "meter", Range: time.Minute}, wantErr: true},
+		{name: "no from and range", query: Query{ID: "Alloc", MType: "gauge"}, wantErr: true},
+		{name: "unknown function", query: Query{ID: "Alloc", MType: "gauge", Range: time.Minute, Func: "median"}, wantErr: true},
+		{name: "median", query: Query{ID: "Alloc", MType: "gauge", Range: time.Minute, Func: FuncPercentile, Quantile: &median}},
+		{name: "no quantile", query: Query{ID: "Alloc", MType: "gauge", Range: time.Minute, Func: FuncPercentile}, wantErr: true},
+		{name: "wrong quantile", query: Query{ID: "Alloc", MType: "gauge", Range: time.Minute, Func: FuncPercentile, Quantile: &wrong}, wantErr: true},
+		{name: "too many points", query: Query{ID: "Alloc", MType: "gauge", Range: 24 * time.Hour, Step: time.Second}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.query.Validate(now)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLimiter tests that every client gets its own bucket refilled with rate
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(2, 3)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("agent-1")
+		assert.True(t, ok, i)
+	}
+	ok, wait := l.Allow("agent-1")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = l.Allow("agent-2")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("agent-1")
+	assert.True(t, ok)
+	ok, _ = l.Allow("agent-1")
+	assert.False(t, ok)
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ = l.Allow("agent-1")
+		assert.True(t, ok, i)
+	}
+	assert.Len(t, l.buckets, 1)
+}
+
+// TestNewLimiterBurst tests default burst
+func TestNewLimiterBurst(t *testing.T) {
+	l := NewLimiter(0.5, 0)
+	ok, _ := l.Allow("agent-1")
+	assert.True(t, ok)
+	ok, wait := l.Allow("agent-1")
+	assert.False(t, ok)
+	assert.Equal(t, 2, RetryAfter(wait))
+	assert.Equal(t, 1, RetryAfter(0))
+}
@@ -0,0 +1,286 @@
+// Package remotewrite decodes Prometheus remote_write requests and maps their series to gauges.
+// Every sample of series becomes a gauge with the labels of series and the timestamp of sample
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// ErrWrongFormat is returned when request or series can't be decoded or mapped
+var ErrWrongFormat = errors.New("wrong remote write format")
+
+// nameLabel is a label holding metric name
+const nameLabel = "__name__"
+
+// Label is a label of series
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value of series at timestamp in milliseconds
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a series of samples with labels
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+	// Histograms is a number of native histogram samples, they are not supported
+	Histograms int
+}
+
+// WriteRequest is a remote_write request, metadata and exemplars are skipped
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// field is a decoded field of protobuf message
+type field struct {
+	num   protowire.Number
+	typ   protowire.Type
+	bytes []byte
+	value uint64
+}
+
+// fields decodes fields of protobuf message
+func fields(data []byte) ([]field, error) {
+	var fs []field
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrWrongFormat, protowire.ParseError(n))
+		}
+		data = data[n:]
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(data)
+			f.value = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrWrongFormat, protowire.ParseError(n))
+		}
+		data = data[n:]
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+// Unmarshal decodes remote_write request from protobuf
+func Unmarshal(data []byte) (*WriteRequest, error) {
+	fs, err := fields(data)
+	if err != nil {
+		return nil, err
+	}
+	var req WriteRequest
+	for _, f := range fs {
+		if f.num != 1 || f.typ != protowire.BytesType {
+			continue
+		}
+		ts, err := unmarshalSeries(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	return &req, nil
+}
+
+// Marshal encodes request to protobuf like Prometheus does
+func (req WriteRequest) Marshal() []byte {
+	var b []byte
+	for _, ts := range req.Timeseries {
+		var series []byte
+		for _, l := range ts.Labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.Name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.Value)
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		for _, s := range ts.Samples {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+			series = protowire.AppendTag(series, 2, protowire.BytesType)
+			series = protowire.AppendBytes(series, sample)
+		}
+		for i := 0; i < ts.Histograms; i++ {
+			series = protowire.AppendTag(series, 4, protowire.BytesType)
+			series = protowire.AppendBytes(series, nil)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, series)
+	}
+	return b
+}
+
+// unmarshalSeries decodes series from protobuf
+func unmarshalSeries(data []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	fs, err := fields(data)
+	if err != nil {
+		return ts, err
+	}
+	for _, f := range fs {
+		if f.typ != protowire.BytesType {
+			continue
+		}
+		switch f.num {
+		case 1:
+			lfs, err := fields(f.bytes)
+			if err != nil {
+				return ts, err
+			}
+			var l Label
+			for _, lf := range lfs {
+				switch {
+				case lf.num == 1 && lf.typ == protowire.BytesType:
+					l.Name = string(lf.bytes)
+				case lf.num == 2 && lf.typ == protowire.BytesType:
+					l.Value = string(lf.bytes)
+				}
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			sfs, err := fields(f.bytes)
+			if err != nil {
+				return ts, err
+			}
+			var s Sample
+			for _, sf := range sfs {
+				switch {
+				case sf.num == 1 && sf.typ == protowire.Fixed64Type:
+					s.Value = math.Float64frombits(sf.value)
+				case sf.num == 2 && sf.typ == protowire.VarintType:
+					s.Timestamp = int64(sf.value)
+				}
+			}
+			ts.Samples = append(ts.Samples, s)
+		case 4:
+			ts.Histograms++
+		}
+	}
+	return ts, nil
+}
+
+// String formats series like Prometheus does: name{label="value"}
+func (ts TimeSeries) String() string {
+	var name string
+	l := make(map[string]string, len(ts.Labels))
+	for _, label := range ts.Labels {
+		if label.Name == nameLabel {
+			name = label.Value
+			continue
+		}
+		l[label.Name] = label.Value
+	}
+	return name + labels.String(l)
+}
+
+// Metrics maps samples of series to gauges sorted by timestamp.
+// NaN samples like staleness markers are skipped, series without name, with wrong labels, native histograms
+// or samples from the future beyond clock skew are rejected
+func (ts TimeSeries) Metrics() ([]types.Metrics, error) {
+	if ts.Histograms > 0 {
+		return nil, fmt.Errorf("%w: native histograms are not supported", ErrWrongFormat)
+	}
+	var (
+		id string
+		l  map[string]string
+	)
+	for _, label := range ts.Labels {
+		if label.Name == nameLabel {
+			id = label.Value
+			continue
+		}
+		if l == nil {
+			l = make(map[string]string, len(ts.Labels))
+		}
+		if _, ok := l[label.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate label %s", ErrWrongFormat, label.Name)
+		}
+		l[label.Name] = label.Value
+	}
+	if id == "" {
+		return nil, fmt.Errorf("%w: series has no %s label", ErrWrongFormat, nameLabel)
+	}
+	if err := labels.Validate(l); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrongFormat, err)
+	}
+	metrics := make([]types.Metrics, 0, len(ts.Samples))
+	latest := time.Now().Add(types.MaxClockSkew)
+	for _, s := range ts.Samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		if time.UnixMilli(s.Timestamp).After(latest) {
+			return nil, fmt.Errorf("%w: sample timestamp %s is in the future", ErrWrongFormat, time.UnixMilli(s.Timestamp).UTC().Format(time.RFC3339))
+		}
+		value := s.Value
+		metrics = append(metrics, types.Metrics{
+			ID:        id,
+			MType:     "gauge",
+			Value:     &value,
+			Labels:    l,
+			Timestamp: time.UnixMilli(s.Timestamp),
+		})
+	}
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].Timestamp.Before(metrics[j].Timestamp) })
+	return metrics, nil
+}
+
+// Batches splits metrics of series into batches of at most size metrics, 0 size means no limit.
+// The n-th batch round holds the n-th sample of every series, so no batch has two samples of one series
+// and storage keeps every sample in history
+func Batches(series [][]types.Metrics, size int) [][]types.Metrics {
+	rounds := 0
+	for _, metrics := range series {
+		if len(metrics) > rounds {
+			rounds = len(metrics)
+		}
+	}
+	var batches [][]types.Metrics
+	for round := 0; round < rounds; round++ {
+		var batch []types.Metrics
+		for _, metrics := range series {
+			if round >= len(metrics) {
+				continue
+			}
+			batch = append(batch, metrics[round])
+			if size > 0 && len(batch) == size {
+				batches = append(batches, batch)
+				batch = nil
+			}
+		}
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+		}
+	}
+	return batches
+}
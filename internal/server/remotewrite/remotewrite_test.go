@@ -0,0 +1,131 @@
+package remotewrite
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestUnmarshal tests decoding of requests
+func TestUnmarshal(t *testing.T) {
+	req := WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+			Samples: []Sample{{Value: 1, Timestamp: 1700000000000}, {Value: -2.5, Timestamp: -1}},
+		},
+		{Labels: []Label{{Name: "__name__", Value: "native"}}, Histograms: 2},
+	}}
+	data := req.Marshal()
+	// metadata and unknown fields are skipped
+	data = protowire.AppendTag(data, 3, protowire.BytesType)
+	data = protowire.AppendBytes(data, []byte{0x08, 0x01})
+	data = protowire.AppendTag(data, 15, protowire.VarintType)
+	data = protowire.AppendVarint(data, 7)
+	got, err := Unmarshal(data)
+	require.NoError(t, err)
+	assert.Equal(t, req, *got)
+
+	_, err = Unmarshal(data[:len(data)-1])
+	assert.ErrorIs(t, err, ErrWrongFormat)
+	_, err = Unmarshal([]byte{0x0a, 0x05, 0x0a})
+	assert.ErrorIs(t, err, ErrWrongFormat)
+}
+
+// TestMetrics tests mapping of series to gauges
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		series  TimeSeries
+		want    []types.Metrics
+		wantErr bool
+	}{
+		{
+			name: "samples are sorted by timestamp and stale markers are skipped",
+			series: TimeSeries{
+				Labels: []Label{{Name: "job", Value: "node"}, {Name: "__name__", Value: "up"}},
+				Samples: []Sample{
+					{Value: 2, Timestamp: 2000},
+					{Value: math.Float64frombits(0x7ff0000000000002), Timestamp: 3000},
+					{Value: 1, Timestamp: 1000},
+				},
+			},
+			want: []types.Metrics{
+				{ID: "up", MType: "gauge", Value: float(1), Labels: map[string]string{"job": "node"}, Timestamp: time.UnixMilli(1000)},
+				{ID: "up", MType: "gauge", Value: float(2), Labels: map[string]string{"job": "node"}, Timestamp: time.UnixMilli(2000)},
+			},
+		},
+		{
+			name:   "series without labels",
+			series: TimeSeries{Labels: []Label{{Name: "__name__", Value: "up"}}, Samples: []Sample{{Value: 1, Timestamp: 1000}}},
+			want:   []types.Metrics{{ID: "up", MType: "gauge", Value: float(1), Timestamp: time.UnixMilli(1000)}},
+		},
+		{
+			name:    "series without name",
+			series:  TimeSeries{Labels: []Label{{Name: "job", Value: "node"}}, Samples: []Sample{{Value: 1}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate label",
+			series:  TimeSeries{Labels: []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "job", Value: "b"}}},
+			wantErr: true,
+		},
+		{
+			name:    "wrong label name",
+			series:  TimeSeries{Labels: []Label{{Name: "__name__", Value: "up"}, {Name: "a=b", Value: "a"}}},
+			wantErr: true,
+		},
+		{
+			name:    "sample from the future",
+			series:  TimeSeries{Labels: []Label{{Name: "__name__", Value: "up"}}, Samples: []Sample{{Value: 1, Timestamp: time.Now().Add(time.Hour).UnixMilli()}}},
+			wantErr: true,
+		},
+		{
+			name:    "native histograms",
+			series:  TimeSeries{Labels: []Label{{Name: "__name__", Value: "up"}}, Histograms: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.series.Metrics()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrWrongFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.Equal(t, `up{job="node"}`, TimeSeries{Labels: []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}}.String())
+}
+
+// TestBatches tests that batches are limited by size and hold at most one sample of series
+func TestBatches(t *testing.T) {
+	a := []types.Metrics{{ID: "a", Timestamp: time.UnixMilli(1)}, {ID: "a", Timestamp: time.UnixMilli(2)}, {ID: "a", Timestamp: time.UnixMilli(3)}}
+	b := []types.Metrics{{ID: "b", Timestamp: time.UnixMilli(1)}}
+	c := []types.Metrics{{ID: "c", Timestamp: time.UnixMilli(1)}, {ID: "c", Timestamp: time.UnixMilli(2)}}
+	assert.Equal(t, [][]types.Metrics{
+		{a[0], b[0], c[0]},
+		{a[1], c[1]},
+		{a[2]},
+	}, Batches([][]types.Metrics{a, b, c}, 0))
+	assert.Equal(t, [][]types.Metrics{
+		{a[0], b[0]},
+		{c[0]},
+		{a[1], c[1]},
+		{a[2]},
+	}, Batches([][]types.Metrics{a, b, c}, 2))
+	assert.Empty(t, Batches(nil, 2))
+}
+
+// float returns pointer to v
+func float(v float64) *float64 {
+	return &v
+}
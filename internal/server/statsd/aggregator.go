@@ -0,0 +1,217 @@
+package statsd
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// entry aggregates samples of one metric between flushes
+type entry struct {
+	id     string
+	mtype  string
+	labels map[string]string
+	// delta is a scaled sum of counter samples
+	delta float64
+	// value is a gauge value, updated is set if it changed since the last flush
+	value   float64
+	updated bool
+	// relative is set if gauge got only relative samples, then value is a change of stored value
+	relative bool
+	members  map[string]struct{}
+	hist     *types.Histogram
+}
+
+// Aggregator aggregates StatsD samples like the agent does between reports.
+// Counters, sets and histograms start from zero after flush, gauges keep their values
+// until a flush without updates, then they are forgotten. Relative samples of gauges which aren't kept
+// change the stored value
+type Aggregator struct {
+	buckets []float64
+	// Storage holds values of gauges changed by relative samples, they start from zero if it is nil
+	Storage storage.Storage
+	// MaxMetrics is a maximum number of aggregated metrics, samples of new metrics are dropped when it is reached,
+	// 0 means no limit
+	MaxMetrics int
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// NewAggregator creates Aggregator making histograms with bucket bounds buckets
+// and holding at most maxMetrics metrics, relative gauges start from values in store
+func NewAggregator(buckets []float64, store storage.Storage, maxMetrics int) *Aggregator {
+	return &Aggregator{
+		buckets:    buckets,
+		Storage:    store,
+		MaxMetrics: maxMetrics,
+		entries:    make(map[string]*entry),
+	}
+}
+
+// Add adds sample to aggregates, it returns false if sample is dropped because there are too many metrics
+func (a *Aggregator) Add(s Sample) bool {
+	mtype := "gauge"
+	switch s.Type {
+	case TypeCounter:
+		mtype = "counter"
+	case TypeTimer, TypeHistogram:
+		mtype = "histogram"
+	}
+	key := s.Type + ":" + s.Name + labels.String(s.Tags)
+	if s.Type == TypeHistogram {
+		key = TypeTimer + ":" + s.Name + labels.String(s.Tags)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.entries[key]
+	if !ok {
+		if a.MaxMetrics > 0 && len(a.entries) >= a.MaxMetrics {
+			return false
+		}
+		e = &entry{id: s.Name, mtype: mtype, labels: s.Tags, relative: s.Type == TypeGauge && s.Relative}
+		a.entries[key] = e
+	}
+	switch s.Type {
+	case TypeCounter:
+		e.delta += s.Value / s.Rate
+	case TypeGauge:
+		if s.Relative {
+			e.value += s.Value
+		} else {
+			e.value = s.Value
+			e.relative = false
+		}
+		e.updated = true
+	case TypeSet:
+		if e.members == nil {
+			e.members = make(map[string]struct{})
+		}
+		e.members[s.Member] = struct{}{}
+	case TypeTimer, TypeHistogram:
+		if e.hist == nil {
+			e.hist = types.NewHistogram(a.buckets)
+		}
+		e.hist.ObserveN(s.Value, uint64(math.Round(1/s.Rate)))
+	}
+	return true
+}
+
+// stored returns value of gauge m in storage, it is 0 if gauge isn't stored
+func (a *Aggregator) stored(m types.Metrics) (float64, error) {
+	if a.Storage == nil {
+		return 0, nil
+	}
+	stored, err := a.Storage.GetMetric(types.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}, "")
+	if errors.Is(err, myerrors.ErrTypeNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if stored.Value == nil {
+		return 0, nil
+	}
+	return *stored.Value, nil
+}
+
+// pending is a change of relative gauge flushed before stored value is read
+type pending struct {
+	key    string
+	index  int
+	change float64
+}
+
+// restoreChange returns change of relative gauge which couldn't be flushed, so that it is flushed next time
+func (a *Aggregator) restoreChange(key string, m types.Metrics, change float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.entries[key]
+	if !ok {
+		e = &entry{id: m.ID, mtype: m.MType, labels: m.Labels, relative: true}
+		a.entries[key] = e
+	}
+	if e.relative {
+		e.value += change
+		e.updated = true
+	}
+}
+
+// Flush returns metrics aggregated since the last flush sorted by ID.
+// Counter deltas are rounded to integers, gauges not updated since the last flush are forgotten.
+// Relative gauges are added to stored values, which are read without blocking samples
+func (a *Aggregator) Flush() []types.Metrics {
+	a.mu.Lock()
+	var (
+		metrics  []types.Metrics
+		relative []pending
+	)
+	for key, e := range a.entries {
+		m := types.Metrics{ID: e.id, MType: e.mtype, Labels: e.labels}
+		switch {
+		case e.mtype == "counter":
+			delta := int64(math.Round(e.delta))
+			m.Delta = &delta
+			delete(a.entries, key)
+		case e.mtype == "histogram":
+			m.Histogram = e.hist
+			delete(a.entries, key)
+		case e.members != nil:
+			size := float64(len(e.members))
+			m.Value = &size
+			delete(a.entries, key)
+		case e.updated:
+			value := e.value
+			m.Value = &value
+			e.updated = false
+			if e.relative {
+				// the next change is added to stored value again, it includes this one after flush is saved
+				relative = append(relative, pending{key: key, index: len(metrics), change: value})
+				e.value = 0
+			}
+		default:
+			delete(a.entries, key)
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	a.mu.Unlock()
+	failed := make(map[int]bool)
+	for _, p := range relative {
+		m := metrics[p.index]
+		stored, err := a.stored(m)
+		if err != nil {
+			loggers.ErrorLogger.Println("error while getting stored statsd gauge:", err)
+			a.restoreChange(p.key, m, p.change)
+			failed[p.index] = true
+			continue
+		}
+		*m.Value += stored
+	}
+	if len(failed) > 0 {
+		kept := metrics[:0]
+		for i, m := range metrics {
+			if !failed[i] {
+				kept = append(kept, m)
+			}
+		}
+		metrics = kept
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		if li, lj := labels.String(metrics[i].Labels), labels.String(metrics[j].Labels); li != lj {
+			return li < lj
+		}
+		return metrics[i].MType < metrics[j].MType
+	})
+	return metrics
+}
@@ -0,0 +1,117 @@
+// Package statsd receives StatsD lines over UDP, aggregates them for a flush interval and saves them to storage.
+// Counters are saved as counters, gauges and sizes of sets as gauges, timers and histograms as histograms
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/labels"
+)
+
+// types of StatsD samples
+const (
+	TypeCounter   = "c"
+	TypeGauge     = "g"
+	TypeTimer     = "ms"
+	TypeHistogram = "h"
+	TypeSet       = "s"
+)
+
+// ErrWrongFormat is returned when StatsD line can't be parsed
+var ErrWrongFormat = errors.New("wrong statsd line format")
+
+// Sample is one value of StatsD line
+type Sample struct {
+	Name string
+	Type string
+	// Value is a number of counter, gauge, timer or histogram sample
+	Value float64
+	// Relative is set for gauges written with sign, they change gauge by Value instead of setting it
+	Relative bool
+	// Member is a value of set sample
+	Member string
+	// Rate is a sample rate in (0, 1], counters and timers are scaled by 1/Rate
+	Rate float64
+	// Tags are DogStatsD tags, tags without value have empty value
+	Tags map[string]string
+}
+
+// ParseLine parses StatsD line name:value[:value...]|type[|@rate][|#tag:value,tag].
+// Other DogStatsD fields like container ID or timestamp are ignored
+func ParseLine(line string) ([]Sample, error) {
+	colon := strings.IndexByte(line, ':')
+	pipe := strings.IndexByte(line, '|')
+	if colon <= 0 || pipe < colon {
+		return nil, fmt.Errorf("%w: %q", ErrWrongFormat, line)
+	}
+	name := line[:colon]
+	fields := strings.Split(line[pipe+1:], "|")
+	sample := Sample{Name: name, Type: fields[0], Rate: 1}
+	switch sample.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHistogram, TypeSet:
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrWrongFormat, sample.Type)
+	}
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("%w: wrong sample rate %q", ErrWrongFormat, field)
+			}
+			sample.Rate = rate
+		case strings.HasPrefix(field, "#"):
+			tags, err := parseTags(field[1:])
+			if err != nil {
+				return nil, err
+			}
+			sample.Tags = tags
+		}
+	}
+	var samples []Sample
+	for _, value := range strings.Split(line[colon+1:pipe], ":") {
+		s := sample
+		if s.Type == TypeSet {
+			if value == "" {
+				return nil, fmt.Errorf("%w: empty set member", ErrWrongFormat)
+			}
+			s.Member = value
+			samples = append(samples, s)
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%w: wrong value %q", ErrWrongFormat, value)
+		}
+		s.Value = v
+		s.Relative = s.Type == TypeGauge && (value[0] == '+' || value[0] == '-')
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// parseTags parses comma separated DogStatsD tags
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		name, value := tag, ""
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			name, value = tag[:i], tag[i+1:]
+		}
+		tags[name] = value
+	}
+	if err := labels.Validate(tags); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrongFormat, err)
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
@@ -0,0 +1,54 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseLine tests parsing of StatsD and DogStatsD lines
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		samples []Sample
+		wantErr bool
+	}{
+		{name: "counter", line: "api.requests:3|c", samples: []Sample{{Name: "api.requests", Type: TypeCounter, Value: 3, Rate: 1}}},
+		{name: "sampled counter", line: "api.requests:1|c|@0.1", samples: []Sample{{Name: "api.requests", Type: TypeCounter, Value: 1, Rate: 0.1}}},
+		{name: "gauge", line: "queue.size:-5.5|g", samples: []Sample{{Name: "queue.size", Type: TypeGauge, Value: -5.5, Relative: true, Rate: 1}}},
+		{name: "absolute gauge", line: "queue.size:7|g", samples: []Sample{{Name: "queue.size", Type: TypeGauge, Value: 7, Rate: 1}}},
+		{name: "timer with tags", line: "api.latency:12.5|ms|#env:prod,canary", samples: []Sample{
+			{Name: "api.latency", Type: TypeTimer, Value: 12.5, Rate: 1, Tags: map[string]string{"env": "prod", "canary": ""}},
+		}},
+		{name: "histogram with several values", line: "payload:10:20|h|@0.5|#env:dev", samples: []Sample{
+			{Name: "payload", Type: TypeHistogram, Value: 10, Rate: 0.5, Tags: map[string]string{"env": "dev"}},
+			{Name: "payload", Type: TypeHistogram, Value: 20, Rate: 0.5, Tags: map[string]string{"env": "dev"}},
+		}},
+		{name: "set", line: "users:alice|s", samples: []Sample{{Name: "users", Type: TypeSet, Member: "alice", Rate: 1}}},
+		{name: "ignored DogStatsD fields", line: "api.requests:1|c|c:abc123|T1656581400", samples: []Sample{{Name: "api.requests", Type: TypeCounter, Value: 1, Rate: 1}}},
+		{name: "tag with colon in value", line: "up:1|g|#url:http://host", samples: []Sample{
+			{Name: "up", Type: TypeGauge, Value: 1, Rate: 1, Tags: map[string]string{"url": "http://host"}},
+		}},
+		{name: "no type", line: "api.requests:1", wantErr: true},
+		{name: "no name", line: ":1|c", wantErr: true},
+		{name: "unknown type", line: "api.requests:1|x", wantErr: true},
+		{name: "wrong value", line: "api.requests:one|c", wantErr: true},
+		{name: "infinite value", line: "api.requests:+Inf|g", wantErr: true},
+		{name: "zero sample rate", line: "api.requests:1|c|@0", wantErr: true},
+		{name: "wrong tag name", line: "api.requests:1|c|#a=b:c", wantErr: true},
+		{name: "empty set member", line: "users:|s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrWrongFormat)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.samples, samples)
+		})
+	}
+}
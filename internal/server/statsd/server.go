@@ -0,0 +1,177 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/loggers"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/clientip"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+)
+
+// maxPacketSize is a maximum size of UDP packet
+const maxPacketSize = 65535
+
+// Server receives StatsD packets and saves aggregated metrics to storage every flush interval
+type Server struct {
+	Addr          string
+	FlushInterval time.Duration
+	Storage       storage.Storage
+	// TrustedSubnet is a list of networks packets are accepted from, packets from anywhere are accepted if it is empty
+	TrustedSubnet clientip.Nets
+	Debug         bool
+	Aggregator    *Aggregator
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewServer creates StatsD server saving metrics to store
+func NewServer(cfg config.Config, store storage.Storage) (*Server, error) {
+	subnet, err := clientip.ParseNets(cfg.TrustedSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing trusted subnet: %w", err)
+	}
+	return &Server{
+		Addr:          cfg.StatsDAddress,
+		FlushInterval: cfg.StatsDFlushInterval,
+		Storage:       store,
+		TrustedSubnet: subnet,
+		Debug:         cfg.Debug,
+		Aggregator:    NewAggregator(cfg.StatsDHistogramBuckets, store, cfg.StatsDMaxMetrics),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// Serve reads packets from conn until server is shut down and flushes metrics every flush interval
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	s.conn = conn
+	s.wg.Add(2)
+	s.mu.Unlock()
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.Flush()
+			}
+		}
+	}()
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			loggers.ErrorLogger.Println("error while reading statsd packet:", err)
+			continue
+		}
+		if len(s.TrustedSubnet) > 0 {
+			if udpAddr, ok := addr.(*net.UDPAddr); !ok || !s.TrustedSubnet.Contains(udpAddr.IP) {
+				if s.Debug {
+					loggers.DebugLogger.Println("statsd packet from untrusted address", addr)
+				}
+				continue
+			}
+		}
+		s.handlePacket(buf[:n])
+	}
+}
+
+// handlePacket adds samples of every line of packet to aggregates, wrong lines are skipped
+func (s *Server) handlePacket(packet []byte) {
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		samples, err := ParseLine(line)
+		if err != nil {
+			loggers.ErrorLogger.Println("error while parsing statsd line:", err)
+			continue
+		}
+		for _, sample := range samples {
+			if !s.Aggregator.Add(sample) && s.Debug {
+				loggers.DebugLogger.Println("statsd metric dropped, too many metrics:", sample.Name)
+			}
+		}
+	}
+}
+
+// Flush saves metrics aggregated since the last flush to storage.
+// If batch is rejected metrics are saved one by one, so that one invalid metric doesn't drop the others
+func (s *Server) Flush() {
+	metrics := s.Aggregator.Flush()
+	if len(metrics) == 0 {
+		return
+	}
+	saved := len(metrics)
+	if err := s.Storage.SaveManyMetrics(metrics, ""); err != nil {
+		saved = 0
+		for _, m := range metrics {
+			if err = s.Storage.SaveMetric(m, ""); err != nil {
+				loggers.ErrorLogger.Printf("error while saving statsd metric %s: %v", m.ID, err)
+				continue
+			}
+			saved++
+		}
+	}
+	if s.Debug {
+		loggers.DebugLogger.Printf("saved %d statsd metrics", saved)
+	}
+}
+
+// Shutdown stops receiving packets and flushes metrics received so far.
+// It waits for server to stop until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	s.mu.Unlock()
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.Flush()
+	return err
+}
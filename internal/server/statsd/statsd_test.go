@@ -0,0 +1,220 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/storage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// add parses lines and adds them to aggregator
+func add(t *testing.T, a *Aggregator, lines ...string) {
+	for _, line := range lines {
+		samples, err := ParseLine(line)
+		require.NoError(t, err, line)
+		for _, s := range samples {
+			a.Add(s)
+		}
+	}
+}
+
+// TestAggregator tests aggregation of samples between flushes
+func TestAggregator(t *testing.T) {
+	a := NewAggregator([]float64{10, 100}, nil, 0)
+	add(t, a,
+		"requests:1|c", "requests:2|c|@0.5", "requests:1|c|#env:prod",
+		"queue:10|g", "queue:+5|g", "queue:-3|g",
+		"latency:5|ms", "latency:50|h|@0.5", "latency:500|ms",
+		"users:alice|s", "users:bob|s", "users:alice|s",
+	)
+	delta, envDelta, queue, users := int64(5), int64(1), 12.0, 2.0
+	assert.Equal(t, []types.Metrics{
+		{ID: "latency", MType: "histogram", Histogram: &types.Histogram{
+			Buckets: []types.Bucket{{UpperBound: 10, Count: 1}, {UpperBound: 100, Count: 2}},
+			Count:   4,
+			Sum:     605,
+		}},
+		{ID: "queue", MType: "gauge", Value: &queue},
+		{ID: "requests", MType: "counter", Delta: &delta},
+		{ID: "requests", MType: "counter", Delta: &envDelta, Labels: map[string]string{"env": "prod"}},
+		{ID: "users", MType: "gauge", Value: &users},
+	}, a.Flush())
+
+	add(t, a, "queue:+1|g")
+	queue = 13
+	assert.Equal(t, []types.Metrics{{ID: "queue", MType: "gauge", Value: &queue}}, a.Flush())
+	assert.Empty(t, a.Flush(), "nothing changed since flush")
+}
+
+// TestAggregatorGauges tests that idle gauges are forgotten and relative gauges start from stored values
+func TestAggregatorGauges(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	a := NewAggregator(nil, store, 0)
+	flush := func() []types.Metrics {
+		metrics := a.Flush()
+		require.NoError(t, store.SaveManyMetrics(metrics, ""))
+		return metrics
+	}
+	queue := 10.0
+	require.NoError(t, store.SaveMetric(types.Metrics{ID: "queue", MType: "gauge", Value: &queue}, ""))
+
+	add(t, a, "queue:+5|g", "queue:-2|g")
+	queue = 13
+	assert.Equal(t, []types.Metrics{{ID: "queue", MType: "gauge", Value: &queue}}, flush(), "relative gauge starts from stored value")
+	assert.Empty(t, flush())
+	assert.Empty(t, a.entries, "idle gauge is forgotten")
+
+	queue = 20
+	require.NoError(t, store.SaveMetric(types.Metrics{ID: "queue", MType: "gauge", Value: &queue}, ""))
+	add(t, a, "queue:+1|g")
+	queue = 21
+	assert.Equal(t, []types.Metrics{{ID: "queue", MType: "gauge", Value: &queue}}, flush(), "forgotten gauge starts from stored value")
+
+	add(t, a, "users:+3|g", "queue:5|g", "queue:+1|g")
+	users, queue := 3.0, 6.0
+	assert.Equal(t, []types.Metrics{
+		{ID: "queue", MType: "gauge", Value: &queue},
+		{ID: "users", MType: "gauge", Value: &users},
+	}, flush(), "gauge which isn't stored starts from zero, set gauge doesn't depend on stored value")
+}
+
+// lockCheckingStorage is a storage which records if aggregator is locked while stored metrics are read
+type lockCheckingStorage struct {
+	storage.Storage
+	a      *Aggregator
+	locked bool
+}
+
+// GetMetric records if aggregator is locked and gets metric from storage
+func (s *lockCheckingStorage) GetMetric(m types.Metrics, key string) (types.Metrics, error) {
+	if s.a.mu.TryLock() {
+		s.a.mu.Unlock()
+	} else {
+		s.locked = true
+	}
+	return s.Storage.GetMetric(m, key)
+}
+
+// TestAggregatorReadsStoredUnlocked tests that samples are not blocked while stored gauges are read
+func TestAggregatorReadsStoredUnlocked(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	checking := &lockCheckingStorage{Storage: store}
+	a := NewAggregator(nil, checking, 0)
+	checking.a = a
+	add(t, a, "queue:+1|g")
+	queue := 1.0
+	assert.Equal(t, []types.Metrics{{ID: "queue", MType: "gauge", Value: &queue}}, a.Flush())
+	assert.False(t, checking.locked)
+}
+
+// TestAggregatorMaxMetrics tests that samples of new metrics are dropped when there are too many metrics
+func TestAggregatorMaxMetrics(t *testing.T) {
+	a := NewAggregator(nil, nil, 2)
+	sample := func(line string) Sample {
+		samples, err := ParseLine(line)
+		require.NoError(t, err)
+		return samples[0]
+	}
+	assert.True(t, a.Add(sample("a:1|c")))
+	assert.True(t, a.Add(sample("b:1|g")))
+	assert.False(t, a.Add(sample("c:1|c")))
+	assert.True(t, a.Add(sample("a:1|c")), "samples of aggregated metrics are added")
+	assert.Len(t, a.Flush(), 2)
+
+	assert.True(t, a.Add(sample("c:1|c")), "counters are forgotten after flush")
+	assert.False(t, a.Add(sample("d:1|c")), "updated gauge is kept after flush")
+	a.Flush()
+	a.Flush()
+	assert.True(t, a.Add(sample("d:1|c")), "idle gauge is forgotten")
+}
+
+// TestServer tests that packets received over UDP are saved to storage on flush and shutdown
+func TestServer(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	s, err := NewServer(config.Config{StatsDFlushInterval: time.Hour, StatsDHistogramBuckets: []float64{10}}, store)
+	require.NoError(t, err)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(conn)
+	}()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("requests:2|c\nbroken line\nlatency:5|ms|#env:prod\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		s.Aggregator.mu.Lock()
+		defer s.Aggregator.mu.Unlock()
+		return len(s.Aggregator.entries) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Shutdown(context.Background()))
+	assert.NoError(t, <-served)
+
+	metrics, err := store.GetAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	requests, err := store.GetMetric(types.Metrics{ID: "requests", MType: "counter"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *requests.Delta)
+	latency, err := store.GetMetric(types.Metrics{ID: "latency", MType: "histogram", Labels: map[string]string{"env": "prod"}}, "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), latency.Histogram.Count)
+}
+
+// TestServerFlushSavesValidMetrics tests that metric rejected by storage doesn't drop other metrics of flush
+func TestServerFlushSavesValidMetrics(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	require.NoError(t, store.SaveMetric(types.Metrics{ID: "latency", MType: "histogram", Histogram: &types.Histogram{
+		Buckets: []types.Bucket{{UpperBound: 1, Count: 1}},
+		Count:   1,
+	}}, ""))
+	s, err := NewServer(config.Config{StatsDFlushInterval: time.Hour, StatsDHistogramBuckets: []float64{10}}, store)
+	require.NoError(t, err)
+	s.handlePacket([]byte("requests:2|c\nlatency:5|ms\nqueue:3|g"))
+	s.Flush()
+
+	requests, err := store.GetMetric(types.Metrics{ID: "requests", MType: "counter"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *requests.Delta)
+	queue, err := store.GetMetric(types.Metrics{ID: "queue", MType: "gauge"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3.0, *queue.Value)
+	latency, err := store.GetMetric(types.Metrics{ID: "latency", MType: "histogram"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), latency.Histogram.Count, "histogram with other bounds is rejected")
+}
+
+// TestServerTrustedSubnet tests that packets from outside of trusted subnet are dropped
+func TestServerTrustedSubnet(t *testing.T) {
+	store, _, err := storage.NewStorage(config.Config{})
+	require.NoError(t, err)
+	s, err := NewServer(config.Config{StatsDFlushInterval: time.Hour, TrustedSubnet: "10.0.0.0/8"}, store)
+	require.NoError(t, err)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(conn)
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("requests:2|c"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, s.Shutdown(context.Background()))
+	metrics, err := store.GetAllMetrics()
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
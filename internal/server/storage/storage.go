@@ -1,7 +1,16 @@
 // Package storage contains storage interface
 package storage
 
-import "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+import (
+	"fmt"
+	"time"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/config"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/database"
+	filestorage "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/fileStorage"
+	memstorage "github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/memStorage"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
 
 // Storage stores metric info
 type Storage interface {
@@ -13,6 +22,30 @@ type Storage interface {
 	SaveMetric(metric types.Metrics, key string) error
 	// SaveManyMetrics saves info about several metrics
 	SaveManyMetrics(metric []types.Metrics, key string) error
+	// GetMetricHistory gets samples of one metric with timestamps in [from, to]
+	GetMetricHistory(m types.Metrics, from, to time.Time) ([]types.Sample, error)
 	// Check checks if storage works OK
 	Check() error
+	// Close flushes unsaved data and releases resources of storage
+	Close() error
+}
+
+// NewStorage creates storage set in config: database if it is opened,
+// file storage if store file is set and memory storage otherwise.
+// Saved metrics are delivered to subscribers of Watcher storage returns
+func NewStorage(cfg config.Config) (Storage, types.StorageType, error) {
+	if cfg.Database == nil && cfg.StoreFile == "" {
+		ms := memstorage.NewMemStorage(cfg)
+		ms.SetHistoryCompaction()
+		return newWatchedStorage(ms, cfg.WatchBufferSize), types.StorageTypeMemory, nil
+	} else if cfg.Database == nil {
+		fs := filestorage.NewFileStorage(cfg)
+		if err := fs.SetFileStorage(); err != nil {
+			return nil, types.StorageTypeFile, fmt.Errorf("error while setting file storage: %w", err)
+		}
+		return newWatchedStorage(fs, cfg.WatchBufferSize), types.StorageTypeFile, nil
+	}
+	db := database.NewDatabase(cfg)
+	db.SetHistoryCompaction()
+	return newWatchedStorage(db, cfg.WatchBufferSize), types.StorageTypeDB, nil
 }
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/watch"
+)
+
+// Watcher is a storage delivering saved metrics to subscribers
+type Watcher interface {
+	// Watch subscribes to metrics selected by filter which are saved after subscription
+	Watch(filter watch.Filter) (*watch.Subscription, error)
+}
+
+// watchedStorage publishes metrics saved to storage
+type watchedStorage struct {
+	Storage
+	hub *watch.Hub
+}
+
+// newWatchedStorage wraps storage to publish saved metrics to subscribers buffering bufferSize updates
+func newWatchedStorage(st Storage, bufferSize int) *watchedStorage {
+	return &watchedStorage{Storage: st, hub: watch.NewHub(bufferSize)}
+}
+
+// SaveMetric saves info about one metric and publishes it if it is saved
+func (s *watchedStorage) SaveMetric(metric types.Metrics, key string) error {
+	if err := s.Storage.SaveMetric(metric, key); err != nil {
+		return err
+	}
+	s.hub.Publish([]types.Metrics{metric})
+	return nil
+}
+
+// SaveManyMetrics saves info about several metrics and publishes them if they are saved
+func (s *watchedStorage) SaveManyMetrics(metrics []types.Metrics, key string) error {
+	if err := s.Storage.SaveManyMetrics(metrics, key); err != nil {
+		return err
+	}
+	s.hub.Publish(metrics)
+	return nil
+}
+
+// Watch subscribes to metrics selected by filter
+func (s *watchedStorage) Watch(filter watch.Filter) (*watch.Subscription, error) {
+	return s.hub.Subscribe(filter)
+}
+
+// Close ends subscriptions, then flushes and closes storage
+func (s *watchedStorage) Close() error {
+	s.hub.Close()
+	return s.Storage.Close()
+}
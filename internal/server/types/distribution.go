@@ -0,0 +1,154 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+)
+
+// Bucket stores a number of histogram observations in (previous bucket's UpperBound, UpperBound]
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// Histogram stores observations counted in buckets.
+// Observations greater than the last bound are only counted in Count
+type Histogram struct {
+	Buckets []Bucket `json:"buckets"`
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+}
+
+// Quantile stores value of a quantile of observations
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Summary stores precomputed quantiles of observations
+type Summary struct {
+	Quantiles []Quantile `json:"quantiles"`
+	Count     uint64     `json:"count"`
+	Sum       float64    `json:"sum"`
+}
+
+// NewHistogram creates empty histogram with sorted bucket bounds
+func NewHistogram(bounds []float64) *Histogram {
+	sorted := make([]float64, len(bounds))
+	copy(sorted, bounds)
+	sort.Float64s(sorted)
+	h := &Histogram{Buckets: make([]Bucket, 0, len(sorted))}
+	for i, bound := range sorted {
+		if i > 0 && bound == sorted[i-1] {
+			continue
+		}
+		h.Buckets = append(h.Buckets, Bucket{UpperBound: bound})
+	}
+	return h
+}
+
+// ObserveN adds n observations of value v
+func (h *Histogram) ObserveN(v float64, n uint64) {
+	h.Count += n
+	h.Sum += v * float64(n)
+	i := sort.Search(len(h.Buckets), func(i int) bool { return v <= h.Buckets[i].UpperBound })
+	if i < len(h.Buckets) {
+		h.Buckets[i].Count += n
+	}
+}
+
+// Validate checks that bounds are finite and increasing and buckets do not exceed total count
+func (h Histogram) Validate() error {
+	var total uint64
+	for i, b := range h.Buckets {
+		if math.IsNaN(b.UpperBound) || math.IsInf(b.UpperBound, 0) {
+			return errors.New("histogram bucket bound must be finite")
+		}
+		if i > 0 && b.UpperBound <= h.Buckets[i-1].UpperBound {
+			return errors.New("histogram bucket bounds must be increasing")
+		}
+		total += b.Count
+	}
+	if total > h.Count {
+		return errors.New("histogram buckets count more observations than total count")
+	}
+	return nil
+}
+
+// Merge adds observations of other histogram. Bucket counts are not cumulative, so they can be added up
+// only if bounds are equal, histogram without buckets and observations takes bounds of other
+func (h *Histogram) Merge(other Histogram) error {
+	if len(h.Buckets) == 0 && h.Count == 0 {
+		h.Buckets = append([]Bucket(nil), other.Buckets...)
+		h.Count = other.Count
+		h.Sum = other.Sum
+		return nil
+	}
+	if len(h.Buckets) != len(other.Buckets) {
+		return fmt.Errorf("%whistogram has %d buckets, stored one has %d", myerrors.ErrTypeBadRequest, len(other.Buckets), len(h.Buckets))
+	}
+	for i, b := range other.Buckets {
+		if b.UpperBound != h.Buckets[i].UpperBound {
+			return fmt.Errorf("%whistogram bucket bound %v differs from stored bound %v", myerrors.ErrTypeBadRequest, b.UpperBound, h.Buckets[i].UpperBound)
+		}
+	}
+	merged := make([]Bucket, len(h.Buckets))
+	for i, b := range h.Buckets {
+		merged[i] = Bucket{UpperBound: b.UpperBound, Count: b.Count + other.Buckets[i].Count}
+	}
+	h.Buckets = merged
+	h.Count += other.Count
+	h.Sum += other.Sum
+	return nil
+}
+
+// Cumulative returns cumulative counts of buckets as Prometheus exposes them
+func (h Histogram) Cumulative() []Bucket {
+	cumulative := make([]Bucket, len(h.Buckets))
+	var count uint64
+	for i, b := range h.Buckets {
+		count += b.Count
+		cumulative[i] = Bucket{UpperBound: b.UpperBound, Count: count}
+	}
+	return cumulative
+}
+
+// String makes a canonical string of histogram used in hashes and plain text output
+func (h Histogram) String() string {
+	parts := make([]string, len(h.Buckets))
+	for i, b := range h.Buckets {
+		parts[i] = fmt.Sprintf("%s=%d", strconv.FormatFloat(b.UpperBound, 'g', -1, 64), b.Count)
+	}
+	return fmt.Sprintf("count=%d sum=%f buckets=%s", h.Count, h.Sum, strings.Join(parts, ","))
+}
+
+// Validate checks that quantiles are in [0, 1] and increasing
+func (s Summary) Validate() error {
+	for i, q := range s.Quantiles {
+		if math.IsNaN(q.Quantile) || q.Quantile < 0 || q.Quantile > 1 {
+			return errors.New("summary quantile must be in [0, 1]")
+		}
+		if i > 0 && q.Quantile <= s.Quantiles[i-1].Quantile {
+			return errors.New("summary quantiles must be increasing")
+		}
+	}
+	return nil
+}
+
+// String makes a canonical string of summary used in hashes and plain text output
+func (s Summary) String() string {
+	quantiles := make([]Quantile, len(s.Quantiles))
+	copy(quantiles, s.Quantiles)
+	sort.Slice(quantiles, func(i, j int) bool { return quantiles[i].Quantile < quantiles[j].Quantile })
+	parts := make([]string, len(quantiles))
+	for i, q := range quantiles {
+		parts[i] = fmt.Sprintf("%s=%f", strconv.FormatFloat(q.Quantile, 'g', -1, 64), q.Value)
+	}
+	return fmt.Sprintf("count=%d sum=%f quantiles=%s", s.Count, s.Sum, strings.Join(parts, ","))
+}
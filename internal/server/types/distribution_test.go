@@ -0,0 +1,72 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/myerrors"
+)
+
+// TestHistogramMerge tests merging of histograms with equal bucket bounds and rejection of different ones
+func TestHistogramMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       Histogram
+		other   Histogram
+		want    Histogram
+		wantErr bool
+	}{
+		{
+			name:  "merge into empty histogram",
+			other: Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 2}}, Count: 3, Sum: 4.5},
+			want:  Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 2}}, Count: 3, Sum: 4.5},
+		},
+		{
+			name:  "equal bounds are added up",
+			h:     Histogram{Buckets: []Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 2}}, Count: 4, Sum: 5},
+			other: Histogram{Buckets: []Bucket{{UpperBound: 0.1, Count: 3}, {UpperBound: 1, Count: 0}}, Count: 3, Sum: 0.2},
+			want:  Histogram{Buckets: []Bucket{{UpperBound: 0.1, Count: 4}, {UpperBound: 1, Count: 2}}, Count: 7, Sum: 5.2},
+		},
+		{
+			name:    "different bounds are rejected",
+			h:       Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 5}, {UpperBound: 10, Count: 3}}, Count: 8, Sum: 20},
+			other:   Histogram{Buckets: []Bucket{{UpperBound: 5, Count: 2}}, Count: 2, Sum: 6},
+			want:    Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 5}, {UpperBound: 10, Count: 3}}, Count: 8, Sum: 20},
+			wantErr: true,
+		},
+		{
+			name:    "more bounds are rejected",
+			h:       Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 1}}, Count: 1, Sum: 1},
+			other:   Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 1}, {UpperBound: 10, Count: 1}}, Count: 2, Sum: 6},
+			want:    Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 1}}, Count: 1, Sum: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.Merge(tt.other)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, myerrors.ErrTypeBadRequest)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, tt.h)
+		})
+	}
+}
+
+// TestHistogramValidate tests validation of histogram buckets
+func TestHistogramValidate(t *testing.T) {
+	assert.NoError(t, Histogram{Buckets: []Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 1}}, Count: 3}.Validate())
+	assert.Error(t, Histogram{Buckets: []Bucket{{UpperBound: 1}, {UpperBound: 0.1}}}.Validate())
+	assert.Error(t, Histogram{Buckets: []Bucket{{UpperBound: 1, Count: 2}}, Count: 1}.Validate())
+	assert.NoError(t, Summary{Quantiles: []Quantile{{Quantile: 0.5, Value: 1}, {Quantile: 0.99, Value: 2}}}.Validate())
+	assert.Error(t, Summary{Quantiles: []Quantile{{Quantile: 1.5, Value: 1}}}.Validate())
+}
+
+// TestHistogramCumulative tests conversion of bucket counts to cumulative counts
+func TestHistogramCumulative(t *testing.T) {
+	h := Histogram{Buckets: []Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 2}, {UpperBound: 10, Count: 0}}, Count: 4}
+	assert.Equal(t, []Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 3}, {UpperBound: 10, Count: 3}}, h.Cumulative())
+}
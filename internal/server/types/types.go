@@ -3,9 +3,14 @@ package types
 
 import (
 	"compress/gzip"
+	"fmt"
 	"net/http"
+	"time"
 )
 
+// MaxClockSkew is how far in the future timestamps of metrics sent by clients may be
+const MaxClockSkew = 5 * time.Minute
+
 // Metrics stores metric data
 type Metrics struct {
 	ID    string   `json:"id"`
@@ -13,6 +18,44 @@ type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
 	Hash  string   `json:"hash,omitempty"`
+	// Labels are optional key/value pairs, metric is identified by its ID, type and labels
+	Labels map[string]string `json:"labels,omitempty"`
+	// Histogram is set for histogram metrics, its observations are added up like counter deltas
+	Histogram *Histogram `json:"histogram,omitempty"`
+	// Summary is set for summary metrics, it replaces previous value like a gauge
+	Summary *Summary `json:"summary,omitempty"`
+	// Timestamp is a time value was observed at, it is used for history and zero means time of saving
+	Timestamp time.Time `json:"-"`
+}
+
+// HashSource makes a string of metric's value signed by hash without labels
+func (m Metrics) HashSource() string {
+	switch m.MType {
+	case "gauge":
+		if m.Value != nil {
+			return fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value)
+		}
+	case "counter":
+		if m.Delta != nil {
+			return fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta)
+		}
+	case "histogram":
+		if m.Histogram != nil {
+			return fmt.Sprintf("%s:histogram:%s", m.ID, m.Histogram.String())
+		}
+	case "summary":
+		if m.Summary != nil {
+			return fmt.Sprintf("%s:summary:%s", m.ID, m.Summary.String())
+		}
+	}
+	return m.ID + ":" + m.MType
+}
+
+// Sample stores value of a metric at a moment of time.
+// For counters Value is the accumulated counter value, for histograms and summaries it is the count of observations
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
 }
 
 // GZIPWriter writes http response encoded as gzip
@@ -26,6 +69,16 @@ func (w GZIPWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush sends data written so far to client, it is used by streams
+func (w GZIPWriter) Flush() {
+	if err := w.Writer.Flush(); err != nil {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // StorageType stores type of storage
 type StorageType string
 
@@ -33,4 +86,6 @@ type StorageType string
 const (
 	StorageTypeDB   StorageType = "database"
 	StorageTypeFile StorageType = "file"
+	// StorageTypeMemory is used when neither database nor store file is set
+	StorageTypeMemory StorageType = "memory"
 )
@@ -0,0 +1,644 @@
+// Dashboard of metrics: table of all metrics with trends, kept up to date by stream of updates.
+// It uses only endpoints of the server: GET / for all metrics, POST /query/ for trends and GET /watch for updates.
+'use strict';
+
+(function () {
+  const TOKEN_KEY = 'metrics-token';
+  // maximum number of trend points kept for metric
+  const MAX_POINTS = 120;
+  // number of trend points requested from history
+  const HISTORY_POINTS = 60;
+  // number of history queries run at once
+  const HISTORY_CONCURRENCY = 4;
+  // period of reloading all metrics, it fixes values missed while stream reconnects
+  const RESYNC_INTERVAL = 60000;
+  const MAX_BACKOFF = 30000;
+
+  class AuthError extends Error {}
+
+  const state = {
+    // metrics by key
+    metrics: new Map(),
+    sort: {key: 'name', dir: 1},
+    filter: '',
+    type: '',
+    group: '',
+    groupValue: '',
+    range: '1h',
+    historyDisabled: false,
+    groupTouched: false,
+  };
+
+  const el = {
+    status: document.getElementById('status'),
+    count: document.getElementById('count'),
+    tokenForm: document.getElementById('token-form'),
+    token: document.getElementById('token'),
+    filter: document.getElementById('filter'),
+    type: document.getElementById('type'),
+    group: document.getElementById('group'),
+    groupValue: document.getElementById('group-value'),
+    groupValueLabel: document.getElementById('group-value-label'),
+    range: document.getElementById('range'),
+    note: document.getElementById('note'),
+    groups: document.getElementById('groups'),
+    tableTemplate: document.getElementById('table-template'),
+  };
+
+  // key identifies metric by type, ID and labels
+  function key(m) {
+    return m.type + '\u0000' + m.id + '\u0000' + labelsText(m.labels);
+  }
+
+  // labelsText formats labels sorted by name as name=value pairs
+  function labelsText(labels) {
+    if (!labels) {
+      return '';
+    }
+    return Object.keys(labels).sort().map((name) => name + '=' + labels[name]).join(',');
+  }
+
+  function rangeMillis(range) {
+    const match = /^(\d+)([mh])$/.exec(range);
+    const n = Number(match[1]);
+    return match[2] === 'h' ? n * 3600000 : n * 60000;
+  }
+
+  // value returns number shown and charted for metric: value of gauge, total of counter,
+  // number of observations of histogram and summary
+  function value(m) {
+    switch (m.type) {
+      case 'gauge':
+        return m.value;
+      case 'counter':
+        return m.delta;
+      case 'histogram':
+        return m.histogram ? m.histogram.count : 0;
+      case 'summary':
+        return m.summary ? m.summary.count : 0;
+    }
+    return 0;
+  }
+
+  function formatNumber(n) {
+    if (n === undefined || n === null) {
+      return '';
+    }
+    if (Number.isInteger(n)) {
+      return n.toLocaleString();
+    }
+    return Number(n.toPrecision(6)).toLocaleString(undefined, {maximumFractionDigits: 6});
+  }
+
+  function formatValue(m) {
+    switch (m.type) {
+      case 'histogram':
+        return m.histogram ? 'count ' + formatNumber(m.histogram.count) + ', sum ' + formatNumber(m.histogram.sum) : '';
+      case 'summary':
+        if (!m.summary) {
+          return '';
+        }
+        return (m.summary.quantiles || [])
+          .slice()
+          .sort((a, b) => a.quantile - b.quantile)
+          .map((q) => 'p' + formatNumber(q.quantile * 100) + ' ' + formatNumber(q.value))
+          .concat('count ' + formatNumber(m.summary.count))
+          .join(', ');
+    }
+    return formatNumber(value(m));
+  }
+
+  function formatAge(time) {
+    if (!time) {
+      return '';
+    }
+    const seconds = Math.max(0, Math.round((Date.now() - time) / 1000));
+    if (seconds < 60) {
+      return seconds + 's ago';
+    }
+    if (seconds < 3600) {
+      return Math.floor(seconds / 60) + 'm ago';
+    }
+    return Math.floor(seconds / 3600) + 'h ago';
+  }
+
+  function setStatus(status) {
+    el.status.dataset.state = status;
+    el.status.textContent = status;
+  }
+
+  function showNote(text) {
+    el.note.textContent = text;
+    el.note.hidden = !text;
+  }
+
+  // api calls endpoint of server with token, it throws AuthError if token is missing or has no read scope
+  async function api(path, options) {
+    options = Object.assign({}, options);
+    const headers = Object.assign({}, options.headers);
+    const token = localStorage.getItem(TOKEN_KEY);
+    if (token) {
+      headers.Authorization = 'Bearer ' + token;
+    }
+    options.headers = headers;
+    const resp = await fetch(path, options);
+    if (resp.status === 401 || resp.status === 403) {
+      throw new AuthError(resp.status === 401 ? 'token is missing or unknown' : 'token has no read scope');
+    }
+    if (!resp.ok) {
+      const text = await resp.text();
+      const err = new Error(text.trim() || resp.statusText);
+      err.status = resp.status;
+      throw err;
+    }
+    return resp;
+  }
+
+  // waitForToken shows token form and resolves when token is entered
+  let tokenWaiter = null;
+  function waitForToken(reason) {
+    if (!tokenWaiter) {
+      tokenWaiter = new Promise((resolve) => {
+        showNote('Authentication is required: ' + reason + '.');
+        el.tokenForm.hidden = false;
+        el.token.focus();
+        el.tokenForm.onsubmit = (event) => {
+          event.preventDefault();
+          localStorage.setItem(TOKEN_KEY, el.token.value.trim());
+          el.token.value = '';
+          el.tokenForm.hidden = true;
+          showNote('');
+          tokenWaiter = null;
+          resolve();
+        };
+      });
+    }
+    return tokenWaiter;
+  }
+
+  // entry is metric shown in table with its trend
+  function upsert(m, time) {
+    const k = key(m);
+    let entry = state.metrics.get(k);
+    if (!entry) {
+      entry = {key: k, metric: m, points: [], updated: time, historyLoaded: false, flash: false};
+      state.metrics.set(k, entry);
+    }
+    return entry;
+  }
+
+  // loadAll replaces metrics with metrics stored at server
+  async function loadAll() {
+    const resp = await api('/', {headers: {Accept: 'application/json'}});
+    const metrics = (await resp.json()) || [];
+    const seen = new Set();
+    for (const m of metrics) {
+      const entry = upsert(m, null);
+      entry.metric = m;
+      seen.add(entry.key);
+    }
+    for (const k of state.metrics.keys()) {
+      if (!seen.has(k)) {
+        state.metrics.delete(k);
+      }
+    }
+    updateGroups();
+    scheduleRender();
+    loadHistories();
+  }
+
+  // apply applies update streamed by server: counters and histograms are added up, other metrics are replaced
+  function apply(update) {
+    const now = Date.now();
+    const entry = upsert(update, now);
+    const m = entry.metric;
+    if (m !== update) {
+      if (update.type === 'counter') {
+        m.delta = (m.delta || 0) + (update.delta || 0);
+      } else if (update.type === 'histogram' && m.histogram && update.histogram) {
+        m.histogram = {
+          count: m.histogram.count + update.histogram.count,
+          sum: m.histogram.sum + update.histogram.sum,
+          buckets: m.histogram.buckets,
+        };
+      } else {
+        entry.metric = update;
+      }
+    }
+    entry.updated = now;
+    entry.flash = true;
+    entry.points.push({t: now, v: value(entry.metric)});
+    trimPoints(entry);
+    if (!state.groupTouched || update.labels) {
+      updateGroups();
+    }
+    scheduleRender();
+  }
+
+  function trimPoints(entry) {
+    const from = Date.now() - rangeMillis(state.range);
+    entry.points = entry.points.filter((p) => p.t >= from);
+    if (entry.points.length > MAX_POINTS) {
+      entry.points = entry.points.slice(entry.points.length - MAX_POINTS);
+    }
+  }
+
+  // loadHistories loads trends of metrics from history, a few queries are run at once
+  let historyQueue = [];
+  let historyRunning = 0;
+  function loadHistories() {
+    if (state.historyDisabled) {
+      return;
+    }
+    historyQueue = Array.from(state.metrics.values()).filter((entry) => !entry.historyLoaded);
+    while (historyRunning < HISTORY_CONCURRENCY && historyQueue.length > 0) {
+      historyRunning++;
+      runHistoryQueue();
+    }
+  }
+
+  async function runHistoryQueue() {
+    try {
+      while (historyQueue.length > 0 && !state.historyDisabled) {
+        await loadHistory(historyQueue.shift());
+      }
+    } finally {
+      historyRunning--;
+    }
+  }
+
+  async function loadHistory(entry) {
+    const range = state.range;
+    const step = Math.max(1000, Math.floor(rangeMillis(range) / HISTORY_POINTS)) + 'ms';
+    const m = entry.metric;
+    try {
+      const resp = await api('/query/', {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({id: m.id, type: m.type, labels: m.labels, range: range, step: step, func: 'last'}),
+      });
+      const result = await resp.json();
+      if (range !== state.range) {
+        return;
+      }
+      const points = (result.points || []).map((p) => ({t: Date.parse(p.timestamp), v: p.value}));
+      const last = points.length > 0 ? points[points.length - 1].t : 0;
+      entry.points = points.concat(entry.points.filter((p) => p.t > last));
+      if (points.length > 0 && !entry.updated) {
+        entry.updated = last;
+      }
+      entry.historyLoaded = true;
+      trimPoints(entry);
+      scheduleRender();
+    } catch (err) {
+      if (err.status === 501) {
+        state.historyDisabled = true;
+        showNote('Metrics history is disabled on server, trends show updates received since the page was opened.');
+      } else {
+        entry.historyLoaded = true;
+      }
+    }
+  }
+
+  // parseEvent parses server-sent event made of field lines
+  function parseEvent(text) {
+    const event = {type: 'message', data: []};
+    for (const line of text.split('\n')) {
+      if (line === '' || line.startsWith(':')) {
+        continue;
+      }
+      const colon = line.indexOf(':');
+      const field = colon < 0 ? line : line.slice(0, colon);
+      let data = colon < 0 ? '' : line.slice(colon + 1);
+      if (data.startsWith(' ')) {
+        data = data.slice(1);
+      }
+      if (field === 'event') {
+        event.type = data;
+      } else if (field === 'data') {
+        event.data.push(data);
+      }
+    }
+    event.data = event.data.join('\n');
+    return event;
+  }
+
+  // watch reads server-sent events with fetch since EventSource can't send token, it resolves when stream ends
+  async function watch() {
+    const resp = await api('/watch', {headers: {Accept: 'text/event-stream'}});
+    setStatus('live');
+    // updates saved after subscription are streamed, so all metrics are loaded after it
+    await loadAll();
+    const reader = resp.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = '';
+    for (;;) {
+      const {value: chunk, done} = await reader.read();
+      if (done) {
+        return;
+      }
+      buffer += decoder.decode(chunk, {stream: true}).replace(/\r\n?/g, '\n');
+      let end;
+      while ((end = buffer.indexOf('\n\n')) >= 0) {
+        const event = parseEvent(buffer.slice(0, end));
+        buffer = buffer.slice(end + 2);
+        if (event.type === 'metric') {
+          apply(JSON.parse(event.data));
+        } else if (event.type === 'error') {
+          showNote('Stream ended by server: ' + event.data + '.');
+          return;
+        }
+      }
+    }
+  }
+
+  async function run() {
+    let backoff = 1000;
+    for (;;) {
+      try {
+        await watch();
+        backoff = 1000;
+      } catch (err) {
+        if (err instanceof AuthError) {
+          setStatus('offline');
+          await waitForToken(err.message);
+          setStatus('connecting');
+          continue;
+        }
+        console.error('stream error:', err);
+      }
+      setStatus('reconnecting');
+      await new Promise((resolve) => setTimeout(resolve, backoff));
+      backoff = Math.min(backoff * 2, MAX_BACKOFF);
+    }
+  }
+
+  // updateGroups fills choices of label to group by and of its values, host is grouped by if metrics have it
+  function updateGroups() {
+    const names = new Set();
+    const values = new Set();
+    for (const entry of state.metrics.values()) {
+      const labels = entry.metric.labels || {};
+      for (const name of Object.keys(labels)) {
+        names.add(name);
+      }
+      if (state.group && labels[state.group] !== undefined) {
+        values.add(labels[state.group]);
+      }
+    }
+    if (!state.groupTouched && !state.group && names.has('host')) {
+      state.group = 'host';
+      return updateGroups();
+    }
+    fillSelect(el.group, 'nothing', Array.from(names).sort(), state.group);
+    fillSelect(el.groupValue, 'all', Array.from(values).sort(), state.groupValue);
+    el.groupValueLabel.hidden = !state.group;
+  }
+
+  function fillSelect(select, emptyText, options, selected) {
+    const current = Array.from(select.options).map((o) => o.value).join('\u0000');
+    const wanted = [''].concat(options).join('\u0000');
+    if (current !== wanted) {
+      select.replaceChildren();
+      select.append(new Option(emptyText, ''));
+      for (const option of options) {
+        select.append(new Option(option, option));
+      }
+    }
+    select.value = selected;
+  }
+
+  // matches checks entry against filter words: words with = match labels, other words match name or label values
+  function matches(entry) {
+    const m = entry.metric;
+    if (state.type && m.type !== state.type) {
+      return false;
+    }
+    if (state.group && state.groupValue && (m.labels || {})[state.group] !== state.groupValue) {
+      return false;
+    }
+    const text = (m.id + ' ' + labelsText(m.labels)).toLowerCase();
+    return state.filter
+      .toLowerCase()
+      .split(/\s+/)
+      .filter((word) => word !== '')
+      .every((word) => text.includes(word));
+  }
+
+  function compare(a, b) {
+    let x;
+    let y;
+    switch (state.sort.key) {
+      case 'labels':
+        x = labelsText(a.metric.labels);
+        y = labelsText(b.metric.labels);
+        break;
+      case 'type':
+        x = a.metric.type;
+        y = b.metric.type;
+        break;
+      case 'value':
+        x = value(a.metric) || 0;
+        y = value(b.metric) || 0;
+        break;
+      case 'updated':
+        x = a.updated || 0;
+        y = b.updated || 0;
+        break;
+      default:
+        x = a.metric.id;
+        y = b.metric.id;
+    }
+    let result = typeof x === 'number' ? x - y : String(x).localeCompare(String(y), undefined, {numeric: true});
+    if (result === 0 && state.sort.key !== 'name') {
+      result = a.metric.id.localeCompare(b.metric.id, undefined, {numeric: true});
+    }
+    return result * state.sort.dir;
+  }
+
+  const SVG = 'http://www.w3.org/2000/svg';
+
+  // sparkline draws points as line scaled to box of 140x28
+  function sparkline(points) {
+    const svg = document.createElementNS(SVG, 'svg');
+    svg.setAttribute('class', 'spark');
+    svg.setAttribute('viewBox', '0 0 140 28');
+    svg.setAttribute('preserveAspectRatio', 'none');
+    if (points.length === 0) {
+      return svg;
+    }
+    const from = Date.now() - rangeMillis(state.range);
+    const to = Date.now();
+    let min = Infinity;
+    let max = -Infinity;
+    for (const p of points) {
+      min = Math.min(min, p.v);
+      max = Math.max(max, p.v);
+    }
+    const span = max - min || 1;
+    const xy = points.map((p) => [
+      ((p.t - from) / (to - from)) * 138 + 1,
+      max === min ? 14 : 27 - ((p.v - min) / span) * 26,
+    ]);
+    if (xy.length === 1) {
+      const dot = document.createElementNS(SVG, 'circle');
+      dot.setAttribute('cx', xy[0][0].toFixed(1));
+      dot.setAttribute('cy', xy[0][1].toFixed(1));
+      dot.setAttribute('r', '2');
+      svg.append(dot);
+      return svg;
+    }
+    const line = document.createElementNS(SVG, 'polyline');
+    line.setAttribute('points', xy.map((p) => p[0].toFixed(1) + ',' + p[1].toFixed(1)).join(' '));
+    svg.append(line);
+    const title = document.createElementNS(SVG, 'title');
+    title.textContent = 'min ' + formatNumber(min) + ', max ' + formatNumber(max);
+    svg.append(title);
+    return svg;
+  }
+
+  function cell(className, content) {
+    const td = document.createElement('td');
+    td.className = className;
+    if (content instanceof Node) {
+      td.append(content);
+    } else {
+      td.textContent = content;
+    }
+    return td;
+  }
+
+  function row(entry) {
+    const m = entry.metric;
+    const tr = document.createElement('tr');
+    if (entry.flash) {
+      tr.className = 'flash';
+      entry.flash = false;
+    }
+    tr.append(cell('name', m.id));
+    const labels = document.createDocumentFragment();
+    for (const name of Object.keys(m.labels || {}).sort()) {
+      const span = document.createElement('span');
+      span.className = 'label';
+      span.textContent = name + '=' + m.labels[name];
+      labels.append(span);
+    }
+    tr.append(cell('labels', labels));
+    tr.append(cell('type', m.type));
+    tr.append(cell('num', formatValue(m)));
+    tr.append(cell('trend', sparkline(entry.points)));
+    tr.append(cell('num updated', formatAge(entry.updated)));
+    return tr;
+  }
+
+  function table(entries) {
+    const fragment = el.tableTemplate.content.cloneNode(true);
+    for (const th of fragment.querySelectorAll('th[data-sort]')) {
+      if (th.dataset.sort === state.sort.key) {
+        th.setAttribute('aria-sort', state.sort.dir > 0 ? 'ascending' : 'descending');
+      }
+      th.addEventListener('click', () => {
+        if (state.sort.key === th.dataset.sort) {
+          state.sort.dir = -state.sort.dir;
+        } else {
+          state.sort = {key: th.dataset.sort, dir: th.dataset.sort === 'updated' ? -1 : 1};
+        }
+        render();
+      });
+    }
+    const tbody = fragment.querySelector('tbody');
+    for (const entry of entries) {
+      tbody.append(row(entry));
+    }
+    return fragment;
+  }
+
+  function render() {
+    renderScheduled = false;
+    const entries = Array.from(state.metrics.values()).filter(matches).sort(compare);
+    el.count.textContent = entries.length + ' of ' + state.metrics.size + ' metrics';
+    const sections = document.createDocumentFragment();
+    if (entries.length === 0) {
+      const empty = document.createElement('p');
+      empty.className = 'empty';
+      empty.textContent = state.metrics.size === 0 ? 'No metrics yet.' : 'No metrics match the filter.';
+      sections.append(empty);
+    } else if (!state.group) {
+      sections.append(table(entries));
+    } else {
+      const groups = new Map();
+      for (const entry of entries) {
+        const groupValue = (entry.metric.labels || {})[state.group];
+        const name = groupValue === undefined ? '' : groupValue;
+        if (!groups.has(name)) {
+          groups.set(name, []);
+        }
+        groups.get(name).push(entry);
+      }
+      const names = Array.from(groups.keys()).sort((a, b) => (a === '') - (b === '') || a.localeCompare(b, undefined, {numeric: true}));
+      for (const name of names) {
+        const h2 = document.createElement('h2');
+        h2.textContent = name === '' ? 'without ' + state.group + ' ' : state.group + ' ' + name + ' ';
+        const count = document.createElement('span');
+        count.className = 'count';
+        count.textContent = groups.get(name).length + ' metrics';
+        h2.append(count);
+        sections.append(h2, table(groups.get(name)));
+      }
+    }
+    el.groups.replaceChildren(sections);
+  }
+
+  let renderScheduled = false;
+  function scheduleRender() {
+    if (!renderScheduled) {
+      renderScheduled = true;
+      requestAnimationFrame(render);
+    }
+  }
+
+  function readControls() {
+    state.filter = el.filter.value.trim();
+    state.type = el.type.value;
+    state.groupValue = el.groupValue.value;
+  }
+
+  el.filter.addEventListener('input', () => {
+    readControls();
+    scheduleRender();
+  });
+  el.type.addEventListener('change', () => {
+    readControls();
+    scheduleRender();
+  });
+  el.group.addEventListener('change', () => {
+    state.group = el.group.value;
+    state.groupTouched = true;
+    state.groupValue = '';
+    updateGroups();
+    scheduleRender();
+  });
+  el.groupValue.addEventListener('change', () => {
+    readControls();
+    scheduleRender();
+  });
+  el.range.addEventListener('change', () => {
+    state.range = el.range.value;
+    for (const entry of state.metrics.values()) {
+      entry.historyLoaded = false;
+      trimPoints(entry);
+    }
+    scheduleRender();
+    loadHistories();
+  });
+
+  // ages of updates and trends move with time
+  setInterval(scheduleRender, 5000);
+  setInterval(() => {
+    if (el.status.dataset.state === 'live') {
+      loadAll().catch((err) => console.error('error while loading metrics:', err));
+    }
+  }, RESYNC_INTERVAL);
+
+  run();
+})();
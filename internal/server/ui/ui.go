@@ -0,0 +1,34 @@
+// Package ui serves web dashboard embedded into server binary.
+// Dashboard reads metrics from GET / as JSON, trends from /query/ and live updates from /watch,
+// so its static files are public and data is protected by scopes of those endpoints
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// static are files of dashboard, they load nothing from other origins
+//
+//go:embed static
+var static embed.FS
+
+// contentSecurityPolicy forbids loading anything from other origins
+const contentSecurityPolicy = "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'"
+
+// Handler serves files of dashboard, it must be mounted with its prefix stripped
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		rw.Header().Set("X-Content-Type-Options", "nosniff")
+		// files have no modification time, so browsers must revalidate them after upgrade
+		rw.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(rw, r)
+	})
+}
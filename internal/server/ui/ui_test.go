@@ -0,0 +1,65 @@
+package ui
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHandler tests that files of dashboard are served with their types and security headers
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+	}{
+		{name: "index", path: "/", contentType: "text/html"},
+		{name: "script", path: "/app.js", contentType: "javascript"},
+		{name: "style", path: "/style.css", contentType: "text/css"},
+	}
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Contains(t, resp.Header.Get("Content-Type"), tt.contentType)
+			assert.Equal(t, contentSecurityPolicy, resp.Header.Get("Content-Security-Policy"))
+			assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+		})
+	}
+}
+
+// TestNoExternalResources tests that dashboard loads nothing from other origins
+func TestNoExternalResources(t *testing.T) {
+	err := fs.WalkDir(static, "static", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := static.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		content, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		// SVG namespace is a name, not a resource
+		text := strings.ReplaceAll(string(content), "http://www.w3.org/2000/svg", "")
+		assert.NotContains(t, text, "http://", path)
+		assert.NotContains(t, text, "https://", path)
+		assert.NotContains(t, text, "//cdn", path)
+		return nil
+	})
+	require.NoError(t, err)
+}
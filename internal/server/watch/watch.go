@@ -0,0 +1,159 @@
+// Package watch delivers accepted metric updates to subscribers.
+// Every subscriber has a buffer of updates, subscribers which don't keep up with updates are disconnected
+// instead of slowing down saving of metrics
+package watch
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+var (
+	// ErrSlowSubscriber ends subscription whose buffer is overflown
+	ErrSlowSubscriber = errors.New("subscriber is too slow")
+	// ErrClosed ends subscriptions when hub is closed
+	ErrClosed = errors.New("watch is closed")
+)
+
+// defaultBufferSize is a number of updates buffered for subscriber if buffer size is not set
+const defaultBufferSize = 256
+
+// Filter selects updates delivered to subscriber, empty fields match any metric
+type Filter struct {
+	// Prefix is a prefix of metric ID
+	Prefix string
+	MType  string
+	// Labels must all be set on metric with the same values
+	Labels map[string]string
+}
+
+// Match checks if metric is selected by filter
+func (f Filter) Match(m types.Metrics) bool {
+	if !strings.HasPrefix(m.ID, f.Prefix) {
+		return false
+	}
+	if f.MType != "" && f.MType != m.MType {
+		return false
+	}
+	for name, value := range f.Labels {
+		if v, ok := m.Labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscription receives updates selected by filter until it is closed
+type Subscription struct {
+	hub     *Hub
+	filter  Filter
+	updates chan types.Metrics
+	done    chan struct{}
+	err     error
+}
+
+// Updates returns channel of updates
+func (s *Subscription) Updates() <-chan types.Metrics {
+	return s.updates
+}
+
+// Done returns channel which is closed when subscription ends
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns reason subscription ended with, it is nil until Done is closed
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Close ends subscription
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.end(s, ErrClosed)
+}
+
+// Hub publishes updates to subscriptions
+type Hub struct {
+	bufferSize int
+
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewHub creates hub buffering bufferSize updates for every subscriber
+func NewHub(bufferSize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	return &Hub{
+		bufferSize: bufferSize,
+		subs:       make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe subscribes to updates selected by filter, it fails if hub is closed
+func (h *Hub) Subscribe(filter Filter) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	s := &Subscription{
+		hub:     h,
+		filter:  filter,
+		updates: make(chan types.Metrics, h.bufferSize),
+		done:    make(chan struct{}),
+	}
+	h.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Publish delivers metrics to subscriptions they are selected by without blocking.
+// Subscriptions without room in buffer end with ErrSlowSubscriber
+func (h *Hub) Publish(metrics []types.Metrics) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		for _, m := range metrics {
+			if !s.filter.Match(m) {
+				continue
+			}
+			m.Hash = ""
+			select {
+			case s.updates <- m:
+				continue
+			default:
+			}
+			h.end(s, ErrSlowSubscriber)
+			break
+		}
+	}
+}
+
+// Close ends all subscriptions with ErrClosed, new subscriptions are rejected
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.end(s, ErrClosed)
+	}
+}
+
+// end ends subscription with err if it is not ended yet, h.mu must be held
+func (h *Hub) end(s *Subscription, err error) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	s.err = err
+	close(s.done)
+}
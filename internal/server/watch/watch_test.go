@@ -0,0 +1,74 @@
+package watch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/AbramovArseniy/YandexRuntimeMetrics/internal/server/types"
+)
+
+// TestFilterMatch tests selection of metrics by filter
+func TestFilterMatch(t *testing.T) {
+	m := types.Metrics{ID: "cpu_usage", MType: "gauge", Labels: map[string]string{"host": "a", "core": "0"}}
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{name: "empty filter", filter: Filter{}, want: true},
+		{name: "prefix", filter: Filter{Prefix: "cpu_"}, want: true},
+		{name: "other prefix", filter: Filter{Prefix: "mem"}, want: false},
+		{name: "type", filter: Filter{MType: "gauge"}, want: true},
+		{name: "other type", filter: Filter{MType: "counter"}, want: false},
+		{name: "labels", filter: Filter{Labels: map[string]string{"host": "a"}}, want: true},
+		{name: "other label value", filter: Filter{Labels: map[string]string{"host": "b"}}, want: false},
+		{name: "missing label", filter: Filter{Labels: map[string]string{"dc": ""}}, want: false},
+		{name: "all fields", filter: Filter{Prefix: "cpu", MType: "gauge", Labels: map[string]string{"host": "a", "core": "0"}}, want: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(m))
+		})
+	}
+}
+
+// TestHub tests delivery of updates and disconnection of slow subscribers
+func TestHub(t *testing.T) {
+	h := NewHub(2)
+	all, err := h.Subscribe(Filter{})
+	require.NoError(t, err)
+	counters, err := h.Subscribe(Filter{MType: "counter"})
+	require.NoError(t, err)
+
+	h.Publish([]types.Metrics{
+		{ID: "a", MType: "gauge", Hash: "secret"},
+		{ID: "b", MType: "counter"},
+	})
+	assert.Equal(t, types.Metrics{ID: "a", MType: "gauge"}, <-all.Updates(), "hash is not published")
+	assert.Equal(t, "b", (<-all.Updates()).ID)
+	assert.Equal(t, "b", (<-counters.Updates()).ID)
+
+	h.Publish([]types.Metrics{{ID: "c", MType: "counter"}, {ID: "d", MType: "counter"}, {ID: "e", MType: "counter"}})
+	<-counters.Done()
+	assert.ErrorIs(t, counters.Err(), ErrSlowSubscriber)
+	<-all.Done()
+	assert.ErrorIs(t, all.Err(), ErrSlowSubscriber)
+
+	next, err := h.Subscribe(Filter{})
+	require.NoError(t, err)
+	next.Close()
+	<-next.Done()
+	assert.ErrorIs(t, next.Err(), ErrClosed)
+	next.Close()
+
+	last, err := h.Subscribe(Filter{})
+	require.NoError(t, err)
+	h.Close()
+	<-last.Done()
+	assert.ErrorIs(t, last.Err(), ErrClosed)
+	_, err = h.Subscribe(Filter{})
+	assert.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,155 @@
+// Package signature signs whole requests and responses with HMAC-SHA256.
+// Signature covers method, request URI with query, timestamp, nonce and body, so a captured request can't be
+// altered or replayed after its timestamp leaves the clock skew window
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// headers carrying signature
+const (
+	HeaderMAC       = "HashSHA256"
+	HeaderTimestamp = "X-Signature-Timestamp"
+	HeaderNonce     = "X-Signature-Nonce"
+)
+
+// nonceSize is a number of random bytes in nonce
+const nonceSize = 16
+
+// DefaultSkew is a default maximum difference between clocks of agent and server
+const DefaultSkew = 5 * time.Minute
+
+var (
+	// ErrMissing is returned when request is not signed
+	ErrMissing = errors.New("signature is missing")
+	// ErrMalformed is returned when signature headers can't be parsed
+	ErrMalformed = errors.New("malformed signature")
+	// ErrInvalid is returned when MAC doesn't match signed data
+	ErrInvalid = errors.New("invalid signature")
+	// ErrExpired is returned when timestamp is out of clock skew window
+	ErrExpired = errors.New("signature timestamp is out of allowed window")
+	// ErrReplayed is returned when nonce has already been used
+	ErrReplayed = errors.New("nonce has already been used")
+)
+
+// Signature is a signature of request or response
+type Signature struct {
+	// Timestamp is a unix time of signing in seconds
+	Timestamp int64
+	// Nonce is a random value unique for every request, response is signed with nonce of its request
+	Nonce string
+	// MAC is a hex encoded HMAC-SHA256 of signed data
+	MAC string
+}
+
+// New creates signature of request with current time and random nonce, uri is a path with query of request
+func New(key, method, uri string, body []byte) (Signature, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return Signature{}, fmt.Errorf("error while generating nonce: %w", err)
+	}
+	s := Signature{Timestamp: time.Now().Unix(), Nonce: hex.EncodeToString(nonce)}
+	s.Sign(key, method, uri, body)
+	return s, nil
+}
+
+// Sign sets MAC of data signed with timestamp and nonce of s
+func (s *Signature) Sign(key, method, uri string, body []byte) {
+	s.MAC = s.mac(key, method, uri, body)
+}
+
+// Valid checks that MAC of s matches data
+func (s Signature) Valid(key, method, uri string, body []byte) bool {
+	return hmac.Equal([]byte(s.MAC), []byte(s.mac(key, method, uri, body)))
+}
+
+// mac makes HMAC of canonical form of signed data
+func (s Signature) mac(key, method, uri string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	h := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(h, "%s\n%s\n%d\n%s\n%x", method, uri, s.Timestamp, s.Nonce, bodyHash)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Fields returns headers carrying s
+func (s Signature) Fields() map[string]string {
+	return map[string]string{
+		HeaderMAC:       s.MAC,
+		HeaderTimestamp: strconv.FormatInt(s.Timestamp, 10),
+		HeaderNonce:     s.Nonce,
+	}
+}
+
+// Parse reads signature from headers got by get
+func Parse(get func(string) string) (Signature, error) {
+	mac, strTimestamp, nonce := get(HeaderMAC), get(HeaderTimestamp), get(HeaderNonce)
+	if mac == "" && strTimestamp == "" && nonce == "" {
+		return Signature{}, ErrMissing
+	}
+	timestamp, err := strconv.ParseInt(strTimestamp, 10, 64)
+	if err != nil || mac == "" || nonce == "" {
+		return Signature{}, ErrMalformed
+	}
+	return Signature{Timestamp: timestamp, Nonce: nonce, MAC: mac}, nil
+}
+
+// Verifier verifies request signatures and remembers nonces seen in clock skew window
+type Verifier struct {
+	key  string
+	skew time.Duration
+	now  func() time.Time
+
+	mu sync.Mutex
+	// nonces maps nonce to time its request leaves the window
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+// NewVerifier creates Verifier accepting requests signed with key at most skew away from now
+func NewVerifier(key string, skew time.Duration) *Verifier {
+	if skew <= 0 {
+		skew = DefaultSkew
+	}
+	return &Verifier{
+		key:    key,
+		skew:   skew,
+		now:    time.Now,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Verify checks that s is a valid signature of request which hasn't been seen before
+func (v *Verifier) Verify(s Signature, method, uri string, body []byte) error {
+	now := v.now()
+	signed := time.Unix(s.Timestamp, 0)
+	if signed.Before(now.Add(-v.skew)) || signed.After(now.Add(v.skew)) {
+		return ErrExpired
+	}
+	if !s.Valid(v.key, method, uri, body) {
+		return ErrInvalid
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.pruned) > v.skew {
+		for nonce, expires := range v.nonces {
+			if expires.Before(now) {
+				delete(v.nonces, nonce)
+			}
+		}
+		v.pruned = now
+	}
+	if _, ok := v.nonces[s.Nonce]; ok {
+		return ErrReplayed
+	}
+	v.nonces[s.Nonce] = signed.Add(v.skew)
+	return nil
+}
@@ -0,0 +1,93 @@
+package signature
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestVerify tests rejection of altered, expired and replayed requests
+func TestVerify(t *testing.T) {
+	const key = "secret"
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":5}]`)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		modify func(s *Signature) ([]byte, string)
+		err    error
+	}{
+		{name: "valid", modify: func(s *Signature) ([]byte, string) { return body, "/updates/" }},
+		{name: "changed body", modify: func(s *Signature) ([]byte, string) { return []byte(`[]`), "/updates/" }, err: ErrInvalid},
+		{name: "changed path", modify: func(s *Signature) ([]byte, string) { return body, "/update/" }, err: ErrInvalid},
+		{name: "changed nonce", modify: func(s *Signature) ([]byte, string) { s.Nonce = "00"; return body, "/updates/" }, err: ErrInvalid},
+		{name: "wrong key", modify: func(s *Signature) ([]byte, string) {
+			s.Sign("other", "POST", "/updates/", body)
+			return body, "/updates/"
+		}, err: ErrInvalid},
+		{name: "old timestamp", modify: func(s *Signature) ([]byte, string) {
+			s.Timestamp = now.Add(-time.Hour).Unix()
+			s.Sign(key, "POST", "/updates/", body)
+			return body, "/updates/"
+		}, err: ErrExpired},
+		{name: "future timestamp", modify: func(s *Signature) ([]byte, string) {
+			s.Timestamp = now.Add(time.Hour).Unix()
+			s.Sign(key, "POST", "/updates/", body)
+			return body, "/updates/"
+		}, err: ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(key, time.Minute)
+			s, err := New(key, "POST", "/updates/", body)
+			require.NoError(t, err)
+			signedBody, path := tt.modify(&s)
+			assert.ErrorIs(t, v.Verify(s, "POST", path, signedBody), tt.err)
+		})
+	}
+}
+
+// TestVerifyRejectsReplay tests that request is accepted once and nonces are forgotten after window
+func TestVerifyRejectsReplay(t *testing.T) {
+	const key = "secret"
+	body := []byte(`{"id":"PollCount","type":"counter","delta":5}`)
+	now := time.Now()
+	v := NewVerifier(key, time.Minute)
+	v.now = func() time.Time { return now }
+	s, err := New(key, "POST", "/update/", body)
+	require.NoError(t, err)
+	require.NoError(t, v.Verify(s, "POST", "/update/", body))
+	assert.ErrorIs(t, v.Verify(s, "POST", "/update/", body), ErrReplayed)
+	other, err := New(key, "POST", "/update/", body)
+	require.NoError(t, err)
+	assert.NoError(t, v.Verify(other, "POST", "/update/", body))
+
+	now = now.Add(2 * time.Minute)
+	fresh, err := New(key, "POST", "/update/", body)
+	require.NoError(t, err)
+	fresh.Timestamp = now.Unix()
+	fresh.Sign(key, "POST", "/update/", body)
+	require.NoError(t, v.Verify(fresh, "POST", "/update/", body))
+	assert.Len(t, v.nonces, 1)
+	assert.ErrorIs(t, v.Verify(s, "POST", "/update/", body), ErrExpired)
+}
+
+// TestParse tests reading signature from headers
+func TestParse(t *testing.T) {
+	s, err := New("secret", "POST", "/update/", nil)
+	require.NoError(t, err)
+	h := http.Header{}
+	for name, value := range s.Fields() {
+		h.Set(name, value)
+	}
+	parsed, err := Parse(h.Get)
+	require.NoError(t, err)
+	assert.Equal(t, s, parsed)
+	_, err = Parse(http.Header{}.Get)
+	assert.ErrorIs(t, err, ErrMissing)
+	h.Set(HeaderTimestamp, "yesterday")
+	_, err = Parse(h.Get)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
@@ -0,0 +1,75 @@
+// Package tlsconfig builds TLS configs of server and agent from certificate files
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNoCertificates is returned when CA file contains no PEM certificates
+var ErrNoCertificates = errors.New("no certificates found")
+
+// readCertPool reads PEM encoded CA certificates from file
+func readCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w in %s", ErrNoCertificates, path)
+	}
+	return pool, nil
+}
+
+// Server creates server TLS config with certificate and key from files.
+// If clientCAFile is set clients must present certificate signed by one of its CAs
+func Server(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both TLS certificate and key files must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading TLS certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		if cfg.ClientCAs, err = readCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Client creates client TLS config verifying server with CAs from caFile or with system CAs if it is not set.
+// If certFile and keyFile are set the certificate is presented to server
+func Client(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	var err error
+	if caFile != "" {
+		if cfg.RootCAs, err = readCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both TLS certificate and key files must be set")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading TLS certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,144 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a certificate authority issuing test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates self-signed CA
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes certificate and key signed by CA to dir and returns paths of files
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// TestMutualTLS tests that server and client configs verify each other
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, otherCA := newTestCA(t, "metrics CA"), newTestCA(t, "other CA")
+	caFile, otherCAFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "other-ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0600))
+	require.NoError(t, os.WriteFile(otherCAFile, otherCA.pem, 0600))
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	agentCert, agentKey := ca.issue(t, dir, "agent", x509.ExtKeyUsageClientAuth)
+	strangerCert, strangerKey := otherCA.issue(t, dir, "stranger", x509.ExtKeyUsageClientAuth)
+	tests := []struct {
+		name       string
+		clientCA   string
+		caFile     string
+		certFile   string
+		keyFile    string
+		expectDone bool
+	}{
+		{name: "TLS without client certificate", caFile: caFile, expectDone: true},
+		{name: "mutual TLS", clientCA: caFile, caFile: caFile, certFile: agentCert, keyFile: agentKey, expectDone: true},
+		{name: "mutual TLS without client certificate", clientCA: caFile, caFile: caFile},
+		{name: "client certificate of unknown CA", clientCA: caFile, caFile: caFile, certFile: strangerCert, keyFile: strangerKey},
+		{name: "server certificate of unknown CA", caFile: otherCAFile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverCfg, err := Server(serverCert, serverKey, tt.clientCA)
+			require.NoError(t, err)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			srv.TLS = serverCfg
+			srv.StartTLS()
+			defer srv.Close()
+			clientCfg, err := Client(tt.caFile, tt.certFile, tt.keyFile, "")
+			require.NoError(t, err)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+			resp, err := client.Get(srv.URL)
+			if !tt.expectDone {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tls.VersionTLS13, int(resp.TLS.Version))
+		})
+	}
+}
+
+// TestConfigErrors tests that incomplete or wrong TLS files are rejected
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "metrics CA")
+	certFile, keyFile := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	emptyCA := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(emptyCA, []byte("not a certificate"), 0600))
+	_, err := Server(certFile, "", "")
+	assert.Error(t, err)
+	_, err = Server(certFile, filepath.Join(dir, "missing.key"), "")
+	assert.Error(t, err)
+	_, err = Server(certFile, keyFile, emptyCA)
+	assert.ErrorIs(t, err, ErrNoCertificates)
+	_, err = Client(emptyCA, "", "", "")
+	assert.ErrorIs(t, err, ErrNoCertificates)
+	_, err = Client("", certFile, "", "")
+	assert.Error(t, err)
+	_, err = Client("", keyFile, certFile, "")
+	assert.Error(t, err)
+}